@@ -0,0 +1,83 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/ethereum/go-ethereum/tests"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var blockTestCommand = cli.Command{
+	Action:    blockTestCmd,
+	Name:      "blocktest",
+	Usage:     "executes the given blockchain tests",
+	ArgsUsage: "<file>",
+	Flags: []cli.Flag{
+		ForkFlag,
+	},
+}
+
+func blockTestCmd(ctx *cli.Context) error {
+	if len(ctx.Args().First()) == 0 {
+		return errors.New("filename required")
+	}
+	src, err := ioutil.ReadFile(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	var blockTests map[string]tests.BlockTest
+	if err = json.Unmarshal(src, &blockTests); err != nil {
+		return err
+	}
+	// Block tests carry their fork in the test itself, fall back to the one
+	// given on the command line for tests which predate the network field.
+	var (
+		fork    = ctx.String(ForkFlag.Name)
+		cfg     = testVMConfig(ctx)
+		results = []testResult{}
+	)
+	for name, test := range blockTests {
+		network := test.Network()
+		if network == "" {
+			network = fork
+		} else if fork != "" && network != fork {
+			continue
+		}
+		config, ok := tests.Forks[network]
+		if !ok {
+			return fmt.Errorf("test %s: unknown fork %q, use --%s", name, network, ForkFlag.Name)
+		}
+		result := testResult{
+			Name:         name,
+			Pass:         true,
+			Fork:         network,
+			ExpectedRoot: test.ExpectedRoot(),
+		}
+		root, err := test.Run(config, cfg)
+		result.StateRoot = root
+		if err != nil {
+			result.Pass, result.Error = false, err.Error()
+		}
+		results = append(results, result)
+	}
+	return reportResults(results)
+}
@@ -0,0 +1,113 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/tests"
+)
+
+// newGenesisBlockTest creates a block test without any blocks, expecting the
+// chain to stay at its genesis block with the given balance of the only account.
+func newGenesisBlockTest(balance *big.Int) (map[string]interface{}, common.Hash) {
+	var (
+		addr  = common.HexToAddress("0xa94f5374fce5edbc8e2a8697c15331677e6ebf0b")
+		gspec = &core.Genesis{
+			Config:     tests.Forks["Homestead"],
+			Nonce:      0x0102030405060708,
+			Timestamp:  0x54c98c81,
+			ExtraData:  []byte{0x42},
+			GasLimit:   0x2fefd8,
+			Difficulty: big.NewInt(0x020000),
+			Coinbase:   common.HexToAddress("0x8888f1f195afa192cfee860698584c030f4c9db1"),
+			Alloc:      core.GenesisAlloc{addr: {Balance: big.NewInt(1000000000)}},
+		}
+	)
+	genesis, _ := gspec.ToBlock()
+	return map[string]interface{}{
+		"genesis": map[string]interface{}{
+			"genesisBlockHeader": map[string]interface{}{
+				"bloom":            types.Bloom{},
+				"coinbase":         gspec.Coinbase,
+				"mixHash":          common.Hash{},
+				"nonce":            types.EncodeNonce(gspec.Nonce),
+				"number":           "0x00",
+				"hash":             genesis.Hash(),
+				"parentHash":       common.Hash{},
+				"receiptTrie":      genesis.ReceiptHash(),
+				"stateRoot":        genesis.Root(),
+				"transactionsTrie": genesis.TxHash(),
+				"uncleHash":        genesis.UncleHash(),
+				"extraData":        "0x42",
+				"difficulty":       "0x020000",
+				"gasLimit":         "0x2fefd8",
+				"gasUsed":          "0x00",
+				"timestamp":        "0x54c98c81",
+			},
+			"pre":           map[string]interface{}{addr.Hex(): map[string]string{"balance": "1000000000"}},
+			"postState":     map[string]interface{}{addr.Hex(): map[string]string{"balance": balance.String()}},
+			"blocks":        []interface{}{},
+			"lastblockhash": genesis.Hash(),
+			"network":       "Homestead",
+		},
+	}, genesis.Root()
+}
+
+// Tests that the blocktest command reports the outcome of the block tests along
+// with the state root of the head they ended up with.
+func TestBlockTestCommand(t *testing.T) {
+	dir := tmpdir(t)
+	defer os.RemoveAll(dir)
+
+	for i, tt := range []struct {
+		balance *big.Int
+		pass    bool
+	}{
+		{big.NewInt(1000000000), true},
+		{big.NewInt(1000000001), false},
+	} {
+		fixture, root := newGenesisBlockTest(tt.balance)
+		path := writeFixture(t, dir, "block.json", fixture)
+
+		evm := runEVM(t, "blocktest", path)
+		var results []testResult
+		evm.expectJSON(&results)
+		if failed := strings.Contains(evm.StderrText(), "test failed"); failed == tt.pass {
+			t.Errorf("test %d: failure report mismatch: have %v, want %v", i, failed, !tt.pass)
+		}
+		if len(results) != 1 {
+			t.Fatalf("test %d: result count mismatch: have %d, want 1", i, len(results))
+		}
+		result := results[0]
+		if result.Name != "genesis" || result.Fork != "Homestead" || result.Pass != tt.pass {
+			t.Errorf("test %d: result mismatch: %+v", i, result)
+		}
+		if result.ExpectedRoot != root || result.StateRoot != root {
+			t.Errorf("test %d: root mismatch: have %x/%x, want %x", i, result.ExpectedRoot, result.StateRoot, root)
+		}
+		if !tt.pass && !strings.Contains(result.Error, "balance mismatch") {
+			t.Errorf("test %d: error mismatch: have %q", i, result.Error)
+		}
+	}
+}
@@ -20,17 +20,26 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"strings"
 
 	"github.com/ethereum/go-ethereum/cmd/evm/internal/compiler"
 
 	cli "gopkg.in/urfave/cli.v1"
 )
 
+var ListingFlag = cli.StringFlag{
+	Name:  "listing",
+	Usage: "file to write the listing mapping source lines to program counters to",
+}
+
 var compileCommand = cli.Command{
 	Action:    compileCmd,
 	Name:      "compile",
 	Usage:     "compiles easm source to evm binary",
 	ArgsUsage: "<file>",
+	Flags: []cli.Flag{
+		ListingFlag,
+	},
 }
 
 func compileCmd(ctx *cli.Context) error {
@@ -46,10 +55,15 @@ func compileCmd(ctx *cli.Context) error {
 		return err
 	}
 
-	bin, err := compiler.Compile(fn, src, debug)
+	bin, listing, err := compiler.CompileListing(fn, src, debug)
 	if err != nil {
 		return err
 	}
+	if path := ctx.String(ListingFlag.Name); path != "" {
+		if err := ioutil.WriteFile(path, []byte(strings.Join(listing, "\n")+"\n"), 0644); err != nil {
+			return err
+		}
+	}
 	fmt.Println(bin)
 	return nil
 }
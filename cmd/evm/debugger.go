@@ -0,0 +1,261 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/rpc"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var DebugRPCFlag = cli.BoolFlag{
+	Name:  "rpc",
+	Usage: "serve the debugger over JSON-RPC on stdin/stdout instead of an interactive prompt",
+}
+
+var debugCommand = cli.Command{
+	Action:    debugCmd,
+	Name:      "debug",
+	Usage:     "steps through the execution of arbitrary evm binary",
+	ArgsUsage: "<code>",
+	Flags: []cli.Flag{
+		DebugRPCFlag,
+	},
+	Description: `
+The debug command runs arbitrary EVM code like the run command does, pausing
+at the first instruction. The execution can then be stepped through and
+inspected from an interactive prompt, or through the debug_* JSON-RPC methods
+when started with --rpc.`,
+}
+
+const debugHelp = `Commands:
+  s, step                  execute the next instruction
+  n, next                  step over nested calls
+  o, out                   run until returning to the calling frame
+  c, continue              run until the next breakpoint
+  sstore                   run until the next SSTORE
+  b, break pc|op|depth <v> add a breakpoint on a pc, an opcode or a call depth
+  d, delete <id>           remove a breakpoint
+  breakpoints              list the breakpoints
+  stack                    print the stack
+  memory                   print the memory
+  storage <key>            print a storage slot of the current contract
+  return                   print the return data of the last call
+  state                    print the current instruction
+  q, quit                  abort the execution and exit`
+
+// DebuggerAPI exposes a debugger over JSON-RPC.
+type DebuggerAPI struct {
+	debugger *vm.Debugger
+}
+
+// State returns the state the execution is paused at.
+func (api *DebuggerAPI) State() *vm.DebugState {
+	return api.debugger.State()
+}
+
+// Step resumes the execution in the given stepping mode.
+func (api *DebuggerAPI) Step(mode string) (*vm.DebugState, error) {
+	return api.debugger.Resume(mode)
+}
+
+// AddBreakpoint registers a breakpoint, returning its ID.
+func (api *DebuggerAPI) AddBreakpoint(kind string, value uint64) (int, error) {
+	return api.debugger.AddBreakpoint(kind, value)
+}
+
+// RemoveBreakpoint deletes a breakpoint.
+func (api *DebuggerAPI) RemoveBreakpoint(id int) error {
+	return api.debugger.RemoveBreakpoint(id)
+}
+
+// Breakpoints lists the registered breakpoints.
+func (api *DebuggerAPI) Breakpoints() []vm.Breakpoint {
+	return api.debugger.Breakpoints()
+}
+
+// Storage retrieves a storage slot of the contract being executed.
+func (api *DebuggerAPI) Storage(key common.Hash) (common.Hash, error) {
+	return api.debugger.Storage(key)
+}
+
+// Stop aborts the execution.
+func (api *DebuggerAPI) Stop() *vm.DebugState {
+	return api.debugger.Stop()
+}
+
+// stdioConn joins stdin and stdout into a connection for the JSON-RPC codec.
+type stdioConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (stdioConn) Close() error { return nil }
+
+func debugCmd(ctx *cli.Context) error {
+	debugger := vm.NewDebugger()
+	env, err := newRunEnv(ctx, debugger)
+	if err != nil {
+		return err
+	}
+	state := debugger.Start(func() ([]byte, error) {
+		ret, _, err := env.execute()
+		return ret, err
+	})
+	if ctx.Bool(DebugRPCFlag.Name) {
+		server := rpc.NewServer()
+		if err := server.RegisterName("debug", &DebuggerAPI{debugger}); err != nil {
+			return err
+		}
+		server.ServeCodec(rpc.NewJSONCodec(stdioConn{os.Stdin, os.Stdout}), rpc.OptionMethodInvocation)
+		debugger.Stop()
+		return nil
+	}
+	printDebugState(state)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for fmt.Print("(evm) "); scanner.Scan(); fmt.Print("(evm) ") {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var mode string
+		switch cmd, args := fields[0], fields[1:]; cmd {
+		case "s", "step":
+			mode = vm.StepInto
+		case "n", "next":
+			mode = vm.StepOver
+		case "o", "out":
+			mode = vm.StepOut
+		case "c", "continue":
+			mode = vm.StepContinue
+		case "sstore":
+			mode = vm.StepStore
+		case "b", "break":
+			if len(args) != 2 {
+				fmt.Println("usage: break pc|op|depth <value>")
+				continue
+			}
+			var value uint64
+			if args[0] == vm.BreakOp {
+				op := vm.StringToOp(strings.ToUpper(args[1]))
+				if op.String() != strings.ToUpper(args[1]) {
+					fmt.Println("unknown opcode", args[1])
+					continue
+				}
+				value = uint64(op)
+			} else if value, err = strconv.ParseUint(args[1], 0, 64); err != nil {
+				fmt.Println("invalid value:", err)
+				continue
+			}
+			id, err := debugger.AddBreakpoint(args[0], value)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("breakpoint %d added\n", id)
+		case "d", "delete":
+			id, err := strconv.Atoi(strings.Join(args, ""))
+			if err == nil {
+				err = debugger.RemoveBreakpoint(id)
+			}
+			if err != nil {
+				fmt.Println(err)
+			}
+		case "breakpoints":
+			for _, bp := range debugger.Breakpoints() {
+				value := fmt.Sprint(bp.Value)
+				if bp.Kind == vm.BreakOp {
+					value = vm.OpCode(bp.Value).String()
+				}
+				fmt.Printf("%d: %s %s\n", bp.ID, bp.Kind, value)
+			}
+		case "stack":
+			stack := debugger.State().Stack
+			for i := len(stack) - 1; i >= 0; i-- {
+				fmt.Printf("%04d: %#x\n", len(stack)-1-i, stack[i].ToInt())
+			}
+		case "memory":
+			memory := debugger.State().Memory
+			for i := 0; i < len(memory); i += 32 {
+				end := i + 32
+				if end > len(memory) {
+					end = len(memory)
+				}
+				fmt.Printf("%04x: %x\n", i, memory[i:end])
+			}
+		case "storage":
+			if len(args) != 1 {
+				fmt.Println("usage: storage <key>")
+				continue
+			}
+			value, err := debugger.Storage(common.HexToHash(args[0]))
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("%x\n", value)
+		case "return":
+			fmt.Printf("%x\n", debugger.State().ReturnData)
+		case "state":
+			printDebugState(debugger.State())
+		case "q", "quit":
+			debugger.Stop()
+			return nil
+		case "h", "help":
+			fmt.Println(debugHelp)
+		default:
+			fmt.Printf("unknown command %q, try help\n", cmd)
+		}
+		if mode == "" {
+			continue
+		}
+		state, err := debugger.Resume(mode)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		printDebugState(state)
+	}
+	fmt.Println()
+	debugger.Stop()
+	return scanner.Err()
+}
+
+// printDebugState prints the instruction the execution is paused at, or the
+// outcome of the execution if it finished.
+func printDebugState(state *vm.DebugState) {
+	if state.Done {
+		fmt.Printf("execution finished, output 0x%x\n", []byte(state.Output))
+		if state.Error != "" {
+			fmt.Println("error:", state.Error)
+		}
+		return
+	}
+	if state.Breakpoint != 0 {
+		fmt.Printf("breakpoint %d hit\n", state.Breakpoint)
+	}
+	fmt.Printf("%x pc=%d op=%s gas=%d cost=%d depth=%d\n", state.Address, state.PC, state.Op, state.Gas, state.Cost, state.Depth)
+}
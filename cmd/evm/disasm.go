@@ -17,9 +17,11 @@
 package main
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"strings"
 
 	"github.com/ethereum/go-ethereum/core/asm"
@@ -31,6 +33,9 @@ var disasmCommand = cli.Command{
 	Name:      "disasm",
 	Usage:     "disassembles evm binary",
 	ArgsUsage: "<file>",
+	Flags: []cli.Flag{
+		CFGFlag,
+	},
 }
 
 func disasmCmd(ctx *cli.Context) error {
@@ -45,6 +50,17 @@ func disasmCmd(ctx *cli.Context) error {
 	}
 
 	code := strings.TrimSpace(string(in[:]))
+	if ctx.Bool(CFGFlag.Name) {
+		script, err := hex.DecodeString(strings.TrimPrefix(code, "0x"))
+		if err != nil {
+			return err
+		}
+		cfg := asm.NewCFG(script)
+		if ctx.GlobalBool(MachineFlag.Name) {
+			return cfg.WriteJSON(os.Stdout)
+		}
+		return cfg.WriteDOT(os.Stdout)
+	}
 	fmt.Printf("%v\n", code)
 	if err = asm.PrintDisassembled(code); err != nil {
 		return err
@@ -24,16 +24,23 @@ import (
 )
 
 func Compile(fn string, src []byte, debug bool) (string, error) {
+	bin, _, err := CompileListing(fn, src, debug)
+	return bin, err
+}
+
+// CompileListing compiles the source like Compile does, additionally returning
+// the listing mapping the source lines to the positions in the code.
+func CompileListing(fn string, src []byte, debug bool) (string, []string, error) {
 	compiler := asm.NewCompiler(debug)
 	compiler.Feed(asm.Lex(fn, src, debug))
 
 	bin, compileErrors := compiler.Compile()
 	if len(compileErrors) > 0 {
-		// report errors
+		// report errors, which carry their source position
 		for _, err := range compileErrors {
-			fmt.Printf("%s:%v\n", fn, err)
+			fmt.Println(err)
 		}
-		return "", errors.New("compiling failed")
+		return "", nil, errors.New("compiling failed")
 	}
-	return bin, nil
+	return bin, compiler.Listing(), nil
 }
@@ -110,6 +110,27 @@ var (
 		Name:  "nostack",
 		Usage: "disable stack output",
 	}
+	ProfileFlag = cli.BoolFlag{
+		Name:  "profile",
+		Usage: "output gas and time profiles per opcode and instruction along with code coverage",
+	}
+	FoldedStacksFlag = cli.StringFlag{
+		Name:  "foldedstacks",
+		Usage: "writes the gas used per call stack in flame graph folded format to the given path",
+	}
+	CFGFlag = cli.BoolFlag{
+		Name:  "cfg",
+		Usage: "output the control flow graph in DOT format, or JSON with --json",
+	}
+	ForkFlag = cli.StringFlag{
+		Name:  "fork",
+		Usage: "only run the tests of the given fork",
+	}
+	SubtestFlag = cli.IntFlag{
+		Name:  "subtest",
+		Usage: "only run the state test subtest with the given index",
+		Value: -1,
+	}
 )
 
 func init() {
@@ -133,11 +154,17 @@ func init() {
 		SenderFlag,
 		DisableMemoryFlag,
 		DisableStackFlag,
+		ProfileFlag,
+		FoldedStacksFlag,
 	}
 	app.Commands = []cli.Command{
 		compileCommand,
 		disasmCommand,
 		runCommand,
+		stateTestCommand,
+		blockTestCommand,
+		transitionCommand,
+		debugCommand,
 	}
 }
 
@@ -0,0 +1,95 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/pkg/reexec"
+	"github.com/ethereum/go-ethereum/internal/cmdtest"
+)
+
+func tmpdir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "evm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+type testEVM struct {
+	*cmdtest.TestCmd
+}
+
+func init() {
+	// Run the app if we've been exec'd as "evm-test" in runEVM.
+	reexec.Register("evm-test", func() {
+		if err := app.Run(os.Args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	})
+}
+
+func TestMain(m *testing.M) {
+	// check if we have been reexec'd
+	if reexec.Init() {
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runEVM spawns evm with the given command line args.
+func runEVM(t *testing.T, args ...string) *testEVM {
+	tt := new(testEVM)
+	tt.TestCmd = cmdtest.NewTestCmd(t, tt)
+
+	// Boot "evm". This actually runs the test binary but the TestMain
+	// function will prevent any tests from running.
+	tt.Run("evm-test", args...)
+	return tt
+}
+
+// expectJSON reads the entire output of the command, decodes it as JSON into
+// the given value and waits for the command to exit.
+func (tt *testEVM) expectJSON(v interface{}) {
+	_, matches := tt.ExpectRegexp(`(?s)^(.*)$`)
+	tt.ExpectExit()
+	if err := json.Unmarshal([]byte(matches[1]), v); err != nil {
+		tt.Fatalf("failed to decode output: %v\n%s", err, matches[1])
+	}
+}
+
+// writeFixture stores the given test fixture as JSON in a file of the given
+// directory, returning the path of the file.
+func writeFixture(t *testing.T, dir, name string, fixture interface{}) string {
+	blob, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, blob, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -49,50 +49,46 @@ var runCommand = cli.Command{
 }
 
 // readGenesis will read the given JSON format genesis file and return
-// the initialized Genesis structure
+// the initialized Genesis structure. A bare genesis allocation, such as
+// the output of the prestate tracer, is also accepted.
 func readGenesis(genesisPath string) *core.Genesis {
 	// Make sure we have a valid genesis JSON
 	//genesisPath := ctx.Args().First()
 	if len(genesisPath) == 0 {
 		utils.Fatalf("Must supply path to genesis JSON file")
 	}
-	file, err := os.Open(genesisPath)
+	blob, err := ioutil.ReadFile(genesisPath)
 	if err != nil {
 		utils.Fatalf("Failed to read genesis file: %v", err)
 	}
-	defer file.Close()
-
 	genesis := new(core.Genesis)
-	if err := json.NewDecoder(file).Decode(genesis); err != nil {
-		utils.Fatalf("invalid genesis file: %v", err)
+	if err := json.Unmarshal(blob, genesis); err != nil {
+		alloc := make(core.GenesisAlloc)
+		if json.Unmarshal(blob, &alloc) != nil {
+			utils.Fatalf("invalid genesis file: %v", err)
+		}
+		genesis = &core.Genesis{Alloc: alloc}
 	}
 	return genesis
 }
 
-func runCmd(ctx *cli.Context) error {
-	glogger := log.NewGlogHandler(log.StreamHandler(os.Stderr, log.TerminalFormat(false)))
-	glogger.Verbosity(log.Lvl(ctx.GlobalInt(VerbosityFlag.Name)))
-	log.Root().SetHandler(glogger)
-	logconfig := &vm.LogConfig{
-		DisableMemory: ctx.GlobalBool(DisableMemoryFlag.Name),
-		DisableStack:  ctx.GlobalBool(DisableStackFlag.Name),
-	}
+// runEnv is an EVM invocation assembled from the command line flags.
+type runEnv struct {
+	statedb *state.StateDB
+	config  runtime.Config
+	code    []byte
+	input   []byte
+	create  bool
+}
 
+// newRunEnv sets up the state, the code and the configuration of the EVM
+// invocation requested on the command line, traced by the given tracer.
+func newRunEnv(ctx *cli.Context, tracer vm.Tracer) (*runEnv, error) {
 	var (
-		tracer      vm.Tracer
-		debugLogger *vm.StructLogger
 		statedb     *state.StateDB
 		chainConfig *params.ChainConfig
 		sender      = common.StringToAddress("sender")
 	)
-	if ctx.GlobalBool(MachineFlag.Name) {
-		tracer = NewJSONLogger(logconfig, os.Stdout)
-	} else if ctx.GlobalBool(DebugFlag.Name) {
-		debugLogger = vm.NewStructLogger(logconfig)
-		tracer = debugLogger
-	} else {
-		debugLogger = vm.NewStructLogger(logconfig)
-	}
 	if ctx.GlobalString(GenesisFlag.Name) != "" {
 		gen := readGenesis(ctx.GlobalString(GenesisFlag.Name))
 		_, statedb = gen.ToBlock()
@@ -107,20 +103,16 @@ func runCmd(ctx *cli.Context) error {
 
 	statedb.CreateAccount(sender)
 
-	var (
-		code []byte
-		ret  []byte
-		err  error
-	)
+	var code []byte
 	if fn := ctx.Args().First(); len(fn) > 0 {
 		src, err := ioutil.ReadFile(fn)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		bin, err := compiler.Compile(fn, src, false)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		code = common.Hex2Bytes(bin)
 	} else if ctx.GlobalString(CodeFlag.Name) != "" {
@@ -153,11 +145,67 @@ func runCmd(ctx *cli.Context) error {
 		Value:    utils.GlobalBig(ctx, ValueFlag.Name),
 		EVMConfig: vm.Config{
 			Tracer:             tracer,
-			Debug:              ctx.GlobalBool(DebugFlag.Name) || ctx.GlobalBool(MachineFlag.Name),
+			Debug:              tracer != nil,
 			DisableGasMetering: ctx.GlobalBool(DisableGasMeteringFlag.Name),
 		},
 	}
 
+	if chainConfig != nil {
+		runtimeConfig.ChainConfig = chainConfig
+	}
+	return &runEnv{
+		statedb: statedb,
+		config:  runtimeConfig,
+		code:    code,
+		input:   common.Hex2Bytes(ctx.GlobalString(InputFlag.Name)),
+		create:  ctx.GlobalBool(CreateFlag.Name),
+	}, nil
+}
+
+// execute runs the EVM invocation, returning its output and the gas left.
+func (env *runEnv) execute() ([]byte, uint64, error) {
+	if env.create {
+		ret, _, leftOverGas, err := runtime.Create(append(env.code, env.input...), &env.config)
+		return ret, leftOverGas, err
+	}
+	receiver := common.StringToAddress("receiver")
+	env.statedb.SetCode(receiver, env.code)
+
+	return runtime.Call(receiver, env.input, &env.config)
+}
+
+func runCmd(ctx *cli.Context) error {
+	glogger := log.NewGlogHandler(log.StreamHandler(os.Stderr, log.TerminalFormat(false)))
+	glogger.Verbosity(log.Lvl(ctx.GlobalInt(VerbosityFlag.Name)))
+	log.Root().SetHandler(glogger)
+	logconfig := &vm.LogConfig{
+		DisableMemory: ctx.GlobalBool(DisableMemoryFlag.Name),
+		DisableStack:  ctx.GlobalBool(DisableStackFlag.Name),
+	}
+
+	var (
+		tracer      vm.Tracer
+		debugLogger *vm.StructLogger
+		profiler    *vm.Profiler
+	)
+	if ctx.GlobalBool(MachineFlag.Name) {
+		tracer = vm.NewJSONLogger(logconfig, os.Stdout)
+	} else if ctx.GlobalBool(DebugFlag.Name) {
+		debugLogger = vm.NewStructLogger(logconfig)
+		tracer = debugLogger
+	} else if ctx.GlobalBool(ProfileFlag.Name) || ctx.GlobalString(FoldedStacksFlag.Name) != "" {
+		profiler = vm.NewProfiler()
+		tracer = profiler
+	} else {
+		debugLogger = vm.NewStructLogger(logconfig)
+	}
+	env, err := newRunEnv(ctx, tracer)
+	if err != nil {
+		return err
+	}
+	statedb := env.statedb
+	initialGas := env.config.GasLimit
+
 	if cpuProfilePath := ctx.GlobalString(CPUProfileFlag.Name); cpuProfilePath != "" {
 		f, err := os.Create(cpuProfilePath)
 		if err != nil {
@@ -171,20 +219,8 @@ func runCmd(ctx *cli.Context) error {
 		defer pprof.StopCPUProfile()
 	}
 
-	if chainConfig != nil {
-		runtimeConfig.ChainConfig = chainConfig
-	}
 	tstart := time.Now()
-	var leftOverGas uint64
-	if ctx.GlobalBool(CreateFlag.Name) {
-		input := append(code, common.Hex2Bytes(ctx.GlobalString(InputFlag.Name))...)
-		ret, _, leftOverGas, err = runtime.Create(input, &runtimeConfig)
-	} else {
-		receiver := common.StringToAddress("receiver")
-		statedb.SetCode(receiver, code)
-
-		ret, leftOverGas, err = runtime.Call(receiver, common.Hex2Bytes(ctx.GlobalString(InputFlag.Name)), &runtimeConfig)
-	}
+	ret, leftOverGas, err := env.execute()
 	execTime := time.Since(tstart)
 
 	if ctx.GlobalBool(DumpFlag.Name) {
@@ -214,6 +250,24 @@ func runCmd(ctx *cli.Context) error {
 		vm.WriteLogs(os.Stderr, statedb.Logs())
 	}
 
+	if profiler != nil {
+		if ctx.GlobalBool(ProfileFlag.Name) {
+			profiler.WriteProfile(os.Stderr)
+		}
+		if path := ctx.GlobalString(FoldedStacksFlag.Name); path != "" {
+			f, err := os.Create(path)
+			if err != nil {
+				fmt.Println("could not create folded stacks file: ", err)
+				os.Exit(1)
+			}
+			if err := profiler.WriteFoldedStacks(f); err != nil {
+				fmt.Println("could not write folded stacks: ", err)
+				os.Exit(1)
+			}
+			f.Close()
+		}
+	}
+
 	if ctx.GlobalBool(StatDumpFlag.Name) {
 		var mem goruntime.MemStats
 		goruntime.ReadMemStats(&mem)
@@ -226,7 +280,7 @@ Gas used:           %d
 
 `, execTime, mem.HeapObjects, mem.Alloc, mem.TotalAlloc, mem.NumGC, initialGas-leftOverGas)
 	}
-	if tracer != nil {
+	if tracer != nil && profiler == nil {
 		tracer.CaptureEnd(ret, initialGas-leftOverGas, execTime)
 	} else {
 		fmt.Printf("0x%x\n", ret)
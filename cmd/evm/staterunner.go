@@ -0,0 +1,130 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/tests"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var stateTestCommand = cli.Command{
+	Action:    stateTestCmd,
+	Name:      "statetest",
+	Usage:     "executes the given state tests",
+	ArgsUsage: "<file>",
+	Flags: []cli.Flag{
+		ForkFlag,
+		SubtestFlag,
+	},
+}
+
+// testResult is the outcome of a single state or block test, as reported to
+// the user.
+type testResult struct {
+	Name         string      `json:"name"`
+	Pass         bool        `json:"pass"`
+	Fork         string      `json:"fork"`
+	Index        int         `json:"index,omitempty"`
+	ExpectedRoot common.Hash `json:"expectedRoot"`
+	StateRoot    common.Hash `json:"stateRoot"`
+	Error        string      `json:"error,omitempty"`
+}
+
+// testVMConfig assembles the EVM configuration of the test runners, tracing
+// the execution to stderr if requested.
+func testVMConfig(ctx *cli.Context) vm.Config {
+	if !ctx.GlobalBool(MachineFlag.Name) {
+		return vm.Config{}
+	}
+	logconfig := &vm.LogConfig{
+		DisableMemory: ctx.GlobalBool(DisableMemoryFlag.Name),
+		DisableStack:  ctx.GlobalBool(DisableStackFlag.Name),
+	}
+	return vm.Config{
+		Debug:  true,
+		Tracer: vm.NewJSONLogger(logconfig, os.Stderr),
+	}
+}
+
+// reportResults prints the test results to stdout and fails if any of them
+// didn't pass.
+func reportResults(results []testResult) error {
+	out, _ := json.MarshalIndent(results, "", "  ")
+	fmt.Println(string(out))
+
+	for _, result := range results {
+		if !result.Pass {
+			return errors.New("test failed")
+		}
+	}
+	return nil
+}
+
+func stateTestCmd(ctx *cli.Context) error {
+	if len(ctx.Args().First()) == 0 {
+		return errors.New("filename required")
+	}
+	src, err := ioutil.ReadFile(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	var stateTests map[string]tests.StateTest
+	if err = json.Unmarshal(src, &stateTests); err != nil {
+		return err
+	}
+	var (
+		fork    = ctx.String(ForkFlag.Name)
+		index   = ctx.Int(SubtestFlag.Name)
+		cfg     = testVMConfig(ctx)
+		results = []testResult{}
+	)
+	for name, test := range stateTests {
+		for _, st := range test.Subtests() {
+			if fork != "" && st.Fork != fork {
+				continue
+			}
+			if index >= 0 && st.Index != index {
+				continue
+			}
+			result := testResult{
+				Name:         name,
+				Pass:         true,
+				Fork:         st.Fork,
+				Index:        st.Index,
+				ExpectedRoot: test.ExpectedRoot(st),
+			}
+			state, err := test.Run(st, cfg)
+			if state != nil {
+				// Run commits the state, empty objects are already removed
+				result.StateRoot = state.IntermediateRoot(false)
+			}
+			if err != nil {
+				result.Pass, result.Error = false, err.Error()
+			}
+			results = append(results, result)
+		}
+	}
+	return reportResults(results)
+}
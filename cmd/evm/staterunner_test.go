@@ -0,0 +1,116 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// newTransferStateTest creates a state test of a plain value transfer, expecting
+// the given post state root for both of its forks.
+func newTransferStateTest(root common.Hash) map[string]interface{} {
+	post := func() []interface{} {
+		return []interface{}{map[string]interface{}{
+			"hash":    root.Hex(),
+			"indexes": map[string]int{"data": 0, "gas": 0, "value": 0},
+		}}
+	}
+	return map[string]interface{}{
+		"transfer": map[string]interface{}{
+			"env": map[string]string{
+				"currentCoinbase":   "2adc25665018aa1fe0e6bc666dac8fc2697ff9ba",
+				"currentDifficulty": "0x020000",
+				"currentGasLimit":   "0x0f4240",
+				"currentNumber":     "0x01",
+				"currentTimestamp":  "0x03e8",
+			},
+			"pre": map[string]interface{}{
+				"a94f5374fce5edbc8e2a8697c15331677e6ebf0b": map[string]string{
+					"balance": "0x0de0b6b3a7640000",
+					"nonce":   "0x00",
+					"code":    "0x",
+				},
+			},
+			"transaction": map[string]interface{}{
+				"data":      []string{"0x"},
+				"gasLimit":  []string{"0x5208"},
+				"gasPrice":  "0x01",
+				"nonce":     "0x00",
+				"secretKey": "0x45a915e4d060149eb4365960e6a7a45f334393093061116b197e3240065ff2d8",
+				"to":        "0x095e7baea6a6c7c4c2dfeb977efac326af552d87",
+				"value":     []string{"0x01"},
+			},
+			"post": map[string]interface{}{
+				"Homestead": post(),
+				"EIP158":    post(),
+			},
+		},
+	}
+}
+
+// Tests that the statetest command reports failing subtests along with the root
+// they produced, and passing ones once the expected root is fixed up.
+func TestStateTestCommand(t *testing.T) {
+	dir := tmpdir(t)
+	defer os.RemoveAll(dir)
+
+	// Run the test with a bogus expected root, every subtest must fail
+	path := writeFixture(t, dir, "state.json", newTransferStateTest(common.Hash{}))
+
+	evm := runEVM(t, "statetest", path)
+	var results []testResult
+	evm.expectJSON(&results)
+	if !strings.Contains(evm.StderrText(), "test failed") {
+		t.Errorf("failure not reported: %q", evm.StderrText())
+	}
+	if len(results) != 2 {
+		t.Fatalf("result count mismatch: have %d, want 2", len(results))
+	}
+	for _, result := range results {
+		if result.Name != "transfer" || result.Pass || result.Error == "" {
+			t.Errorf("fork %s: bogus root accepted: %+v", result.Fork, result)
+		}
+		if result.StateRoot == (common.Hash{}) {
+			t.Errorf("fork %s: missing state root", result.Fork)
+		}
+	}
+	var root common.Hash
+	for _, result := range results {
+		if result.Fork == "EIP158" {
+			root = result.StateRoot
+		}
+	}
+	// Run the test again expecting the produced root, only its fork selected
+	path = writeFixture(t, dir, "state.json", newTransferStateTest(root))
+
+	evm = runEVM(t, "statetest", "--fork", "EIP158", path)
+	results = nil
+	evm.expectJSON(&results)
+	if strings.Contains(evm.StderrText(), "test failed") {
+		t.Errorf("passing test reported as failed: %q", evm.StderrText())
+	}
+	if len(results) != 1 {
+		t.Fatalf("result count mismatch: have %d, want 1", len(results))
+	}
+	if result := results[0]; !result.Pass || result.Fork != "EIP158" || result.ExpectedRoot != root || result.StateRoot != root {
+		t.Errorf("result mismatch: %+v", result)
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/tests"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var (
+	InputAllocFlag = cli.StringFlag{
+		Name:  "input.alloc",
+		Usage: "JSON file with the prestate alloc",
+	}
+	InputEnvFlag = cli.StringFlag{
+		Name:  "input.env",
+		Usage: "JSON file with the block environment",
+	}
+	InputTxsFlag = cli.StringFlag{
+		Name:  "input.txs",
+		Usage: "JSON file with the list of transactions to apply",
+	}
+	OutputAllocFlag = cli.StringFlag{
+		Name:  "output.alloc",
+		Usage: "writes the poststate alloc to the given path instead of stdout",
+	}
+	OutputResultFlag = cli.StringFlag{
+		Name:  "output.result",
+		Usage: "writes the execution result to the given path instead of stdout",
+	}
+	TransitionForkFlag = cli.StringFlag{
+		Name:  "fork",
+		Usage: "name of the fork whose rules to apply (Frontier, Homestead, EIP150, EIP158, Metropolis)",
+	}
+)
+
+var transitionCommand = cli.Command{
+	Action: transitionCmd,
+	Name:   "transition",
+	Usage:  "applies a list of transactions to a prestate and outputs the poststate",
+	Flags: []cli.Flag{
+		TransitionForkFlag,
+		InputAllocFlag,
+		InputEnvFlag,
+		InputTxsFlag,
+		OutputAllocFlag,
+		OutputResultFlag,
+	},
+}
+
+// transitionEnv is the block environment the transactions are executed in.
+type transitionEnv struct {
+	Coinbase    common.Address                      `json:"currentCoinbase"`
+	Difficulty  *math.HexOrDecimal256               `json:"currentDifficulty"`
+	GasLimit    *math.HexOrDecimal256               `json:"currentGasLimit"`
+	Number      math.HexOrDecimal64                 `json:"currentNumber"`
+	Timestamp   math.HexOrDecimal64                 `json:"currentTimestamp"`
+	BlockHashes map[math.HexOrDecimal64]common.Hash `json:"blockHashes,omitempty"`
+}
+
+// transitionChain is the chain context of the transactions, serving the block
+// hashes given by the environment.
+type transitionChain struct {
+	env *transitionEnv
+}
+
+// header assembles the header of the block the transactions are executed in.
+func (c *transitionChain) header() *types.Header {
+	number := uint64(c.env.Number)
+	return &types.Header{
+		ParentHash: c.env.BlockHashes[math.HexOrDecimal64(number-1)],
+		Coinbase:   c.env.Coinbase,
+		Difficulty: bigOrZero(c.env.Difficulty),
+		Number:     new(big.Int).SetUint64(number),
+		GasLimit:   bigOrZero(c.env.GasLimit),
+		Time:       new(big.Int).SetUint64(uint64(c.env.Timestamp)),
+	}
+}
+
+// Engine implements core.ChainContext. The coinbase is given by the environment,
+// so no consensus engine is needed.
+func (c *transitionChain) Engine() consensus.Engine {
+	return nil
+}
+
+// GetHeader implements core.ChainContext. The environment only holds the hashes
+// of the previous blocks, which are served through GetAncestorHash instead.
+func (c *transitionChain) GetHeader(hash common.Hash, number uint64) *types.Header {
+	return nil
+}
+
+// GetAncestorHash returns the hash of a previous block given by the environment.
+func (c *transitionChain) GetAncestorHash(number uint64) common.Hash {
+	return c.env.BlockHashes[math.HexOrDecimal64(number)]
+}
+
+// transitionTx is an unsigned transaction along with the key to sign it with.
+type transitionTx struct {
+	Nonce     math.HexOrDecimal64   `json:"nonce"`
+	GasPrice  *math.HexOrDecimal256 `json:"gasPrice"`
+	Gas       *math.HexOrDecimal256 `json:"gas"`
+	To        *common.Address       `json:"to"`
+	Value     *math.HexOrDecimal256 `json:"value"`
+	Input     hexutil.Bytes         `json:"input"`
+	SecretKey *common.Hash          `json:"secretKey"`
+}
+
+// transitionResult is the outcome of applying the transactions.
+type transitionResult struct {
+	StateRoot   common.Hash    `json:"stateRoot"`
+	TxRoot      common.Hash    `json:"txRoot"`
+	ReceiptRoot common.Hash    `json:"receiptRoot"`
+	Bloom       types.Bloom    `json:"logsBloom"`
+	GasUsed     *hexutil.Big   `json:"gasUsed"`
+	Receipts    types.Receipts `json:"receipts"`
+	Rejected    []int          `json:"rejected"`
+}
+
+func transitionCmd(ctx *cli.Context) error {
+	fork := ctx.String(TransitionForkFlag.Name)
+	config, ok := tests.Forks[fork]
+	if !ok {
+		return fmt.Errorf("unknown fork %q", fork)
+	}
+	var (
+		alloc core.GenesisAlloc
+		env   transitionEnv
+		raws  []json.RawMessage
+	)
+	if err := readJSONFile(ctx.String(InputAllocFlag.Name), &alloc); err != nil {
+		return fmt.Errorf("failed to read prestate: %v", err)
+	}
+	if err := readJSONFile(ctx.String(InputEnvFlag.Name), &env); err != nil {
+		return fmt.Errorf("failed to read environment: %v", err)
+	}
+	if err := readJSONFile(ctx.String(InputTxsFlag.Name), &raws); err != nil {
+		return fmt.Errorf("failed to read transactions: %v", err)
+	}
+	signer := types.MakeSigner(config, new(big.Int).SetUint64(uint64(env.Number)))
+
+	txs := make(types.Transactions, len(raws))
+	for i, raw := range raws {
+		tx, err := decodeTransitionTx(raw, signer)
+		if err != nil {
+			return fmt.Errorf("transaction %d: %v", i, err)
+		}
+		txs[i] = tx
+	}
+	db, _ := ethdb.NewMemDatabase()
+	statedb := makePreState(db, alloc)
+
+	var (
+		chain  = &transitionChain{env: &env}
+		header = chain.header()
+		gp     = new(core.GasPool).AddGas(header.GasLimit)
+
+		gasUsed  = new(big.Int)
+		included types.Transactions
+		receipts = types.Receipts{}
+		rejected = []int{}
+	)
+	for i, tx := range txs {
+		// The messages of this fork don't check nonces, so do it here to reject
+		// the transactions other clients would.
+		sender, err := types.Sender(signer, tx)
+		if err != nil {
+			log.Warn("Rejected transaction", "index", i, "err", err)
+			rejected = append(rejected, i)
+			continue
+		}
+		if nonce := statedb.GetNonce(sender); nonce != tx.Nonce() {
+			log.Warn("Rejected transaction", "index", i, "err", fmt.Errorf("invalid nonce: have %d, expected %d", tx.Nonce(), nonce))
+			rejected = append(rejected, i)
+			continue
+		}
+		statedb.Prepare(tx.Hash(), common.Hash{}, len(included))
+
+		// Invalid transactions may fail after having touched the state or
+		// the gas pool, roll both back before moving on.
+		var (
+			snapshot = statedb.Snapshot()
+			gasLeft  = new(big.Int).Set((*big.Int)(gp))
+		)
+		receipt, _, err := core.ApplyTransaction(config, chain, &env.Coinbase, gp, statedb, header, tx, gasUsed, vm.Config{})
+		if err != nil {
+			statedb.RevertToSnapshot(snapshot)
+			(*big.Int)(gp).Set(gasLeft)
+			log.Warn("Rejected transaction", "index", i, "err", err)
+			rejected = append(rejected, i)
+			continue
+		}
+		included = append(included, tx)
+		receipts = append(receipts, receipt)
+	}
+	root, err := statedb.CommitTo(db, config.IsEIP158(header.Number))
+	if err != nil {
+		return fmt.Errorf("failed to commit state: %v", err)
+	}
+	statedb, _ = state.New(root, state.NewDatabase(db))
+	alloc, err = dumpAlloc(statedb)
+	if err != nil {
+		return fmt.Errorf("failed to dump poststate: %v", err)
+	}
+
+	result := &transitionResult{
+		StateRoot:   root,
+		TxRoot:      types.DeriveSha(included),
+		ReceiptRoot: types.DeriveSha(receipts),
+		Bloom:       types.CreateBloom(receipts),
+		GasUsed:     (*hexutil.Big)(gasUsed),
+		Receipts:    receipts,
+		Rejected:    rejected,
+	}
+	// Write the outputs to their files, collecting the rest for stdout
+	stdout := make(map[string]interface{})
+	outputs := []struct {
+		name  string
+		path  string
+		value interface{}
+	}{
+		{"alloc", ctx.String(OutputAllocFlag.Name), alloc},
+		{"result", ctx.String(OutputResultFlag.Name), result},
+	}
+	for _, out := range outputs {
+		if out.path == "" {
+			stdout[out.name] = out.value
+			continue
+		}
+		b, err := json.MarshalIndent(out.value, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(out.path, b, 0644); err != nil {
+			return err
+		}
+	}
+	if len(stdout) > 0 {
+		b, err := json.MarshalIndent(stdout, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	}
+	return nil
+}
+
+// readJSONFile decodes the JSON content of the given file into value.
+func readJSONFile(path string, value interface{}) error {
+	if path == "" {
+		return errors.New("path required")
+	}
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(src, value)
+}
+
+// decodeTransitionTx decodes a transaction in the RPC format, signing it with
+// the key it carries if it's not signed yet.
+func decodeTransitionTx(raw json.RawMessage, signer types.Signer) (*types.Transaction, error) {
+	var unsigned transitionTx
+	if err := json.Unmarshal(raw, &unsigned); err != nil {
+		return nil, err
+	}
+	if unsigned.SecretKey == nil {
+		tx := new(types.Transaction)
+		if err := json.Unmarshal(raw, tx); err != nil {
+			return nil, err
+		}
+		return tx, nil
+	}
+	key, err := crypto.ToECDSA(unsigned.SecretKey[:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret key: %v", err)
+	}
+	var tx *types.Transaction
+	if unsigned.To == nil {
+		tx = types.NewContractCreation(uint64(unsigned.Nonce), bigOrZero(unsigned.Value), bigOrZero(unsigned.Gas), bigOrZero(unsigned.GasPrice), unsigned.Input)
+	} else {
+		tx = types.NewTransaction(uint64(unsigned.Nonce), *unsigned.To, bigOrZero(unsigned.Value), bigOrZero(unsigned.Gas), bigOrZero(unsigned.GasPrice), unsigned.Input)
+	}
+	return types.SignTx(tx, signer, key)
+}
+
+// makePreState creates a state database populated with the given accounts.
+func makePreState(db ethdb.Database, accounts core.GenesisAlloc) *state.StateDB {
+	sdb := state.NewDatabase(db)
+	statedb, _ := state.New(common.Hash{}, sdb)
+	for addr, a := range accounts {
+		statedb.SetCode(addr, a.Code)
+		statedb.SetNonce(addr, a.Nonce)
+		statedb.SetBalance(addr, bigOrZero((*math.HexOrDecimal256)(a.Balance)))
+		for k, v := range a.Storage {
+			statedb.SetState(addr, k, v)
+		}
+	}
+	// Commit and re-open to start with a clean state.
+	root, _ := statedb.CommitTo(db, false)
+	statedb, _ = state.New(root, sdb)
+	return statedb
+}
+
+// dumpAlloc converts the content of a committed state into a genesis alloc.
+func dumpAlloc(statedb *state.StateDB) (core.GenesisAlloc, error) {
+	dump, err := statedb.RawDumpWithConfig(nil)
+	if err != nil {
+		return nil, err
+	}
+	alloc := make(core.GenesisAlloc)
+	for addr, account := range dump.Accounts {
+		balance, ok := new(big.Int).SetString(account.Balance, 10)
+		if !ok {
+			return nil, fmt.Errorf("account %s: invalid balance %q", addr, account.Balance)
+		}
+		genesisAccount := core.GenesisAccount{
+			Balance: balance,
+			Nonce:   account.Nonce,
+			Code:    common.FromHex(account.Code),
+		}
+		if len(account.Storage) > 0 {
+			genesisAccount.Storage = make(map[common.Hash]common.Hash)
+		}
+		for key, value := range account.Storage {
+			// Storage values are kept RLP encoded in the trie
+			var content []byte
+			if err := rlp.DecodeBytes(common.FromHex(value), &content); err != nil {
+				return nil, fmt.Errorf("account %s: invalid storage slot %s: %v", addr, key, err)
+			}
+			genesisAccount.Storage[common.HexToHash(key)] = common.BytesToHash(content)
+		}
+		alloc[common.HexToAddress(addr)] = genesisAccount
+	}
+	return alloc, nil
+}
+
+// bigOrZero returns the value of an optional numeric field, zero if missing.
+func bigOrZero(n *math.HexOrDecimal256) *big.Int {
+	if n == nil {
+		return new(big.Int)
+	}
+	return new(big.Int).Set((*big.Int)(n))
+}
@@ -0,0 +1,228 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var (
+	transitionKey, _  = crypto.HexToECDSA("45a915e4d060149eb4365960e6a7a45f334393093061116b197e3240065ff2d8")
+	transitionSender  = crypto.PubkeyToAddress(transitionKey.PublicKey)
+	transitionSecret  = common.BytesToHash(crypto.FromECDSA(transitionKey)).Hex()
+	transitionBalance = big.NewInt(1000000000000000000)
+)
+
+// transitionOutput is the stdout output of the transition command.
+type transitionOutput struct {
+	Alloc  core.GenesisAlloc `json:"alloc"`
+	Result struct {
+		StateRoot common.Hash       `json:"stateRoot"`
+		GasUsed   *hexutil.Big      `json:"gasUsed"`
+		Receipts  []json.RawMessage `json:"receipts"`
+		Rejected  []int             `json:"rejected"`
+	} `json:"result"`
+}
+
+// runTransition writes the inputs of the transition command into the given
+// directory and runs it on them, returning its decoded output.
+func runTransition(t *testing.T, dir string, alloc, env, txs interface{}) *transitionOutput {
+	var (
+		allocPath = writeFixture(t, dir, "alloc.json", alloc)
+		envPath   = writeFixture(t, dir, "env.json", env)
+		txsPath   = writeFixture(t, dir, "txs.json", txs)
+	)
+	evm := runEVM(t, "transition", "--fork", "Homestead", "--input.alloc", allocPath, "--input.env", envPath, "--input.txs", txsPath)
+
+	out := new(transitionOutput)
+	evm.expectJSON(out)
+	return out
+}
+
+// transitionTestEnv returns a block environment with the given gas limit.
+func transitionTestEnv(gasLimit uint64) map[string]interface{} {
+	return map[string]interface{}{
+		"currentCoinbase":   common.Address{0xc0}.Hex(),
+		"currentDifficulty": "0x020000",
+		"currentGasLimit":   hexutil.EncodeUint64(gasLimit),
+		"currentNumber":     "0x05",
+		"currentTimestamp":  "0x03e8",
+		"blockHashes":       map[string]string{"4": common.Hash{0x04}.Hex()},
+	}
+}
+
+// transitionTestTx returns a transaction of the test sender, signed with its
+// secret key by the command.
+func transitionTestTx(nonce uint64, to common.Address, value int64, gas uint64, input string) map[string]interface{} {
+	return map[string]interface{}{
+		"nonce":     hexutil.EncodeUint64(nonce),
+		"gasPrice":  "0x01",
+		"gas":       hexutil.EncodeUint64(gas),
+		"to":        to.Hex(),
+		"value":     hexutil.EncodeBig(big.NewInt(value)),
+		"input":     input,
+		"secretKey": transitionSecret,
+	}
+}
+
+// Tests that transactions with a wrong nonce or failing after having touched the
+// state are rejected, leaving the state and gas pool as they were before them.
+func TestTransitionRejected(t *testing.T) {
+	dir := tmpdir(t)
+	defer os.RemoveAll(dir)
+
+	var (
+		recipient = common.Address{0x01}
+		alloc     = core.GenesisAlloc{transitionSender: {Balance: transitionBalance}}
+		txs       = []interface{}{
+			transitionTestTx(0, recipient, 1, 21000, "0x"),   // valid
+			transitionTestTx(5, recipient, 1, 21000, "0x"),   // nonce too high
+			transitionTestTx(1, recipient, 1, 21000, "0x01"), // buys its gas, but too little for the input
+			transitionTestTx(1, recipient, 2, 21000, "0x"),   // valid, fits in the gas pool only if rolled back
+			transitionTestTx(1, recipient, 1, 21000, "0x"),   // nonce too low
+		}
+	)
+	out := runTransition(t, dir, alloc, transitionTestEnv(42000), txs)
+
+	if want := []int{1, 2, 4}; !reflect.DeepEqual(out.Result.Rejected, want) {
+		t.Errorf("rejected transactions mismatch: have %v, want %v", out.Result.Rejected, want)
+	}
+	if len(out.Result.Receipts) != 2 {
+		t.Errorf("receipt count mismatch: have %d, want 2", len(out.Result.Receipts))
+	}
+	if out.Result.GasUsed == nil || out.Result.GasUsed.ToInt().Uint64() != 42000 {
+		t.Errorf("gas used mismatch: have %v, want 42000", out.Result.GasUsed)
+	}
+	sender := out.Alloc[transitionSender]
+	if sender.Nonce != 2 {
+		t.Errorf("sender nonce mismatch: have %d, want 2", sender.Nonce)
+	}
+	if want := new(big.Int).Sub(transitionBalance, big.NewInt(3+42000)); sender.Balance == nil || sender.Balance.Cmp(want) != 0 {
+		t.Errorf("sender balance mismatch: have %v, want %v", sender.Balance, want)
+	}
+	if balance := out.Alloc[recipient].Balance; balance == nil || balance.Int64() != 3 {
+		t.Errorf("recipient balance mismatch: have %v, want 3", balance)
+	}
+}
+
+// Tests that the block environment is parsed and exposed to the executed code.
+func TestTransitionEnv(t *testing.T) {
+	dir := tmpdir(t)
+	defer os.RemoveAll(dir)
+
+	// The contract stores the hash of the previous block, the timestamp and the
+	// number of the current block into slots 0, 1 and 2.
+	var (
+		contract = common.Address{0xcc}
+		code     = common.FromHex("0x600143034060005542600155436002550000")
+		alloc    = core.GenesisAlloc{
+			transitionSender: {Balance: transitionBalance},
+			contract:         {Balance: new(big.Int), Code: code},
+		}
+		txs = []interface{}{transitionTestTx(0, contract, 0, 100000, "0x")}
+	)
+	out := runTransition(t, dir, alloc, transitionTestEnv(1000000), txs)
+
+	if len(out.Result.Rejected) != 0 {
+		t.Fatalf("transaction rejected")
+	}
+	storage := out.Alloc[contract].Storage
+	want := map[common.Hash]common.Hash{
+		common.BigToHash(big.NewInt(0)): common.Hash{0x04},
+		common.BigToHash(big.NewInt(1)): common.BigToHash(big.NewInt(1000)),
+		common.BigToHash(big.NewInt(2)): common.BigToHash(big.NewInt(5)),
+	}
+	if !reflect.DeepEqual(storage, want) {
+		t.Errorf("storage mismatch: have %x, want %x", storage, want)
+	}
+}
+
+// Tests that the poststate alloc written by the command can be fed back to it,
+// yielding the same state.
+func TestTransitionAllocRoundTrip(t *testing.T) {
+	dir := tmpdir(t)
+	defer os.RemoveAll(dir)
+
+	alloc := core.GenesisAlloc{
+		transitionSender: {Balance: transitionBalance, Nonce: 3},
+		common.Address{0xcc}: {
+			Balance: big.NewInt(7),
+			Nonce:   1,
+			Code:    common.FromHex("0x6001600055"),
+			Storage: map[common.Hash]common.Hash{
+				common.Hash{0x01}:               common.Hash{0x02},
+				common.BigToHash(big.NewInt(3)): common.BigToHash(big.NewInt(42)),
+			},
+		},
+	}
+	first := runTransition(t, dir, alloc, transitionTestEnv(1000000), []interface{}{})
+
+	// Write the poststate to a file through the output flag and feed it back
+	envPath := writeFixture(t, dir, "env.json", transitionTestEnv(1000000))
+	txsPath := writeFixture(t, dir, "txs.json", []interface{}{})
+	allocPath := filepath.Join(dir, "post.json")
+
+	evm := runEVM(t, "transition", "--fork", "Homestead", "--input.alloc", writeFixture(t, dir, "alloc.json", first.Alloc),
+		"--input.env", envPath, "--input.txs", txsPath, "--output.alloc", allocPath)
+	second := new(transitionOutput)
+	evm.expectJSON(second)
+
+	blob, err := ioutil.ReadFile(allocPath)
+	if err != nil {
+		t.Fatalf("failed to read poststate: %v", err)
+	}
+	var post core.GenesisAlloc
+	if err := json.Unmarshal(blob, &post); err != nil {
+		t.Fatalf("failed to decode poststate: %v", err)
+	}
+	if second.Result.StateRoot != first.Result.StateRoot {
+		t.Errorf("state root mismatch: have %x, want %x", second.Result.StateRoot, first.Result.StateRoot)
+	}
+	if len(post) != len(alloc) {
+		t.Fatalf("account count mismatch: have %d, want %d", len(post), len(alloc))
+	}
+	for addr, want := range alloc {
+		have, ok := post[addr]
+		if !ok {
+			t.Errorf("account %x: missing", addr)
+			continue
+		}
+		if have.Balance == nil || have.Balance.Cmp(want.Balance) != 0 || have.Nonce != want.Nonce || !bytes.Equal(have.Code, want.Code) {
+			t.Errorf("account %x: mismatch: have %+v, want %+v", addr, have, want)
+		}
+		if len(have.Storage) != len(want.Storage) {
+			t.Errorf("account %x: storage size mismatch: have %d, want %d", addr, len(have.Storage), len(want.Storage))
+		}
+		for key, value := range want.Storage {
+			if have.Storage[key] != value {
+				t.Errorf("account %x: slot %x mismatch: have %x, want %x", addr, key, have.Storage[key], value)
+			}
+		}
+	}
+}
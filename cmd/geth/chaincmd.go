@@ -31,13 +31,74 @@ import (
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/trie"
-	"github.com/syndtr/goleveldb/leveldb/util"
 	"gopkg.in/urfave/cli.v1"
 )
 
+var (
+	verifyCommandRootFlag = cli.StringFlag{
+		Name:  "root",
+		Usage: "State root to verify (default = newest state persisted at or below the head block)",
+	}
+	workersFlag = cli.IntFlag{
+		Name:  "workers",
+		Value: runtime.NumCPU(),
+		Usage: "Number of parallel workers",
+	}
+	replayCommandFromFlag = cli.Uint64Flag{
+		Name:  "from",
+		Value: 1,
+		Usage: "First block to replay",
+	}
+	replayCommandToFlag = cli.Uint64Flag{
+		Name:  "to",
+		Usage: "Last block to replay (0 = head block)",
+	}
+	archiveSegmentSizeFlag = cli.Uint64Flag{
+		Name:  "segment-size",
+		Value: utils.DefaultArchiveSegmentSize,
+		Usage: "Number of blocks per archive segment file",
+	}
+	archiveReceiptsFlag = cli.BoolFlag{
+		Name:  "receipts",
+		Usage: "Include the block receipts in the archive",
+	}
+	archiveTdFlag = cli.BoolFlag{
+		Name:  "td",
+		Usage: "Include the total difficulty of the blocks in the archive",
+	}
+	replayCommandReportFlag = cli.StringFlag{
+		Name:  "report",
+		Usage: "File to write the JSON report of the divergences to (default = stdout)",
+	}
+	dumpIterativeFlag = cli.BoolFlag{
+		Name:  "iterative",
+		Usage: "Stream the accounts as JSON lines instead of a single JSON object",
+	}
+	dumpNoCodeFlag = cli.BoolFlag{
+		Name:  "nocode",
+		Usage: "Exclude the contract codes from the dump",
+	}
+	dumpNoStorageFlag = cli.BoolFlag{
+		Name:  "nostorage",
+		Usage: "Exclude the contract storages from the dump",
+	}
+	dumpStartFlag = cli.StringFlag{
+		Name:  "start",
+		Usage: "Account address or hex key to start the dump at (default = first account)",
+	}
+	dumpLimitFlag = cli.StringFlag{
+		Name:  "limit",
+		Usage: "Account address or hex key to stop the dump before (default = none)",
+	}
+	dumpMaxResultsFlag = cli.Uint64Flag{
+		Name:  "max-results",
+		Usage: "Maximum number of accounts to dump (0 = no limit)",
+	}
+)
+
 var (
 	initCommand = cli.Command{
 		Action:    utils.MigrateFlags(initGenesis),
@@ -63,6 +124,7 @@ It expects the genesis file as argument.`,
 		ArgsUsage: "<filename> (<filename 2> ... <filename N>) ",
 		Flags: []cli.Flag{
 			utils.DataDirFlag,
+			utils.AncientFlag,
 			utils.CacheFlag,
 			utils.LightModeFlag,
 		},
@@ -81,6 +143,7 @@ processing will proceed even if an individual RLP-file import failure occurs.`,
 		ArgsUsage: "<filename> [<blockNumFirst> <blockNumLast>]",
 		Flags: []cli.Flag{
 			utils.DataDirFlag,
+			utils.AncientFlag,
 			utils.CacheFlag,
 			utils.LightModeFlag,
 		},
@@ -90,6 +153,49 @@ Requires a first argument of the file to write to.
 Optional second and third arguments control the first and
 last block to write. In this mode, the file will be appended
 if already existing.`,
+	}
+	exportArchiveCommand = cli.Command{
+		Action:    utils.MigrateFlags(exportArchive),
+		Name:      "export-archive",
+		Usage:     "Export blockchain into a segmented archive directory",
+		ArgsUsage: "<dirname> [<blockNumFirst> <blockNumLast>]",
+		Flags: []cli.Flag{
+			utils.DataDirFlag,
+			utils.AncientFlag,
+			utils.CacheFlag,
+			utils.LightModeFlag,
+			archiveSegmentSizeFlag,
+			archiveReceiptsFlag,
+			archiveTdFlag,
+			workersFlag,
+		},
+		Category: "BLOCKCHAIN COMMANDS",
+		Description: `
+Exports the canonical chain, or the given range of it, into a new archive in the
+given directory. The blocks are written into fixed size, compressed segment files
+exported in parallel, optionally along with their receipts and total difficulty.
+A manifest lists the chain ID, the genesis hash, the range and the checksums of
+the segments, and is written once all the segments are complete.`,
+	}
+	importArchiveCommand = cli.Command{
+		Action:    utils.MigrateFlags(importArchive),
+		Name:      "import-archive",
+		Usage:     "Import a blockchain archive directory",
+		ArgsUsage: "<dirname>",
+		Flags: []cli.Flag{
+			utils.DataDirFlag,
+			utils.AncientFlag,
+			utils.CacheFlag,
+			utils.LightModeFlag,
+		},
+		Category: "BLOCKCHAIN COMMANDS",
+		Description: `
+Imports the blocks of an archive created by export-archive, after checking that
+it belongs to the same chain. The checksum of each segment is verified before
+importing it, as well as the receipts and total difficulties if archived.
+
+The segments and batches of blocks already present in the database are skipped,
+so an interrupted import resumes where it stopped when run again.`,
 	}
 	removedbCommand = cli.Command{
 		Action:    utils.MigrateFlags(removeDB),
@@ -98,11 +204,13 @@ if already existing.`,
 		ArgsUsage: " ",
 		Flags: []cli.Flag{
 			utils.DataDirFlag,
+			utils.AncientFlag,
 			utils.LightModeFlag,
 		},
 		Category: "BLOCKCHAIN COMMANDS",
 		Description: `
-Remove blockchain and state databases`,
+Remove blockchain and state databases, along with the ancient database if it's
+placed outside of the chain database with --datadir.ancient.`,
 	}
 	dumpCommand = cli.Command{
 		Action:    utils.MigrateFlags(dump),
@@ -111,13 +219,81 @@ Remove blockchain and state databases`,
 		ArgsUsage: "[<blockHash> | <blockNum>]...",
 		Flags: []cli.Flag{
 			utils.DataDirFlag,
+			utils.AncientFlag,
 			utils.CacheFlag,
 			utils.LightModeFlag,
+			dumpIterativeFlag,
+			dumpNoCodeFlag,
+			dumpNoStorageFlag,
+			dumpStartFlag,
+			dumpLimitFlag,
+			dumpMaxResultsFlag,
 		},
 		Category: "BLOCKCHAIN COMMANDS",
 		Description: `
 The arguments are interpreted as block numbers or hashes.
-Use "ethereum dump 0" to dump the genesis block.`,
+Use "ethereum dump 0" to dump the genesis block.
+
+The accounts are dumped in the order of their keys, the hashes of their addresses,
+optionally restricted to a range of keys and a maximum count. With --iterative the
+state is streamed as JSON lines, a first line holding the state root followed by
+a line per account, without collecting it in memory. If the dump is cut short by
+--max-results, the key to continue at is logged, to be passed as --start.`,
+	}
+	verifyCommand = cli.Command{
+		Action:    utils.MigrateFlags(verifyChain),
+		Name:      "verify",
+		Usage:     "Verify the integrity of the chain and state databases",
+		ArgsUsage: "[<blockNumFirst> <blockNumLast>]",
+		Flags: []cli.Flag{
+			utils.DataDirFlag,
+			utils.AncientFlag,
+			utils.CacheFlag,
+			utils.LightModeFlag,
+			verifyCommandRootFlag,
+			workersFlag,
+		},
+		Category: "BLOCKCHAIN COMMANDS",
+		Description: `
+The verify command checks the database of a stopped node for corruption. It
+walks the account and storage tries of a state root, checking that every trie
+node and contract code is present and matches its hash, then checks that the
+canonical hashes, headers, bodies, total difficulties and receipts of a range
+of blocks are consistent with each other.
+
+By default the state of the head block is checked, or if it's missing, as with
+pruning nodes after an unclean shutdown, the newest state persisted below it.
+The optional arguments limit the checked blocks to the given range, by default
+the entire chain up to the head block is checked. The first corruption found is
+reported and the command exits with an error.`,
+	}
+	replayCommand = cli.Command{
+		Action:    utils.MigrateFlags(replayChain),
+		Name:      "replay",
+		Usage:     "Re-execute blocks and compare the results with the stored ones",
+		ArgsUsage: " ",
+		Flags: []cli.Flag{
+			utils.DataDirFlag,
+			utils.AncientFlag,
+			utils.CacheFlag,
+			utils.LightModeFlag,
+			replayCommandFromFlag,
+			replayCommandToFlag,
+			replayCommandReportFlag,
+			workersFlag,
+		},
+		Category: "BLOCKCHAIN COMMANDS",
+		Description: `
+The replay command re-executes a range of canonical blocks on top of their stored
+parent states, and compares the gas used, the receipts, the logs and the state
+roots with the stored ones. It is meant to check that changes to the EVM or the
+state handling still produce the same results for the historical blocks.
+
+The range is split into segments replayed in parallel, each starting at a block
+whose parent state is stored, so the parent state of the first block must be
+available (all states are available on archive nodes). Blocks following a failed
+one are counted as unverified until a stored parent state is reached. The
+differences found are written as a JSON report. The database is not modified.`,
 	}
 )
 
@@ -193,12 +369,12 @@ func importChain(ctx *cli.Context) error {
 		}
 	}
 
+	// Persist the state of the imported head held in memory
+	chain.Stop()
 	fmt.Printf("Import done in %v.\n\n", time.Since(start))
 
 	// Output pre-compaction stats mostly to see the import trashing
-	db := chainDb.(*ethdb.LDBDatabase)
-
-	stats, err := db.LDB().GetProperty("leveldb.stats")
+	stats, err := chainDb.Stat("leveldb.stats")
 	if err != nil {
 		utils.Fatalf("Failed to read database stats: %v", err)
 	}
@@ -222,12 +398,12 @@ func importChain(ctx *cli.Context) error {
 	// Compact the entire database to more accurately measure disk io and print the stats
 	start = time.Now()
 	fmt.Println("Compacting entire database...")
-	if err = db.LDB().CompactRange(util.Range{}); err != nil {
+	if err = chainDb.Compact(nil, nil); err != nil {
 		utils.Fatalf("Compaction failed: %v", err)
 	}
 	fmt.Printf("Compaction done in %v.\n\n", time.Since(start))
 
-	stats, err = db.LDB().GetProperty("leveldb.stats")
+	stats, err = chainDb.Stat("leveldb.stats")
 	if err != nil {
 		utils.Fatalf("Failed to read database stats: %v", err)
 	}
@@ -268,20 +444,77 @@ func exportChain(ctx *cli.Context) error {
 	return nil
 }
 
+func exportArchive(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 && len(ctx.Args()) != 3 {
+		utils.Fatalf("This command requires a directory argument, optionally followed by a block range.")
+	}
+	stack := makeFullNode(ctx)
+	chain, chainDb := utils.MakeChain(ctx, stack)
+	defer chainDb.Close()
+	defer chain.Stop()
+
+	config := utils.ArchiveExportConfig{
+		Last:        chain.CurrentBlock().NumberU64(),
+		SegmentSize: ctx.Uint64(archiveSegmentSizeFlag.Name),
+		Receipts:    ctx.Bool(archiveReceiptsFlag.Name),
+		Td:          ctx.Bool(archiveTdFlag.Name),
+		Workers:     ctx.Int(workersFlag.Name),
+	}
+	if len(ctx.Args()) == 3 {
+		var ferr, lerr error
+		config.First, ferr = strconv.ParseUint(ctx.Args().Get(1), 10, 64)
+		config.Last, lerr = strconv.ParseUint(ctx.Args().Get(2), 10, 64)
+		if ferr != nil || lerr != nil {
+			utils.Fatalf("Export error in parsing parameters: block number not an integer")
+		}
+	}
+	start := time.Now()
+	if err := utils.ExportArchive(chain, ctx.Args().First(), config); err != nil {
+		utils.Fatalf("Export error: %v", err)
+	}
+	fmt.Printf("Export done in %v\n", time.Since(start))
+	return nil
+}
+
+func importArchive(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		utils.Fatalf("This command requires an archive directory argument.")
+	}
+	stack := makeFullNode(ctx)
+	chain, chainDb := utils.MakeChain(ctx, stack)
+	defer chainDb.Close()
+
+	start := time.Now()
+	err := utils.ImportArchive(chain, ctx.Args().First())
+	chain.Stop()
+	if err != nil {
+		utils.Fatalf("Import error: %v", err)
+	}
+	fmt.Printf("Import done in %v\n", time.Since(start))
+	return nil
+}
+
 func removeDB(ctx *cli.Context) error {
 	stack, _ := makeConfigNode(ctx)
 
-	for _, name := range []string{"chaindata", "lightchaindata"} {
+	databases := []struct{ name, dir string }{
+		{"chaindata", stack.ResolvePath("chaindata")},
+		{"lightchaindata", stack.ResolvePath("lightchaindata")},
+	}
+	// The ancient database lives inside the chain database unless moved elsewhere
+	if ctx.GlobalIsSet(utils.AncientFlag.Name) {
+		databases = append(databases, struct{ name, dir string }{"ancient", stack.ResolvePath(ctx.GlobalString(utils.AncientFlag.Name))})
+	}
+	for _, db := range databases {
 		// Ensure the database exists in the first place
-		logger := log.New("database", name)
+		logger := log.New("database", db.name)
 
-		dbdir := stack.ResolvePath(name)
-		if !common.FileExist(dbdir) {
-			logger.Info("Database doesn't exist, skipping", "path", dbdir)
+		if !common.FileExist(db.dir) {
+			logger.Info("Database doesn't exist, skipping", "path", db.dir)
 			continue
 		}
 		// Confirm removal and execute
-		fmt.Println(dbdir)
+		fmt.Println(db.dir)
 		confirm, err := console.Stdin.PromptConfirm("Remove this database?")
 		switch {
 		case err != nil:
@@ -290,14 +523,52 @@ func removeDB(ctx *cli.Context) error {
 			logger.Warn("Database deletion aborted")
 		default:
 			start := time.Now()
-			os.RemoveAll(dbdir)
+			os.RemoveAll(db.dir)
 			logger.Info("Database successfully deleted", "elapsed", common.PrettyDuration(time.Since(start)))
 		}
 	}
 	return nil
 }
 
+// parseDumpKey parses an account address or key given on the command line into
+// the key of the account in the state trie.
+func parseDumpKey(arg string) ([]byte, error) {
+	key, err := parseHexArg(arg)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == common.AddressLength {
+		key = crypto.Keccak256(key)
+	}
+	return key, nil
+}
+
+// makeDumpConfig creates the state dump configuration from the command flags.
+func makeDumpConfig(ctx *cli.Context) (*state.DumpConfig, error) {
+	conf := &state.DumpConfig{
+		SkipCode:    ctx.Bool(dumpNoCodeFlag.Name),
+		SkipStorage: ctx.Bool(dumpNoStorageFlag.Name),
+		Max:         ctx.Uint64(dumpMaxResultsFlag.Name),
+	}
+	var err error
+	if ctx.IsSet(dumpStartFlag.Name) {
+		if conf.Start, err = parseDumpKey(ctx.String(dumpStartFlag.Name)); err != nil {
+			return nil, err
+		}
+	}
+	if ctx.IsSet(dumpLimitFlag.Name) {
+		if conf.Limit, err = parseDumpKey(ctx.String(dumpLimitFlag.Name)); err != nil {
+			return nil, err
+		}
+	}
+	return conf, nil
+}
+
 func dump(ctx *cli.Context) error {
+	conf, err := makeDumpConfig(ctx)
+	if err != nil {
+		utils.Fatalf("%v", err)
+	}
 	stack := makeFullNode(ctx)
 	chain, chainDb := utils.MakeChain(ctx, stack)
 	for _, arg := range ctx.Args() {
@@ -316,13 +587,130 @@ func dump(ctx *cli.Context) error {
 			if err != nil {
 				utils.Fatalf("could not create new state: %v", err)
 			}
-			fmt.Printf("%s\n", state.Dump())
+			if !ctx.Bool(dumpIterativeFlag.Name) {
+				dump, err := state.DumpWithConfig(conf)
+				if err != nil {
+					utils.Fatalf("Failed to dump state: %v", err)
+				}
+				fmt.Printf("%s\n", dump)
+				continue
+			}
+			next, err := state.IterativeDump(conf, os.Stdout)
+			if err != nil {
+				utils.Fatalf("Failed to dump state: %v", err)
+			}
+			if next != nil {
+				log.Info("Account limit reached", "block", block.NumberU64(), "next", fmt.Sprintf("%#x", next))
+			}
 		}
 	}
+	chain.Stop()
 	chainDb.Close()
 	return nil
 }
 
+func verifyChain(ctx *cli.Context) error {
+	if len(ctx.Args()) != 0 && len(ctx.Args()) != 2 {
+		utils.Fatalf("This command accepts either no arguments or a first and last block number.")
+	}
+	db := openChainDB(ctx)
+	defer db.Close()
+
+	hash := core.GetHeadBlockHash(db)
+	head := core.GetBlock(db, hash, core.GetBlockNumber(db, hash))
+	if head == nil {
+		utils.Fatalf("Failed to load the head block")
+	}
+	first, last := uint64(0), head.NumberU64()
+	if len(ctx.Args()) == 2 {
+		var ferr, lerr error
+		first, ferr = strconv.ParseUint(ctx.Args().Get(0), 10, 64)
+		last, lerr = strconv.ParseUint(ctx.Args().Get(1), 10, 64)
+		if ferr != nil || lerr != nil || first > last {
+			utils.Fatalf("Invalid block range: %s - %s", ctx.Args().Get(0), ctx.Args().Get(1))
+		}
+	}
+	var (
+		root    common.Hash
+		statedb = state.NewDatabase(db)
+	)
+	if ctx.IsSet(verifyCommandRootFlag.Name) {
+		blob, err := parseHexArg(ctx.String(verifyCommandRootFlag.Name))
+		if err != nil || len(blob) != common.HashLength {
+			utils.Fatalf("Invalid state root: %s", ctx.String(verifyCommandRootFlag.Name))
+		}
+		root = common.BytesToHash(blob)
+		if _, err := state.New(root, statedb); err != nil {
+			utils.Fatalf("State missing: %v", err)
+		}
+	} else {
+		// Pruning nodes lose the recent states held in memory on an unclean
+		// shutdown, so walk back to the newest state actually persisted
+		block := head
+		for block != nil {
+			if _, err := state.New(block.Root(), statedb); err == nil {
+				break
+			}
+			block = core.GetBlock(db, block.ParentHash(), block.NumberU64()-1)
+		}
+		if block == nil {
+			utils.Fatalf("No state found in the database")
+		}
+		if block != head {
+			log.Warn("Head state missing, verifying the newest persisted one", "head", head.NumberU64(), "number", block.NumberU64(), "hash", block.Hash())
+		}
+		root = block.Root()
+	}
+	workers := ctx.Int(workersFlag.Name)
+
+	start := time.Now()
+	log.Info("Verifying state", "root", root, "workers", workers)
+	if _, err := state.VerifyState(db, root, workers); err != nil {
+		utils.Fatalf("State corrupted: %v", err)
+	}
+	log.Info("Verifying chain", "first", first, "last", last, "workers", workers)
+	if err := core.VerifyChain(db, first, last, workers); err != nil {
+		utils.Fatalf("Chain corrupted: %v", err)
+	}
+	fmt.Printf("Verification done in %v, no corruption found.\n", time.Since(start))
+	return nil
+}
+
+func replayChain(ctx *cli.Context) error {
+	db := openChainDB(ctx)
+	defer db.Close()
+
+	genesis := core.GetCanonicalHash(db, 0)
+	config, err := core.GetChainConfig(db, genesis)
+	if err != nil {
+		utils.Fatalf("Failed to load the chain config: %v", err)
+	}
+	// Replaying doesn't verify the seals, the engine only applies the rewards
+	engine := utils.MakeEngine(ctx, config, db)
+	from, to := ctx.Uint64(replayCommandFromFlag.Name), ctx.Uint64(replayCommandToFlag.Name)
+	if to == 0 {
+		to = core.GetBlockNumber(db, core.GetHeadBlockHash(db))
+	}
+	report, err := core.ReplayChain(db, config, engine, from, to, ctx.Int(workersFlag.Name))
+	if err != nil {
+		utils.Fatalf("Replay failed: %v", err)
+	}
+	out := os.Stdout
+	if path := ctx.String(replayCommandReportFlag.Name); path != "" {
+		if out, err = os.Create(path); err != nil {
+			utils.Fatalf("Failed to create report file: %v", err)
+		}
+		defer out.Close()
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		utils.Fatalf("Failed to write report: %v", err)
+	}
+	log.Info("Replay done", "blocks", report.Replayed, "unverified", report.Unverified, "divergences", len(report.Divergences))
+	return nil
+}
+
 // hashish returns true for strings that look like hashes.
 func hashish(x string) bool {
 	_, err := strconv.Atoi(x)
@@ -0,0 +1,355 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/cmd/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/olekukonko/tablewriter"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var (
+	dbFlags = []cli.Flag{
+		utils.DataDirFlag,
+		utils.AncientFlag,
+		utils.CacheFlag,
+		utils.LightModeFlag,
+	}
+	dbDryRunFlag = cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "Only measure the compression, leaving the database unmodified",
+	}
+	dbDecompressFlag = cli.BoolFlag{
+		Name:  "decompress",
+		Usage: "Store the compressed entries plain again",
+	}
+	dbCommand = cli.Command{
+		Name:      "db",
+		Usage:     "Low level database operations",
+		ArgsUsage: "",
+		Category:  "DATABASE COMMANDS",
+		Description: `
+The db command family operates directly on the chain database of a stopped node,
+allowing to inspect its content and to fix individual entries by hand.`,
+		Subcommands: []cli.Command{
+			{
+				Name:      "inspect",
+				Usage:     "Inspect the storage size for each type of data in the database",
+				ArgsUsage: " ",
+				Action:    utils.MigrateFlags(inspectDB),
+				Flags:     dbFlags,
+				Description: `
+Iterates over the entire database and reports the number of entries and the
+storage size of each category of the stored data.`,
+			},
+			{
+				Name:      "stats",
+				Usage:     "Print the internal statistics of the database engine",
+				ArgsUsage: " ",
+				Action:    utils.MigrateFlags(dbStats),
+				Flags:     dbFlags,
+			},
+			{
+				Name:      "get",
+				Usage:     "Show the value of a database key",
+				ArgsUsage: "<hex-key>",
+				Action:    utils.MigrateFlags(dbGet),
+				Flags:     dbFlags,
+			},
+			{
+				Name:      "put",
+				Usage:     "Set the value of a database key (WARNING: may corrupt your database)",
+				ArgsUsage: "<hex-key> <hex-value>",
+				Action:    utils.MigrateFlags(dbPut),
+				Flags:     dbFlags,
+			},
+			{
+				Name:      "delete",
+				Usage:     "Delete a database key (WARNING: may corrupt your database)",
+				ArgsUsage: "<hex-key>",
+				Action:    utils.MigrateFlags(dbDelete),
+				Flags:     dbFlags,
+			},
+			{
+				Name:      "compact",
+				Usage:     "Compact the database, or a range of its keys",
+				ArgsUsage: "[<hex-start> [<hex-limit>]]",
+				Action:    utils.MigrateFlags(dbCompact),
+				Flags:     dbFlags,
+				Description: `
+Flattens the storage of the keys in the range [start, limit), discarding deleted
+and overwritten data. Omitting the limit or both keys compacts the remainder of
+the database or all of it. This may take a long time on large databases.`,
+			},
+			{
+				Name:      "compress",
+				Usage:     "Migrate the block bodies and trie nodes to the compressed storage format",
+				ArgsUsage: " ",
+				Action:    utils.MigrateFlags(dbCompress),
+				Flags: []cli.Flag{
+					utils.DataDirFlag,
+					utils.AncientFlag,
+					utils.CacheFlag,
+					utils.LightModeFlag,
+					dbDryRunFlag,
+					dbDecompressFlag,
+				},
+				Description: `
+Rewrites the block bodies and the hash keyed entries (trie nodes, contract codes,
+transactions) of the database run-length compressed, or plain again with the
+--decompress flag, and reports the space saved and the compression throughput.
+With --dry-run the database is only measured. Run the node with --dbcompress to
+keep storing new entries compressed, and compact the database afterwards to
+reclaim the space.`,
+			},
+			{
+				Name:      "dump-head",
+				Usage:     "Show the head markers of the chain",
+				ArgsUsage: " ",
+				Action:    utils.MigrateFlags(dbDumpHead),
+				Flags:     dbFlags,
+			},
+		},
+	}
+)
+
+// openChainDB opens the chain database of the node configured by the command
+// line flags.
+func openChainDB(ctx *cli.Context) ethdb.Database {
+	stack, _ := makeConfigNode(ctx)
+	return utils.MakeChainDatabase(ctx, stack)
+}
+
+// parseHexArg decodes a hex command line argument, with or without 0x prefix.
+func parseHexArg(arg string) ([]byte, error) {
+	if strings.HasPrefix(arg, "0x") || strings.HasPrefix(arg, "0X") {
+		arg = arg[2:]
+	}
+	data, err := hex.DecodeString(arg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex argument %q: %v", arg, err)
+	}
+	return data, nil
+}
+
+func inspectDB(ctx *cli.Context) error {
+	db := openChainDB(ctx)
+	defer db.Close()
+
+	start := time.Now()
+	stats := core.InspectDatabase(db)
+
+	var (
+		table = tablewriter.NewWriter(os.Stdout)
+		count uint64
+		size  common.StorageSize
+	)
+	table.SetHeader([]string{"Category", "Items", "Size"})
+	for _, stat := range stats {
+		table.Append([]string{stat.Category, fmt.Sprintf("%d", stat.Count), stat.Size.String()})
+		count, size = count+stat.Count, size+stat.Size
+	}
+	if reader, ok := db.(ethdb.AncientReader); ok {
+		if frozen, err := reader.Ancients(); err == nil {
+			table.Append([]string{"Ancient blocks", fmt.Sprintf("%d", frozen), "-"})
+		}
+	}
+	table.Append([]string{"Total", fmt.Sprintf("%d", count), size.String()})
+	table.Render()
+
+	log.Info("Database inspection completed", "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
+func dbStats(ctx *cli.Context) error {
+	db := openChainDB(ctx)
+	defer db.Close()
+
+	for _, property := range []string{"leveldb.stats", "leveldb.sstables", "leveldb.cachedblock", "leveldb.openedtables", "leveldb.alivesnaps", "leveldb.aliveiters"} {
+		stat, err := db.Stat(property)
+		if err != nil {
+			utils.Fatalf("Failed to retrieve database property %s: %v", property, err)
+		}
+		fmt.Printf("%s:\n%s\n\n", property, strings.TrimRight(stat, "\n"))
+	}
+	return nil
+}
+
+func dbGet(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		utils.Fatalf("This command requires a single key argument.")
+	}
+	key, err := parseHexArg(ctx.Args().First())
+	if err != nil {
+		utils.Fatalf("%v", err)
+	}
+	db := openChainDB(ctx)
+	defer db.Close()
+
+	value, err := db.Get(key)
+	if err != nil {
+		utils.Fatalf("Failed to retrieve key %x: %v", key, err)
+	}
+	fmt.Printf("key %#x: %#x\n", key, value)
+	return nil
+}
+
+func dbPut(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		utils.Fatalf("This command requires a key and a value argument.")
+	}
+	key, err := parseHexArg(ctx.Args().Get(0))
+	if err != nil {
+		utils.Fatalf("%v", err)
+	}
+	value, err := parseHexArg(ctx.Args().Get(1))
+	if err != nil {
+		utils.Fatalf("%v", err)
+	}
+	db := openChainDB(ctx)
+	defer db.Close()
+
+	if old, err := db.Get(key); err == nil {
+		fmt.Printf("Previous value: %#x\n", old)
+	}
+	if err := db.Put(key, value); err != nil {
+		utils.Fatalf("Failed to write key %x: %v", key, err)
+	}
+	return nil
+}
+
+func dbDelete(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		utils.Fatalf("This command requires a single key argument.")
+	}
+	key, err := parseHexArg(ctx.Args().First())
+	if err != nil {
+		utils.Fatalf("%v", err)
+	}
+	db := openChainDB(ctx)
+	defer db.Close()
+
+	if old, err := db.Get(key); err == nil {
+		fmt.Printf("Previous value: %#x\n", old)
+	}
+	if err := db.Delete(key); err != nil {
+		utils.Fatalf("Failed to delete key %x: %v", key, err)
+	}
+	return nil
+}
+
+func dbCompact(ctx *cli.Context) error {
+	if len(ctx.Args()) > 2 {
+		utils.Fatalf("This command accepts at most a start and a limit key.")
+	}
+	var start, limit []byte
+	if len(ctx.Args()) > 0 {
+		var err error
+		if start, err = parseHexArg(ctx.Args().Get(0)); err != nil {
+			utils.Fatalf("%v", err)
+		}
+		if len(ctx.Args()) > 1 {
+			if limit, err = parseHexArg(ctx.Args().Get(1)); err != nil {
+				utils.Fatalf("%v", err)
+			}
+		}
+	}
+	db := openChainDB(ctx)
+	defer db.Close()
+
+	log.Info("Compacting database", "start", fmt.Sprintf("%#x", start), "limit", fmt.Sprintf("%#x", limit))
+	begin := time.Now()
+	if err := db.Compact(start, limit); err != nil {
+		utils.Fatalf("Compaction failed: %v", err)
+	}
+	log.Info("Database compaction finished", "elapsed", common.PrettyDuration(time.Since(begin)))
+	return nil
+}
+
+func dbCompress(ctx *cli.Context) error {
+	db := openChainDB(ctx)
+	defer db.Close()
+
+	stats, err := core.MigrateDatabaseCompression(db, !ctx.Bool(dbDecompressFlag.Name), ctx.Bool(dbDryRunFlag.Name))
+	if err != nil {
+		utils.Fatalf("Compression migration failed: %v", err)
+	}
+	var (
+		table = tablewriter.NewWriter(os.Stdout)
+		ratio = func(a, b common.StorageSize) string {
+			if b == 0 {
+				return "-"
+			}
+			return fmt.Sprintf("%.2f%%", 100*float64(a)/float64(b))
+		}
+		throughput = func(size common.StorageSize, elapsed time.Duration) string {
+			if elapsed == 0 {
+				return "-"
+			}
+			return fmt.Sprintf("%.2f MB/s", float64(size)/elapsed.Seconds()/1024/1024)
+		}
+	)
+	table.SetHeader([]string{"Measure", "Value"})
+	table.Append([]string{"Entries", fmt.Sprintf("%d", stats.Entries)})
+	table.Append([]string{"Entries migrated", fmt.Sprintf("%d", stats.Migrated)})
+	table.Append([]string{"Plain size", stats.Size.String()})
+	table.Append([]string{"Compressed size", fmt.Sprintf("%v (%s)", stats.Compressed, ratio(stats.Compressed, stats.Size))})
+	table.Append([]string{"Space saved by compression", fmt.Sprintf("%v (%s)", stats.Size-stats.Compressed, ratio(stats.Size-stats.Compressed, stats.Size))})
+	table.Append([]string{"Stored size before", stats.Before.String()})
+	table.Append([]string{"Stored size after", stats.After.String()})
+	table.Append([]string{"Compression throughput", throughput(stats.Size, stats.Encoding)})
+	table.Append([]string{"Decompression throughput", throughput(stats.Size, stats.Decoding)})
+	table.Render()
+	return nil
+}
+
+func dbDumpHead(ctx *cli.Context) error {
+	db := openChainDB(ctx)
+	defer db.Close()
+
+	for _, head := range []struct {
+		name string
+		hash common.Hash
+	}{
+		{"Head header", core.GetHeadHeaderHash(db)},
+		{"Head block", core.GetHeadBlockHash(db)},
+		{"Head fast block", core.GetHeadFastBlockHash(db)},
+	} {
+		if head.hash == (common.Hash{}) {
+			fmt.Printf("%-20s not set\n", head.name+":")
+			continue
+		}
+		fmt.Printf("%-20s #%d [%x]\n", head.name+":", core.GetBlockNumber(db, head.hash), head.hash)
+	}
+	if tail := core.GetTxIndexTail(db); tail != nil {
+		fmt.Printf("%-20s #%d\n", "Tx index tail:", *tail)
+	} else {
+		fmt.Printf("%-20s not set\n", "Tx index tail:")
+	}
+	fmt.Printf("%-20s %d\n", "Chain version:", core.GetBlockChainVersion(db))
+	return nil
+}
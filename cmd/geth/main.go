@@ -58,6 +58,9 @@ var (
 		utils.BootnodesV4Flag,
 		utils.BootnodesV5Flag,
 		utils.DataDirFlag,
+		utils.AncientFlag,
+		utils.FreezerFlag,
+		utils.FreezerThresholdFlag,
 		utils.KeyStoreDirFlag,
 		utils.NoUSBFlag,
 		utils.EthashCacheDirFlag,
@@ -77,11 +80,18 @@ var (
 		utils.FastSyncFlag,
 		utils.LightModeFlag,
 		utils.SyncModeFlag,
+		utils.GCModeFlag,
+		utils.SnapshotFlag,
+		utils.DatabaseCompressFlag,
+		utils.StateDiffsFlag,
+		utils.TxLookupLimitFlag,
+		utils.StateReexecFlag,
 		utils.LightServFlag,
 		utils.LightPeersFlag,
 		utils.LightKDFFlag,
 		utils.CacheFlag,
 		utils.TrieCacheGenFlag,
+		utils.TrieFlushIntervalFlag,
 		utils.ListenPortFlag,
 		utils.MaxPeersFlag,
 		utils.MaxPendingPeersFlag,
@@ -143,8 +153,14 @@ func init() {
 		initCommand,
 		importCommand,
 		exportCommand,
+		exportArchiveCommand,
+		importArchiveCommand,
 		removedbCommand,
 		dumpCommand,
+		verifyCommand,
+		replayCommand,
+		// See dbcmd.go:
+		dbCommand,
 		// See monitorcmd.go:
 		monitorCommand,
 		// See accountcmd.go:
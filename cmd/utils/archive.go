@@ -0,0 +1,456 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package utils
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+const (
+	// archiveVersion is the version of the chain archive format.
+	archiveVersion = 1
+
+	// archiveManifestFile is the name of the manifest file in an archive directory.
+	archiveManifestFile = "manifest.json"
+
+	// DefaultArchiveSegmentSize is the default number of blocks per archive segment.
+	DefaultArchiveSegmentSize = 10000
+)
+
+// archiveManifest describes the content of a chain archive. It is written after
+// all the segments, so an archive without a manifest is an incomplete export.
+type archiveManifest struct {
+	Version   uint64           `json:"version"`
+	ChainID   *big.Int         `json:"chainId"`             // Chain ID of the exported chain (nil if not EIP155)
+	Genesis   common.Hash      `json:"genesis"`             // Genesis hash of the exported chain
+	First     uint64           `json:"first"`               // Number of the first block in the archive
+	Last      uint64           `json:"last"`                // Number of the last block in the archive
+	Receipts  bool             `json:"receipts"`            // Whether the blocks are accompanied by their receipts
+	Td        bool             `json:"td"`                  // Whether the blocks are accompanied by their total difficulty
+	GenesisTd *big.Int         `json:"genesisTd,omitempty"` // Total difficulty of the genesis block, if Td is set
+	Segments  []archiveSegment `json:"segments"`
+}
+
+// archiveSegment describes a segment file of a chain archive. The file holds the
+// gzip compressed RLP stream of the archive entries of a contiguous block range.
+type archiveSegment struct {
+	File     string      `json:"file"`
+	First    uint64      `json:"first"`    // Number of the first block in the segment
+	Last     uint64      `json:"last"`     // Number of the last block in the segment
+	LastHash common.Hash `json:"lastHash"` // Hash of the last block, to skip imported segments
+	Checksum string      `json:"sha256"`   // Checksum of the segment file
+}
+
+// archiveEntry is a block stored in a chain archive, along with its receipts and
+// total difficulty if the archive was exported with them.
+type archiveEntry struct {
+	Block    *types.Block
+	Receipts []*types.ReceiptForStorage
+	Td       *big.Int
+}
+
+// ArchiveExportConfig are the options of a chain archive export.
+type ArchiveExportConfig struct {
+	First, Last uint64 // Range of blocks to export
+	SegmentSize uint64 // Number of blocks per segment file
+	Receipts    bool   // Whether to include the receipts of the blocks
+	Td          bool   // Whether to include the total difficulty of the blocks
+	Workers     int    // Number of segments to export concurrently
+}
+
+// ExportArchive writes a range of the canonical chain into a new archive in the
+// given directory. The range is split into segment files of fixed size, which
+// are exported concurrently and listed in a manifest along with their checksums.
+func ExportArchive(chain *core.BlockChain, dir string, config ArchiveExportConfig) error {
+	if config.First > config.Last {
+		return fmt.Errorf("export failed: first (%d) is greater than last (%d)", config.First, config.Last)
+	}
+	if head := chain.CurrentBlock().NumberU64(); config.Last > head {
+		return fmt.Errorf("export failed: last (%d) is above the head block (%d)", config.Last, head)
+	}
+	if config.SegmentSize == 0 {
+		config.SegmentSize = DefaultArchiveSegmentSize
+	}
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+	if _, err := os.Stat(filepath.Join(dir, archiveManifestFile)); err == nil {
+		return fmt.Errorf("export failed: archive already exists in %s", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	manifest := &archiveManifest{
+		Version:  archiveVersion,
+		ChainID:  chain.Config().ChainId,
+		Genesis:  chain.Genesis().Hash(),
+		First:    config.First,
+		Last:     config.Last,
+		Receipts: config.Receipts,
+		Td:       config.Td,
+	}
+	if config.Td {
+		// The total difficulties are only comparable relative to the genesis
+		genesis := chain.Genesis()
+		if manifest.GenesisTd = chain.GetTd(genesis.Hash(), 0); manifest.GenesisTd == nil {
+			return fmt.Errorf("export failed: genesis total difficulty not found")
+		}
+	}
+	for first := config.First; first <= config.Last; first += config.SegmentSize {
+		last := first + config.SegmentSize - 1
+		if last > config.Last || last < first {
+			last = config.Last
+		}
+		manifest.Segments = append(manifest.Segments, archiveSegment{
+			File:  fmt.Sprintf("blocks-%012d-%012d.rlp.gz", first, last),
+			First: first,
+			Last:  last,
+		})
+		if last == config.Last {
+			break
+		}
+	}
+	log.Info("Exporting chain archive", "dir", dir, "first", config.First, "last", config.Last, "segments", len(manifest.Segments))
+
+	// Export the segments concurrently, filling in their checksums
+	var (
+		tasks   = make(chan int, len(manifest.Segments))
+		failure error
+		lock    sync.Mutex
+		wg      sync.WaitGroup
+		start   = time.Now()
+	)
+	for i := range manifest.Segments {
+		tasks <- i
+	}
+	close(tasks)
+
+	for i := 0; i < config.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range tasks {
+				segment := &manifest.Segments[task]
+				if err := exportArchiveSegment(chain, filepath.Join(dir, segment.File), segment, config); err != nil {
+					lock.Lock()
+					if failure == nil {
+						failure = err
+					}
+					lock.Unlock()
+					return
+				}
+				log.Info("Exported archive segment", "file", segment.File, "elapsed", common.PrettyDuration(time.Since(start)))
+			}
+		}()
+	}
+	wg.Wait()
+	if failure != nil {
+		return failure
+	}
+	// Write the manifest last, marking the archive complete
+	blob, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, archiveManifestFile), blob); err != nil {
+		return err
+	}
+	log.Info("Exported chain archive", "dir", dir, "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
+// exportArchiveSegment writes the blocks of a segment into its file, recording
+// the checksum and the hash of the last block in the segment descriptor.
+func exportArchiveSegment(chain *core.BlockChain, path string, segment *archiveSegment, config ArchiveExportConfig) error {
+	// Write into a temporary file, only moved in place once complete
+	fh, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path + ".tmp")
+	defer fh.Close()
+
+	hasher := sha256.New()
+	writer := gzip.NewWriter(io.MultiWriter(fh, hasher))
+
+	for number := segment.First; number <= segment.Last; number++ {
+		block := chain.GetBlockByNumber(number)
+		if block == nil {
+			return fmt.Errorf("export failed on #%d: not found", number)
+		}
+		entry := &archiveEntry{Block: block, Td: new(big.Int)}
+		if config.Receipts {
+			receipts := chain.GetReceiptsByHash(block.Hash())
+			if receipts == nil && len(block.Transactions()) > 0 {
+				return fmt.Errorf("export failed on #%d: receipts not found", number)
+			}
+			for _, receipt := range receipts {
+				entry.Receipts = append(entry.Receipts, (*types.ReceiptForStorage)(receipt))
+			}
+		}
+		if config.Td {
+			if entry.Td = chain.GetTd(block.Hash(), number); entry.Td == nil {
+				return fmt.Errorf("export failed on #%d: total difficulty not found", number)
+			}
+		}
+		if err := rlp.Encode(writer, entry); err != nil {
+			return err
+		}
+		segment.LastHash = block.Hash()
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := fh.Sync(); err != nil {
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	segment.Checksum = hex.EncodeToString(hasher.Sum(nil))
+	return os.Rename(path+".tmp", path)
+}
+
+// ImportArchive imports the blocks of a chain archive, checking that it belongs
+// to the same chain. Segments already imported are skipped without reading them,
+// so an interrupted import can be resumed by running it again. The checksum of
+// every segment read is verified, as well as the hash chain and the bodies of its
+// blocks, and their receipts and total difficulty if the archive contains them.
+func ImportArchive(chain *core.BlockChain, dir string) error {
+	checkInterrupt, release := watchImportInterrupt()
+	defer release()
+
+	blob, err := ioutil.ReadFile(filepath.Join(dir, archiveManifestFile))
+	if err != nil {
+		return fmt.Errorf("failed to read archive manifest: %v", err)
+	}
+	manifest := new(archiveManifest)
+	if err := json.Unmarshal(blob, manifest); err != nil {
+		return fmt.Errorf("invalid archive manifest: %v", err)
+	}
+	if manifest.Version != archiveVersion {
+		return fmt.Errorf("unsupported archive version %d", manifest.Version)
+	}
+	if genesis := chain.Genesis().Hash(); manifest.Genesis != genesis {
+		return fmt.Errorf("archive genesis mismatch: have %x, want %x", manifest.Genesis, genesis)
+	}
+	if id := chain.Config().ChainId; (id == nil) != (manifest.ChainID == nil) || (id != nil && id.Cmp(manifest.ChainID) != 0) {
+		return fmt.Errorf("archive chain ID mismatch: have %v, want %v", manifest.ChainID, id)
+	}
+	if manifest.Td && manifest.GenesisTd == nil {
+		return fmt.Errorf("invalid archive manifest: missing genesis total difficulty")
+	}
+	log.Info("Importing chain archive", "dir", dir, "first", manifest.First, "last", manifest.Last, "segments", len(manifest.Segments))
+
+	// The parent of the first archived block is unknown unless it's the genesis,
+	// leaving its linkage to the chain to the block import
+	var parent common.Hash
+	for _, segment := range manifest.Segments {
+		if checkInterrupt() {
+			return fmt.Errorf("interrupted")
+		}
+		if chain.HasBlock(segment.LastHash) {
+			log.Info("Skipping imported archive segment", "file", segment.File)
+			parent = segment.LastHash
+			continue
+		}
+		if err := importArchiveSegment(chain, filepath.Join(dir, segment.File), segment, parent, manifest, checkInterrupt); err != nil {
+			return fmt.Errorf("segment %s: %v", segment.File, err)
+		}
+		parent = segment.LastHash
+	}
+	return nil
+}
+
+// importArchiveSegment verifies the checksum of a segment file and imports its
+// blocks, skipping the batches already present in the chain. The blocks must link
+// up to the given parent hash, unless it's empty.
+func importArchiveSegment(chain *core.BlockChain, path string, segment archiveSegment, parent common.Hash, manifest *archiveManifest, checkInterrupt func() bool) error {
+	log.Info("Importing archive segment", "file", segment.File)
+	if err := verifyArchiveChecksum(path, segment.Checksum); err != nil {
+		return err
+	}
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	reader, err := gzip.NewReader(fh)
+	if err != nil {
+		return err
+	}
+	var (
+		stream  = rlp.NewStream(reader, 0)
+		next    = segment.First
+		entries []*archiveEntry
+	)
+	for {
+		entry := new(archiveEntry)
+		err := stream.Decode(entry)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("at block #%d: %v", next, err)
+		}
+		if err == nil {
+			if number := entry.Block.NumberU64(); number != next {
+				return fmt.Errorf("non contiguous block #%d, expected #%d", number, next)
+			}
+			if err := verifyArchiveEntry(entry, parent, manifest); err != nil {
+				return err
+			}
+			parent = entry.Block.Hash()
+			next++
+			entries = append(entries, entry)
+		}
+		// Import the full batches and the remainder at the end of the segment
+		if len(entries) == importBatchSize || (err == io.EOF && len(entries) > 0) {
+			if checkInterrupt() {
+				return fmt.Errorf("interrupted")
+			}
+			if err := importArchiveBatch(chain, entries, manifest); err != nil {
+				return err
+			}
+			entries = entries[:0]
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if next != segment.Last+1 {
+		return fmt.Errorf("truncated segment: last block #%d, expected #%d", next-1, segment.Last)
+	}
+	if parent != segment.LastHash {
+		return fmt.Errorf("last block hash mismatch: have %x, want %x", parent, segment.LastHash)
+	}
+	return nil
+}
+
+// importArchiveBatch inserts a batch of archived blocks into the chain unless all
+// are present already, and checks their total difficulty if archived.
+func importArchiveBatch(chain *core.BlockChain, entries []*archiveEntry, manifest *archiveManifest) error {
+	blocks := make(types.Blocks, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Block.NumberU64() > 0 { // The genesis block is never imported
+			blocks = append(blocks, entry.Block)
+		}
+	}
+	if hasAllBlocks(chain, blocks) {
+		if len(blocks) > 0 {
+			log.Info("Skipping batch as all blocks present", "first", blocks[0].Number(), "last", blocks[len(blocks)-1].Number())
+		}
+	} else if n, err := chain.InsertChain(blocks); err != nil {
+		return fmt.Errorf("invalid block #%d: %v", blocks[n].NumberU64(), err)
+	}
+	// The genesis total difficulty of the chains may differ, so only compare the
+	// difficulty accumulated on top of it
+	if manifest.Td {
+		genesis := chain.Genesis()
+		gtd := chain.GetTd(genesis.Hash(), 0)
+		if gtd == nil {
+			return fmt.Errorf("genesis total difficulty not found")
+		}
+		for _, entry := range entries {
+			number, hash := entry.Block.NumberU64(), entry.Block.Hash()
+			td := chain.GetTd(hash, number)
+			if td == nil {
+				return fmt.Errorf("block #%d total difficulty not found", number)
+			}
+			have, want := new(big.Int).Sub(td, gtd), new(big.Int).Sub(entry.Td, manifest.GenesisTd)
+			if have.Cmp(want) != 0 {
+				return fmt.Errorf("block #%d total difficulty mismatch: have %v, archived %v (relative to genesis)", number, have, want)
+			}
+		}
+	}
+	return nil
+}
+
+// verifyArchiveEntry checks the linkage of an archived block to its parent, or
+// to the genesis, and its body and archived receipts against its header.
+func verifyArchiveEntry(entry *archiveEntry, parent common.Hash, manifest *archiveManifest) error {
+	block := entry.Block
+	if block.NumberU64() == 0 {
+		if hash := block.Hash(); hash != manifest.Genesis {
+			return fmt.Errorf("genesis hash mismatch: have %x, want %x", hash, manifest.Genesis)
+		}
+	} else if parent != (common.Hash{}) && block.ParentHash() != parent {
+		return fmt.Errorf("block #%d parent hash mismatch: have %x, want %x", block.NumberU64(), block.ParentHash(), parent)
+	}
+	if hash := types.DeriveSha(block.Transactions()); hash != block.TxHash() {
+		return fmt.Errorf("block #%d transaction root mismatch: have %x, want %x", block.NumberU64(), hash, block.TxHash())
+	}
+	if hash := types.CalcUncleHash(block.Uncles()); hash != block.UncleHash() {
+		return fmt.Errorf("block #%d uncle root mismatch: have %x, want %x", block.NumberU64(), hash, block.UncleHash())
+	}
+	if !manifest.Receipts {
+		return nil
+	}
+	receipts := make(types.Receipts, len(entry.Receipts))
+	for i, receipt := range entry.Receipts {
+		receipts[i] = (*types.Receipt)(receipt)
+	}
+	if err := core.DeriveReceiptsData(block.Hash(), block.NumberU64(), block.Transactions(), receipts); err != nil {
+		return fmt.Errorf("block #%d: %v", block.NumberU64(), err)
+	}
+	if root := types.DeriveSha(receipts); root != block.ReceiptHash() {
+		return fmt.Errorf("block #%d receipt root mismatch: have %x, want %x", block.NumberU64(), root, block.ReceiptHash())
+	}
+	return nil
+}
+
+// verifyArchiveChecksum checks the SHA256 checksum of an archive segment file.
+func verifyArchiveChecksum(path string, checksum string) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, fh); err != nil {
+		return err
+	}
+	if have := hex.EncodeToString(hasher.Sum(nil)); have != checksum {
+		return fmt.Errorf("checksum mismatch: have %s, want %s", have, checksum)
+	}
+	return nil
+}
+
+// writeFileAtomic writes a file through a temporary one renamed in place, so the
+// file is either complete or missing.
+func writeFileAtomic(path string, data []byte) error {
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
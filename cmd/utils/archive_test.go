@@ -0,0 +1,285 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package utils
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+var (
+	archiveTestKey, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	archiveTestAddress = crypto.PubkeyToAddress(archiveTestKey.PublicKey)
+	archiveTestGenesis = &core.Genesis{
+		Config: params.TestChainConfig,
+		Alloc:  core.GenesisAlloc{archiveTestAddress: {Balance: big.NewInt(1000000000)}},
+	}
+)
+
+// newArchiveTestChain creates a blockchain on the test genesis, with the given
+// blocks imported.
+func newArchiveTestChain(t *testing.T, blocks types.Blocks) *core.BlockChain {
+	db, _ := ethdb.NewMemDatabase()
+	archiveTestGenesis.MustCommit(db)
+
+	chain, err := core.NewBlockChain(db, nil, archiveTestGenesis.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	return chain
+}
+
+// newArchiveTestBlocks generates a chain of blocks on the test genesis, each with
+// a transfer transaction.
+func newArchiveTestBlocks(t *testing.T, n int) types.Blocks {
+	gendb, _ := ethdb.NewMemDatabase()
+	blocks, _ := core.GenerateChain(archiveTestGenesis.Config, archiveTestGenesis.MustCommit(gendb), gendb, n, func(i int, block *core.BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(archiveTestAddress), common.Address{1}, big.NewInt(1000), big.NewInt(21000), new(big.Int), nil), types.HomesteadSigner{}, archiveTestKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.AddTx(tx)
+	})
+	return blocks
+}
+
+// readArchiveManifest reads and decodes the manifest of an archive.
+func readArchiveManifest(t *testing.T, dir string) *archiveManifest {
+	blob, err := ioutil.ReadFile(filepath.Join(dir, archiveManifestFile))
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	manifest := new(archiveManifest)
+	if err := json.Unmarshal(blob, manifest); err != nil {
+		t.Fatalf("failed to decode manifest: %v", err)
+	}
+	return manifest
+}
+
+// writeArchiveManifest encodes and writes the manifest of an archive.
+func writeArchiveManifest(t *testing.T, dir string, manifest *archiveManifest) {
+	blob, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("failed to encode manifest: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, archiveManifestFile), blob, 0644); err != nil {
+		t.Fatalf("failed to write manifest: %v", err)
+	}
+}
+
+// rewriteArchiveSegment modifies the entries of an archive segment, updating its
+// checksum in the manifest so that only the entry verification can catch it.
+func rewriteArchiveSegment(t *testing.T, dir string, index int, modify func(entries []*archiveEntry)) {
+	manifest := readArchiveManifest(t, dir)
+	segment := &manifest.Segments[index]
+
+	path := filepath.Join(dir, segment.File)
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open segment: %v", err)
+	}
+	reader, err := gzip.NewReader(fh)
+	if err != nil {
+		t.Fatalf("failed to decompress segment: %v", err)
+	}
+	var (
+		stream  = rlp.NewStream(reader, 0)
+		entries []*archiveEntry
+	)
+	for {
+		entry := new(archiveEntry)
+		if err := stream.Decode(entry); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("failed to decode segment: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	fh.Close()
+	modify(entries)
+
+	fh, err = os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create segment: %v", err)
+	}
+	hasher := sha256.New()
+	writer := gzip.NewWriter(io.MultiWriter(fh, hasher))
+	for _, entry := range entries {
+		if err := rlp.Encode(writer, entry); err != nil {
+			t.Fatalf("failed to encode segment: %v", err)
+		}
+	}
+	writer.Close()
+	fh.Close()
+
+	segment.Checksum = hex.EncodeToString(hasher.Sum(nil))
+	writeArchiveManifest(t, dir, manifest)
+}
+
+// Tests that a chain archive is exported into checksummed segments, imported into
+// an empty chain, and that corruptions and interrupted imports are handled.
+func TestChainArchive(t *testing.T) {
+	blocks := newArchiveTestBlocks(t, 32)
+	source := newArchiveTestChain(t, blocks)
+	defer source.Stop()
+
+	dir, err := ioutil.TempDir("", "chain-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := ArchiveExportConfig{Last: 32, SegmentSize: 5, Receipts: true, Td: true, Workers: 3}
+	if err := ExportArchive(source, dir, config); err != nil {
+		t.Fatalf("failed to export archive: %v", err)
+	}
+	if err := ExportArchive(source, dir, config); err == nil {
+		t.Fatalf("existing archive overwritten")
+	}
+	manifest := readArchiveManifest(t, dir)
+	if len(manifest.Segments) != 7 || manifest.Segments[6].First != 30 || manifest.Segments[6].Last != 32 {
+		t.Fatalf("segment layout mismatch: %+v", manifest.Segments)
+	}
+	if manifest.Genesis != source.Genesis().Hash() || manifest.ChainID.Cmp(params.TestChainConfig.ChainId) != 0 {
+		t.Fatalf("chain identity mismatch: genesis %x, chain ID %v", manifest.Genesis, manifest.ChainID)
+	}
+	// Corrupt a segment, the import must stop right before it
+	path := filepath.Join(dir, manifest.Segments[3].File)
+	segment, _ := ioutil.ReadFile(path)
+	corrupt := common.CopyBytes(segment)
+	corrupt[len(corrupt)/2] ^= 0xff
+	ioutil.WriteFile(path, corrupt, 0644)
+
+	target := newArchiveTestChain(t, nil)
+	defer target.Stop()
+
+	if err := ImportArchive(target, dir); err == nil {
+		t.Fatalf("corrupted segment imported")
+	}
+	if head := target.CurrentBlock().NumberU64(); head != manifest.Segments[2].Last {
+		t.Fatalf("head mismatch after failed import: have #%d, want #%d", head, manifest.Segments[2].Last)
+	}
+	// Repair the segment and resume the import
+	ioutil.WriteFile(path, segment, 0644)
+	os.Remove(filepath.Join(dir, manifest.Segments[0].File)) // Imported, must not be read
+
+	if err := ImportArchive(target, dir); err != nil {
+		t.Fatalf("failed to resume import: %v", err)
+	}
+	if head := target.CurrentBlock(); head.Hash() != blocks[31].Hash() {
+		t.Fatalf("head mismatch: have #%d [%x], want #%d [%x]", head.NumberU64(), head.Hash(), blocks[31].NumberU64(), blocks[31].Hash())
+	}
+	// An archive of another chain must be rejected
+	other := *archiveTestGenesis
+	other.ExtraData = []byte("other")
+	db, _ := ethdb.NewMemDatabase()
+	other.MustCommit(db)
+	foreign, _ := core.NewBlockChain(db, nil, other.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
+	defer foreign.Stop()
+
+	if err := ImportArchive(foreign, dir); err == nil {
+		t.Fatalf("archive of another chain imported")
+	}
+}
+
+// Tests that archived blocks not matching their headers, not linking up, or with
+// a total difficulty accumulated differently are rejected before being imported.
+func TestChainArchiveVerification(t *testing.T) {
+	blocks := newArchiveTestBlocks(t, 16)
+	source := newArchiveTestChain(t, blocks)
+	defer source.Stop()
+
+	tests := []struct {
+		name   string
+		modify func(dir string)
+	}{
+		{"transactions", func(dir string) {
+			rewriteArchiveSegment(t, dir, 1, func(entries []*archiveEntry) {
+				entries[2].Block = entries[2].Block.WithBody(nil, nil)
+			})
+		}},
+		{"uncles", func(dir string) {
+			rewriteArchiveSegment(t, dir, 1, func(entries []*archiveEntry) {
+				block := entries[2].Block
+				entries[2].Block = block.WithBody(block.Transactions(), []*types.Header{blocks[0].Header()})
+			})
+		}},
+		{"receipts", func(dir string) {
+			rewriteArchiveSegment(t, dir, 1, func(entries []*archiveEntry) {
+				entries[2].Receipts = nil
+			})
+		}},
+		{"linkage", func(dir string) {
+			rewriteArchiveSegment(t, dir, 1, func(entries []*archiveEntry) {
+				block := entries[2].Block
+				header := block.Header()
+				header.ParentHash = common.Hash{1}
+				entries[2].Block = types.NewBlockWithHeader(header).WithBody(block.Transactions(), block.Uncles())
+			})
+		}},
+		{"td", func(dir string) {
+			manifest := readArchiveManifest(t, dir)
+			manifest.GenesisTd.Add(manifest.GenesisTd, common.Big1)
+			writeArchiveManifest(t, dir, manifest)
+		}},
+	}
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "chain-archive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		if err := ExportArchive(source, dir, ArchiveExportConfig{Last: 16, SegmentSize: 5, Receipts: true, Td: true}); err != nil {
+			t.Fatalf("%s: failed to export archive: %v", tt.name, err)
+		}
+		tt.modify(dir)
+
+		target := newArchiveTestChain(t, nil)
+		if err := ImportArchive(target, dir); err == nil {
+			t.Errorf("%s: tampered archive imported", tt.name)
+		}
+		if tt.name != "td" {
+			if head := target.CurrentBlock().NumberU64(); head != 4 {
+				t.Errorf("%s: head mismatch: have #%d, want #%d", tt.name, head, 4)
+			}
+		}
+		target.Stop()
+	}
+}
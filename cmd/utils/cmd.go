@@ -80,14 +80,13 @@ func StartNode(stack *node.Node) {
 	}()
 }
 
-func ImportChain(chain *core.BlockChain, fn string) error {
-	// Watch for Ctrl-C while the import is running.
-	// If a signal is received, the import will stop at the next batch.
+// watchImportInterrupt watches for Ctrl-C while an import is running, returning
+// a function reporting whether one was received and a function to stop watching.
+// If a signal is received, the import will stop at the next batch.
+func watchImportInterrupt() (func() bool, func()) {
 	interrupt := make(chan os.Signal, 1)
 	stop := make(chan struct{})
 	signal.Notify(interrupt, os.Interrupt)
-	defer signal.Stop(interrupt)
-	defer close(interrupt)
 	go func() {
 		if _, ok := <-interrupt; ok {
 			log.Info("Interrupted during import, stopping at next batch")
@@ -102,6 +101,16 @@ func ImportChain(chain *core.BlockChain, fn string) error {
 			return false
 		}
 	}
+	release := func() {
+		signal.Stop(interrupt)
+		close(interrupt)
+	}
+	return checkInterrupt, release
+}
+
+func ImportChain(chain *core.BlockChain, fn string) error {
+	checkInterrupt, release := watchImportInterrupt()
+	defer release()
 
 	log.Info("Importing blockchain", "file", fn)
 	fh, err := os.Open(fn)
@@ -31,6 +31,8 @@ import (
 	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/consensus/clique"
 	"github.com/ethereum/go-ethereum/consensus/ethash"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/state"
@@ -115,6 +117,19 @@ var (
 		Usage: "Data directory for the databases and keystore",
 		Value: DirectoryString{node.DefaultDataDir()},
 	}
+	AncientFlag = DirectoryFlag{
+		Name:  "datadir.ancient",
+		Usage: "Data directory for ancient chain segments (default = inside chaindata)",
+	}
+	FreezerFlag = cli.BoolFlag{
+		Name:  "freezer",
+		Usage: "Move ancient chain segments out of the key-value store into append-only flat files",
+	}
+	FreezerThresholdFlag = cli.Uint64Flag{
+		Name:  "freezer.threshold",
+		Usage: "Number of recent blocks to keep in the key-value store when freezing",
+		Value: eth.DefaultConfig.FreezerThreshold,
+	}
 	KeyStoreDirFlag = DirectoryFlag{
 		Name:  "keystore",
 		Usage: "Directory for the keystore (default = inside the datadir)",
@@ -163,6 +178,34 @@ var (
 		Usage: `Blockchain sync mode ("fast", "full", or "light")`,
 		Value: &defaultSyncMode,
 	}
+	GCModeFlag = cli.StringFlag{
+		Name:  "gcmode",
+		Usage: `Blockchain garbage collection mode ("full", "archive")`,
+		Value: "full",
+	}
+	SnapshotFlag = cli.BoolFlag{
+		Name:  "snapshot",
+		Usage: "Maintain a flat snapshot of the state to accelerate state reads (experimental)",
+	}
+	DatabaseCompressFlag = cli.BoolFlag{
+		Name:  "dbcompress",
+		Usage: "Store block bodies and trie nodes run-length compressed in the database",
+	}
+	StateDiffsFlag = cli.Uint64Flag{
+		Name:  "statediffs",
+		Usage: "Number of recent blocks to record per-block state diffs for (0 = disabled)",
+		Value: 0,
+	}
+	TxLookupLimitFlag = cli.Uint64Flag{
+		Name:  "txlookuplimit",
+		Usage: "Number of recent blocks to maintain transaction lookup indices for (0 = entire chain)",
+		Value: 0,
+	}
+	StateReexecFlag = cli.Uint64Flag{
+		Name:  "reexec",
+		Usage: "Maximum number of blocks to re-execute to regenerate pruned historical states (0 = disabled)",
+		Value: eth.DefaultConfig.StateReexec,
+	}
 
 	LightServFlag = cli.IntFlag{
 		Name:  "lightserv",
@@ -259,6 +302,11 @@ var (
 		Usage: "Number of trie node generations to keep in memory",
 		Value: int(state.MaxTrieCacheGen),
 	}
+	TrieFlushIntervalFlag = cli.Uint64Flag{
+		Name:  "cache.flush",
+		Usage: "Number of blocks between flushing a full state to disk when pruning",
+		Value: eth.DefaultConfig.TrieFlushInterval,
+	}
 	// Miner settings
 	MiningEnabledFlag = cli.BoolFlag{
 		Name:  "mine",
@@ -675,6 +723,16 @@ func setIPC(ctx *cli.Context, cfg *node.Config) {
 	}
 }
 
+// isArchiveMode reports whether the garbage collection mode set by the user keeps
+// all historical states, failing on unknown modes.
+func isArchiveMode(ctx *cli.Context) bool {
+	gcmode := ctx.GlobalString(GCModeFlag.Name)
+	if gcmode != "full" && gcmode != "archive" {
+		Fatalf("--%s must be either 'full' or 'archive'", GCModeFlag.Name)
+	}
+	return gcmode == "archive"
+}
+
 // makeDatabaseHandles raises out the number of allowed file handles per process
 // for Geth and returns half of the allowance to assign to the database.
 func makeDatabaseHandles() int {
@@ -942,6 +1000,35 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *eth.Config) {
 		cfg.DatabaseCache = ctx.GlobalInt(CacheFlag.Name)
 	}
 	cfg.DatabaseHandles = makeDatabaseHandles()
+	if ctx.GlobalIsSet(AncientFlag.Name) {
+		cfg.DatabaseFreezer = ctx.GlobalString(AncientFlag.Name)
+	}
+	if ctx.GlobalIsSet(FreezerFlag.Name) {
+		cfg.Freezer = ctx.GlobalBool(FreezerFlag.Name)
+	}
+	if ctx.GlobalIsSet(FreezerThresholdFlag.Name) {
+		cfg.FreezerThreshold = ctx.GlobalUint64(FreezerThresholdFlag.Name)
+	}
+
+	cfg.NoPruning = isArchiveMode(ctx)
+	if ctx.GlobalIsSet(SnapshotFlag.Name) {
+		cfg.Snapshot = ctx.GlobalBool(SnapshotFlag.Name)
+	}
+	if ctx.GlobalIsSet(DatabaseCompressFlag.Name) {
+		cfg.DatabaseCompress = ctx.GlobalBool(DatabaseCompressFlag.Name)
+	}
+	if ctx.GlobalIsSet(StateDiffsFlag.Name) {
+		cfg.StateDiffs = ctx.GlobalUint64(StateDiffsFlag.Name)
+	}
+	if ctx.GlobalIsSet(TxLookupLimitFlag.Name) {
+		cfg.TxLookupLimit = ctx.GlobalUint64(TxLookupLimitFlag.Name)
+	}
+	if ctx.GlobalIsSet(StateReexecFlag.Name) {
+		cfg.StateReexec = ctx.GlobalUint64(StateReexecFlag.Name)
+	}
+	if ctx.GlobalIsSet(TrieFlushIntervalFlag.Name) {
+		cfg.TrieFlushInterval = ctx.GlobalUint64(TrieFlushIntervalFlag.Name)
+	}
 
 	if ctx.GlobalIsSet(MinerThreadsFlag.Name) {
 		cfg.MinerThreads = ctx.GlobalInt(MinerThreadsFlag.Name)
@@ -1054,9 +1141,31 @@ func MakeChainDatabase(ctx *cli.Context, stack *node.Node) ethdb.Database {
 	if err != nil {
 		Fatalf("Could not open database: %v", err)
 	}
+	ldb, persistent := chainDb.(*ethdb.LDBDatabase)
+	chainDb = core.NewCompressedDatabase(chainDb, ctx.GlobalBool(DatabaseCompressFlag.Name))
+
+	// Full nodes keep the ancient chain segments in a freezer, which is only
+	// read by the tools, the node itself creates it and moves blocks into it
+	if persistent && !ctx.GlobalBool(LightModeFlag.Name) {
+		ancient := MakeAncientDir(ctx, stack, ldb.Path())
+		if _, err := os.Stat(ancient); err == nil {
+			if chainDb, err = core.NewDatabaseWithFreezer(chainDb, ancient, 0, true); err != nil {
+				Fatalf("Could not open ancient database: %v", err)
+			}
+		}
+	}
 	return chainDb
 }
 
+// MakeAncientDir returns the directory of the freezer belonging to the chain
+// database at the given path, either set by the user or inside the database.
+func MakeAncientDir(ctx *cli.Context, stack *node.Node, dbdir string) string {
+	if ctx.GlobalIsSet(AncientFlag.Name) {
+		return stack.ResolvePath(ctx.GlobalString(AncientFlag.Name))
+	}
+	return filepath.Join(dbdir, "ancient")
+}
+
 func MakeGenesis(ctx *cli.Context) *core.Genesis {
 	var genesis *core.Genesis
 	switch {
@@ -1075,22 +1184,44 @@ func MakeChain(ctx *cli.Context, stack *node.Node) (chain *core.BlockChain, chai
 	var err error
 	chainDb = MakeChainDatabase(ctx, stack)
 
-	engine := ethash.NewFaker()
-	if !ctx.GlobalBool(FakePoWFlag.Name) {
-		engine = ethash.New("", 1, 0, "", 1, 0)
-	}
 	config, _, err := core.SetupGenesisBlock(chainDb, MakeGenesis(ctx))
 	if err != nil {
 		Fatalf("%v", err)
 	}
+	engine := MakeEngine(ctx, config, chainDb)
+
+	cache := *core.DefaultCacheConfig
+	cache.Disabled = isArchiveMode(ctx)
+	cache.Snapshot = ctx.GlobalBool(SnapshotFlag.Name)
+	cache.StateDiffs = ctx.GlobalUint64(StateDiffsFlag.Name)
+	if ctx.GlobalIsSet(TxLookupLimitFlag.Name) {
+		limit := ctx.GlobalUint64(TxLookupLimitFlag.Name)
+		cache.TxLookupLimit = &limit
+	}
+	if interval := ctx.GlobalUint64(TrieFlushIntervalFlag.Name); interval > 0 {
+		cache.TrieFlushInterval = interval
+	}
+
 	vmcfg := vm.Config{EnablePreimageRecording: ctx.GlobalBool(VMEnableDebugFlag.Name)}
-	chain, err = core.NewBlockChain(chainDb, config, engine, new(event.TypeMux), vmcfg)
+	chain, err = core.NewBlockChain(chainDb, &cache, config, engine, new(event.TypeMux), vmcfg)
 	if err != nil {
 		Fatalf("Can't create BlockChain: %v", err)
 	}
 	return chain, chainDb
 }
 
+// MakeEngine creates the consensus engine of a chain from set command line flags,
+// as the node would: clique for proof-of-authority chains, ethash otherwise.
+func MakeEngine(ctx *cli.Context, config *params.ChainConfig, chainDb ethdb.Database) consensus.Engine {
+	if config.Clique != nil {
+		return clique.New(config.Clique, chainDb)
+	}
+	if ctx.GlobalBool(FakePoWFlag.Name) {
+		return ethash.NewFaker()
+	}
+	return ethash.New("", 1, 0, "", 1, 0)
+}
+
 // MakeConsolePreloads retrieves the absolute paths for the console JavaScript
 // scripts to preload before starting.
 func MakeConsolePreloads(ctx *cli.Context) []string {
@@ -31,35 +31,56 @@ const (
 	tokenToken             = 0xff
 )
 
+// maxZeroRun is the longest run of zeros encoded by a single token. Longer runs
+// would collide with the special tokens above.
+const maxZeroRun = 250
+
 var empty = crypto.Keccak256([]byte(""))
 var emptyList = crypto.Keccak256([]byte{0x80})
 
+var (
+	errTruncated  = errors.New("error reading bytes. token encountered without proceeding bytes")
+	errInvalidRun = errors.New("error reading bytes. invalid zero run length")
+)
+
+// Decompress decodes run-length encoded data.
 func Decompress(dat []byte) ([]byte, error) {
-	buf := new(bytes.Buffer)
+	buf := make([]byte, 0, len(dat))
 
 	for i := 0; i < len(dat); i++ {
-		if dat[i] == token {
-			if i+1 < len(dat) {
-				switch dat[i+1] {
-				case emptyShaToken:
-					buf.Write(empty)
-				case emptyListShaToken:
-					buf.Write(emptyList)
-				case tokenToken:
-					buf.WriteByte(token)
-				default:
-					buf.Write(make([]byte, int(dat[i+1]-2)))
-				}
-				i++
-			} else {
-				return nil, errors.New("error reading bytes. token encountered without proceeding bytes")
-			}
-		} else {
-			buf.WriteByte(dat[i])
+		if dat[i] != token {
+			buf = append(buf, dat[i])
+			continue
+		}
+		if i+1 >= len(dat) {
+			return nil, errTruncated
+		}
+		var err error
+		if buf, err = decodeToken(buf, dat[i+1]); err != nil {
+			return nil, err
 		}
+		i++
 	}
+	return buf, nil
+}
 
-	return buf.Bytes(), nil
+// decodeToken appends the data encoded by the byte following a token to dst.
+func decodeToken(dst []byte, code byte) ([]byte, error) {
+	switch code {
+	case emptyShaToken:
+		return append(dst, empty...), nil
+	case emptyListShaToken:
+		return append(dst, emptyList...), nil
+	case tokenToken:
+		return append(dst, token), nil
+	}
+	if code < 2 {
+		return nil, errInvalidRun
+	}
+	for i := 0; i < int(code-2); i++ {
+		dst = append(dst, 0)
+	}
+	return dst, nil
 }
 
 func compressChunk(dat []byte) (ret []byte, n int) {
@@ -68,7 +89,7 @@ func compressChunk(dat []byte) (ret []byte, n int) {
 		return []byte{token, tokenToken}, 1
 	case len(dat) > 1 && dat[0] == 0x0 && dat[1] == 0x0:
 		j := 0
-		for j <= 254 && j < len(dat) {
+		for j < maxZeroRun && j < len(dat) {
 			if dat[j] != 0 {
 				break
 			}
@@ -87,15 +108,21 @@ func compressChunk(dat []byte) (ret []byte, n int) {
 	}
 }
 
+// Compress run-length encodes the given data.
 func Compress(dat []byte) []byte {
-	buf := new(bytes.Buffer)
+	buf, _ := compress(nil, dat, true)
+	return buf
+}
 
+// compress appends the encoding of dat to dst, returning the number of bytes
+// consumed. Unless final is set, the chunks shorter than the longest encodable
+// run are left over, as their encoding might depend on the data following them.
+func compress(dst, dat []byte, final bool) ([]byte, int) {
 	i := 0
-	for i < len(dat) {
+	for i < len(dat) && (final || len(dat)-i > maxZeroRun) {
 		b, n := compressChunk(dat[i:])
-		buf.Write(b)
+		dst = append(dst, b...)
 		i += n
 	}
-
-	return buf.Bytes()
+	return dst, i
 }
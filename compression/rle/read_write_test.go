@@ -17,6 +17,8 @@
 package rle
 
 import (
+	"bytes"
+	"math/rand"
 	"testing"
 
 	checker "gopkg.in/check.v1"
@@ -48,3 +50,81 @@ func (s *CompressionRleSuite) TestDecompressSimple(c *checker.C) {
 	c.Assert(res, checker.DeepEquals, make([]byte, 10))
 
 }
+
+func (s *CompressionRleSuite) TestDecompressInvalid(c *checker.C) {
+	_, err := Decompress([]byte{0x01, token})
+	c.Assert(err, checker.Equals, errTruncated)
+
+	_, err = Decompress([]byte{token, 0x00})
+	c.Assert(err, checker.Equals, errInvalidRun)
+
+	_, err = Decompress([]byte{token, 0x01})
+	c.Assert(err, checker.Equals, errInvalidRun)
+}
+
+func (s *CompressionRleSuite) TestCompressZeroRuns(c *checker.C) {
+	// Runs longer than a single token are split, none colliding with the special tokens
+	for _, n := range []int{2, 3, 249, 250, 251, 252, 253, 254, 255, 256, 500, 1000} {
+		enc := Compress(make([]byte, n))
+		c.Assert(len(enc) <= 2*(n/maxZeroRun+1), checker.Equals, true)
+		for i := 0; i+1 < len(enc); i += 2 {
+			c.Assert(enc[i], checker.Equals, token)
+			c.Assert(enc[i+1] <= maxZeroRun+2, checker.Equals, true)
+		}
+		dec, err := Decompress(enc)
+		c.Assert(err, checker.IsNil)
+		c.Assert(dec, checker.DeepEquals, make([]byte, n))
+	}
+}
+
+func (s *CompressionRleSuite) TestRoundTrip(c *checker.C) {
+	rand := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		data := randomRleData(rand)
+
+		dec, err := Decompress(Compress(data))
+		c.Assert(err, checker.IsNil)
+		c.Assert(bytes.Equal(dec, data), checker.Equals, true)
+	}
+}
+
+func (s *CompressionRleSuite) TestDecompressRandom(c *checker.C) {
+	// Arbitrary input must either fail or decode to data encoding back the same
+	rand := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		data := Compress(randomRleData(rand))
+		for j := rand.Intn(4); j >= 0 && len(data) > 0; j-- {
+			data[rand.Intn(len(data))] = byte(rand.Intn(256))
+		}
+		dec, err := Decompress(data)
+		if err != nil {
+			continue
+		}
+		redec, err := Decompress(Compress(dec))
+		c.Assert(err, checker.IsNil)
+		c.Assert(bytes.Equal(redec, dec), checker.Equals, true)
+	}
+}
+
+// randomRleData generates data rich in the patterns handled by the encoding:
+// zero runs of all lengths, empty hashes and token bytes.
+func randomRleData(rand *rand.Rand) []byte {
+	var data []byte
+	for i := rand.Intn(16); i > 0; i-- {
+		switch rand.Intn(6) {
+		case 0:
+			data = append(data, make([]byte, rand.Intn(600))...)
+		case 1:
+			data = append(data, empty...)
+		case 2:
+			data = append(data, emptyList[:rand.Intn(33)]...)
+		case 3:
+			data = append(data, []byte{token, emptyShaToken, emptyListShaToken, tokenToken}[rand.Intn(4)])
+		default:
+			chunk := make([]byte, rand.Intn(64))
+			rand.Read(chunk)
+			data = append(data, chunk...)
+		}
+	}
+	return data
+}
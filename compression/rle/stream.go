@@ -0,0 +1,166 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rle
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// streamBufferSize is the amount of data buffered by the streaming reader and
+// writer before decoding or encoding it.
+const streamBufferSize = 4096
+
+var errWriterClosed = errors.New("rle: write to closed writer")
+
+// Writer is an io.WriteCloser compressing the data written into it to an
+// underlying writer. The data is buffered until the encoding of its chunks is
+// settled, so the writer must be flushed or closed to write out the tail.
+//
+// Without flushes in between, the output is identical to compressing the whole
+// data at once.
+type Writer struct {
+	w      io.Writer
+	buf    []byte // Data written but not yet encoded
+	out    []byte // Encoded data to be written out
+	err    error
+	closed bool
+}
+
+// NewWriter creates a compressing writer on top of w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Write compresses p into the underlying writer.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errWriterClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= streamBufferSize {
+		w.encode(false)
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	return len(p), nil
+}
+
+// Flush encodes and writes out all the buffered data. Zero runs spanning the
+// flush are split, which costs a few bytes of compression ratio.
+func (w *Writer) Flush() error {
+	if w.closed {
+		return errWriterClosed
+	}
+	if w.err == nil {
+		w.encode(true)
+	}
+	return w.err
+}
+
+// Close flushes the buffered data. The underlying writer is not closed.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	err := w.Flush()
+	w.closed = true
+	return err
+}
+
+// encode compresses the buffered data into the underlying writer, leaving over
+// the unsettled tail unless final is set.
+func (w *Writer) encode(final bool) {
+	var n int
+	w.out, n = compress(w.out[:0], w.buf, final)
+	w.buf = w.buf[:copy(w.buf, w.buf[n:])]
+
+	if len(w.out) > 0 {
+		_, w.err = w.w.Write(w.out)
+	}
+}
+
+// Reader is an io.Reader decompressing the data read from an underlying reader.
+type Reader struct {
+	r   io.ByteReader
+	buf []byte // Decoded data not yet returned
+	off int    // Position of the next byte to return in buf
+	err error
+}
+
+// NewReader creates a decompressing reader on top of r. If r doesn't implement
+// io.ByteReader, it is wrapped into a buffered reader, which may read more data
+// from r than needed.
+func NewReader(r io.Reader) *Reader {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Reader{r: br}
+}
+
+// Read decompresses data into p.
+func (r *Reader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for r.off == len(r.buf) {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.fill()
+	}
+	n := copy(p, r.buf[r.off:])
+	r.off += n
+	return n, nil
+}
+
+// fill decodes the next batch of data into the buffer, recording any error
+// encountered to be returned once the decoded data is consumed.
+func (r *Reader) fill() {
+	r.buf, r.off = r.buf[:0], 0
+	for len(r.buf) < streamBufferSize {
+		b, err := r.r.ReadByte()
+		if err != nil {
+			r.err = err
+			return
+		}
+		if b != token {
+			r.buf = append(r.buf, b)
+			continue
+		}
+		code, err := r.r.ReadByte()
+		if err == io.EOF {
+			err = errTruncated
+		}
+		if err != nil {
+			r.err = err
+			return
+		}
+		buf, err := decodeToken(r.buf, code)
+		if err != nil {
+			r.err = err
+			return
+		}
+		r.buf = buf
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rle
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+
+	checker "gopkg.in/check.v1"
+)
+
+// writeRandomChunks writes data into w in chunks of random size, flushing it at
+// random if requested.
+func writeRandomChunks(c *checker.C, rand *rand.Rand, w *Writer, data []byte, flush bool) {
+	for len(data) > 0 {
+		n := rand.Intn(len(data)) + 1
+		if n > 2*streamBufferSize {
+			n = 2 * streamBufferSize
+		}
+		written, err := w.Write(data[:n])
+		c.Assert(err, checker.IsNil)
+		c.Assert(written, checker.Equals, n)
+		data = data[n:]
+
+		if flush && rand.Intn(4) == 0 {
+			c.Assert(w.Flush(), checker.IsNil)
+		}
+	}
+	c.Assert(w.Close(), checker.IsNil)
+}
+
+// readRandomChunks reads r to the end in chunks of random size.
+func readRandomChunks(rand *rand.Rand, r io.Reader) ([]byte, error) {
+	var data []byte
+	for {
+		buf := make([]byte, rand.Intn(2*streamBufferSize)+1)
+		n, err := r.Read(buf)
+		data = append(data, buf[:n]...)
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			return data, err
+		}
+	}
+}
+
+func (s *CompressionRleSuite) TestStreamRoundTrip(c *checker.C) {
+	rand := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		var data []byte
+		for j := rand.Intn(20); j >= 0; j-- {
+			data = append(data, randomRleData(rand)...)
+		}
+		// Without flushes the stream must match the one shot encoding
+		buf := new(bytes.Buffer)
+		writeRandomChunks(c, rand, NewWriter(buf), data, false)
+		c.Assert(bytes.Equal(buf.Bytes(), Compress(data)), checker.Equals, true)
+
+		// With flushes the stream may differ, but must still decode
+		buf.Reset()
+		writeRandomChunks(c, rand, NewWriter(buf), data, true)
+
+		dec, err := readRandomChunks(rand, NewReader(buf))
+		c.Assert(err, checker.IsNil)
+		c.Assert(bytes.Equal(dec, data), checker.Equals, true)
+
+		// Readers without byte level access must work too
+		dec, err = readRandomChunks(rand, NewReader(struct{ io.Reader }{bytes.NewReader(Compress(data))}))
+		c.Assert(err, checker.IsNil)
+		c.Assert(bytes.Equal(dec, data), checker.Equals, true)
+	}
+}
+
+func (s *CompressionRleSuite) TestStreamInvalid(c *checker.C) {
+	_, err := ioutil.ReadAll(NewReader(bytes.NewReader([]byte{0x01, 0x02, token})))
+	c.Assert(err, checker.Equals, errTruncated)
+
+	_, err = ioutil.ReadAll(NewReader(bytes.NewReader([]byte{0x01, token, 0x01})))
+	c.Assert(err, checker.Equals, errInvalidRun)
+
+	w := NewWriter(new(bytes.Buffer))
+	c.Assert(w.Close(), checker.IsNil)
+	_, err = w.Write([]byte{0x01})
+	c.Assert(err, checker.Equals, errWriterClosed)
+}
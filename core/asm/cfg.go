@@ -0,0 +1,328 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package asm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// Instruction is a single disassembled EVM instruction.
+type Instruction struct {
+	PC  uint64
+	Op  vm.OpCode
+	Arg []byte
+}
+
+// String returns the instruction in the disassembler's format.
+func (ins Instruction) String() string {
+	if len(ins.Arg) > 0 {
+		return fmt.Sprintf("%06v: %v 0x%x", ins.PC, ins.Op, ins.Arg)
+	}
+	return fmt.Sprintf("%06v: %v", ins.PC, ins.Op)
+}
+
+// MarshalJSON encodes the instruction with its opcode name.
+func (ins Instruction) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		PC  uint64        `json:"pc"`
+		Op  string        `json:"op"`
+		Arg hexutil.Bytes `json:"arg,omitempty"`
+	}{ins.PC, ins.Op.String(), ins.Arg})
+}
+
+// BasicBlock is a straight sequence of instructions, which can only be entered
+// through its first instruction and left after its last one.
+type BasicBlock struct {
+	Start        uint64        `json:"start"`        // PC of the first instruction
+	End          uint64        `json:"end"`          // PC of the last instruction
+	Instructions []Instruction `json:"instructions"` // Instructions making up the block
+	Successors   []uint64      `json:"successors"`   // Start of the blocks control may flow to
+	Dynamic      bool          `json:"dynamic"`      // Whether the block ends in a jump with an unresolved target
+	Reachable    bool          `json:"reachable"`    // Whether the block may be executed at all
+}
+
+// last returns the final instruction of the block.
+func (b *BasicBlock) last() Instruction {
+	return b.Instructions[len(b.Instructions)-1]
+}
+
+// Function is an entry of the contract's function dispatcher.
+type Function struct {
+	Selector hexutil.Bytes `json:"selector"` // 4-byte function selector
+	Entry    uint64        `json:"entry"`    // Jump destination the selector dispatches to
+}
+
+// CFG is the control flow graph of a piece of EVM bytecode.
+//
+// Jump targets are resolved statically when the destination is pushed right
+// before the jump. Jumps with any other target are assumed to go to any valid
+// JUMPDEST whose address is pushed somewhere in the reachable code, which
+// covers the return jumps emitted by the usual compilers.
+type CFG struct {
+	Blocks       []*BasicBlock `json:"blocks"`       // Blocks of the code, ordered by start
+	Functions    []Function    `json:"functions"`    // Functions found in the dispatcher
+	InvalidJumps []uint64      `json:"invalidJumps"` // PCs of jumps statically targeting an invalid destination
+	Unreachable  []uint64      `json:"unreachable"`  // Start of the blocks which can never be executed
+
+	blocks map[uint64]*BasicBlock // Blocks indexed by start
+}
+
+// NewCFG disassembles code and recovers its control flow graph. A push at the
+// end of the code missing some of its argument, as is common when metadata is
+// appended to a contract, is kept with its argument truncated.
+func NewCFG(code []byte) *CFG {
+	var instrs []Instruction
+	it := NewInstructionIterator(code)
+	for it.Next() {
+		instrs = append(instrs, Instruction{PC: it.PC(), Op: it.Op(), Arg: it.Arg()})
+	}
+	if it.Error() != nil {
+		instrs = append(instrs, Instruction{PC: it.PC(), Op: vm.OpCode(code[it.PC()]), Arg: code[it.PC()+1:]})
+	}
+	cfg := &CFG{
+		Blocks:       []*BasicBlock{},
+		Functions:    []Function{},
+		InvalidJumps: []uint64{},
+		Unreachable:  []uint64{},
+		blocks:       make(map[uint64]*BasicBlock),
+	}
+	cfg.split(instrs)
+	cfg.link()
+	cfg.markReachable()
+	cfg.findFunctions()
+
+	for _, block := range cfg.Blocks {
+		if !block.Reachable {
+			cfg.Unreachable = append(cfg.Unreachable, block.Start)
+		}
+	}
+	return cfg
+}
+
+// Block returns the basic block starting at pc, if any.
+func (c *CFG) Block(pc uint64) *BasicBlock {
+	return c.blocks[pc]
+}
+
+// split cuts the instructions into basic blocks. A new block starts at every
+// JUMPDEST and after every instruction which alters the control flow.
+func (c *CFG) split(instrs []Instruction) {
+	var block *BasicBlock
+	for _, ins := range instrs {
+		if block == nil || ins.Op == vm.JUMPDEST {
+			block = &BasicBlock{Start: ins.PC, Successors: []uint64{}}
+			c.Blocks = append(c.Blocks, block)
+			c.blocks[ins.PC] = block
+		}
+		block.Instructions = append(block.Instructions, ins)
+		block.End = ins.PC
+
+		if ins.Op == vm.JUMPI || halts(ins.Op) {
+			block = nil
+		}
+	}
+}
+
+// link resolves the successors of every block and records the jumps with
+// invalid static destinations.
+func (c *CFG) link() {
+	for i, block := range c.Blocks {
+		last := block.last()
+		if last.Op == vm.JUMP || last.Op == vm.JUMPI {
+			if target, ok := c.jumpTarget(block); !ok {
+				block.Dynamic = true
+			} else if c.isJumpdest(target) {
+				block.Successors = append(block.Successors, target)
+			} else {
+				c.InvalidJumps = append(c.InvalidJumps, last.PC)
+			}
+		}
+		if !halts(last.Op) && i+1 < len(c.Blocks) {
+			block.Successors = append(block.Successors, c.Blocks[i+1].Start)
+		}
+	}
+}
+
+// jumpTarget returns the destination of the jump ending the block, if it is
+// pushed right before the jump.
+func (c *CFG) jumpTarget(block *BasicBlock) (uint64, bool) {
+	if len(block.Instructions) < 2 {
+		return 0, false
+	}
+	push := block.Instructions[len(block.Instructions)-2]
+	if !push.Op.IsPush() {
+		return 0, false
+	}
+	target := new(big.Int).SetBytes(push.Arg)
+	if target.BitLen() > 64 {
+		return ^uint64(0), true
+	}
+	return target.Uint64(), true
+}
+
+// isJumpdest reports whether pc is a valid jump destination.
+func (c *CFG) isJumpdest(pc uint64) bool {
+	block := c.blocks[pc]
+	return block != nil && block.Instructions[0].Op == vm.JUMPDEST
+}
+
+// markReachable flags every block which may be executed, starting from the
+// entry point. Dynamic jumps are followed to every valid destination pushed
+// by the code found reachable so far, until no new block is found.
+func (c *CFG) markReachable() {
+	if len(c.Blocks) == 0 {
+		return
+	}
+	var (
+		queue   = []*BasicBlock{c.Blocks[0]}
+		dynamic bool          // Whether a reachable block ends in a dynamic jump
+		pushed  []*BasicBlock // Jump destinations pushed by reachable code
+		seen    = map[uint64]bool{}
+	)
+	c.Blocks[0].Reachable = true
+	for len(queue) > 0 {
+		for len(queue) > 0 {
+			block := queue[0]
+			queue = queue[1:]
+
+			dynamic = dynamic || block.Dynamic
+			for _, ins := range block.Instructions {
+				if !ins.Op.IsPush() || len(ins.Arg) > 8 {
+					continue
+				}
+				target := new(big.Int).SetBytes(ins.Arg).Uint64()
+				if c.isJumpdest(target) && !seen[target] {
+					seen[target] = true
+					pushed = append(pushed, c.blocks[target])
+				}
+			}
+			for _, succ := range block.Successors {
+				if next := c.blocks[succ]; !next.Reachable {
+					next.Reachable = true
+					queue = append(queue, next)
+				}
+			}
+		}
+		if dynamic {
+			for _, next := range pushed {
+				if !next.Reachable {
+					next.Reachable = true
+					queue = append(queue, next)
+				}
+			}
+		}
+	}
+}
+
+// findFunctions detects the selectors checked by the function dispatcher,
+// looking for the comparison sequences emitted by the Solidity compiler:
+//
+//	[DUP1] PUSH4 <selector> [DUP2] EQ PUSHn <entry> JUMPI
+func (c *CFG) findFunctions() {
+	for _, block := range c.Blocks {
+		if !block.Reachable {
+			continue
+		}
+		instrs := block.Instructions
+		for i, ins := range instrs {
+			if ins.Op != vm.PUSH4 || len(ins.Arg) != 4 {
+				continue
+			}
+			j := i + 1
+			if j < len(instrs) && instrs[j].Op == vm.DUP2 {
+				j++
+			}
+			if j+2 >= len(instrs) || instrs[j].Op != vm.EQ || !instrs[j+1].Op.IsPush() || instrs[j+2].Op != vm.JUMPI {
+				continue
+			}
+			entry := new(big.Int).SetBytes(instrs[j+1].Arg)
+			if entry.BitLen() > 64 || !c.isJumpdest(entry.Uint64()) {
+				continue
+			}
+			c.Functions = append(c.Functions, Function{Selector: ins.Arg, Entry: entry.Uint64()})
+		}
+	}
+}
+
+// WriteDOT writes the graph in the Graphviz DOT format. Unreachable blocks are
+// drawn dashed, dynamic jumps and invalid jump destinations in red.
+func (c *CFG) WriteDOT(w io.Writer) error {
+	invalid := make(map[uint64]bool)
+	for _, pc := range c.InvalidJumps {
+		invalid[pc] = true
+	}
+	entries := make(map[uint64][]string)
+	for _, fn := range c.Functions {
+		entries[fn.Entry] = append(entries[fn.Entry], fn.Selector.String())
+	}
+	if _, err := fmt.Fprintln(w, "digraph cfg {\n\tnode [shape=box fontname=monospace];"); err != nil {
+		return err
+	}
+	for _, block := range c.Blocks {
+		label := ""
+		for _, selector := range entries[block.Start] {
+			label += fmt.Sprintf("function %s\\l", selector)
+		}
+		for _, ins := range block.Instructions {
+			label += ins.String() + "\\l"
+		}
+		attrs := ""
+		if !block.Reachable {
+			attrs += " style=dashed"
+		}
+		if block.Dynamic || invalid[block.End] {
+			attrs += " color=red"
+		}
+		if _, err := fmt.Fprintf(w, "\tb%d [label=\"%s\"%s];\n", block.Start, label, attrs); err != nil {
+			return err
+		}
+		for _, succ := range block.Successors {
+			if _, err := fmt.Fprintf(w, "\tb%d -> b%d;\n", block.Start, succ); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+// WriteJSON writes the graph along with the analysis results in JSON format.
+func (c *CFG) WriteJSON(w io.Writer) error {
+	out, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(out, '\n'))
+	return err
+}
+
+// halts reports whether execution can't continue with the next instruction
+// after op.
+func halts(op vm.OpCode) bool {
+	switch op {
+	case vm.STOP, vm.JUMP, vm.RETURN, vm.SELFDESTRUCT:
+		return true
+	}
+	// Undefined opcodes abort the execution
+	return vm.StringToOp(op.String()) != op
+}
@@ -0,0 +1,102 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package asm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Tests the recovery of basic blocks, static jumps and unreachable code.
+func TestCFGBlocks(t *testing.T) {
+	// 0: PUSH1 0x06, 2: JUMPI, 3: PUSH1 0x09, 5: JUMP, 6: JUMPDEST, 7: STOP,
+	// 8: ADD, 9: JUMPDEST, 10: PUSH1 0x08, 12: JUMP
+	code, _ := hex.DecodeString("6006576009565b00015b600856")
+	cfg := NewCFG(code)
+
+	var starts []uint64
+	for _, block := range cfg.Blocks {
+		starts = append(starts, block.Start)
+	}
+	if want := []uint64{0, 3, 6, 8, 9}; !reflect.DeepEqual(starts, want) {
+		t.Fatalf("block starts mismatch: have %v, want %v", starts, want)
+	}
+	if succ := cfg.Block(0).Successors; !reflect.DeepEqual(succ, []uint64{6, 3}) {
+		t.Errorf("JUMPI successors mismatch: have %v, want [6 3]", succ)
+	}
+	if succ := cfg.Block(3).Successors; !reflect.DeepEqual(succ, []uint64{9}) {
+		t.Errorf("JUMP successors mismatch: have %v, want [9]", succ)
+	}
+	if !reflect.DeepEqual(cfg.InvalidJumps, []uint64{12}) {
+		t.Errorf("invalid jumps mismatch: have %v, want [12]", cfg.InvalidJumps)
+	}
+	if !reflect.DeepEqual(cfg.Unreachable, []uint64{8}) {
+		t.Errorf("unreachable blocks mismatch: have %v, want [8]", cfg.Unreachable)
+	}
+}
+
+// Tests that dynamic jumps are assumed to reach the pushed jump destinations.
+func TestCFGDynamicJumps(t *testing.T) {
+	// 0: PUSH1 0x05, 2: DUP1, 3: POP, 4: JUMP, 5: JUMPDEST, 6: STOP, 7: JUMPDEST, 8: STOP
+	code, _ := hex.DecodeString("6005805056" + "5b00" + "5b00")
+	cfg := NewCFG(code)
+
+	if !cfg.Block(0).Dynamic {
+		t.Errorf("jump not flagged dynamic")
+	}
+	if !cfg.Block(5).Reachable {
+		t.Errorf("pushed jump destination not reachable")
+	}
+	if cfg.Block(7).Reachable {
+		t.Errorf("never pushed jump destination reachable")
+	}
+}
+
+// Tests the detection of the function dispatcher.
+func TestCFGFunctions(t *testing.T) {
+	// 0: PUSH1 0x00, 2: CALLDATALOAD, 3: DUP1, 4: PUSH4 0xa9059cbb, 9: EQ,
+	// 10: PUSH1 0x0e, 12: JUMPI, 13: STOP, 14: JUMPDEST, 15: STOP
+	code, _ := hex.DecodeString("600035" + "80" + "63a9059cbb" + "14" + "600e" + "57" + "00" + "5b00")
+	cfg := NewCFG(code)
+
+	if len(cfg.Functions) != 1 {
+		t.Fatalf("function count mismatch: have %d, want 1", len(cfg.Functions))
+	}
+	if fn := cfg.Functions[0]; fn.Selector.String() != "0xa9059cbb" || fn.Entry != 14 {
+		t.Errorf("function mismatch: have %s at %d, want 0xa9059cbb at 14", fn.Selector, fn.Entry)
+	}
+	var dot bytes.Buffer
+	if err := cfg.WriteDOT(&dot); err != nil {
+		t.Fatalf("failed to write DOT: %v", err)
+	}
+	if !strings.Contains(dot.String(), "function 0xa9059cbb") || !strings.Contains(dot.String(), "b0 -> b14") {
+		t.Errorf("DOT output missing function or edge:\n%s", dot.String())
+	}
+}
+
+// Tests that a truncated push at the end of the code doesn't abort the analysis.
+func TestCFGTruncatedPush(t *testing.T) {
+	code, _ := hex.DecodeString("00" + "61ff")
+	cfg := NewCFG(code)
+
+	if len(cfg.Blocks) != 2 || !reflect.DeepEqual(cfg.Unreachable, []uint64{1}) {
+		t.Errorf("unexpected blocks %v, unreachable %v", len(cfg.Blocks), cfg.Unreachable)
+	}
+}
@@ -17,230 +17,619 @@
 package asm
 
 import (
-	"errors"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/big"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/ethereum/go-ethereum/common/math"
 	"github.com/ethereum/go-ethereum/core/vm"
 )
 
+// maxMacroDepth is the maximum nesting of macro invocations, guarding against
+// recursive macros.
+const maxMacroDepth = 64
+
 // Compiler contains information about the parsed source
 // and holds the tokens for the program.
+//
+// Besides instructions and labels, the source may contain the following
+// directives:
+//
+//	#define NAME value         defines a named constant
+//	#macro name [param ...]    starts the definition of a macro, invoked as
+//	...                        "name arg ...", with every element matching
+//	#end                       a parameter replaced by the argument
+//	#include "file"            includes another source file
+//	#data name value ...       appends data after the code, @name referring
+//	                           to its offset and @name.size to its length
+//
+// Pushes of labels use the smallest width fitting the label's position,
+// unless an explicit width is given (e.g. "push2 @label").
 type Compiler struct {
-	tokens []token
-	binary []interface{}
-
+	lines     [][]token         // instruction lines, after directive processing and macro expansion
+	constants map[string]token  // values of the defined constants
+	macros    map[string]*macro // definitions of the macros
+	data      []*dataSection    // data sections, in definition order
+	including map[string]bool   // files currently being included, for cycle detection
+	errors    []error           // errors encountered while feeding
+
+	instrs []*instruction
 	labels map[string]int
 
-	pc, pos int
-
 	debug bool
 }
 
-// newCompiler returns a new allocated compiler.
+// macro is a sequence of lines substituted at each invocation of its name.
+type macro struct {
+	params []string
+	body   [][]token
+}
+
+// dataSection is a blob of data appended after the code.
+type dataSection struct {
+	name token
+	data []byte
+}
+
+// instruction is a single compiled instruction along with the source it was
+// compiled from.
+type instruction struct {
+	pos   token     // token the instruction originates from
+	text  string    // source of the instruction, for listings
+	op    vm.OpCode // opcode, or the smallest push for automatically sized pushes
+	arg   []byte    // push argument, if known ahead of the layout
+	ref   token     // label referenced by the push argument, if any
+	width int       // explicit push width, or zero for automatic sizing
+	pc    int       // position of the instruction in the code
+}
+
+// size returns the number of bytes the instruction occupies in the code.
+func (ins *instruction) size() int {
+	if ins.op.IsPush() {
+		return 1 + int(ins.op-vm.PUSH1) + 1
+	}
+	return 1
+}
+
+// NewCompiler returns a new allocated compiler.
 func NewCompiler(debug bool) *Compiler {
 	return &Compiler{
-		labels: make(map[string]int),
-		debug:  debug,
+		constants: make(map[string]token),
+		macros:    make(map[string]*macro),
+		including: make(map[string]bool),
+		labels:    make(map[string]int),
+		debug:     debug,
 	}
 }
 
 // Feed feeds tokens in to ch and are interpreted by
 // the compiler.
 //
-// feed is the first pass in the compile stage as it
-// collect the used labels in the program and keeps a
-// program counter which is used to determine the locations
-// of the jump dests. The labels can than be used in the
-// second stage to push labels and determine the right
-// position.
+// feed is the first pass in the compile stage as it processes the
+// directives, collecting the constants, macros and data sections and
+// pulling in the included files, and expands the macro invocations.
+// Errors are reported by Compile.
 func (c *Compiler) Feed(ch <-chan token) {
-	for i := range ch {
-		switch i.typ {
-		case number:
-			num := math.MustParseBig256(i.text).Bytes()
-			if len(num) == 0 {
-				num = []byte{0}
+	var (
+		line      []token
+		macroDef  *macro // macro whose body is being collected
+		macroName token
+	)
+	for tok := range ch {
+		switch tok.typ {
+		case lineStart:
+			line = line[:0:0]
+			continue
+		case lineEnd, eof:
+		default:
+			line = append(line, tok)
+			continue
+		}
+		if len(line) == 0 {
+			continue
+		}
+		// A full line was collected, process it
+		switch {
+		case line[0].typ == directive && line[0].text == "#end":
+			if macroDef == nil {
+				c.errorf(line[0], "#end outside of a macro definition")
+				continue
 			}
-			c.pc += len(num)
-		case stringValue:
-			c.pc += len(i.text) - 2
-		case element:
-			c.pc++
-		case labelDef:
-			c.labels[i.text] = c.pc
-			c.pc++
-		case label:
-			c.pc += 5
+			c.macros[macroName.text] = macroDef
+			macroDef = nil
+		case macroDef != nil:
+			if line[0].typ == directive && line[0].text == "#macro" {
+				c.errorf(line[0], "nested macro definition")
+				continue
+			}
+			macroDef.body = append(macroDef.body, line)
+		case line[0].typ == directive && line[0].text == "#macro":
+			if len(line) < 2 || line[1].typ != element {
+				c.errorf(line[0], "expected macro name")
+				continue
+			}
+			if _, ok := c.macros[line[1].text]; ok {
+				c.errorf(line[1], "macro %s redefined", line[1].text)
+				continue
+			}
+			macroDef, macroName = new(macro), line[1]
+			for _, param := range line[2:] {
+				if param.typ != element {
+					c.errorf(param, "expected parameter name, got %v", param.typ)
+				}
+				macroDef.params = append(macroDef.params, param.text)
+			}
+		case line[0].typ == directive:
+			c.directive(line)
+		default:
+			c.expand(line, 0)
+		}
+	}
+	if macroDef != nil {
+		c.errorf(macroName, "macro %s not terminated by #end", macroName.text)
+	}
+}
+
+// directive processes the directives other than macro definitions.
+func (c *Compiler) directive(line []token) {
+	dir, args := line[0], line[1:]
+	switch dir.text {
+	case "#define":
+		if len(args) != 2 || args[0].typ != element {
+			c.errorf(dir, "expected #define NAME value")
+			return
+		}
+		if _, ok := c.constants[args[0].text]; ok {
+			c.errorf(args[0], "constant %s redefined", args[0].text)
+			return
+		}
+		value, err := c.resolve(args[1])
+		if err != nil {
+			c.errors = append(c.errors, err)
+			return
+		}
+		c.constants[args[0].text] = value
+
+	case "#include":
+		if len(args) != 1 || args[0].typ != stringValue {
+			c.errorf(dir, "expected #include \"file\"")
+			return
+		}
+		path := filepath.Join(filepath.Dir(dir.file), unquote(args[0].text))
+		if c.including[path] {
+			c.errorf(args[0], "recursive include of %s", path)
+			return
 		}
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			c.errorf(args[0], "%v", err)
+			return
+		}
+		c.including[path] = true
+		c.Feed(Lex(path, src, c.debug))
+		delete(c.including, path)
+
+	case "#data":
+		if len(args) < 1 || args[0].typ != element {
+			c.errorf(dir, "expected #data name value ...")
+			return
+		}
+		section := &dataSection{name: args[0]}
+		for _, arg := range args[1:] {
+			value, err := c.resolve(arg)
+			if err != nil {
+				c.errors = append(c.errors, err)
+				return
+			}
+			switch value.typ {
+			case number:
+				num, err := parseData(value)
+				if err != nil {
+					c.errors = append(c.errors, err)
+					return
+				}
+				section.data = append(section.data, num...)
+			case stringValue:
+				section.data = append(section.data, unquote(value.text)...)
+			default:
+				c.errorf(arg, "expected number or string, got %v", value.typ)
+				return
+			}
+		}
+		c.data = append(c.data, section)
 
-		c.tokens = append(c.tokens, i)
+	default:
+		c.errorf(dir, "unknown directive %s", dir.text)
 	}
-	if c.debug {
-		fmt.Fprintln(os.Stderr, "found", len(c.labels), "labels")
+}
+
+// expand appends a line to the program, substituting it with the body of the
+// macro it invokes if any.
+func (c *Compiler) expand(line []token, depth int) {
+	m, ok := c.macros[line[0].text]
+	if line[0].typ != element || !ok {
+		c.lines = append(c.lines, line)
+		return
+	}
+	if depth >= maxMacroDepth {
+		c.errorf(line[0], "macro %s nested too deeply", line[0].text)
+		return
+	}
+	args := line[1:]
+	if len(args) != len(m.params) {
+		c.errorf(line[0], "macro %s expects %d arguments, got %d", line[0].text, len(m.params), len(args))
+		return
+	}
+	for _, body := range m.body {
+		expanded := make([]token, len(body))
+		for i, tok := range body {
+			for j, param := range m.params {
+				if tok.typ == element && tok.text == param {
+					tok = args[j]
+					break
+				}
+			}
+			// Expanded code is attributed to the invocation
+			tok.file, tok.lineno, tok.col = line[0].file, line[0].lineno, line[0].col
+			expanded[i] = tok
+		}
+		c.expand(expanded, depth+1)
 	}
 }
 
+// resolve substitutes a constant by its value.
+func (c *Compiler) resolve(tok token) (token, error) {
+	if tok.typ != element {
+		return tok, nil
+	}
+	value, ok := c.constants[tok.text]
+	if !ok {
+		return token{}, compileErr(tok, tok.text, "number, string, label or constant")
+	}
+	return value, nil
+}
+
 // Compile compiles the current tokens and returns a
 // binary string that can be interpreted by the EVM
 // and an error if it failed.
 //
 // compile is the second stage in the compile phase
-// which compiles the tokens to EVM instructions.
+// which compiles the tokens to EVM instructions, lays
+// them out choosing the push widths of the label
+// references and finally emits the binary.
 func (c *Compiler) Compile() (string, []error) {
-	var errors []error
-	// continue looping over the tokens until
-	// the stack has been exhausted.
-	for c.pos < len(c.tokens) {
-		if err := c.compileLine(); err != nil {
+	errors := c.errors
+	for _, line := range c.lines {
+		if err := c.compileLine(line); err != nil {
 			errors = append(errors, err)
 		}
 	}
-
+	if len(errors) == 0 {
+		errors = c.layout()
+	}
+	if len(errors) > 0 {
+		return "", errors
+	}
+	if c.debug {
+		fmt.Fprintln(os.Stderr, "found", len(c.labels), "labels")
+	}
 	// turn the binary to hex
 	var bin string
-	for _, v := range c.binary {
-		switch v := v.(type) {
-		case vm.OpCode:
-			bin += fmt.Sprintf("%x", []byte{byte(v)})
-		case []byte:
-			bin += fmt.Sprintf("%x", v)
+	for _, ins := range c.instrs {
+		if c.debug {
+			fmt.Printf("%d: %v %x\n", ins.pc, ins.op, ins.arg)
 		}
+		bin += fmt.Sprintf("%x%x", []byte{byte(ins.op)}, ins.arg)
 	}
-	return bin, errors
+	for _, section := range c.data {
+		bin += fmt.Sprintf("%x", section.data)
+	}
+	return bin, nil
 }
 
-// next returns the next token and increments the
-// posititon.
-func (c *Compiler) next() token {
-	token := c.tokens[c.pos]
-	c.pos++
-	return token
+// Listing returns the compiled program, one instruction or data section per
+// line, along with its position in the code and in the source. Instructions
+// expanded from macros are attributed to the line invoking the macro. It
+// must be called after a successful Compile.
+func (c *Compiler) Listing() []string {
+	listing := make([]string, 0, len(c.instrs)+len(c.data))
+	for _, ins := range c.instrs {
+		code := append([]byte{byte(ins.op)}, ins.arg...)
+		listing = append(listing, fmt.Sprintf("%06d  %-24x  %s  %s", ins.pc, code, ins.pos.position(), ins.text))
+	}
+	for _, section := range c.data {
+		listing = append(listing, fmt.Sprintf("%06d  %-24x  %s  #data %s", c.labels[section.name.text], section.data, section.name.position(), section.name.text))
+	}
+	return listing
+}
+
+// WriteListing writes the listing of the compiled program to w.
+func (c *Compiler) WriteListing(w io.Writer) error {
+	for _, line := range c.Listing() {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // compile line compiles a single line instruction e.g.
 // "push 1", "jump @labal".
-func (c *Compiler) compileLine() error {
-	n := c.next()
-	if n.typ != lineStart {
-		return compileErr(n, n.typ.String(), lineStart.String())
+func (c *Compiler) compileLine(line []token) error {
+	for _, tok := range line {
+		if tok.typ == invalidStatement {
+			return compileErr(tok, tok.text, "instruction")
+		}
 	}
+	lvalue, args := line[0], line[1:]
+	text := lineText(line)
 
-	lvalue := c.next()
 	switch lvalue.typ {
-	case eof:
-		return nil
-	case element:
-		if err := c.compileElement(lvalue); err != nil {
+	case labelDef:
+		if len(args) > 0 {
+			return compileErr(args[0], args[0].text, lineEnd.String())
+		}
+		if err := c.defineLabel(lvalue); err != nil {
 			return err
 		}
-	case labelDef:
-		c.compileLabel()
-	case lineEnd:
+		c.instrs = append(c.instrs, &instruction{pos: lvalue, text: text, op: vm.JUMPDEST})
 		return nil
+
+	case element:
+		name := strings.ToLower(lvalue.text)
+		switch {
+		case isPush(name):
+			if len(args) != 1 {
+				return fmt.Errorf("%s: %s expects a single argument", lvalue.position(), name)
+			}
+			ins, err := c.compilePush(lvalue, args[0], pushWidth(name))
+			if err != nil {
+				return err
+			}
+			ins.text = text
+			c.instrs = append(c.instrs, ins)
+			return nil
+
+		case isJump(name):
+			if len(args) > 1 {
+				return compileErr(args[1], args[1].text, lineEnd.String())
+			}
+			// jumps with a destination push it first
+			if len(args) == 1 {
+				ins, err := c.compilePush(lvalue, args[0], 0)
+				if err != nil {
+					return err
+				}
+				ins.text = text
+				c.instrs = append(c.instrs, ins)
+			}
+			c.instrs = append(c.instrs, &instruction{pos: lvalue, text: text, op: toBinary(name)})
+			return nil
+
+		default:
+			op := toBinary(name)
+			if op.String() != strings.ToUpper(name) {
+				return compileErr(lvalue, lvalue.text, "instruction or macro")
+			}
+			if len(args) > 0 {
+				return compileErr(args[0], args[0].text, lineEnd.String())
+			}
+			c.instrs = append(c.instrs, &instruction{pos: lvalue, text: text, op: op})
+			return nil
+		}
 	default:
 		return compileErr(lvalue, lvalue.text, fmt.Sprintf("%v or %v", labelDef, element))
 	}
+}
 
-	if n := c.next(); n.typ != lineEnd {
-		return compileErr(n, n.text, lineEnd.String())
+// compilePush compiles a push of the given value, with an explicit width or
+// the smallest one fitting the value if width is zero.
+func (c *Compiler) compilePush(pos, value token, width int) (*instruction, error) {
+	value, err := c.resolve(value)
+	if err != nil {
+		return nil, err
 	}
+	ins := &instruction{pos: pos, width: width}
 
+	switch value.typ {
+	case number:
+		if ins.arg, err = parseNumber(value); err != nil {
+			return nil, err
+		}
+	case stringValue:
+		ins.arg = []byte(unquote(value.text))
+		if len(ins.arg) == 0 {
+			return nil, fmt.Errorf("%s: empty string pushed", value.position())
+		}
+	case label:
+		// The position of the label is only known after the layout
+		ins.ref = value
+		ins.op = vm.PUSH1
+		if width > 0 {
+			ins.op = vm.PUSH1 + vm.OpCode(width-1)
+		}
+		return ins, nil
+	default:
+		return nil, compileErr(value, value.text, "number, string, label or constant")
+	}
+	if err := ins.setArg(ins.arg); err != nil {
+		return nil, fmt.Errorf("%s: %v", value.position(), err)
+	}
+	return ins, nil
+}
+
+// setArg sets the argument of a push, padding it to the explicit width of the
+// push if there is one.
+func (ins *instruction) setArg(arg []byte) error {
+	width := ins.width
+	if width == 0 {
+		width = len(arg)
+	}
+	if len(arg) > width {
+		return fmt.Errorf("value of %d bytes doesn't fit in PUSH%d", len(arg), width)
+	}
+	if width > 32 {
+		return fmt.Errorf("unsupported string or number with size %d > 32", width)
+	}
+	ins.arg = append(make([]byte, width-len(arg)), arg...)
+	ins.op = vm.PUSH1 + vm.OpCode(width-1)
 	return nil
 }
 
-// compileNumber compiles the number to bytes
-func (c *Compiler) compileNumber(element token) (int, error) {
-	num := math.MustParseBig256(element.text).Bytes()
-	if len(num) == 0 {
-		num = []byte{0}
+// defineLabel registers a label name, checking for duplicates.
+func (c *Compiler) defineLabel(tok token) error {
+	if _, ok := c.labels[tok.text]; ok {
+		return fmt.Errorf("%s: label %s redefined", tok.position(), tok.text)
 	}
-	c.pushBin(num)
-	return len(num), nil
+	c.labels[tok.text] = 0
+	return nil
 }
 
-// compileElement compiles the element (push & label or both)
-// to a binary representation and may error if incorrect statements
-// where fed.
-func (c *Compiler) compileElement(element token) error {
-	// check for a jump. jumps must be read and compiled
-	// from right to left.
-	if isJump(element.text) {
-		rvalue := c.next()
-		switch rvalue.typ {
-		case number:
-			// TODO figure out how to return the error properly
-			c.compileNumber(rvalue)
-		case stringValue:
-			// strings are quoted, remove them.
-			c.pushBin(rvalue.text[1 : len(rvalue.text)-2])
-		case label:
-			c.pushBin(vm.PUSH4)
-			pos := big.NewInt(int64(c.labels[rvalue.text])).Bytes()
-			pos = append(make([]byte, 4-len(pos)), pos...)
-			c.pushBin(pos)
-		default:
-			return compileErr(rvalue, rvalue.text, "number, string or label")
+// layout assigns positions to the instructions and resolves the label
+// references. Label pushes start out with a single byte and are widened
+// whenever the label doesn't fit in them, until the layout is stable. As
+// instructions only ever grow, this always terminates.
+func (c *Compiler) layout() []error {
+	for _, section := range c.data {
+		if err := c.defineLabel(section.name); err != nil {
+			return []error{err}
 		}
-		// push the operation
-		c.pushBin(toBinary(element.text))
-		return nil
-	} else if isPush(element.text) {
-		// handle pushes. pushes are read from left to right.
-		var value []byte
-
-		rvalue := c.next()
-		switch rvalue.typ {
-		case number:
-			value = math.MustParseBig256(rvalue.text).Bytes()
-			if len(value) == 0 {
-				value = []byte{0}
+	}
+	for changed := true; changed; {
+		changed = false
+
+		pc := 0
+		for _, ins := range c.instrs {
+			ins.pc = pc
+			if ins.op == vm.JUMPDEST && ins.pos.typ == labelDef {
+				c.labels[ins.pos.text] = pc
 			}
-		case stringValue:
-			value = []byte(rvalue.text[1 : len(rvalue.text)-1])
-		case label:
-			value = make([]byte, 4)
-			copy(value, big.NewInt(int64(c.labels[rvalue.text])).Bytes())
-		default:
-			return compileErr(rvalue, rvalue.text, "number, string or label")
+			pc += ins.size()
+		}
+		for _, section := range c.data {
+			c.labels[section.name.text] = pc
+			pc += len(section.data)
+		}
+		var errors []error
+		for _, ins := range c.instrs {
+			if ins.ref.typ != label {
+				continue
+			}
+			value, err := c.labelValue(ins.ref)
+			if err != nil {
+				errors = append(errors, err)
+				continue
+			}
+			arg := big.NewInt(int64(value)).Bytes()
+			if len(arg) == 0 {
+				arg = []byte{0}
+			}
+			if ins.width == 0 && len(arg) > ins.size()-1 {
+				changed = true
+			}
+			if err := ins.setArg(arg); err != nil {
+				errors = append(errors, fmt.Errorf("%s: label %s: %v", ins.ref.position(), ins.ref.text, err))
+			}
+		}
+		if len(errors) > 0 {
+			return errors
 		}
+	}
+	return nil
+}
 
-		if len(value) > 32 {
-			return fmt.Errorf("%d type error: unsupported string or number with size > 32", rvalue.lineno)
+// labelValue returns the position a label reference resolves to, or the size
+// of a data section for name.size references.
+func (c *Compiler) labelValue(ref token) (int, error) {
+	if pc, ok := c.labels[ref.text]; ok {
+		return pc, nil
+	}
+	if name := strings.TrimSuffix(ref.text, ".size"); name != ref.text {
+		for _, section := range c.data {
+			if section.name.text == name {
+				return len(section.data), nil
+			}
 		}
+	}
+	return 0, fmt.Errorf("%s: undefined label %s", ref.position(), ref.text)
+}
+
+// errorf records an error at the position of the given token.
+func (c *Compiler) errorf(tok token, format string, args ...interface{}) {
+	c.errors = append(c.errors, fmt.Errorf("%s: %s", tok.position(), fmt.Sprintf(format, args...)))
+}
 
-		c.pushBin(vm.OpCode(int(vm.PUSH1) - 1 + len(value)))
-		c.pushBin(value)
-	} else {
-		c.pushBin(toBinary(element.text))
+// parseNumber converts a number token to its minimal big endian encoding.
+func parseNumber(tok token) ([]byte, error) {
+	num, ok := math.ParseBig256(tok.text)
+	if !ok {
+		return nil, fmt.Errorf("%s: invalid number %s", tok.position(), tok.text)
+	}
+	if num.Sign() == 0 {
+		return []byte{0}, nil
 	}
+	return num.Bytes(), nil
+}
 
-	return nil
+// parseData converts a number token to bytes for a data section, keeping the
+// leading zeroes of hexadecimal numbers.
+func parseData(tok token) ([]byte, error) {
+	if !strings.HasPrefix(tok.text, "0x") && !strings.HasPrefix(tok.text, "0X") {
+		return parseNumber(tok)
+	}
+	digits := tok.text[2:]
+	if len(digits)%2 == 1 {
+		digits = "0" + digits
+	}
+	data, err := hex.DecodeString(digits)
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("%s: invalid number %s", tok.position(), tok.text)
+	}
+	return data, nil
 }
 
-// compileLabel pushes a jumpdest to the binary slice.
-func (c *Compiler) compileLabel() {
-	c.pushBin(vm.JUMPDEST)
+// unquote removes the quotes around a string token.
+func unquote(text string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(text, `"`), `"`)
 }
 
-// pushBin pushes the value v to the binary stack.
-func (c *Compiler) pushBin(v interface{}) {
-	if c.debug {
-		fmt.Printf("%d: %v\n", len(c.binary), v)
+// lineText reconstructs the source of a line from its tokens.
+func lineText(line []token) string {
+	parts := make([]string, len(line))
+	for i, tok := range line {
+		switch tok.typ {
+		case label:
+			parts[i] = "@" + tok.text
+		case labelDef:
+			parts[i] = tok.text + ":"
+		default:
+			parts[i] = tok.text
+		}
 	}
-	c.binary = append(c.binary, v)
+	return strings.Join(parts, " ")
 }
 
 // isPush returns whether the string op is either any of
 // push(N).
 func isPush(op string) bool {
+	return pushWidth(op) >= 0
+}
+
+// pushWidth returns the explicit width of a push(N), zero for a plain push
+// sized automatically, or -1 if op isn't a push.
+func pushWidth(op string) int {
 	if op == "push" {
-		return true
+		return 0
+	}
+	if code := vm.StringToOp(strings.ToUpper(op)); code.IsPush() {
+		return int(code-vm.PUSH1) + 1
 	}
-	return false
+	return -1
 }
 
 // isJump returns whether the string op is jump(i)
@@ -260,22 +649,17 @@ type compileError struct {
 	got  string
 	want string
 
-	lineno int
+	pos token
 }
 
 func (err compileError) Error() string {
-	return fmt.Sprintf("%d syntax error: unexpected %v, expected %v", err.lineno, err.got, err.want)
+	return fmt.Sprintf("%s: syntax error: unexpected %v, expected %v", err.pos.position(), err.got, err.want)
 }
 
-var (
-	errExpBol            = errors.New("expected beginning of line")
-	errExpElementOrLabel = errors.New("expected beginning of line")
-)
-
 func compileErr(c token, got, want string) error {
 	return compileError{
-		got:    got,
-		want:   want,
-		lineno: c.lineno,
+		got:  got,
+		want: want,
+		pos:  c,
 	}
 }
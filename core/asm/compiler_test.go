@@ -0,0 +1,144 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package asm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// compile compiles the source, failing the test on errors.
+func compile(t *testing.T, name, src string) (string, *Compiler) {
+	c := NewCompiler(false)
+	c.Feed(Lex(name, []byte(src), false))
+	bin, errs := c.Compile()
+	if len(errs) > 0 {
+		t.Fatalf("compilation failed: %v", errs)
+	}
+	return bin, c
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		src, bin string
+	}{
+		// Plain opcodes and pushes sized by their value
+		{"push 1\npush 0x0102\nadd", "600161010201"},
+		// Explicit push widths pad the value
+		{"push2 1", "610001"},
+		// Jumps push their destination, labels become JUMPDESTs
+		{"jump @end\nend:\nstop", "6003565b00"},
+		{"push 1\njumpi @end\nend:", "60016005575b"},
+		// Comments terminate their line
+		{"push 1 ;; one\npush 2", "60016002"},
+		// Constants
+		{"#define ONE 1\n#define ALIAS ONE\npush ALIAS\npush2 ONE", "6001610001"},
+		// Macros, including nested invocations
+		{"#macro store slot value\npush value\npush slot\nsstore\n#end\nstore 1 2", "6002600155"},
+		{"#macro inc\npush 1\nadd\n#end\n#macro inc2\ninc\ninc\n#end\ninc2", "600101600101"},
+		// Data sections, their offset and size
+		{"#data blob \"ab\" 0x0001\npush @blob\npush @blob.size", "6004600461620001"},
+	}
+	for i, test := range tests {
+		bin, _ := compile(t, "test.asm", test.src)
+		if bin != test.bin {
+			t.Errorf("test %d: binary mismatch: have %s, want %s", i, bin, test.bin)
+		}
+	}
+}
+
+// Tests that label pushes are widened as needed to reach their label.
+func TestCompilePushWidth(t *testing.T) {
+	src := "jump @end\n" + strings.Repeat("stop\n", 300) + "end:\npush2 @end"
+	bin, _ := compile(t, "test.asm", src)
+	// PUSH2 0x0130 JUMP, 300 STOPs, JUMPDEST at 304
+	if want := "61013056" + strings.Repeat("00", 300) + "5b610130"; bin != want {
+		t.Errorf("binary mismatch: have %s, want %s", bin, want)
+	}
+}
+
+func TestCompileInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lib := "#define TWO 2\n#macro double\npush TWO\nmul\n#end\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "lib.asm"), []byte(lib), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "self.asm"), []byte("#include \"self.asm\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bin, _ := compile(t, filepath.Join(dir, "main.asm"), "#include \"lib.asm\"\npush 1\ndouble")
+	if want := "6001600202"; bin != want {
+		t.Errorf("binary mismatch: have %s, want %s", bin, want)
+	}
+	c := NewCompiler(false)
+	c.Feed(Lex(filepath.Join(dir, "main.asm"), []byte("#include \"self.asm\""), false))
+	if _, errs := c.Compile(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "recursive include") {
+		t.Errorf("expected recursive include error, got %v", errs)
+	}
+}
+
+// Tests that errors are reported with their position in the source.
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+	}{
+		{"push 1\n  foo", "test.asm:2:3: syntax error: unexpected foo, expected instruction or macro"},
+		{"push1 0x0102", "test.asm:1:7: value of 2 bytes doesn't fit in PUSH1"},
+		{"jump @nowhere", "test.asm:1:7: undefined label nowhere"},
+		{"stop\n push 1 2", "test.asm:2:2: push expects a single argument"},
+		{"#macro m\nstop", "test.asm:1:8: macro m not terminated by #end"},
+		{"#macro m a\n#end\nm", "test.asm:3:1: macro m expects 1 arguments, got 0"},
+		{"#macro m\nm\n#end\nm", "test.asm:4:1: macro m nested too deeply"},
+		{"#bogus", "test.asm:1:1: unknown directive #bogus"},
+		{"a:\na:", "test.asm:2:1: label a redefined"},
+	}
+	for i, test := range tests {
+		c := NewCompiler(false)
+		c.Feed(Lex("test.asm", []byte(test.src), false))
+		_, errs := c.Compile()
+		if len(errs) != 1 || errs[0].Error() != test.err {
+			t.Errorf("test %d: error mismatch: have %v, want %q", i, errs, test.err)
+		}
+	}
+}
+
+// Tests that the listing maps the instructions to their source lines, with
+// macro expansions attributed to the invocation.
+func TestCompileListing(t *testing.T) {
+	src := "#macro one\npush 1\n#end\none\nloop:\njump @loop\n#data d 0xff"
+	_, c := compile(t, "test.asm", src)
+
+	want := []string{
+		"000000  6001                      test.asm:4:1  push 1",
+		"000002  5b                        test.asm:5:1  loop:",
+		"000003  6002                      test.asm:6:1  jump @loop",
+		"000005  56                        test.asm:6:1  jump @loop",
+		"000006  ff                        test.asm:7:7  #data d",
+	}
+	if listing := c.Listing(); !reflect.DeepEqual(listing, want) {
+		t.Errorf("listing mismatch:\nhave %q\nwant %q", listing, want)
+	}
+}
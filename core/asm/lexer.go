@@ -34,10 +34,17 @@ type stateFn func(*lexer) stateFn
 // the tokens channels of the lexer
 type token struct {
 	typ    tokenType
+	file   string
 	lineno int
+	col    int
 	text   string
 }
 
+// position returns the location of the token in the source for reporting.
+func (t token) position() string {
+	return fmt.Sprintf("%s:%d:%d", t.file, t.lineno+1, t.col+1)
+}
+
 // tokenType are the different types the lexer
 // is able to parse and return.
 type tokenType int
@@ -52,6 +59,7 @@ const (
 	labelDef                          // label definition is emitted when a new label is found
 	number                            // number is emitted when a number is found
 	stringValue                       // stringValue is emitted when a string has been found
+	directive                         // directive is emitted when an assembler directive (#define, #macro, ...) is found
 
 	Numbers            = "1234567890"                                           // characters representing any decimal number
 	HexadecimalNumbers = Numbers + "aAbBcCdDeEfF"                               // characters representing any hexadecimal
@@ -60,7 +68,7 @@ const (
 
 // String implements stringer
 func (it tokenType) String() string {
-	if int(it) > len(stringtokenTypes) {
+	if int(it) >= len(stringtokenTypes) {
 		return "invalid"
 	}
 	return stringtokenTypes[it]
@@ -76,18 +84,21 @@ var stringtokenTypes = []string{
 	labelDef:         "label definition",
 	number:           "number",
 	stringValue:      "string",
+	directive:        "directive",
 }
 
 // lexer is the basic construct for parsing
 // source code and turning them in to tokens.
 // Tokens are interpreted by the compiler.
 type lexer struct {
+	name  string // name of the source file, used for positions
 	input string // input contains the source code of the program
 
 	tokens chan token // tokens is used to deliver tokens to the listener
 	state  stateFn    // the current state function
 
 	lineno            int // current line number in the source file
+	linepos           int // position of the start of the current line
 	start, pos, width int // positions for lexing and returning value
 
 	debug bool // flag for triggering debug output
@@ -98,6 +109,7 @@ type lexer struct {
 func Lex(name string, source []byte, debug bool) <-chan token {
 	ch := make(chan token)
 	l := &lexer{
+		name:   name,
 		input:  string(source),
 		tokens: ch,
 		state:  lexLine,
@@ -182,7 +194,7 @@ func (l *lexer) blob() string {
 
 // Emits a new token on to token channel for processing
 func (l *lexer) emit(t tokenType) {
-	token := token{t, l.lineno, l.blob()}
+	token := token{t, l.name, l.lineno, l.start - l.linepos, l.blob()}
 
 	if l.debug {
 		fmt.Fprintf(os.Stderr, "%04d: (%-20v) %s\n", token.lineno, token.typ, token.text)
@@ -200,6 +212,7 @@ func lexLine(l *lexer) stateFn {
 			l.emit(lineEnd)
 			l.ignore()
 			l.lineno++
+			l.linepos = l.pos
 
 			l.emit(lineStart)
 		case r == ';' && l.peek() == ';':
@@ -215,8 +228,12 @@ func lexLine(l *lexer) stateFn {
 			return lexLabel
 		case r == '"':
 			return lexInsideString
-		default:
+		case r == '#':
+			return lexDirective
+		case r == 0:
 			return nil
+		default:
+			l.emit(invalidStatement)
 		}
 	}
 }
@@ -224,7 +241,10 @@ func lexLine(l *lexer) stateFn {
 // lexComment parses the current position until the end
 // of the line and discards the text.
 func lexComment(l *lexer) stateFn {
-	l.acceptRunUntil('\n')
+	// Leave the newline to lexLine so the line is terminated
+	if l.acceptRunUntil('\n') {
+		l.backup()
+	}
 	l.ignore()
 
 	return lexLine
@@ -234,7 +254,7 @@ func lexComment(l *lexer) stateFn {
 // the lex text state function to advance the parsing
 // process.
 func lexLabel(l *lexer) stateFn {
-	l.acceptRun(Alpha + "_")
+	l.acceptRun(Alpha + "_." + Numbers)
 
 	l.emit(label)
 
@@ -252,9 +272,18 @@ func lexInsideString(l *lexer) stateFn {
 	return lexLine
 }
 
+// lexDirective parses an assembler directive such as #define.
+func lexDirective(l *lexer) stateFn {
+	l.acceptRun(Alpha)
+
+	l.emit(directive)
+
+	return lexLine
+}
+
 func lexNumber(l *lexer) stateFn {
 	acceptance := Numbers
-	if l.accept("0") && l.accept("xX") {
+	if l.blob() == "0" && l.accept("xX") {
 		acceptance = HexadecimalNumbers
 	}
 	l.acceptRun(acceptance)
@@ -32,6 +32,7 @@ import (
 	"github.com/ethereum/go-ethereum/common/mclock"
 	"github.com/ethereum/go-ethereum/consensus"
 	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -43,6 +44,7 @@ import (
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
 	"github.com/hashicorp/golang-lru"
+	"gopkg.in/karalabe/cookiejar.v2/collections/prque"
 )
 
 var (
@@ -57,11 +59,29 @@ const (
 	maxFutureBlocks     = 8
 	maxTimeFutureBlocks = 8
 	badBlockLimit       = 8
+	triesInMemory       = 128
 
 	// BlockChainVersion ensures that an incompatible database forces a resync from scratch.
 	BlockChainVersion = 3
 )
 
+// CacheConfig contains the configuration values for the caching and pruning of
+// the state tries resident in a blockchain.
+type CacheConfig struct {
+	Disabled          bool               // Whether to disable trie write caching (archive node)
+	TrieNodeLimit     common.StorageSize // Memory limit at which to flush the oldest trie nodes to disk
+	TrieFlushInterval uint64             // Number of blocks between flushing a full state to disk
+	Snapshot          bool               // Whether to maintain a flat snapshot of the state for fast reads
+	StateDiffs        uint64             // Number of recent blocks to keep state diffs for (0 = disabled)
+	TxLookupLimit     *uint64            // Number of recent blocks to keep transaction lookup indices for (0 = entire chain, nil = leave as is)
+}
+
+// DefaultCacheConfig is the trie caching configuration used when none is given.
+var DefaultCacheConfig = &CacheConfig{
+	TrieNodeLimit:     256 * 1024 * 1024,
+	TrieFlushInterval: 1024,
+}
+
 // BlockChain represents the canonical chain given a database with a genesis
 // block. The Blockchain manages chain imports, reverts, chain reorganisations.
 //
@@ -77,7 +97,8 @@ const (
 // included in the canonical one where as GetBlockByNumber always represents the
 // canonical chain.
 type BlockChain struct {
-	config *params.ChainConfig // chain & network configuration
+	config      *params.ChainConfig // chain & network configuration
+	cacheConfig *CacheConfig        // Cache configuration for pruning
 
 	hc           *HeaderChain
 	chainDb      ethdb.Database
@@ -93,6 +114,9 @@ type BlockChain struct {
 	currentFastBlock *types.Block // Current head of the fast-sync chain (may be above the block chain!)
 
 	stateCache   state.Database // State database to reuse between imports (contains state cache)
+	triegc       *prque.Prque   // Priority queue mapping block numbers to tries to gc
+	snaps        *snapshot.Tree // Flat snapshot of the recent states, nil if disabled
+	pendingDiffs []interface{}  // State diff events of the blocks made canonical, yet to be posted
 	bodyCache    *lru.Cache     // Cache for the most recent block bodies
 	bodyRLPCache *lru.Cache     // Cache for the most recent block bodies in RLP encoded format
 	blockCache   *lru.Cache     // Cache for the most recent entire blocks
@@ -102,6 +126,7 @@ type BlockChain struct {
 	running int32         // running must be called atomically
 	// procInterrupt must be atomically called
 	procInterrupt int32          // interrupt signaler for block processing
+	txIndexing    int32          // set while older transactions are being indexed, must be called atomically
 	wg            sync.WaitGroup // chain processing wait group for shutting down
 
 	engine    consensus.Engine
@@ -114,8 +139,11 @@ type BlockChain struct {
 
 // NewBlockChain returns a fully initialised block chain using information
 // available in the database. It initialises the default Ethereum Validator and
-// Processor.
-func NewBlockChain(chainDb ethdb.Database, config *params.ChainConfig, engine consensus.Engine, mux *event.TypeMux, vmConfig vm.Config) (*BlockChain, error) {
+// Processor. A nil cacheConfig selects the DefaultCacheConfig.
+func NewBlockChain(chainDb ethdb.Database, cacheConfig *CacheConfig, config *params.ChainConfig, engine consensus.Engine, mux *event.TypeMux, vmConfig vm.Config) (*BlockChain, error) {
+	if cacheConfig == nil {
+		cacheConfig = DefaultCacheConfig
+	}
 	bodyCache, _ := lru.New(bodyCacheLimit)
 	bodyRLPCache, _ := lru.New(bodyCacheLimit)
 	blockCache, _ := lru.New(blockCacheLimit)
@@ -124,8 +152,10 @@ func NewBlockChain(chainDb ethdb.Database, config *params.ChainConfig, engine co
 
 	bc := &BlockChain{
 		config:       config,
+		cacheConfig:  cacheConfig,
 		chainDb:      chainDb,
 		stateCache:   state.NewDatabase(chainDb),
+		triegc:       prque.New(),
 		eventMux:     mux,
 		quit:         make(chan struct{}),
 		bodyCache:    bodyCache,
@@ -151,6 +181,14 @@ func NewBlockChain(chainDb ethdb.Database, config *params.ChainConfig, engine co
 	if err := bc.loadLastState(); err != nil {
 		return nil, err
 	}
+	bc.replay()
+
+	// Load the state snapshot, regenerating it in the background if it's unusable
+	if cacheConfig.Snapshot {
+		if bc.snaps, err = snapshot.New(chainDb, bc.stateCache.TrieDB(), bc.currentBlock.Root()); err != nil {
+			log.Warn("Failed to load state snapshot, disabling", "err", err)
+		}
+	}
 	// Check the current state of the block hashes and make sure that we do not have any of the bad blocks in our chain
 	for hash := range BadHashes {
 		if header := bc.GetHeaderByHash(hash); header != nil {
@@ -166,6 +204,13 @@ func NewBlockChain(chainDb ethdb.Database, config *params.ChainConfig, engine co
 	}
 	// Take ownership of this particular state
 	go bc.update()
+
+	// Keep the transaction lookup index within its configured bounds
+	if bc.cacheConfig.TxLookupLimit != nil {
+		bc.wg.Add(1)
+		go bc.maintainTxIndex()
+	}
+
 	return bc, nil
 }
 
@@ -192,9 +237,13 @@ func (bc *BlockChain) loadLastState() error {
 	}
 	// Make sure the state associated with the block is available
 	if _, err := state.New(currentBlock.Root(), bc.stateCache); err != nil {
-		// Dangling block without a state associated, init from scratch
-		log.Warn("Head state missing, resetting chain", "number", currentBlock.Number(), "hash", currentBlock.Hash())
-		return bc.Reset()
+		// Dangling block without a state associated, most probably the recent
+		// states held in memory were lost to an unclean shutdown
+		log.Warn("Head state missing, repairing chain", "number", currentBlock.Number(), "hash", currentBlock.Hash())
+		if currentBlock = bc.repair(currentBlock); currentBlock == nil {
+			log.Warn("No state found in chain, resetting chain")
+			return bc.Reset()
+		}
 	}
 	// Everything seems to be fine, set as the head block
 	bc.currentBlock = currentBlock
@@ -228,6 +277,50 @@ func (bc *BlockChain) loadLastState() error {
 	return nil
 }
 
+// repair rolls back the given head until a block with an associated state is
+// found, returning nil if there is none. The blocks above it can be replayed
+// afterwards by replay.
+func (bc *BlockChain) repair(head *types.Block) *types.Block {
+	for head != nil {
+		if _, err := state.New(head.Root(), bc.stateCache); err == nil {
+			log.Info("Rewound blockchain to past state", "number", head.Number(), "hash", head.Hash())
+			return head
+		}
+		head = bc.GetBlock(head.ParentHash(), head.NumberU64()-1)
+	}
+	return nil
+}
+
+// replay reprocesses the blocks between the current block and the head block
+// recorded in the database, whose state got lost and was rewound by repair.
+// Failures only leave the chain at a lower head, as the blocks can always be
+// synchronised again.
+func (bc *BlockChain) replay() {
+	head := bc.GetBlockByHash(GetHeadBlockHash(bc.chainDb))
+	if head == nil || head.NumberU64() <= bc.currentBlock.NumberU64() {
+		return
+	}
+	var blocks types.Blocks
+	for block := head; block != nil && block.NumberU64() > bc.currentBlock.NumberU64(); block = bc.GetBlock(block.ParentHash(), block.NumberU64()-1) {
+		blocks = append(blocks, block)
+	}
+	for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+		blocks[i], blocks[j] = blocks[j], blocks[i]
+	}
+	if blocks[0].ParentHash() != bc.currentBlock.Hash() {
+		log.Warn("Head block not descending from repaired head, skipping replay", "number", head.Number(), "hash", head.Hash())
+		return
+	}
+	// Mark the repaired block as the head until the replay succeeds
+	if err := WriteHeadBlockHash(bc.chainDb, bc.currentBlock.Hash()); err != nil {
+		log.Crit("Failed to reset head full block", "err", err)
+	}
+	log.Info("Replaying blocks with missing state", "count", len(blocks), "from", blocks[0].Number(), "to", head.Number())
+	if _, err := bc.InsertChain(blocks); err != nil {
+		log.Error("Failed to replay blocks", "err", err)
+	}
+}
+
 // SetHead rewinds the local chain to a new head. In the case of headers, everything
 // above the new head will be deleted and the new one set. In the case of blocks
 // though, the head may be further rewound if block bodies are missing (non-archive
@@ -245,6 +338,13 @@ func (bc *BlockChain) SetHead(head uint64) error {
 	bc.hc.SetHead(head, delFn)
 	currentHeader := bc.hc.CurrentHeader()
 
+	// Discard any frozen blocks above the new head, the freezer can't hold gaps
+	if ancients, ok := bc.chainDb.(ethdb.AncientWriter); ok {
+		if err := ancients.TruncateAncients(currentHeader.Number.Uint64() + 1); err != nil {
+			return err
+		}
+	}
+
 	// Clear out any stale content from the caches
 	bc.bodyCache.Purge()
 	bc.bodyRLPCache.Purge()
@@ -278,7 +378,14 @@ func (bc *BlockChain) SetHead(head uint64) error {
 	if err := WriteHeadFastBlockHash(bc.chainDb, bc.currentFastBlock.Hash()); err != nil {
 		log.Crit("Failed to reset head fast block", "err", err)
 	}
-	return bc.loadLastState()
+	if err := bc.loadLastState(); err != nil {
+		return err
+	}
+	// The snapshot only tracks the recent states of the old head, start afresh
+	if bc.snaps != nil {
+		return bc.snaps.Rebuild(bc.currentBlock.Root())
+	}
+	return nil
 }
 
 // FastSyncCommitHead sets the current head block to the one defined by the hash
@@ -297,6 +404,13 @@ func (bc *BlockChain) FastSyncCommitHead(hash common.Hash) error {
 	bc.currentBlock = block
 	bc.mu.Unlock()
 
+	// The snapshot doesn't know about the synced state, generate it afresh
+	if bc.snaps != nil {
+		if err := bc.snaps.Rebuild(block.Root()); err != nil {
+			return err
+		}
+	}
+
 	log.Info("Committed new head block", "number", block.Number(), "hash", hash)
 	return nil
 }
@@ -379,7 +493,12 @@ func (bc *BlockChain) State() (*state.StateDB, error) {
 
 // StateAt returns a new mutable state based on a particular point in time.
 func (bc *BlockChain) StateAt(root common.Hash) (*state.StateDB, error) {
-	return state.New(root, bc.stateCache)
+	return state.NewWithSnapshot(root, bc.stateCache, bc.snaps)
+}
+
+// StateCache returns the caching database underpinning the blockchain instance.
+func (bc *BlockChain) StateCache() state.Database {
+	return bc.stateCache
 }
 
 // Reset purges the entire blockchain, restoring it to its genesis state.
@@ -511,10 +630,16 @@ func (bc *BlockChain) GetBodyRLP(hash common.Hash) rlp.RawValue {
 	return body
 }
 
-// HasBlock checks if a block is fully present in the database or not, caching
-// it if present.
+// HasBlock checks if a block is fully present in the database or not.
 func (bc *BlockChain) HasBlock(hash common.Hash) bool {
-	return bc.GetBlockByHash(hash) != nil
+	if bc.blockCache.Contains(hash) {
+		return true
+	}
+	number := bc.hc.GetBlockNumber(hash)
+	if number == missingNumber {
+		return false
+	}
+	return HasBody(bc.chainDb, hash, number)
 }
 
 // HasBlockAndState checks if a block and associated state trie is fully present
@@ -561,6 +686,15 @@ func (bc *BlockChain) GetBlockByNumber(number uint64) *types.Block {
 	return bc.GetBlock(hash, number)
 }
 
+// GetReceiptsByHash retrieves the receipts of all the transactions in a block.
+func (bc *BlockChain) GetReceiptsByHash(hash common.Hash) types.Receipts {
+	number := bc.hc.GetBlockNumber(hash)
+	if number == missingNumber {
+		return nil
+	}
+	return GetBlockReceipts(bc.chainDb, hash, number)
+}
+
 // GetBlocksFromHash returns the block corresponding to hash and up to n-1 ancestors.
 // [deprecated by eth/62]
 func (bc *BlockChain) GetBlocksFromHash(hash common.Hash, n int) (blocks []*types.Block) {
@@ -598,6 +732,26 @@ func (bc *BlockChain) Stop() {
 	atomic.StoreInt32(&bc.procInterrupt, 1)
 
 	bc.wg.Wait()
+
+	// Flatten the state snapshot into its disk layer, as the in-memory diff
+	// layers are lost otherwise
+	if bc.snaps != nil {
+		bc.snaps.Close()
+		if err := bc.snaps.Cap(bc.CurrentBlock().Root(), 0); err != nil {
+			log.Error("Failed to persist state snapshot", "err", err)
+		}
+	}
+	// Persist the state of the current head, so that the chain can be resumed
+	// without replaying blocks
+	if !bc.cacheConfig.Disabled {
+		triedb := bc.stateCache.TrieDB()
+		if err := triedb.Commit(bc.CurrentBlock().Root()); err != nil {
+			log.Error("Failed to commit recent state trie", "err", err)
+		}
+		for !bc.triegc.Empty() {
+			triedb.Dereference(bc.triegc.PopItem().(common.Hash))
+		}
+	}
 	log.Info("Blockchain manager stopped")
 }
 
@@ -654,8 +808,38 @@ func (bc *BlockChain) Rollback(chain []common.Hash) {
 // SetReceiptsData computes all the non-consensus fields of the receipts
 func SetReceiptsData(config *params.ChainConfig, block *types.Block, receipts types.Receipts) {
 	signer := types.MakeSigner(config, block.Number())
+	setReceiptsData(block.Hash(), block.NumberU64(), block.Transactions(), receipts, func(*types.Transaction) types.Signer {
+		return signer
+	})
+}
+
+// DeriveReceiptsData computes the fields of stored receipts derivable from their
+// block, blooms included. The senders of contract creations are recovered with
+// the signer matching their signature, so no chain configuration is needed.
+func DeriveReceiptsData(hash common.Hash, number uint64, transactions types.Transactions, receipts types.Receipts) error {
+	if len(transactions) != len(receipts) {
+		return fmt.Errorf("transaction and receipt count mismatch: %d != %d", len(transactions), len(receipts))
+	}
+	setReceiptsData(hash, number, transactions, receipts, storedTxSigner)
+	for _, receipt := range receipts {
+		receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+	}
+	return nil
+}
 
-	transactions, logIndex := block.Transactions(), uint(0)
+// storedTxSigner returns a signer able to recover the sender of a transaction
+// already included in the chain.
+func storedTxSigner(tx *types.Transaction) types.Signer {
+	if tx.Protected() {
+		return types.NewEIP155Signer(tx.ChainId())
+	}
+	return types.FrontierSigner{}
+}
+
+// setReceiptsData computes the non-consensus fields of the receipts of a block,
+// using the given function to pick the signer of contract creations.
+func setReceiptsData(hash common.Hash, number uint64, transactions types.Transactions, receipts types.Receipts, signer func(*types.Transaction) types.Signer) {
+	logIndex := uint(0)
 
 	for j := 0; j < len(receipts); j++ {
 		// The transaction hash can be retrieved from the transaction itself
@@ -664,7 +848,7 @@ func SetReceiptsData(config *params.ChainConfig, block *types.Block, receipts ty
 		// The contract address can be derived from the transaction itself
 		if transactions[j].To() == nil {
 			// Deriving the signer is expensive, only do if it's actually needed
-			from, _ := types.Sender(signer, transactions[j])
+			from, _ := types.Sender(signer(transactions[j]), transactions[j])
 			receipts[j].ContractAddress = crypto.CreateAddress(from, transactions[j].Nonce())
 		}
 		// The used gas can be calculated based on previous receipts
@@ -675,8 +859,8 @@ func SetReceiptsData(config *params.ChainConfig, block *types.Block, receipts ty
 		}
 		// The derived log fields can simply be set from the block and transaction
 		for k := 0; k < len(receipts[j].Logs); k++ {
-			receipts[j].Logs[k].BlockNumber = block.NumberU64()
-			receipts[j].Logs[k].BlockHash = block.Hash()
+			receipts[j].Logs[k].BlockNumber = number
+			receipts[j].Logs[k].BlockHash = hash
 			receipts[j].Logs[k].TxHash = receipts[j].TxHash
 			receipts[j].Logs[k].TxIndex = uint(j)
 			receipts[j].Logs[k].Index = logIndex
@@ -753,24 +937,12 @@ func (bc *BlockChain) InsertReceiptChain(blockChain types.Blocks, receiptChain [
 				log.Crit("Failed to write block receipts", "err", err)
 				return
 			}
-			if err := WriteMipmapBloom(bc.chainDb, block.NumberU64(), receipts); err != nil {
-				errs[index] = fmt.Errorf("failed to write log blooms: %v", err)
-				atomic.AddInt32(&failed, 1)
-				log.Crit("Failed to write log blooms", "err", err)
-				return
-			}
 			if err := WriteTransactions(bc.chainDb, block); err != nil {
 				errs[index] = fmt.Errorf("failed to write individual transactions: %v", err)
 				atomic.AddInt32(&failed, 1)
 				log.Crit("Failed to write individual transactions", "err", err)
 				return
 			}
-			if err := WriteReceipts(bc.chainDb, receipts); err != nil {
-				errs[index] = fmt.Errorf("failed to write individual receipts: %v", err)
-				atomic.AddInt32(&failed, 1)
-				log.Crit("Failed to write individual receipts", "err", err)
-				return
-			}
 			atomic.AddInt32(&stats.processed, 1)
 		}
 	}
@@ -865,6 +1037,103 @@ func (bc *BlockChain) WriteBlock(block *types.Block) (status WriteStatus, err er
 	return
 }
 
+// WriteBlockWithState writes the block along with its state, committed to the
+// state database of the chain, and makes the block the new head if it has the
+// highest total difficulty. The recorded state diffs of the blocks made canonical,
+// the block itself and those of a reorg, are posted before returning.
+func (bc *BlockChain) WriteBlockWithState(block *types.Block, state *state.StateDB) (status WriteStatus, err error) {
+	bc.chainmu.Lock()
+	status, err = bc.writeBlockWithState(block, state)
+	bc.chainmu.Unlock()
+
+	for _, diff := range bc.takePendingDiffs() {
+		bc.eventMux.Post(diff)
+	}
+	return status, err
+}
+
+// writeBlockWithState is the non-locking version of WriteBlockWithState. The
+// state is kept in memory for the most recent blocks only, older ones being
+// garbage collected unless they are flushed to disk, which happens every few
+// blocks or when the memory allowance is exceeded. Archive nodes write every
+// state to disk straight away.
+func (bc *BlockChain) writeBlockWithState(block *types.Block, state *state.StateDB) (status WriteStatus, err error) {
+	// Record the state changes before committing them, if requested
+	diff, err := bc.writeStateDiff(block, state)
+	if err != nil {
+		return NonStatTy, err
+	}
+	root, err := state.Commit(bc.config.IsEIP158(block.Number()))
+	if err != nil {
+		return NonStatTy, err
+	}
+	// Track the state of the block in the snapshot, which is only maintained for
+	// the states written into the chain
+	if err := state.UpdateSnapshot(root); err != nil {
+		log.Warn("Failed to update snapshot tree", "root", root, "err", err)
+	}
+	// Flatten the snapshot layers falling out of the reorg window, keeping the
+	// state of the disk layer referenced in memory
+	if bc.snaps != nil && bc.snaps.Snapshot(root) != nil {
+		if err := bc.snaps.Cap(root, triesInMemory-1); err != nil {
+			log.Warn("Failed to cap snapshot tree", "root", root, "err", err)
+		}
+	}
+	triedb := bc.stateCache.TrieDB()
+	if bc.cacheConfig.Disabled {
+		if err := triedb.Commit(root); err != nil {
+			return NonStatTy, err
+		}
+		return bc.writeBlockWithDiff(block, diff)
+	}
+	triedb.Reference(root)
+	bc.triegc.Push(root, -float32(block.NumberU64()))
+
+	if current := block.NumberU64(); current > triesInMemory {
+		chosen := current - triesInMemory
+
+		// Flush the oldest nodes if the memory allowance is exceeded
+		if triedb.Size() > bc.cacheConfig.TrieNodeLimit {
+			if err := triedb.Cap(bc.cacheConfig.TrieNodeLimit); err != nil {
+				return NonStatTy, err
+			}
+		}
+		// Persist the oldest retained state every now and then, bounding the
+		// number of blocks to replay after a crash
+		if chosen%bc.cacheConfig.TrieFlushInterval == 0 {
+			if header := bc.GetHeaderByNumber(chosen); header != nil {
+				if err := triedb.Commit(header.Root); err != nil {
+					return NonStatTy, err
+				}
+			}
+		}
+		// Garbage collect the states below the retention window
+		for !bc.triegc.Empty() {
+			root, number := bc.triegc.Pop()
+			if uint64(-number) > chosen {
+				bc.triegc.Push(root, number)
+				break
+			}
+			triedb.Dereference(root.(common.Hash))
+		}
+	}
+	return bc.writeBlockWithDiff(block, diff)
+}
+
+// writeBlockWithDiff writes the block to the chain, queueing its state diff, if
+// any, to be announced if the block became canonical.
+func (bc *BlockChain) writeBlockWithDiff(block *types.Block, diff []*state.AccountDiff) (WriteStatus, error) {
+	status, err := bc.WriteBlock(block)
+	if err != nil || status != CanonStatTy || diff == nil {
+		return status, err
+	}
+	bc.mu.Lock()
+	bc.pendingDiffs = append(bc.pendingDiffs, StateDiffEvent{block.Hash(), block.NumberU64(), diff})
+	bc.mu.Unlock()
+
+	return status, nil
+}
+
 // InsertChain will attempt to insert the given chain in to the canonical chain or, otherwise, create a fork. If an error is returned
 // it will return the index number of the failing block as well an error describing what went wrong (for possible errors see core/errors.go).
 func (bc *BlockChain) InsertChain(chain types.Blocks) (int, error) {
@@ -960,7 +1229,7 @@ func (bc *BlockChain) InsertChain(chain types.Blocks) (int, error) {
 		} else {
 			parent = chain[i-1]
 		}
-		state, err := state.New(parent.Root(), bc.stateCache)
+		state, err := state.NewWithSnapshot(parent.Root(), bc.stateCache, bc.snaps)
 		if err != nil {
 			return i, err
 		}
@@ -976,11 +1245,6 @@ func (bc *BlockChain) InsertChain(chain types.Blocks) (int, error) {
 			bc.reportBlock(block, receipts, err)
 			return i, err
 		}
-		// Write state changes to database
-		if _, err = state.CommitTo(bc.chainDb, bc.config.IsEIP158(block.Number())); err != nil {
-			return i, err
-		}
-
 		// coalesce logs for later processing
 		coalescedLogs = append(coalescedLogs, logs...)
 
@@ -988,8 +1252,8 @@ func (bc *BlockChain) InsertChain(chain types.Blocks) (int, error) {
 			return i, err
 		}
 
-		// write the block to the chain and get the status
-		status, err := bc.WriteBlock(block)
+		// write the block and its state to the chain and get the status
+		status, err := bc.writeBlockWithState(block, state)
 		if err != nil {
 			return i, err
 		}
@@ -1000,20 +1264,13 @@ func (bc *BlockChain) InsertChain(chain types.Blocks) (int, error) {
 				"txs", len(block.Transactions()), "gas", block.GasUsed(), "elapsed", common.PrettyDuration(time.Since(bstart)))
 
 			blockInsertTimer.UpdateSince(bstart)
+			events = append(events, bc.takePendingDiffs()...)
 			events = append(events, ChainEvent{block, block.Hash(), logs})
 
 			// This puts transactions in a extra db for rpc
 			if err := WriteTransactions(bc.chainDb, block); err != nil {
 				return i, err
 			}
-			// store the receipts
-			if err := WriteReceipts(bc.chainDb, receipts); err != nil {
-				return i, err
-			}
-			// Write map map bloom filters
-			if err := WriteMipmapBloom(bc.chainDb, block.NumberU64(), receipts); err != nil {
-				return i, err
-			}
 			// Write hash preimages
 			if err := WritePreimages(bc.chainDb, block.NumberU64(), state.Preimages()); err != nil {
 				return i, err
@@ -1034,6 +1291,43 @@ func (bc *BlockChain) InsertChain(chain types.Blocks) (int, error) {
 	return 0, nil
 }
 
+// writeStateDiff computes the changes a processed block made to the state of its
+// parent and stores them, dropping the diffs falling out of the retention window,
+// canonical or not. Nothing is done if state diffs are disabled.
+func (bc *BlockChain) writeStateDiff(block *types.Block, statedb *state.StateDB) ([]*state.AccountDiff, error) {
+	if bc.cacheConfig.StateDiffs == 0 {
+		return nil, nil
+	}
+	parent := bc.GetHeader(block.ParentHash(), block.NumberU64()-1)
+	if parent == nil {
+		return nil, consensus.ErrUnknownAncestor
+	}
+	origin, err := state.New(parent.Root, bc.stateCache)
+	if err != nil {
+		return nil, err
+	}
+	diff := statedb.Diff(origin)
+	if diff == nil {
+		diff = []*state.AccountDiff{}
+	}
+	if err := WriteStateDiff(bc.chainDb, block.Hash(), block.NumberU64(), diff); err != nil {
+		return nil, err
+	}
+	// Move the tail back if the chain was rewound below it, or the diff would
+	// never be pruned
+	if tail := GetStateDiffTail(bc.chainDb); tail != nil && block.NumberU64() < *tail {
+		if err := WriteStateDiffTail(bc.chainDb, block.NumberU64()); err != nil {
+			return nil, err
+		}
+	}
+	if number := block.NumberU64(); number >= bc.cacheConfig.StateDiffs {
+		if err := DeleteStateDiffsBelow(bc.chainDb, number-bc.cacheConfig.StateDiffs+1); err != nil {
+			return nil, err
+		}
+	}
+	return diff, nil
+}
+
 // insertStats tracks and reports on block insertion.
 type insertStats struct {
 	queued, processed, ignored int
@@ -1167,18 +1461,11 @@ func (bc *BlockChain) reorg(oldBlock, newBlock *types.Block) error {
 	for _, block := range newChain {
 		// insert the block in the canonical way, re-writing history
 		bc.insert(block)
-		// write canonical receipts and transactions
-		if err := WriteTransactions(bc.chainDb, block); err != nil {
-			return err
-		}
-		receipts := GetBlockReceipts(bc.chainDb, block.Hash(), block.NumberU64())
-		// write receipts
-		if err := WriteReceipts(bc.chainDb, receipts); err != nil {
-			return err
-		}
-		// Write map map bloom filters
-		if err := WriteMipmapBloom(bc.chainDb, block.NumberU64(), receipts); err != nil {
-			return err
+		// write canonical transactions, unless they are beyond the lookup index
+		if tail := GetTxIndexTail(bc.chainDb); tail == nil || block.NumberU64() >= *tail {
+			if err := WriteTransactions(bc.chainDb, block); err != nil {
+				return err
+			}
 		}
 		addedTxs = append(addedTxs, block.Transactions()...)
 	}
@@ -1186,9 +1473,8 @@ func (bc *BlockChain) reorg(oldBlock, newBlock *types.Block) error {
 	// calculate the difference between deleted and added transactions
 	diff := types.TxDifference(deletedTxs, addedTxs)
 	// When transactions get deleted from the database that means the
-	// receipts that were created in the fork must also be deleted
+	// lookup entries of the fork must also be deleted
 	for _, tx := range diff {
-		DeleteReceipt(bc.chainDb, tx.Hash())
 		DeleteTransaction(bc.chainDb, tx.Hash())
 	}
 	// Must be posted in a goroutine because of the transaction pool trying
@@ -1207,10 +1493,28 @@ func (bc *BlockChain) reorg(oldBlock, newBlock *types.Block) error {
 			}
 		}()
 	}
-
+	// Queue the recorded state diffs of the blocks becoming canonical, oldest
+	// first, to be posted ahead of the diff of the new head, which is queued
+	// once it is written.
+	for i := len(newChain) - 1; i > 0; i-- {
+		if diff := GetStateDiff(bc.chainDb, newChain[i].Hash(), newChain[i].NumberU64()); diff != nil {
+			bc.pendingDiffs = append(bc.pendingDiffs, StateDiffEvent{newChain[i].Hash(), newChain[i].NumberU64(), diff})
+		}
+	}
 	return nil
 }
 
+// takePendingDiffs returns the state diff events queued by the block writes and
+// reorgs since the last call.
+func (bc *BlockChain) takePendingDiffs() []interface{} {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	diffs := bc.pendingDiffs
+	bc.pendingDiffs = nil
+	return diffs
+}
+
 // postChainEvents iterates over the events generated by a chain insertion and
 // posts them into the event mux.
 func (bc *BlockChain) postChainEvents(events []interface{}, logs []*types.Log) {
@@ -32,6 +32,7 @@ import (
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/trie"
 )
 
 // newTestBlockChain creates a blockchain without validation.
@@ -46,7 +47,7 @@ func newTestBlockChain(fake bool) *BlockChain {
 	if !fake {
 		engine = ethash.NewTester()
 	}
-	blockchain, err := NewBlockChain(db, gspec.Config, engine, new(event.TypeMux), vm.Config{})
+	blockchain, err := NewBlockChain(db, nil, gspec.Config, engine, new(event.TypeMux), vm.Config{})
 	if err != nil {
 		panic(err)
 	}
@@ -479,7 +480,7 @@ func testReorgBadHashes(t *testing.T, full bool) {
 	}
 
 	// Create a new BlockChain and check that it rolled back the state.
-	ncm, err := NewBlockChain(bc.chainDb, bc.config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
+	ncm, err := NewBlockChain(bc.chainDb, nil, bc.config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
 	if err != nil {
 		t.Fatalf("failed to create new chain manager: %v", err)
 	}
@@ -588,7 +589,7 @@ func TestFastVsFullChains(t *testing.T) {
 	// Import the chain as an archive node for the comparison baseline
 	archiveDb, _ := ethdb.NewMemDatabase()
 	gspec.MustCommit(archiveDb)
-	archive, _ := NewBlockChain(archiveDb, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
+	archive, _ := NewBlockChain(archiveDb, nil, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
 
 	if n, err := archive.InsertChain(blocks); err != nil {
 		t.Fatalf("failed to process block %d: %v", n, err)
@@ -597,7 +598,7 @@ func TestFastVsFullChains(t *testing.T) {
 	// Fast import the chain as a non-archive node to test
 	fastDb, _ := ethdb.NewMemDatabase()
 	gspec.MustCommit(fastDb)
-	fast, _ := NewBlockChain(fastDb, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
+	fast, _ := NewBlockChain(fastDb, nil, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
 
 	headers := make([]*types.Header, len(blocks))
 	for i, block := range blocks {
@@ -674,7 +675,7 @@ func TestLightVsFastVsFullChainHeads(t *testing.T) {
 	archiveDb, _ := ethdb.NewMemDatabase()
 	gspec.MustCommit(archiveDb)
 
-	archive, _ := NewBlockChain(archiveDb, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
+	archive, _ := NewBlockChain(archiveDb, nil, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
 	if n, err := archive.InsertChain(blocks); err != nil {
 		t.Fatalf("failed to process block %d: %v", n, err)
 	}
@@ -685,7 +686,7 @@ func TestLightVsFastVsFullChainHeads(t *testing.T) {
 	// Import the chain as a non-archive node and ensure all pointers are updated
 	fastDb, _ := ethdb.NewMemDatabase()
 	gspec.MustCommit(fastDb)
-	fast, _ := NewBlockChain(fastDb, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
+	fast, _ := NewBlockChain(fastDb, nil, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
 
 	headers := make([]*types.Header, len(blocks))
 	for i, block := range blocks {
@@ -705,7 +706,7 @@ func TestLightVsFastVsFullChainHeads(t *testing.T) {
 	lightDb, _ := ethdb.NewMemDatabase()
 	gspec.MustCommit(lightDb)
 
-	light, _ := NewBlockChain(lightDb, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
+	light, _ := NewBlockChain(lightDb, nil, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
 	if n, err := light.InsertHeaderChain(headers, 1); err != nil {
 		t.Fatalf("failed to insert header %d: %v", n, err)
 	}
@@ -773,7 +774,7 @@ func TestChainTxReorgs(t *testing.T) {
 	})
 	// Import the chain. This runs all block validation rules.
 	evmux := &event.TypeMux{}
-	blockchain, _ := NewBlockChain(db, gspec.Config, ethash.NewFaker(), evmux, vm.Config{})
+	blockchain, _ := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), evmux, vm.Config{})
 	if i, err := blockchain.InsertChain(chain); err != nil {
 		t.Fatalf("failed to insert original chain[%d]: %v", i, err)
 	}
@@ -844,7 +845,7 @@ func TestLogReorgs(t *testing.T) {
 	)
 
 	var evmux event.TypeMux
-	blockchain, _ := NewBlockChain(db, gspec.Config, ethash.NewFaker(), &evmux, vm.Config{})
+	blockchain, _ := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), &evmux, vm.Config{})
 
 	subs := evmux.Subscribe(RemovedLogsEvent{})
 	chain, _ := GenerateChain(params.TestChainConfig, genesis, db, 2, func(i int, gen *BlockGen) {
@@ -885,7 +886,7 @@ func TestReorgSideEvent(t *testing.T) {
 	)
 
 	evmux := &event.TypeMux{}
-	blockchain, _ := NewBlockChain(db, gspec.Config, ethash.NewFaker(), evmux, vm.Config{})
+	blockchain, _ := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), evmux, vm.Config{})
 
 	chain, _ := GenerateChain(gspec.Config, genesis, db, 3, func(i int, gen *BlockGen) {})
 	if _, err := blockchain.InsertChain(chain); err != nil {
@@ -1000,7 +1001,7 @@ func TestEIP155Transition(t *testing.T) {
 		mux     event.TypeMux
 	)
 
-	blockchain, _ := NewBlockChain(db, gspec.Config, ethash.NewFaker(), &mux, vm.Config{})
+	blockchain, _ := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), &mux, vm.Config{})
 	blocks, _ := GenerateChain(gspec.Config, genesis, db, 4, func(i int, block *BlockGen) {
 		var (
 			tx      *types.Transaction
@@ -1106,7 +1107,7 @@ func TestEIP161AccountRemoval(t *testing.T) {
 		}
 		genesis       = gspec.MustCommit(db)
 		mux           event.TypeMux
-		blockchain, _ = NewBlockChain(db, gspec.Config, ethash.NewFaker(), &mux, vm.Config{})
+		blockchain, _ = NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), &mux, vm.Config{})
 	)
 	blocks, _ := GenerateChain(gspec.Config, genesis, db, 3, func(i int, block *BlockGen) {
 		var (
@@ -1151,3 +1152,364 @@ func TestEIP161AccountRemoval(t *testing.T) {
 		t.Error("account should not exist")
 	}
 }
+
+// Tests that the states of old blocks are garbage collected in full mode, while
+// the recent ones are retained in memory and archive mode keeps them all.
+func TestTrieGarbageCollection(t *testing.T) {
+	for _, archive := range []bool{false, true} {
+		var (
+			gendb, _ = ethdb.NewMemDatabase()
+			db, _    = ethdb.NewMemDatabase()
+			gspec    = &Genesis{Config: params.TestChainConfig}
+			genesis  = gspec.MustCommit(gendb)
+		)
+		gspec.MustCommit(db)
+		blocks, _ := GenerateChain(gspec.Config, genesis, gendb, 2*triesInMemory, func(i int, b *BlockGen) {
+			b.SetCoinbase(common.Address{1})
+		})
+		cache := *DefaultCacheConfig
+		cache.Disabled = archive
+		chain, err := NewBlockChain(db, &cache, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
+		if err != nil {
+			t.Fatalf("failed to create blockchain: %v", err)
+		}
+		if n, err := chain.InsertChain(blocks); err != nil {
+			t.Fatalf("block %d: failed to insert into chain: %v", n, err)
+		}
+		for i, block := range blocks {
+			_, err := chain.StateAt(block.Root())
+			_, diskErr := trie.NewSecure(block.Root(), db, 0)
+			switch {
+			case archive && diskErr != nil:
+				t.Errorf("archive: block %d: state missing from disk: %v", i+1, diskErr)
+			case !archive && diskErr == nil:
+				t.Errorf("full: block %d: state written to disk", i+1)
+			case !archive && i >= len(blocks)-triesInMemory && err != nil:
+				t.Errorf("full: block %d: recent state missing: %v", i+1, err)
+			case !archive && i < len(blocks)-triesInMemory && err == nil:
+				t.Errorf("full: block %d: old state not garbage collected", i+1)
+			}
+		}
+		chain.Stop()
+	}
+}
+
+// Tests that the recent states lost on an unclean shutdown are regenerated by
+// replaying the blocks from the last persisted state, and that a clean shutdown
+// persists the head state.
+func TestTrieStateRepair(t *testing.T) {
+	var (
+		gendb, _ = ethdb.NewMemDatabase()
+		db, _    = ethdb.NewMemDatabase()
+		gspec    = &Genesis{Config: params.TestChainConfig}
+		genesis  = gspec.MustCommit(gendb)
+	)
+	gspec.MustCommit(db)
+	blocks, _ := GenerateChain(gspec.Config, genesis, gendb, 32, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{1})
+	})
+	chain, _ := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("block %d: failed to insert into chain: %v", n, err)
+	}
+	head := blocks[len(blocks)-1]
+
+	// Drop the chain without stopping it, losing all states held in memory
+	chain, _ = NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
+	if current := chain.CurrentBlock(); current.Hash() != head.Hash() {
+		t.Fatalf("head mismatch after repair: have #%d [%x…], want #%d [%x…]", current.NumberU64(), current.Hash().Bytes()[:4], head.NumberU64(), head.Hash().Bytes()[:4])
+	}
+	if _, err := chain.State(); err != nil {
+		t.Fatalf("head state missing after repair: %v", err)
+	}
+	chain.Stop()
+
+	if _, err := trie.NewSecure(head.Root(), db, 0); err != nil {
+		t.Fatalf("head state not persisted on stop: %v", err)
+	}
+	chain, _ = NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
+	if current := chain.CurrentBlock(); current.Hash() != head.Hash() {
+		t.Fatalf("head mismatch after clean restart: have #%d, want #%d", current.NumberU64(), head.NumberU64())
+	}
+	chain.Stop()
+}
+
+// Tests that the state snapshot tracks the state of the chain across storage
+// changes, self destructs and restarts.
+func TestSnapshotConsistency(t *testing.T) {
+	var (
+		key, _   = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address  = crypto.PubkeyToAddress(key.PublicKey)
+		counter  = common.Address{0x01} // Stores the block number at slot number%4
+		suicider = common.Address{0x02} // Self destructs when called
+		db, _    = ethdb.NewMemDatabase()
+		gspec    = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc: GenesisAlloc{
+				address:  {Balance: big.NewInt(1000000000000000)},
+				counter:  {Balance: big.NewInt(0), Code: []byte{0x43, 0x60, 0x04, 0x43, 0x06, 0x55}},
+				suicider: {Balance: big.NewInt(0), Code: []byte{0x60, 0x00, 0xff}, Storage: map[common.Hash]common.Hash{{0x01}: {0x01}}},
+			},
+		}
+		genesis = gspec.MustCommit(db)
+		signer  = types.NewEIP155Signer(gspec.Config.ChainId)
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, db, triesInMemory+32, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x03})
+
+		to := counter
+		switch i {
+		case 10:
+			to = suicider
+		case 20:
+			to = suicider // Recreate the destructed account with a transfer
+		}
+		tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(address), to, big.NewInt(1), big.NewInt(100000), nil, nil), signer, key)
+		b.AddTx(tx)
+	})
+	cache := *DefaultCacheConfig
+	cache.Snapshot = true
+
+	chain, err := NewBlockChain(db, &cache, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to create blockchain: %v", err)
+	}
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("block %d: failed to insert into chain: %v", n, err)
+	}
+	waitSnapshotGeneration(t, chain)
+
+	head := blocks[len(blocks)-1]
+	if err := chain.snaps.Verify(head.Root()); err != nil {
+		t.Fatalf("snapshot inconsistent with state: %v", err)
+	}
+	statedb, _ := chain.State()
+	if have, want := statedb.GetState(counter, common.Hash{}), common.BigToHash(head.Number()); have != want {
+		t.Errorf("counter slot mismatch: have %x, want %x", have, want)
+	}
+	if have := statedb.GetState(suicider, common.Hash{0x01}); have != (common.Hash{}) {
+		t.Errorf("destructed storage still readable: %x", have)
+	}
+	// States committed outside of the chain, like the pending state of a miner,
+	// must not be tracked by the snapshot
+	statedb.SetState(counter, common.Hash{0x01}, common.Hash{0x01})
+	root, _ := statedb.Commit(true)
+	if chain.snaps.Snapshot(root) != nil {
+		t.Errorf("snapshot layer added for state not written into the chain")
+	}
+	// Restart the chain and ensure the flattened snapshot is reused
+	chain.Stop()
+
+	chain, err = NewBlockChain(db, &cache, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to recreate blockchain: %v", err)
+	}
+	defer chain.Stop()
+
+	if generating, _ := chain.snaps.Generating(); generating {
+		t.Fatalf("persisted snapshot regenerated after restart")
+	}
+	if err := chain.snaps.Verify(head.Root()); err != nil {
+		t.Fatalf("snapshot inconsistent with state after restart: %v", err)
+	}
+	blob, err := chain.snaps.Snapshot(head.Root()).Storage(crypto.Keccak256Hash(suicider[:]), crypto.Keccak256Hash(common.Hash{0x01}.Bytes()))
+	if err != nil || blob != nil {
+		t.Fatalf("destructed storage persisted: %x (%v)", blob, err)
+	}
+}
+
+// waitSnapshotGeneration blocks until the state snapshot of the chain is fully
+// generated.
+func waitSnapshotGeneration(t *testing.T, chain *BlockChain) {
+	for i := 0; i < 500; i++ {
+		if generating, _ := chain.snaps.Generating(); !generating {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("snapshot generation timed out")
+}
+
+// Tests that state diffs are recorded for imported blocks when enabled, pruned
+// beyond the retention window and announced for canonical blocks.
+func TestStateDiffs(t *testing.T) {
+	var (
+		db, _   = ethdb.NewMemDatabase()
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		funds   = big.NewInt(1000000000)
+		theAddr = common.Address{1}
+		gspec   = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  GenesisAlloc{address: {Balance: funds}},
+		}
+		genesis = gspec.MustCommit(db)
+		signer  = types.HomesteadSigner{}
+		mux     event.TypeMux
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, db, 8, func(i int, block *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), theAddr, big.NewInt(1000), big.NewInt(21000), new(big.Int), nil), signer, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.AddTx(tx)
+	})
+	cacheConfig := *DefaultCacheConfig
+	cacheConfig.StateDiffs = 4
+
+	blockchain, _ := NewBlockChain(db, &cacheConfig, gspec.Config, ethash.NewFaker(), &mux, vm.Config{})
+	defer blockchain.Stop()
+
+	sub := mux.Subscribe(StateDiffEvent{})
+	defer sub.Unsubscribe()
+
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	// Only the diffs of the last few blocks must be retained
+	for _, block := range blocks {
+		diff := GetStateDiff(db, block.Hash(), block.NumberU64())
+		if block.NumberU64() <= 4 {
+			if diff != nil {
+				t.Errorf("block #%d: state diff not pruned", block.NumberU64())
+			}
+			continue
+		}
+		if len(diff) != 3 {
+			t.Fatalf("block #%d: diff account count mismatch: have %d, want 3", block.NumberU64(), len(diff))
+		}
+		for _, account := range diff {
+			if account.Address != theAddr {
+				continue
+			}
+			want := new(big.Int).SetUint64(1000 * block.NumberU64())
+			if account.Post == nil || account.Post.Balance.Cmp(want) != 0 {
+				t.Errorf("block #%d: post balance mismatch: have %+v, want %v", block.NumberU64(), account.Post, want)
+			}
+			if account.Pre == nil || account.Pre.Balance.Cmp(new(big.Int).Sub(want, big.NewInt(1000))) != 0 {
+				t.Errorf("block #%d: pre balance mismatch: have %+v", block.NumberU64(), account.Pre)
+			}
+		}
+	}
+	// All the imported blocks must have been announced
+	for i := range blocks {
+		select {
+		case ev := <-sub.Chan():
+			if diff := ev.Data.(StateDiffEvent); diff.Hash != blocks[i].Hash() {
+				t.Fatalf("event %d: block mismatch: have %x, want %x", i, diff.Hash, blocks[i].Hash())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d: state diff not announced", i)
+		}
+	}
+	// Diffs of non-canonical blocks must be pruned too once out of the window
+	if err := WriteStateDiff(db, common.Hash{0x01}, 5, []*state.AccountDiff{}); err != nil {
+		t.Fatalf("failed to write stale diff: %v", err)
+	}
+	// Reorg to a heavier fork, whose blocks must all be announced in order once canonical
+	forks, _ := GenerateChain(gspec.Config, blocks[3], db, 5, func(i int, block *BlockGen) {
+		block.OffsetTime(-9) // Raise the difficulty to outweigh the canonical chain
+		block.SetCoinbase(common.Address{0x02})
+	})
+	if _, err := blockchain.InsertChain(forks); err != nil {
+		t.Fatalf("failed to insert fork: %v", err)
+	}
+	if head := blockchain.CurrentBlock().Hash(); head != forks[len(forks)-1].Hash() {
+		t.Fatalf("fork not canonical: head %x", head)
+	}
+	if GetStateDiff(db, common.Hash{0x01}, 5) != nil {
+		t.Errorf("stale state diff not pruned")
+	}
+	for i := range forks {
+		select {
+		case ev := <-sub.Chan():
+			if diff := ev.Data.(StateDiffEvent); diff.Hash != forks[i].Hash() {
+				t.Fatalf("fork event %d: block mismatch: have #%d %x, want #%d %x", i, diff.Number, diff.Hash, forks[i].NumberU64(), forks[i].Hash())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("fork event %d: state diff not announced", i)
+		}
+	}
+}
+
+// Tests that state diffs are recorded and announced for blocks written along
+// with their state directly, as locally mined blocks are.
+func TestStateDiffsWriteBlockWithState(t *testing.T) {
+	var (
+		db, _   = ethdb.NewMemDatabase()
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		theAddr = common.Address{1}
+		gspec   = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  GenesisAlloc{address: {Balance: big.NewInt(1000000000)}},
+		}
+		genesis = gspec.MustCommit(db)
+		mux     event.TypeMux
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, db, 4, func(i int, block *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), theAddr, big.NewInt(1000), big.NewInt(21000), new(big.Int), nil), types.HomesteadSigner{}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.AddTx(tx)
+	})
+	cacheConfig := *DefaultCacheConfig
+	cacheConfig.StateDiffs = 16
+
+	blockchain, _ := NewBlockChain(db, &cacheConfig, gspec.Config, ethash.NewFaker(), &mux, vm.Config{})
+	defer blockchain.Stop()
+
+	sub := mux.Subscribe(StateDiffEvent{})
+	defer sub.Unsubscribe()
+
+	// Write the blocks in the background, as the events are posted synchronously
+	errc := make(chan error, 1)
+	go func() {
+		for _, block := range blocks {
+			statedb, err := state.New(blockchain.GetBlockByHash(block.ParentHash()).Root(), blockchain.StateCache())
+			if err != nil {
+				errc <- err
+				return
+			}
+			if _, _, _, err := blockchain.Processor().Process(block, statedb, vm.Config{}); err != nil {
+				errc <- err
+				return
+			}
+			if status, err := blockchain.WriteBlockWithState(block, statedb); err != nil || status != CanonStatTy {
+				errc <- fmt.Errorf("block #%d: failed to write: status %v, err %v", block.NumberU64(), status, err)
+				return
+			}
+		}
+		errc <- nil
+	}()
+	for i, block := range blocks {
+		select {
+		case ev := <-sub.Chan():
+			if diff := ev.Data.(StateDiffEvent); diff.Hash != block.Hash() {
+				t.Fatalf("event %d: block mismatch: have %x, want %x", i, diff.Hash, block.Hash())
+			}
+		case err := <-errc:
+			t.Fatalf("event %d: state diff not announced: %v", i, err)
+		case <-time.After(time.Second):
+			t.Fatalf("event %d: state diff not announced", i)
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range blocks {
+		diff := GetStateDiff(db, block.Hash(), block.NumberU64())
+		if len(diff) != 3 {
+			t.Fatalf("block #%d: diff account count mismatch: have %d, want 3", block.NumberU64(), len(diff))
+		}
+		for _, account := range diff {
+			if account.Address != theAddr {
+				continue
+			}
+			if want := new(big.Int).SetUint64(1000 * block.NumberU64()); account.Post == nil || account.Post.Balance.Cmp(want) != 0 {
+				t.Errorf("block #%d: post balance mismatch: have %+v, want %v", block.NumberU64(), account.Post, want)
+			}
+		}
+	}
+}
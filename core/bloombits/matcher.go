@@ -0,0 +1,336 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package bloombits
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common/bitutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	// sessionBatch is the number of sections whose bit vectors are requested
+	// together in a single retrieval.
+	sessionBatch = 16
+
+	// sessionWindow is the number of section batches a session retrieves ahead
+	// of the ones being matched.
+	sessionWindow = 4
+)
+
+// errSessionClosed is returned for retrievals aborted by closing their session.
+var errSessionClosed = errors.New("session closed")
+
+// bloomIndexes represents the bit indexes inside the bloom filter that belong
+// to some key.
+type bloomIndexes [3]uint
+
+// calcBloomIndexes returns the bloom filter bit indexes belonging to the given key.
+func calcBloomIndexes(b []byte) bloomIndexes {
+	b = crypto.Keccak256(b)
+
+	var idxs bloomIndexes
+	for i := 0; i < len(idxs); i++ {
+		idxs[i] = (uint(b[2*i])<<8)&2047 + uint(b[2*i+1])
+	}
+	return idxs
+}
+
+// Retrieval is a request for the bit vectors of a single bloom bit in a batch
+// of sections, filled in by the backend servicing a matcher session.
+type Retrieval struct {
+	Bit      uint
+	Sections []uint64
+	Bitsets  [][]byte
+	Error    error
+
+	done chan struct{} // closed when the retrieval has been serviced
+}
+
+// Matcher filters sections of bloom bit vectors for blocks potentially matching
+// a set of address and topic criteria. The criteria are a conjunction of groups,
+// each group being a disjunction of keys.
+type Matcher struct {
+	sectionSize uint64 // Number of blocks in a single section
+
+	filters [][]bloomIndexes // Filter groups the blooms are matched against
+	bits    []uint           // Unique bloom bits needed by the filters
+}
+
+// NewMatcher creates a new matcher for sections of the given size, matching the
+// blocks whose blooms contain at least one key from every filter group. An empty
+// group, or one containing a nil key, matches everything.
+func NewMatcher(sectionSize uint64, filters [][][]byte) *Matcher {
+	m := &Matcher{sectionSize: sectionSize}
+
+	needed := make(map[uint]struct{})
+	for _, filter := range filters {
+		// Gather the bit indexes of the filter rule, special casing the nil filter
+		if len(filter) == 0 {
+			continue
+		}
+		bloomBits := make([]bloomIndexes, len(filter))
+		for i, clause := range filter {
+			if clause == nil {
+				bloomBits = nil
+				break
+			}
+			bloomBits[i] = calcBloomIndexes(clause)
+		}
+		// Accumulate the filter rules if no nil rule was within
+		if bloomBits == nil {
+			continue
+		}
+		m.filters = append(m.filters, bloomBits)
+		for _, idxs := range bloomBits {
+			for _, bit := range idxs {
+				needed[bit] = struct{}{}
+			}
+		}
+	}
+	for bit := range needed {
+		m.bits = append(m.bits, bit)
+	}
+	sort.Sort(bitList(m.bits))
+
+	return m
+}
+
+// Start starts matching the blocks in the range [begin, end], delivering the
+// numbers of the potentially matching ones on the results channel in ascending
+// order. The channel is closed when the matching finishes, is aborted by closing
+// the session or fails, in which case the session reports the error.
+//
+// The bit vectors are requested from the returned session, which must be
+// serviced via Multiplex for the matching to progress.
+func (m *Matcher) Start(begin, end uint64, results chan uint64) (*MatcherSession, error) {
+	if m.sectionSize == 0 || m.sectionSize%8 != 0 {
+		return nil, fmt.Errorf("invalid section size %d", m.sectionSize)
+	}
+	if begin > end {
+		return nil, fmt.Errorf("invalid range [%d, %d]", begin, end)
+	}
+	s := &MatcherSession{
+		matcher: m,
+		begin:   begin,
+		end:     end,
+		tasks:   make(chan *Retrieval),
+		quit:    make(chan struct{}),
+	}
+	batches := make(chan *sectionBatch, sessionWindow)
+
+	s.pend.Add(2)
+	go s.retrieve(batches)
+	go s.match(batches, results)
+
+	return s, nil
+}
+
+// bitset computes the bit vector of the blocks in a section potentially matching
+// all the filters, given the bit vectors of the needed bloom bits.
+func (m *Matcher) bitset(vectors map[uint][]byte) []byte {
+	result := make([]byte, m.sectionSize/8)
+	for i := range result {
+		result[i] = 0xff
+	}
+	for _, filter := range m.filters {
+		group := make([]byte, len(result))
+		for _, clause := range filter {
+			match := make([]byte, len(result))
+			copy(match, vectors[clause[0]])
+			bitutil.ANDBytes(match, match, vectors[clause[1]])
+			bitutil.ANDBytes(match, match, vectors[clause[2]])
+			bitutil.ORBytes(group, group, match)
+		}
+		bitutil.ANDBytes(result, result, group)
+	}
+	return result
+}
+
+// sectionBatch is a batch of consecutive sections along with the retrievals of
+// their bit vectors.
+type sectionBatch struct {
+	sections   []uint64
+	retrievals map[uint]*Retrieval
+}
+
+// MatcherSession is an active matching of a block range, whose bit vector
+// retrievals are serviced by one or more multiplexers.
+type MatcherSession struct {
+	matcher    *Matcher
+	begin, end uint64
+
+	tasks chan *Retrieval // Retrievals waiting to be picked up by a multiplexer
+	quit  chan struct{}   // Channel closed when the session is torn down
+	once  sync.Once       // Ensures the quit channel is closed only once
+	pend  sync.WaitGroup  // Goroutines of the session
+
+	err  error      // First failure of the session
+	lock sync.Mutex // Mutex protecting the error
+}
+
+// retrieve schedules the retrievals of the bit vectors of all the sections in the
+// session's range, batch by batch, feeding the batches to the matcher.
+func (s *MatcherSession) retrieve(batches chan *sectionBatch) {
+	defer s.pend.Done()
+	defer close(batches)
+
+	size := s.matcher.sectionSize
+	for first, last := s.begin/size, s.end/size; first <= last; first += sessionBatch {
+		batch := &sectionBatch{retrievals: make(map[uint]*Retrieval)}
+		for section := first; section <= last && section < first+sessionBatch; section++ {
+			batch.sections = append(batch.sections, section)
+		}
+		for _, bit := range s.matcher.bits {
+			task := &Retrieval{Bit: bit, Sections: batch.sections, done: make(chan struct{})}
+			batch.retrievals[bit] = task
+
+			select {
+			case s.tasks <- task:
+			case <-s.quit:
+				return
+			}
+		}
+		select {
+		case batches <- batch:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// match waits for the bit vectors of each batch of sections, matches them and
+// delivers the potentially matching block numbers.
+func (s *MatcherSession) match(batches chan *sectionBatch, results chan uint64) {
+	defer s.pend.Done()
+	defer close(results)
+
+	size := s.matcher.sectionSize
+	for {
+		var batch *sectionBatch
+		select {
+		case batch = <-batches:
+			if batch == nil {
+				return
+			}
+		case <-s.quit:
+			return
+		}
+		// Wait for all the bit vectors of the batch to arrive
+		for _, task := range batch.retrievals {
+			select {
+			case <-task.done:
+			case <-s.quit:
+				return
+			}
+			if task.Error == nil && len(task.Bitsets) != len(task.Sections) {
+				task.Error = fmt.Errorf("bit %d: bitset count mismatch: have %d, want %d", task.Bit, len(task.Bitsets), len(task.Sections))
+			}
+			for _, bitset := range task.Bitsets {
+				if task.Error == nil && uint64(len(bitset)) != size/8 {
+					task.Error = fmt.Errorf("bit %d: bitset length mismatch: have %d, want %d", task.Bit, len(bitset), size/8)
+				}
+			}
+			if task.Error != nil {
+				s.setError(task.Error)
+				return
+			}
+		}
+		// Match each section and deliver the potential matches in the range
+		for i, section := range batch.sections {
+			vectors := make(map[uint][]byte, len(batch.retrievals))
+			for bit, task := range batch.retrievals {
+				vectors[bit] = task.Bitsets[i]
+			}
+			bitset := s.matcher.bitset(vectors)
+			for j := uint64(0); j < size; j++ {
+				if bitset[j/8]&(byte(1)<<byte(7-j%8)) == 0 {
+					continue
+				}
+				number := section*size + j
+				if number < s.begin || number > s.end {
+					continue
+				}
+				select {
+				case results <- number:
+				case <-s.quit:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Multiplex takes the pending bit vector retrievals of the session and forwards
+// them to a retrieval servicer through the mux channel: a request channel is
+// sent over the mux, followed by the retrieval itself, which the servicer must
+// send back once filled in. Multiple multiplexers may service a session, each
+// blocking until the session is closed.
+func (s *MatcherSession) Multiplex(mux chan chan *Retrieval) {
+	for {
+		var task *Retrieval
+		select {
+		case task = <-s.tasks:
+		case <-s.quit:
+			return
+		}
+		request := make(chan *Retrieval)
+		select {
+		case mux <- request:
+			request <- task
+			<-request
+		case <-s.quit:
+			task.Error = errSessionClosed
+		}
+		close(task.done)
+	}
+}
+
+// Error returns the failure of the session, if any.
+func (s *MatcherSession) Error() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.err
+}
+
+// setError records the first failure of the session.
+func (s *MatcherSession) setError(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// Close stops the matching process and waits for all the goroutines of the
+// session to terminate.
+func (s *MatcherSession) Close() {
+	s.once.Do(func() { close(s.quit) })
+	s.pend.Wait()
+}
+
+type bitList []uint
+
+func (b bitList) Len() int           { return len(b) }
+func (b bitList) Less(i, j int) bool { return b[i] < b[j] }
+func (b bitList) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -0,0 +1,202 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package bloombits
+
+import (
+	"errors"
+	"math/big"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const testSectionSize = 64
+
+// testChain is a set of random header blooms, rotated into bloom bits sections.
+type testChain struct {
+	blooms []types.Bloom
+	bits   [][types.BloomBitLength][]byte // Bit vectors per section
+}
+
+// newTestChain creates a chain of random blooms, each containing a few keys out
+// of a small set so that matches are frequent. The keys must not have leading
+// zero bytes, which the bloom methods strip.
+func newTestChain(t *testing.T, sections int, keys [][]byte) *testChain {
+	chain := &testChain{
+		blooms: make([]types.Bloom, sections*testSectionSize),
+		bits:   make([][types.BloomBitLength][]byte, sections),
+	}
+	for i := range chain.blooms {
+		for _, key := range keys {
+			if rand.Intn(8) == 0 {
+				chain.blooms[i].Add(new(big.Int).SetBytes(key))
+			}
+		}
+	}
+	for section := 0; section < sections; section++ {
+		gen, _ := NewGenerator(testSectionSize)
+		for i := 0; i < testSectionSize; i++ {
+			if err := gen.AddBloom(uint(i), chain.blooms[section*testSectionSize+i]); err != nil {
+				t.Fatalf("failed to add bloom: %v", err)
+			}
+		}
+		for bit := uint(0); bit < types.BloomBitLength; bit++ {
+			chain.bits[section][bit], _ = gen.Bitset(bit)
+		}
+	}
+	return chain
+}
+
+// serve services bloom bit retrievals from the chain until quit is closed.
+func (c *testChain) serve(requests chan chan *Retrieval, quit chan struct{}) {
+	for {
+		select {
+		case request := <-requests:
+			task := <-request
+			task.Bitsets = make([][]byte, len(task.Sections))
+			for i, section := range task.Sections {
+				if int(section) >= len(c.bits) {
+					task.Error = errors.New("section not available")
+					break
+				}
+				task.Bitsets[i] = c.bits[section][task.Bit]
+			}
+			request <- task
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Tests that the matcher finds exactly the blocks whose blooms contain the keys
+// of all the filter groups, for various filters and ranges.
+func TestMatcher(t *testing.T) {
+	keys := make([][]byte, 6)
+	for i := range keys {
+		keys[i] = []byte{byte(i + 1), 0x01, 0x02}
+	}
+	chain := newTestChain(t, 40, keys)
+
+	requests := make(chan chan *Retrieval)
+	quit := make(chan struct{})
+	defer close(quit)
+	for i := 0; i < 4; i++ {
+		go chain.serve(requests, quit)
+	}
+	tests := []struct {
+		filters    [][][]byte
+		begin, end uint64
+	}{
+		{[][][]byte{{keys[0]}}, 0, 40*testSectionSize - 1},
+		{[][][]byte{{keys[0], keys[1]}}, 10, 1000},
+		{[][][]byte{{keys[0]}, {keys[1], keys[2]}}, 0, 2000},
+		{[][][]byte{{keys[0]}, {keys[1]}, {keys[2]}}, 63, 64},
+		{[][][]byte{{keys[3]}, nil, {nil, keys[4]}}, 500, 500},
+		{[][][]byte{{[]byte("missing")}}, 0, 40*testSectionSize - 1},
+		{nil, 100, 300},
+	}
+	for i, tt := range tests {
+		matcher := NewMatcher(testSectionSize, tt.filters)
+
+		results := make(chan uint64, 16)
+		session, err := matcher.Start(tt.begin, tt.end, results)
+		if err != nil {
+			t.Fatalf("test %d: failed to start session: %v", i, err)
+		}
+		for j := 0; j < 3; j++ {
+			go session.Multiplex(requests)
+		}
+		var want []uint64
+		for number := tt.begin; number <= tt.end; number++ {
+			if chain.matches(number, tt.filters) {
+				want = append(want, number)
+			}
+		}
+		var have []uint64
+		timeout := time.After(5 * time.Second)
+	loop:
+		for {
+			select {
+			case number, ok := <-results:
+				if !ok {
+					break loop
+				}
+				have = append(have, number)
+			case <-timeout:
+				t.Fatalf("test %d: matching timed out", i)
+			}
+		}
+		session.Close()
+		if err := session.Error(); err != nil {
+			t.Fatalf("test %d: matching failed: %v", i, err)
+		}
+		if len(have) != len(want) {
+			t.Fatalf("test %d: match count mismatch: have %d, want %d", i, len(have), len(want))
+		}
+		for j := range have {
+			if have[j] != want[j] {
+				t.Fatalf("test %d: match %d mismatch: have %d, want %d", i, j, have[j], want[j])
+			}
+		}
+	}
+}
+
+// Tests that retrieval failures abort the matching and are reported.
+func TestMatcherRetrievalFailure(t *testing.T) {
+	chain := newTestChain(t, 2, [][]byte{{0x01}})
+
+	requests := make(chan chan *Retrieval)
+	quit := make(chan struct{})
+	defer close(quit)
+	go chain.serve(requests, quit)
+
+	results := make(chan uint64)
+	session, err := NewMatcher(testSectionSize, [][][]byte{{{0x01}}}).Start(0, 10*testSectionSize, results)
+	if err != nil {
+		t.Fatalf("failed to start session: %v", err)
+	}
+	go session.Multiplex(requests)
+	for range results {
+	}
+	session.Close()
+	if session.Error() == nil {
+		t.Fatalf("retrieval failure not reported")
+	}
+}
+
+// matches checks the filters against the bloom of a block the hard way.
+func (c *testChain) matches(number uint64, filters [][][]byte) bool {
+	bloom := c.blooms[number]
+	for _, filter := range filters {
+		if len(filter) == 0 {
+			continue
+		}
+		match := false
+		for _, key := range filter {
+			if key == nil || bloom.TestBytes(key) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
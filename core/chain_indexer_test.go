@@ -0,0 +1,171 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/event"
+)
+
+// testChainIndexBackend is a chain indexer backend recording the headers of the
+// sections it committed.
+type testChainIndexBackend struct {
+	section uint64
+	headers []common.Hash
+
+	committed map[uint64][]common.Hash
+	lock      sync.Mutex
+}
+
+func (b *testChainIndexBackend) Reset(section uint64) {
+	b.section, b.headers = section, nil
+}
+
+func (b *testChainIndexBackend) Process(header *types.Header) error {
+	b.headers = append(b.headers, header.Hash())
+	return nil
+}
+
+func (b *testChainIndexBackend) Commit() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.committed[b.section] = b.headers
+	return nil
+}
+
+func (b *testChainIndexBackend) sectionHeaders(section uint64) []common.Hash {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.committed[section]
+}
+
+// testIndexedChain is a canonical header chain stored in a database, announcing
+// its new heads on an event mux.
+type testIndexedChain struct {
+	db      ethdb.Database
+	mux     *event.TypeMux
+	headers []*types.Header
+}
+
+// extend appends a new header to the chain on top of the given number, marking
+// it canonical and announcing it as the new head.
+func (c *testIndexedChain) extend(parent uint64, extra byte) {
+	c.set(&types.Header{
+		ParentHash: c.headers[parent].Hash(),
+		Number:     new(big.Int).SetUint64(parent + 1),
+		Extra:      []byte{extra},
+	})
+}
+
+func (c *testIndexedChain) set(header *types.Header) {
+	number := header.Number.Uint64()
+	c.headers = append(c.headers[:number], header)
+
+	WriteHeader(c.db, header)
+	WriteCanonicalHash(c.db, header.Hash(), number)
+	c.mux.Post(ChainHeadEvent{Block: types.NewBlockWithHeader(header)})
+}
+
+// waitSections waits until the indexer reports the given number of sections,
+// failing the test after a timeout.
+func waitSections(t *testing.T, indexer *ChainIndexer, sections uint64) {
+	for i := 0; i < 200; i++ {
+		if have, _ := indexer.Sections(); have == sections {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	have, _ := indexer.Sections()
+	t.Fatalf("section count mismatch: have %d, want %d", have, sections)
+}
+
+// Tests that the chain indexer processes the sections of the canonical chain as
+// they get confirmed, and rolls back and reprocesses the ones affected by reorgs.
+func TestChainIndexer(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	chain := &testIndexedChain{db: db, mux: new(event.TypeMux)}
+	defer chain.mux.Stop()
+
+	chain.set(&types.Header{Number: big.NewInt(0)})
+
+	backend := &testChainIndexBackend{committed: make(map[uint64][]common.Hash)}
+	indexer := NewChainIndexer(db, ethdb.NewTable(db, "i-"), backend, 4, 2, 0, "test")
+	indexer.Start(chain.headers[0], chain.mux)
+	defer indexer.Close()
+
+	// Sections are only processed after enough confirmations
+	for i := uint64(0); i < 5; i++ {
+		chain.extend(i, 0)
+	}
+	waitSections(t, indexer, 1)
+
+	for i := uint64(5); i < 9; i++ {
+		chain.extend(i, 0)
+	}
+	waitSections(t, indexer, 2)
+
+	// Check the committed sections against the canonical chain
+	for section := uint64(0); section < 2; section++ {
+		if err := checkSection(backend.sectionHeaders(section), chain.headers[section*4:(section+1)*4]); err != nil {
+			t.Fatalf("section %d: %v", section, err)
+		}
+	}
+	if _, head := indexer.Sections(); head != chain.headers[7].Hash() {
+		t.Fatalf("section head mismatch: have %x, want %x", head, chain.headers[7].Hash())
+	}
+	// Reorg into the second section and check that it's reprocessed
+	chain.extend(5, 1)
+	waitSections(t, indexer, 1)
+
+	for i := uint64(6); i < 9; i++ {
+		chain.extend(i, 1)
+	}
+	waitSections(t, indexer, 2)
+
+	if err := checkSection(backend.sectionHeaders(1), chain.headers[4:8]); err != nil {
+		t.Fatalf("reorged section: %v", err)
+	}
+	// Restarting the indexer must retain the processed sections
+	restarted := NewChainIndexer(db, ethdb.NewTable(db, "i-"), backend, 4, 2, 0, "test")
+	defer restarted.Close()
+
+	if sections, head := restarted.Sections(); sections != 2 || head != chain.headers[7].Hash() {
+		t.Fatalf("restarted indexer mismatch: have %d/%x, want %d/%x", sections, head, 2, chain.headers[7].Hash())
+	}
+}
+
+func checkSection(have []common.Hash, want []*types.Header) error {
+	if len(have) != len(want) {
+		return fmt.Errorf("header count mismatch: have %d, want %d", len(have), len(want))
+	}
+	for i, header := range want {
+		if have[i] != header.Hash() {
+			return fmt.Errorf("header %d mismatch: have %x, want %x", i, have[i], header.Hash())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// VerifyChain checks the consistency of the canonical chain stored in the database
+// for the blocks in the range [from, to], using the given number of parallel
+// workers. For every block it checks that the canonical hash, the header, the
+// body, the total difficulty and the receipts are present and agree with each
+// other and with the parent block. If any of the blocks is corrupted, the error
+// of the lowest one is returned.
+func VerifyChain(db ethdb.Database, from, to uint64, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		next    = from     // Next block number to verify
+		lowest  = to + 1   // Lowest block number found corrupted
+		failure error      // Corruption of the lowest block
+		checked uint64     // Number of blocks verified so far
+		lock    sync.Mutex // Protects next, lowest and failure
+		wg      sync.WaitGroup
+
+		start = time.Now()
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				// Pick the next block, stopping above any corruption found
+				lock.Lock()
+				number := next
+				if number >= lowest {
+					lock.Unlock()
+					return
+				}
+				next++
+				lock.Unlock()
+
+				if err := verifyChainBlock(db, number); err != nil {
+					lock.Lock()
+					if number < lowest {
+						lowest, failure = number, err
+					}
+					lock.Unlock()
+				}
+				atomic.AddUint64(&checked, 1)
+			}
+		}()
+	}
+	// Report the progress while the workers are running
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(8 * time.Second)
+	defer ticker.Stop()
+wait:
+	for {
+		select {
+		case <-ticker.C:
+			log.Info("Verifying chain", "checked", atomic.LoadUint64(&checked), "total", to-from+1, "elapsed", common.PrettyDuration(time.Since(start)))
+		case <-done:
+			break wait
+		}
+	}
+	if failure != nil {
+		return failure
+	}
+	log.Info("Verified chain", "from", from, "to", to, "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
+// verifyChainBlock checks the consistency of the stored data of a single block of
+// the canonical chain.
+func verifyChainBlock(db ethdb.Database, number uint64) error {
+	hash := GetCanonicalHash(db, number)
+	if hash == (common.Hash{}) {
+		return fmt.Errorf("block #%d: missing canonical hash", number)
+	}
+	header := GetHeader(db, hash, number)
+	if header == nil {
+		return fmt.Errorf("block #%d [%x]: missing or undecodable header", number, hash)
+	}
+	if have := header.Hash(); have != hash {
+		return fmt.Errorf("block #%d [%x]: header hash mismatch: have %x", number, hash, have)
+	}
+	if header.Number == nil || header.Number.Uint64() != number {
+		return fmt.Errorf("block #%d [%x]: header number mismatch: have %v", number, hash, header.Number)
+	}
+	if have := GetBlockNumber(db, hash); have != number {
+		return fmt.Errorf("block #%d [%x]: block number lookup mismatch: have %d", number, hash, have)
+	}
+	// Check the linkage and the total difficulty against the parent. The total
+	// difficulty of the genesis block is whatever it was committed with, so only
+	// its presence is checked.
+	td := GetTd(db, hash, number)
+	if td == nil {
+		return fmt.Errorf("block #%d [%x]: missing total difficulty", number, hash)
+	}
+	if number > 0 {
+		parent := GetCanonicalHash(db, number-1)
+		if header.ParentHash != parent {
+			return fmt.Errorf("block #%d [%x]: parent hash mismatch: have %x, canonical %x", number, hash, header.ParentHash, parent)
+		}
+		ptd := GetTd(db, parent, number-1)
+		if ptd == nil {
+			return fmt.Errorf("block #%d [%x]: missing parent total difficulty", number, hash)
+		}
+		if want := new(big.Int).Add(ptd, header.Difficulty); td.Cmp(want) != 0 {
+			return fmt.Errorf("block #%d [%x]: total difficulty mismatch: have %v, want %v", number, hash, td, want)
+		}
+	}
+	// Check the body and the receipts against the header
+	body := GetBody(db, hash, number)
+	if body == nil {
+		return fmt.Errorf("block #%d [%x]: missing or undecodable body", number, hash)
+	}
+	if have := types.DeriveSha(types.Transactions(body.Transactions)); have != header.TxHash {
+		return fmt.Errorf("block #%d [%x]: transaction root mismatch: have %x, want %x", number, hash, have, header.TxHash)
+	}
+	if have := types.CalcUncleHash(body.Uncles); have != header.UncleHash {
+		return fmt.Errorf("block #%d [%x]: uncle hash mismatch: have %x, want %x", number, hash, have, header.UncleHash)
+	}
+	receipts := GetBlockReceipts(db, hash, number)
+	if receipts == nil && len(body.Transactions) > 0 {
+		return fmt.Errorf("block #%d [%x]: missing or undecodable receipts", number, hash)
+	}
+	if have := types.DeriveSha(receipts); have != header.ReceiptHash {
+		return fmt.Errorf("block #%d [%x]: receipt root mismatch: have %x, want %x", number, hash, have, header.ReceiptHash)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// Tests that the chain verifier accepts an intact chain and reports the lowest
+// corrupted block of a damaged one.
+func TestVerifyChain(t *testing.T) {
+	db, blockchain, blocks := newTxIndexTestChain(t, 32, 0)
+	blockchain.Stop()
+
+	if err := VerifyChain(db, 0, 32, 4); err != nil {
+		t.Fatalf("failed to verify intact chain: %v", err)
+	}
+	receipts := make(map[common.Hash]types.Receipts)
+	for _, block := range blocks {
+		receipts[block.Hash()] = GetBlockReceipts(db, block.Hash(), block.NumberU64())
+	}
+	tests := []struct {
+		corrupt func(db ethdb.Database, block *types.Block) // Damages the stored data of a block
+		restore func(db ethdb.Database, block *types.Block) // Repairs the damage
+		reason  string
+	}{
+		{
+			corrupt: func(db ethdb.Database, block *types.Block) { DeleteCanonicalHash(db, block.NumberU64()) },
+			restore: func(db ethdb.Database, block *types.Block) { WriteCanonicalHash(db, block.Hash(), block.NumberU64()) },
+			reason:  "missing canonical hash",
+		},
+		{
+			corrupt: func(db ethdb.Database, block *types.Block) { DeleteBody(db, block.Hash(), block.NumberU64()) },
+			restore: func(db ethdb.Database, block *types.Block) {
+				WriteBody(db, block.Hash(), block.NumberU64(), block.Body())
+			},
+			reason: "missing or undecodable body",
+		},
+		{
+			corrupt: func(db ethdb.Database, block *types.Block) {
+				WriteBody(db, block.Hash(), block.NumberU64(), &types.Body{Uncles: []*types.Header{blocks[0].Header()}})
+			},
+			restore: func(db ethdb.Database, block *types.Block) {
+				WriteBody(db, block.Hash(), block.NumberU64(), block.Body())
+			},
+			reason: "transaction root mismatch",
+		},
+		{
+			corrupt: func(db ethdb.Database, block *types.Block) {
+				WriteTd(db, block.Hash(), block.NumberU64(), new(big.Int).Add(GetTd(db, block.Hash(), block.NumberU64()), big.NewInt(1)))
+			},
+			restore: func(db ethdb.Database, block *types.Block) {
+				WriteTd(db, block.Hash(), block.NumberU64(), new(big.Int).Sub(GetTd(db, block.Hash(), block.NumberU64()), big.NewInt(1)))
+			},
+			reason: "total difficulty mismatch",
+		},
+		{
+			corrupt: func(db ethdb.Database, block *types.Block) { DeleteBlockReceipts(db, block.Hash(), block.NumberU64()) },
+			restore: func(db ethdb.Database, block *types.Block) {
+				WriteBlockReceipts(db, block.Hash(), block.NumberU64(), receipts[block.Hash()])
+			},
+			reason: "missing or undecodable receipts",
+		},
+	}
+	for i, tt := range tests {
+		// Damage two blocks, the lowest one must be reported
+		tt.corrupt(db, blocks[19])
+		tt.corrupt(db, blocks[9])
+
+		err := VerifyChain(db, 0, 32, 4)
+		if err == nil {
+			t.Errorf("test %d: corruption not detected", i)
+		} else if !strings.HasPrefix(err.Error(), "block #10") || !strings.Contains(err.Error(), tt.reason) {
+			t.Errorf("test %d: error mismatch: have %q, want block #10 %s", i, err, tt.reason)
+		}
+		// Blocks below the damage must pass
+		if err := VerifyChain(db, 0, 9, 4); err != nil {
+			t.Errorf("test %d: failed to verify intact range: %v", i, err)
+		}
+		tt.restore(db, blocks[9])
+		tt.restore(db, blocks[19])
+		if err := VerifyChain(db, 0, 32, 4); err != nil {
+			t.Fatalf("test %d: failed to verify restored chain: %v", i, err)
+		}
+	}
+}
+
+// Tests that the chain verifier doesn't check the total difficulty of the genesis
+// block against its difficulty, as the genesis total difficulty stored by a spec
+// without a difficulty is zero, offsetting the whole chain.
+func TestVerifyChainGenesisTd(t *testing.T) {
+	db, blockchain, blocks := newTxIndexTestChain(t, 8, 0)
+	blockchain.Stop()
+
+	genesis := blockchain.Genesis()
+	if td := GetTd(db, genesis.Hash(), 0); td.Sign() != 0 {
+		t.Fatalf("genesis total difficulty mismatch: have %v, want 0", td)
+	}
+	if err := VerifyChain(db, 0, 8, 4); err != nil {
+		t.Fatalf("failed to verify chain with zero genesis total difficulty: %v", err)
+	}
+	// Shift the whole chain to start from the genesis difficulty instead
+	offset := genesis.Difficulty()
+	WriteTd(db, genesis.Hash(), 0, offset)
+	for _, block := range blocks {
+		WriteTd(db, block.Hash(), block.NumberU64(), new(big.Int).Add(GetTd(db, block.Hash(), block.NumberU64()), offset))
+	}
+	if err := VerifyChain(db, 0, 8, 4); err != nil {
+		t.Fatalf("failed to verify chain with genesis difficulty total difficulty: %v", err)
+	}
+}
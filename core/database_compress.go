@@ -0,0 +1,287 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/compression/rle"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// compressedFormat is the leading byte of the values stored run-length encoded.
+// Block bodies and trie nodes are RLP lists, starting with a byte of at least
+// 0xc0, so the format byte tells compressed values apart from the plain ones.
+const compressedFormat byte = 0x01
+
+// compressedDatabase is a key-value store transparently compressing the block
+// bodies and the hash keyed entries (trie nodes, contract codes, transactions)
+// written into it if enabled. Compressed values are decompressed on read in any
+// case, so a database holding a mix of plain and compressed values can be used
+// with the compression turned on or off.
+type compressedDatabase struct {
+	ethdb.Database
+	compress bool // Whether to compress the values written
+}
+
+// ancientStore is the ancient chain segment store of a database, if it has one.
+type ancientStore interface {
+	ethdb.AncientReader
+	ethdb.AncientWriter
+}
+
+// compressedAncientDatabase is a compressed database wrapping one with an ancient
+// store, which it forwards so that the ancient chain segments stay reachable.
+type compressedAncientDatabase struct {
+	*compressedDatabase
+	ancientStore
+}
+
+// NewCompressedDatabase wraps a key-value store into one decoding compressed
+// block bodies and trie nodes on read, and compressing them on write if compress
+// is set. It's meant to be layered below the freezer, but forwards the ancient
+// store of the wrapped database otherwise.
+func NewCompressedDatabase(db ethdb.Database, compress bool) ethdb.Database {
+	switch cdb := db.(type) {
+	case *compressedDatabase:
+		db = cdb.Database
+	case *compressedAncientDatabase:
+		db = cdb.Database
+	}
+	cdb := &compressedDatabase{Database: db, compress: compress}
+	if ancients, ok := db.(ancientStore); ok {
+		return &compressedAncientDatabase{compressedDatabase: cdb, ancientStore: ancients}
+	}
+	return cdb
+}
+
+// uncompressedDatabase returns the key-value store below the compression layer
+// of a database, giving access to the values as stored.
+func uncompressedDatabase(db ethdb.Database) ethdb.Database {
+	switch db := db.(type) {
+	case *freezerdb:
+		return uncompressedDatabase(db.Database)
+	case *compressedDatabase:
+		return db.Database
+	case *compressedAncientDatabase:
+		return uncompressedDatabase(db.Database)
+	}
+	return db
+}
+
+// Get retrieves the given key, decompressing its value if needed.
+func (db *compressedDatabase) Get(key []byte) ([]byte, error) {
+	value, err := db.Database.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDatabaseValue(key, value)
+}
+
+// Put stores the given key, compressing its value if enabled.
+func (db *compressedDatabase) Put(key []byte, value []byte) error {
+	if db.compress && compressibleKey(key) {
+		value = encodeDatabaseValue(value)
+	}
+	return db.Database.Put(key, value)
+}
+
+// NewBatch creates a batch compressing the values put into it if enabled.
+func (db *compressedDatabase) NewBatch() ethdb.Batch {
+	return &compressedBatch{Batch: db.Database.NewBatch(), compress: db.compress}
+}
+
+// NewIterator creates an iterator over the entire key space of the database,
+// decompressing the values.
+func (db *compressedDatabase) NewIterator() ethdb.Iterator {
+	return &compressedIterator{db.Database.NewIterator()}
+}
+
+// NewIteratorWithPrefix creates an iterator over the keys starting with a
+// particular prefix, decompressing the values.
+func (db *compressedDatabase) NewIteratorWithPrefix(prefix []byte) ethdb.Iterator {
+	return &compressedIterator{db.Database.NewIteratorWithPrefix(prefix)}
+}
+
+// NewIteratorWithRange creates an iterator over the keys in the range [start,
+// limit), decompressing the values.
+func (db *compressedDatabase) NewIteratorWithRange(start, limit []byte) ethdb.Iterator {
+	return &compressedIterator{db.Database.NewIteratorWithRange(start, limit)}
+}
+
+// compressedBatch is a batch compressing the values put into it if enabled.
+type compressedBatch struct {
+	ethdb.Batch
+	compress bool
+}
+
+// Put stores the given key, compressing its value if enabled.
+func (b *compressedBatch) Put(key []byte, value []byte) error {
+	if b.compress && compressibleKey(key) {
+		value = encodeDatabaseValue(value)
+	}
+	return b.Batch.Put(key, value)
+}
+
+// compressedIterator is an iterator decompressing the values iterated over.
+type compressedIterator struct {
+	ethdb.Iterator
+}
+
+// Value returns the decompressed value of the current key/value pair, or the
+// value as stored if it can't be decompressed.
+func (it *compressedIterator) Value() []byte {
+	value := it.Iterator.Value()
+	if dec, err := decodeDatabaseValue(it.Iterator.Key(), value); err == nil {
+		return dec
+	}
+	return value
+}
+
+// compressibleKey reports whether the values of a key are subject to compression,
+// i.e. whether it's the key of a block body or a hash keyed entry.
+func compressibleKey(key []byte) bool {
+	if len(key) == common.HashLength {
+		return true
+	}
+	return len(key) == len(bodyPrefix)+8+common.HashLength && bytes.HasPrefix(key, bodyPrefix)
+}
+
+// encodeDatabaseValue compresses a value, prefixed with the format byte. Values
+// not shrinking are returned as is.
+func encodeDatabaseValue(value []byte) []byte {
+	if len(value) == 0 {
+		return value
+	}
+	enc := append([]byte{compressedFormat}, rle.Compress(value)...)
+	if len(enc) >= len(value) {
+		return value
+	}
+	return enc
+}
+
+// decodeDatabaseValue decompresses a value of a given key if it's stored in the
+// compressed format, returning plain values as is.
+func decodeDatabaseValue(key, value []byte) ([]byte, error) {
+	if len(value) == 0 || value[0] != compressedFormat || !compressibleKey(key) {
+		return value, nil
+	}
+	// Contract codes may start with the format byte by chance. Those stored plain
+	// are recognized by matching the hash they are keyed by.
+	if len(key) == common.HashLength && bytes.Equal(crypto.Keccak256(value), key) {
+		return value, nil
+	}
+	dec, err := rle.Decompress(value[1:])
+	if err != nil {
+		return nil, fmt.Errorf("corrupted compressed value of key %x: %v", key, err)
+	}
+	return dec, nil
+}
+
+// CompressionStats is the outcome of a migration of the compressible entries of
+// a database between the plain and the compressed storage formats.
+type CompressionStats struct {
+	Entries    uint64             // Number of block bodies and hash keyed entries
+	Migrated   uint64             // Number of entries whose stored format changed
+	Size       common.StorageSize // Total size of the plain values
+	Compressed common.StorageSize // Total size of the values if all compressed
+	Before     common.StorageSize // Total size of the values as stored before the migration
+	After      common.StorageSize // Total size of the values as stored after the migration
+	Encoding   time.Duration      // Time spent compressing the values
+	Decoding   time.Duration      // Time spent decompressing the compressed values
+}
+
+// MigrateDatabaseCompression rewrites the block bodies and the hash keyed entries
+// of a database in the compressed format, or in the plain one if compress isn't
+// set, measuring the space saved and the time spent encoding and decoding. The
+// database is only measured if dryRun is set.
+func MigrateDatabaseCompression(db ethdb.Database, compress, dryRun bool) (*CompressionStats, error) {
+	db = uncompressedDatabase(db)
+
+	var (
+		stats  = new(CompressionStats)
+		batch  = db.NewBatch()
+		start  = time.Now()
+		logged = time.Now()
+	)
+	it := db.NewIterator()
+	defer it.Release()
+
+	for it.Next() {
+		key, stored := it.Key(), it.Value()
+		if !compressibleKey(key) {
+			continue
+		}
+		value, err := decodeDatabaseValue(key, stored)
+		if err != nil {
+			return nil, err
+		}
+		// Measure the compression, ensuring it round-trips before storing anything
+		encStart := time.Now()
+		enc := encodeDatabaseValue(value)
+		decStart := time.Now()
+		dec, err := decodeDatabaseValue(key, enc)
+		stats.Encoding += decStart.Sub(encStart)
+		stats.Decoding += time.Since(decStart)
+
+		if err != nil || !bytes.Equal(dec, value) {
+			return nil, fmt.Errorf("compression of key %x doesn't round-trip: %v", key, err)
+		}
+
+		migrated := value
+		if compress {
+			migrated = enc
+		}
+		stats.Entries++
+		stats.Size += common.StorageSize(len(value))
+		stats.Compressed += common.StorageSize(len(enc))
+		stats.Before += common.StorageSize(len(stored))
+		stats.After += common.StorageSize(len(migrated))
+
+		if !bytes.Equal(migrated, stored) {
+			stats.Migrated++
+			if !dryRun {
+				if err := batch.Put(key, migrated); err != nil {
+					return nil, err
+				}
+				if batch.ValueSize() > ethdb.IdealBatchSize {
+					if err := batch.Write(); err != nil {
+						return nil, err
+					}
+					batch.Reset()
+				}
+			}
+		}
+		if time.Since(logged) > inspectLogInterval {
+			log.Info("Migrating database compression", "entries", stats.Entries, "migrated", stats.Migrated, "elapsed", common.PrettyDuration(time.Since(start)))
+			logged = time.Now()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	if err := batch.Write(); err != nil {
+		return nil, err
+	}
+	log.Info("Migrated database compression", "entries", stats.Entries, "migrated", stats.Migrated, "before", stats.Before, "after", stats.After, "elapsed", common.PrettyDuration(time.Since(start)))
+	return stats, nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// countCompressed returns the number of values stored in the compressed format.
+func countCompressed(db *ethdb.MemDatabase) (count int) {
+	for _, key := range db.Keys() {
+		value, _ := db.Get(key)
+		if compressibleKey(key) && len(value) > 0 && value[0] == compressedFormat && !bytes.Equal(crypto.Keccak256(value), key) {
+			count++
+		}
+	}
+	return count
+}
+
+// checkCompressedChain verifies that the blocks and the states of a chain can be
+// read back from a database.
+func checkCompressedChain(t *testing.T, db ethdb.Database, blocks []*types.Block) {
+	if err := VerifyChain(db, 0, uint64(len(blocks)), 2); err != nil {
+		t.Fatalf("failed to verify chain: %v", err)
+	}
+	if _, err := state.VerifyState(db, blocks[len(blocks)-1].Root(), 2); err != nil {
+		t.Fatalf("failed to verify state: %v", err)
+	}
+	for _, block := range blocks {
+		if body := GetBody(db, block.Hash(), block.NumberU64()); body == nil || types.DeriveSha(types.Transactions(body.Transactions)) != block.TxHash() {
+			t.Fatalf("block #%d: body mismatch", block.NumberU64())
+		}
+	}
+}
+
+// Tests that a chain stored in a compressed database can be read back with the
+// compression turned on or off, and migrated between the storage formats.
+func TestCompressedDatabase(t *testing.T) {
+	var (
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  GenesisAlloc{address: {Balance: big.NewInt(1000000000)}},
+		}
+		gendb, _ = ethdb.NewMemDatabase()
+		memdb, _ = ethdb.NewMemDatabase()
+		db       = NewCompressedDatabase(memdb, true)
+	)
+	blocks, _ := GenerateChain(gspec.Config, gspec.MustCommit(gendb), gendb, 16, func(i int, block *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.Address{byte(i)}, big.NewInt(1000), big.NewInt(21000), new(big.Int), nil), types.HomesteadSigner{}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.AddTx(tx)
+	})
+	gspec.MustCommit(db)
+	blockchain, _ := NewBlockChain(db, &CacheConfig{Disabled: true}, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	blockchain.Stop()
+
+	if countCompressed(memdb) == 0 {
+		t.Fatalf("no values stored compressed")
+	}
+	// Plain contract codes starting with the format byte must be read unchanged
+	code := []byte{compressedFormat, 0xfe, 0x10}
+	memdb.Put(crypto.Keccak256(code), code)
+	if have, _ := db.Get(crypto.Keccak256(code)); !bytes.Equal(have, code) {
+		t.Fatalf("plain code mismatch: have %x, want %x", have, code)
+	}
+	checkCompressedChain(t, db, blocks)
+	checkCompressedChain(t, NewCompressedDatabase(memdb, false), blocks)
+
+	compressed := InspectDatabase(db)
+
+	// Measure the database without modifying it
+	stats, err := MigrateDatabaseCompression(db, true, true)
+	if err != nil {
+		t.Fatalf("failed to measure database: %v", err)
+	}
+	if stats.Migrated != 0 || stats.Before != stats.After || stats.Compressed >= stats.Size {
+		t.Fatalf("compressed database stats mismatch: %+v", stats)
+	}
+	if _, err := MigrateDatabaseCompression(db, false, true); err != nil {
+		t.Fatalf("failed to measure database: %v", err)
+	}
+	if countCompressed(memdb) == 0 {
+		t.Fatalf("database modified by dry run")
+	}
+	// Decompress the database and compress it back
+	if stats, err = MigrateDatabaseCompression(db, false, false); err != nil {
+		t.Fatalf("failed to decompress database: %v", err)
+	}
+	if stats.Migrated == 0 || stats.After != stats.Size || stats.Before >= stats.After {
+		t.Fatalf("decompressed database stats mismatch: %+v", stats)
+	}
+	if n := countCompressed(memdb); n != 0 {
+		t.Fatalf("%d values left compressed", n)
+	}
+	checkCompressedChain(t, memdb, blocks)
+
+	if stats, err = MigrateDatabaseCompression(memdb, true, false); err != nil {
+		t.Fatalf("failed to compress database: %v", err)
+	}
+	if stats.After != stats.Compressed || stats.After >= stats.Before {
+		t.Fatalf("compressed database stats mismatch: %+v", stats)
+	}
+	checkCompressedChain(t, db, blocks)
+
+	// The inspection must classify the compressed entries as the plain ones
+	plain, _ := ethdb.NewMemDatabase()
+	for _, key := range memdb.Keys() {
+		value, _ := db.Get(key)
+		plain.Put(key, value)
+	}
+	for i, stat := range InspectDatabase(plain) {
+		if compressed[i].Count != stat.Count {
+			t.Errorf("%s: item count mismatch: have %d, want %d", stat.Category, compressed[i].Count, stat.Count)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// The categories the database content is broken down into by InspectDatabase.
+const (
+	StatHeaders       = "Headers"
+	StatBodies        = "Bodies"
+	StatReceipts      = "Receipts"
+	StatDifficulties  = "Difficulties"
+	StatCanonicalHash = "Canonical hashes"
+	StatBlockNumbers  = "Block number lookups"
+	StatTxLookups     = "Transaction lookups"
+	StatTransactions  = "Transactions"
+	StatStateDiffs    = "State diffs"
+	StatBloomBits     = "Bloom bits"
+	StatTrieNodes     = "Trie nodes"
+	StatContractCodes = "Contract codes"
+	StatPreimages     = "Trie preimages"
+	StatSnapshot      = "State snapshot"
+	StatMipmaps       = "Legacy mipmap blooms"
+	StatLegacy        = "Legacy chain data"
+	StatMetadata      = "Metadata"
+	StatUnaccounted   = "Unaccounted"
+)
+
+// inspectLogInterval is the time between progress reports of database inspection.
+const inspectLogInterval = 8 * time.Second
+
+var (
+	// snapshotAccountPrefix and snapshotStoragePrefix mirror the key layout of
+	// the flat state snapshot, which is private to the snapshot package.
+	snapshotAccountPrefix = []byte("a") // snapshotAccountPrefix + account hash -> account
+	snapshotStoragePrefix = []byte("o") // snapshotStoragePrefix + account hash + storage hash -> slot
+	snapshotMetaPrefix    = []byte("Snapshot")
+
+	mipmapPrefix  = []byte("mipmap-log-bloom-")
+	legacyTxMeta  = []byte("receipts-")
+	upgradePrefix = []byte("dbUpgrade_")
+
+	// metadataKeys are the single entries tracking the state of the chain.
+	metadataKeys = [][]byte{headHeaderKey, headBlockKey, headFastKey, txIndexTailKey, stateDiffTailKey, blockChainVersionKey}
+)
+
+// DatabaseStat is the number of entries and their total size in a category of
+// the database content.
+type DatabaseStat struct {
+	Category string
+	Count    uint64
+	Size     common.StorageSize
+}
+
+// InspectDatabase iterates over the entire database, tallying the number and the
+// size of the entries in each category of the data stored by the chain. Entries
+// not matching any known layout are reported as unaccounted. Compressed entries
+// are reported with their stored size.
+func InspectDatabase(db ethdb.Database) []DatabaseStat {
+	categories := []string{
+		StatHeaders, StatBodies, StatReceipts, StatDifficulties, StatCanonicalHash,
+		StatBlockNumbers, StatTxLookups, StatTransactions, StatStateDiffs, StatBloomBits,
+		StatTrieNodes, StatContractCodes, StatPreimages, StatSnapshot, StatMipmaps,
+		StatLegacy, StatMetadata, StatUnaccounted,
+	}
+	stats := make(map[string]*DatabaseStat)
+	for _, category := range categories {
+		stats[category] = &DatabaseStat{Category: category}
+	}
+	var (
+		start  = time.Now()
+		logged = time.Now()
+		count  uint64
+	)
+	it := uncompressedDatabase(db).NewIterator()
+	defer it.Release()
+
+	for it.Next() {
+		key, value := it.Key(), it.Value()
+
+		plain, err := decodeDatabaseValue(key, value)
+		if err != nil {
+			plain = value
+		}
+		stat := stats[classifyDatabaseEntry(key, plain)]
+		stat.Count++
+		stat.Size += common.StorageSize(len(key) + len(value))
+
+		if count++; time.Since(logged) > inspectLogInterval {
+			log.Info("Inspecting database", "count", count, "elapsed", common.PrettyDuration(time.Since(start)))
+			logged = time.Now()
+		}
+	}
+	result := make([]DatabaseStat, len(categories))
+	for i, category := range categories {
+		result[i] = *stats[category]
+	}
+	return result
+}
+
+// classifyDatabaseEntry returns the category of a database entry based on the
+// layout of its key, looking into the value only for hash keyed entries.
+func classifyDatabaseEntry(key, value []byte) string {
+	switch {
+	case bytes.HasPrefix(key, mipmapPrefix):
+		return StatMipmaps
+	case bytes.HasPrefix(key, oldBlockPrefix) || bytes.HasPrefix(key, legacyTxMeta):
+		return StatLegacy
+	case bytes.HasPrefix(key, []byte(preimagePrefix)) && len(key) == len(preimagePrefix)+common.HashLength:
+		return StatPreimages
+	case bytes.HasPrefix(key, configPrefix) || bytes.HasPrefix(key, BloomBitsIndexPrefix) || bytes.HasPrefix(key, upgradePrefix):
+		return StatMetadata
+	case bytes.HasPrefix(key, snapshotMetaPrefix):
+		return StatSnapshot
+
+	case len(key) == common.HashLength+len(txMetaSuffix) && bytes.HasSuffix(key, txMetaSuffix) && rlpListItems(value) == 3:
+		return StatTxLookups
+
+	case bytes.HasPrefix(key, headerPrefix) && len(key) == len(headerPrefix)+8+common.HashLength:
+		return StatHeaders
+	case bytes.HasPrefix(key, headerPrefix) && bytes.HasSuffix(key, tdSuffix) && len(key) == len(headerPrefix)+8+common.HashLength+len(tdSuffix):
+		return StatDifficulties
+	case bytes.HasPrefix(key, headerPrefix) && bytes.HasSuffix(key, numSuffix) && len(key) == len(headerPrefix)+8+len(numSuffix):
+		return StatCanonicalHash
+	case bytes.HasPrefix(key, blockHashPrefix) && len(key) == len(blockHashPrefix)+common.HashLength:
+		return StatBlockNumbers
+	case bytes.HasPrefix(key, bodyPrefix) && len(key) == len(bodyPrefix)+8+common.HashLength:
+		return StatBodies
+	case bytes.HasPrefix(key, blockReceiptsPrefix) && len(key) == len(blockReceiptsPrefix)+8+common.HashLength:
+		return StatReceipts
+	case bytes.HasPrefix(key, stateDiffPrefix) && len(key) == len(stateDiffPrefix)+8+common.HashLength:
+		return StatStateDiffs
+	case bytes.HasPrefix(key, bloomBitsPrefix) && len(key) == len(bloomBitsPrefix)+2+8+common.HashLength:
+		return StatBloomBits
+	case bytes.HasPrefix(key, snapshotAccountPrefix) && len(key) == len(snapshotAccountPrefix)+common.HashLength:
+		return StatSnapshot
+	case bytes.HasPrefix(key, snapshotStoragePrefix) && len(key) == len(snapshotStoragePrefix)+2*common.HashLength:
+		return StatSnapshot
+
+	case len(key) == common.HashLength:
+		// Trie nodes, contract codes and transactions are all keyed by the hash
+		// of their content, tell them apart by the shape of the value
+		switch items := rlpListItems(value); {
+		case items == 2 || items == 17:
+			return StatTrieNodes
+		case items > 0:
+			return StatTransactions
+		default:
+			return StatContractCodes
+		}
+	}
+	for _, meta := range metadataKeys {
+		if bytes.Equal(key, meta) {
+			return StatMetadata
+		}
+	}
+	return StatUnaccounted
+}
+
+// rlpListItems returns the number of items in an RLP encoded list, or -1 if the
+// data isn't a well formed list.
+func rlpListItems(data []byte) int {
+	content, rest, err := rlp.SplitList(data)
+	if err != nil || len(rest) > 0 {
+		return -1
+	}
+	items, err := rlp.CountValues(content)
+	if err != nil {
+		return -1
+	}
+	return items
+}
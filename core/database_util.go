@@ -23,9 +23,9 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
-	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/log"
@@ -39,19 +39,29 @@ var (
 	headBlockKey  = []byte("LastBlock")
 	headFastKey   = []byte("LastFast")
 
+	// txIndexTailKey tracks the oldest block whose transactions are indexed.
+	txIndexTailKey = []byte("TransactionIndexTail")
+
+	// stateDiffTailKey tracks the oldest block whose state diff may be retained.
+	stateDiffTailKey = []byte("StateDiffTail")
+
+	blockChainVersionKey = []byte("BlockchainVersion")
+
 	headerPrefix        = []byte("h")   // headerPrefix + num (uint64 big endian) + hash -> header
 	tdSuffix            = []byte("t")   // headerPrefix + num (uint64 big endian) + hash + tdSuffix -> td
 	numSuffix           = []byte("n")   // headerPrefix + num (uint64 big endian) + numSuffix -> hash
 	blockHashPrefix     = []byte("H")   // blockHashPrefix + hash -> num (uint64 big endian)
 	bodyPrefix          = []byte("b")   // bodyPrefix + num (uint64 big endian) + hash -> block body
 	blockReceiptsPrefix = []byte("r")   // blockReceiptsPrefix + num (uint64 big endian) + hash -> block receipts
+	stateDiffPrefix     = []byte("d")   // stateDiffPrefix + num (uint64 big endian) + hash -> block state diff
+	bloomBitsPrefix     = []byte("B")   // bloomBitsPrefix + bit (uint16 big endian) + section (uint64 big endian) + hash -> bloom bits
 	preimagePrefix      = "secure-key-" // preimagePrefix + hash -> preimage
 
-	txMetaSuffix   = []byte{0x01}
-	receiptsPrefix = []byte("receipts-")
+	txMetaSuffix = []byte{0x01}
 
-	mipmapPre    = []byte("mipmap-log-bloom-")
-	MIPMapLevels = []uint64{1000000, 500000, 100000, 50000, 1000}
+	// BloomBitsIndexPrefix is the data table of the chain indexer tracking the
+	// progress of the bloom bits index.
+	BloomBitsIndexPrefix = []byte("iB")
 
 	configPrefix = []byte("ethereum-config-") // config prefix for the db
 
@@ -66,8 +76,6 @@ var (
 
 	ErrChainConfigNotFound = errors.New("ChainConfig not found") // general config not found error
 
-	mipmapBloomMu sync.Mutex // protect against race condition when updating mipmap blooms
-
 	preimageCounter    = metrics.NewCounter("db/preimage/total")
 	preimageHitCounter = metrics.NewCounter("db/preimage/hits")
 )
@@ -113,6 +121,35 @@ func GetBlockNumber(db ethdb.Database, hash common.Hash) uint64 {
 	return binary.BigEndian.Uint64(data)
 }
 
+// getAncient retrieves an item of the given kind belonging to a canonical block
+// from the ancient store, or nil if the database has none or the block with the
+// given hash is not frozen.
+func getAncient(db ethdb.Database, kind string, hash common.Hash, number uint64) []byte {
+	reader, ok := db.(ethdb.AncientReader)
+	if !ok {
+		return nil
+	}
+	if frozen, _ := reader.Ancient(freezerHashTable, number); !bytes.Equal(frozen, hash[:]) {
+		return nil
+	}
+	data, _ := reader.Ancient(kind, number)
+	return data
+}
+
+// hasAncient verifies the existence of an item of the given kind belonging to a
+// canonical block in the ancient store.
+func hasAncient(db ethdb.Database, kind string, hash common.Hash, number uint64) bool {
+	reader, ok := db.(ethdb.AncientReader)
+	if !ok {
+		return false
+	}
+	if frozen, _ := reader.Ancient(freezerHashTable, number); !bytes.Equal(frozen, hash[:]) {
+		return false
+	}
+	has, err := reader.HasAncient(kind, number)
+	return has && err == nil
+}
+
 // GetHeadHeaderHash retrieves the hash of the current canonical head block's
 // header. The difference between this and GetHeadBlockHash is that whereas the
 // last block hash is only updated upon a full block import, the last header
@@ -151,12 +188,27 @@ func GetHeadFastBlockHash(db ethdb.Database) common.Hash {
 // if the header's not found.
 func GetHeaderRLP(db ethdb.Database, hash common.Hash, number uint64) rlp.RawValue {
 	data, _ := db.Get(append(append(headerPrefix, encodeBlockNumber(number)...), hash.Bytes()...))
+	if len(data) == 0 {
+		data = getAncient(db, freezerHeaderTable, hash, number)
+	}
 	if len(data) == 0 {
 		data, _ = db.Get(append(append(oldBlockPrefix, hash.Bytes()...), oldHeaderSuffix...))
 	}
 	return data
 }
 
+// HasHeader verifies the existence of a block header corresponding to the hash.
+func HasHeader(db ethdb.Database, hash common.Hash, number uint64) bool {
+	if has, err := db.Has(append(append(headerPrefix, encodeBlockNumber(number)...), hash.Bytes()...)); has && err == nil {
+		return true
+	}
+	if hasAncient(db, freezerHeaderTable, hash, number) {
+		return true
+	}
+	has, err := db.Has(append(append(oldBlockPrefix, hash.Bytes()...), oldHeaderSuffix...))
+	return has && err == nil
+}
+
 // GetHeader retrieves the block header corresponding to the hash, nil if none
 // found.
 func GetHeader(db ethdb.Database, hash common.Hash, number uint64) *types.Header {
@@ -175,12 +227,27 @@ func GetHeader(db ethdb.Database, hash common.Hash, number uint64) *types.Header
 // GetBodyRLP retrieves the block body (transactions and uncles) in RLP encoding.
 func GetBodyRLP(db ethdb.Database, hash common.Hash, number uint64) rlp.RawValue {
 	data, _ := db.Get(append(append(bodyPrefix, encodeBlockNumber(number)...), hash.Bytes()...))
+	if len(data) == 0 {
+		data = getAncient(db, freezerBodiesTable, hash, number)
+	}
 	if len(data) == 0 {
 		data, _ = db.Get(append(append(oldBlockPrefix, hash.Bytes()...), oldBodySuffix...))
 	}
 	return data
 }
 
+// HasBody verifies the existence of a block body corresponding to the hash.
+func HasBody(db ethdb.Database, hash common.Hash, number uint64) bool {
+	if has, err := db.Has(append(append(bodyPrefix, encodeBlockNumber(number)...), hash.Bytes()...)); has && err == nil {
+		return true
+	}
+	if hasAncient(db, freezerBodiesTable, hash, number) {
+		return true
+	}
+	has, err := db.Has(append(append(oldBlockPrefix, hash.Bytes()...), oldBodySuffix...))
+	return has && err == nil
+}
+
 // GetBody retrieves the block body (transactons, uncles) corresponding to the
 // hash, nil if none found.
 func GetBody(db ethdb.Database, hash common.Hash, number uint64) *types.Body {
@@ -200,6 +267,9 @@ func GetBody(db ethdb.Database, hash common.Hash, number uint64) *types.Body {
 // none found.
 func GetTd(db ethdb.Database, hash common.Hash, number uint64) *big.Int {
 	data, _ := db.Get(append(append(append(headerPrefix, encodeBlockNumber(number)...), hash[:]...), tdSuffix...))
+	if len(data) == 0 {
+		data = getAncient(db, freezerDifficultyTable, hash, number)
+	}
 	if len(data) == 0 {
 		data, _ = db.Get(append(append(oldBlockPrefix, hash.Bytes()...), oldTdSuffix...))
 		if len(data) == 0 {
@@ -234,10 +304,14 @@ func GetBlock(db ethdb.Database, hash common.Hash, number uint64) *types.Block {
 	return types.NewBlockWithHeader(header).WithBody(body.Transactions, body.Uncles)
 }
 
-// GetBlockReceipts retrieves the receipts generated by the transactions included
-// in a block given by its hash.
-func GetBlockReceipts(db ethdb.Database, hash common.Hash, number uint64) types.Receipts {
+// GetRawBlockReceipts retrieves the receipts generated by the transactions
+// included in a block given by its hash, without the fields derivable from the
+// block itself.
+func GetRawBlockReceipts(db ethdb.Database, hash common.Hash, number uint64) types.Receipts {
 	data, _ := db.Get(append(append(blockReceiptsPrefix, encodeBlockNumber(number)...), hash[:]...))
+	if len(data) == 0 {
+		data = getAncient(db, freezerReceiptTable, hash, number)
+	}
 	if len(data) == 0 {
 		data, _ = db.Get(append(oldBlockReceiptsPrefix, hash.Bytes()...))
 		if len(data) == 0 {
@@ -256,6 +330,66 @@ func GetBlockReceipts(db ethdb.Database, hash common.Hash, number uint64) types.
 	return receipts
 }
 
+// GetBlockReceipts retrieves the receipts generated by the transactions included
+// in a block given by its hash, recomputing the fields derived from the block.
+// If the receipts or the block body are not found, nil is returned.
+func GetBlockReceipts(db ethdb.Database, hash common.Hash, number uint64) types.Receipts {
+	receipts := GetRawBlockReceipts(db, hash, number)
+	if receipts == nil {
+		return nil
+	}
+	body := GetBody(db, hash, number)
+	if body == nil {
+		log.Error("Missing body of block receipts", "number", number, "hash", hash)
+		return nil
+	}
+	if err := DeriveReceiptsData(hash, number, body.Transactions, receipts); err != nil {
+		log.Error("Failed to derive block receipts fields", "number", number, "hash", hash, "err", err)
+		return nil
+	}
+	return receipts
+}
+
+// GetStateDiff retrieves the changes a block made to the state, as recorded
+// during its import. If it is not found, nil is returned, but the diff of a
+// block which didn't change the state is empty, not nil.
+func GetStateDiff(db ethdb.Database, hash common.Hash, number uint64) []*state.AccountDiff {
+	data, _ := db.Get(stateDiffKey(hash, number))
+	if len(data) == 0 {
+		return nil
+	}
+	diff := []*state.AccountDiff{}
+	if err := rlp.DecodeBytes(data, &diff); err != nil {
+		log.Error("Invalid state diff RLP", "hash", hash, "err", err)
+		return nil
+	}
+	return diff
+}
+
+// txLookupEntry is the positional metadata stored along with a transaction,
+// locating it within the canonical chain.
+type txLookupEntry struct {
+	BlockHash  common.Hash
+	BlockIndex uint64
+	Index      uint64
+}
+
+// GetTxLookupEntry retrieves the block hash, block number and position within
+// the block of a transaction from its lookup entry. If the entry is not found,
+// the zero hash is returned.
+func GetTxLookupEntry(db ethdb.Database, hash common.Hash) (common.Hash, uint64, uint64) {
+	data, _ := db.Get(append(hash.Bytes(), txMetaSuffix...))
+	if len(data) == 0 {
+		return common.Hash{}, 0, 0
+	}
+	var entry txLookupEntry
+	if err := rlp.DecodeBytes(data, &entry); err != nil {
+		log.Error("Invalid lookup entry RLP", "hash", hash, "err", err)
+		return common.Hash{}, 0, 0
+	}
+	return entry.BlockHash, entry.BlockIndex, entry.Index
+}
+
 // GetTransaction retrieves a specific transaction from the database, along with
 // its added positional metadata.
 func GetTransaction(db ethdb.Database, hash common.Hash) (*types.Transaction, common.Hash, uint64, uint64) {
@@ -269,37 +403,30 @@ func GetTransaction(db ethdb.Database, hash common.Hash) (*types.Transaction, co
 		return nil, common.Hash{}, 0, 0
 	}
 	// Retrieve the blockchain positional metadata
-	data, _ = db.Get(append(hash.Bytes(), txMetaSuffix...))
-	if len(data) == 0 {
-		return nil, common.Hash{}, 0, 0
-	}
-	var meta struct {
-		BlockHash  common.Hash
-		BlockIndex uint64
-		Index      uint64
-	}
-	if err := rlp.DecodeBytes(data, &meta); err != nil {
+	blockHash, blockNumber, index := GetTxLookupEntry(db, hash)
+	if blockHash == (common.Hash{}) {
 		return nil, common.Hash{}, 0, 0
 	}
-	return &tx, meta.BlockHash, meta.BlockIndex, meta.Index
+	return &tx, blockHash, blockNumber, index
 }
 
-// GetReceipt returns a receipt by hash
+// GetReceipt retrieves a specific transaction receipt from the database, locating
+// the receipts of its block through the transaction lookup entry.
 func GetReceipt(db ethdb.Database, hash common.Hash) *types.Receipt {
-	data, _ := db.Get(append(receiptsPrefix, hash[:]...))
-	if len(data) == 0 {
+	blockHash, blockNumber, index := GetTxLookupEntry(db, hash)
+	if blockHash == (common.Hash{}) {
 		return nil
 	}
-	var receipt types.ReceiptForStorage
-	err := rlp.DecodeBytes(data, &receipt)
-	if err != nil {
-		log.Error("Invalid receipt RLP", "hash", hash, "err", err)
+	receipts := GetBlockReceipts(db, blockHash, blockNumber)
+	if len(receipts) <= int(index) {
+		log.Error("Receipt referenced missing", "number", blockNumber, "hash", blockHash, "index", index)
+		return nil
 	}
-	return (*types.Receipt)(&receipt)
+	return receipts[index]
 }
 
 // WriteCanonicalHash stores the canonical hash for the given block number.
-func WriteCanonicalHash(db ethdb.Database, hash common.Hash, number uint64) error {
+func WriteCanonicalHash(db ethdb.Putter, hash common.Hash, number uint64) error {
 	key := append(append(headerPrefix, encodeBlockNumber(number)...), numSuffix...)
 	if err := db.Put(key, hash.Bytes()); err != nil {
 		log.Crit("Failed to store number to hash mapping", "err", err)
@@ -308,7 +435,7 @@ func WriteCanonicalHash(db ethdb.Database, hash common.Hash, number uint64) erro
 }
 
 // WriteHeadHeaderHash stores the head header's hash.
-func WriteHeadHeaderHash(db ethdb.Database, hash common.Hash) error {
+func WriteHeadHeaderHash(db ethdb.Putter, hash common.Hash) error {
 	if err := db.Put(headHeaderKey, hash.Bytes()); err != nil {
 		log.Crit("Failed to store last header's hash", "err", err)
 	}
@@ -316,7 +443,7 @@ func WriteHeadHeaderHash(db ethdb.Database, hash common.Hash) error {
 }
 
 // WriteHeadBlockHash stores the head block's hash.
-func WriteHeadBlockHash(db ethdb.Database, hash common.Hash) error {
+func WriteHeadBlockHash(db ethdb.Putter, hash common.Hash) error {
 	if err := db.Put(headBlockKey, hash.Bytes()); err != nil {
 		log.Crit("Failed to store last block's hash", "err", err)
 	}
@@ -324,7 +451,7 @@ func WriteHeadBlockHash(db ethdb.Database, hash common.Hash) error {
 }
 
 // WriteHeadFastBlockHash stores the fast head block's hash.
-func WriteHeadFastBlockHash(db ethdb.Database, hash common.Hash) error {
+func WriteHeadFastBlockHash(db ethdb.Putter, hash common.Hash) error {
 	if err := db.Put(headFastKey, hash.Bytes()); err != nil {
 		log.Crit("Failed to store last fast block's hash", "err", err)
 	}
@@ -332,7 +459,7 @@ func WriteHeadFastBlockHash(db ethdb.Database, hash common.Hash) error {
 }
 
 // WriteHeader serializes a block header into the database.
-func WriteHeader(db ethdb.Database, header *types.Header) error {
+func WriteHeader(db ethdb.Putter, header *types.Header) error {
 	data, err := rlp.EncodeToBytes(header)
 	if err != nil {
 		return err
@@ -352,7 +479,7 @@ func WriteHeader(db ethdb.Database, header *types.Header) error {
 }
 
 // WriteBody serializes the body of a block into the database.
-func WriteBody(db ethdb.Database, hash common.Hash, number uint64, body *types.Body) error {
+func WriteBody(db ethdb.Putter, hash common.Hash, number uint64, body *types.Body) error {
 	data, err := rlp.EncodeToBytes(body)
 	if err != nil {
 		return err
@@ -361,7 +488,7 @@ func WriteBody(db ethdb.Database, hash common.Hash, number uint64, body *types.B
 }
 
 // WriteBodyRLP writes a serialized body of a block into the database.
-func WriteBodyRLP(db ethdb.Database, hash common.Hash, number uint64, rlp rlp.RawValue) error {
+func WriteBodyRLP(db ethdb.Putter, hash common.Hash, number uint64, rlp rlp.RawValue) error {
 	key := append(append(bodyPrefix, encodeBlockNumber(number)...), hash.Bytes()...)
 	if err := db.Put(key, rlp); err != nil {
 		log.Crit("Failed to store block body", "err", err)
@@ -370,7 +497,7 @@ func WriteBodyRLP(db ethdb.Database, hash common.Hash, number uint64, rlp rlp.Ra
 }
 
 // WriteTd serializes the total difficulty of a block into the database.
-func WriteTd(db ethdb.Database, hash common.Hash, number uint64, td *big.Int) error {
+func WriteTd(db ethdb.Putter, hash common.Hash, number uint64, td *big.Int) error {
 	data, err := rlp.EncodeToBytes(td)
 	if err != nil {
 		return err
@@ -383,7 +510,7 @@ func WriteTd(db ethdb.Database, hash common.Hash, number uint64, td *big.Int) er
 }
 
 // WriteBlock serializes a block into the database, header and body separately.
-func WriteBlock(db ethdb.Database, block *types.Block) error {
+func WriteBlock(db ethdb.Putter, block *types.Block) error {
 	// Store the body first to retain database consistency
 	if err := WriteBody(db, block.Hash(), block.NumberU64(), block.Body()); err != nil {
 		return err
@@ -396,9 +523,9 @@ func WriteBlock(db ethdb.Database, block *types.Block) error {
 }
 
 // WriteBlockReceipts stores all the transaction receipts belonging to a block
-// as a single receipt slice. This is used during chain reorganisations for
-// rescheduling dropped transactions.
-func WriteBlockReceipts(db ethdb.Database, hash common.Hash, number uint64, receipts types.Receipts) error {
+// as a single receipt slice, dropping the fields derivable from the block. This
+// is used during chain reorganisations for rescheduling dropped transactions.
+func WriteBlockReceipts(db ethdb.Putter, hash common.Hash, number uint64, receipts types.Receipts) error {
 	// Convert the receipts into their storage form and serialize them
 	storageReceipts := make([]*types.ReceiptForStorage, len(receipts))
 	for i, receipt := range receipts {
@@ -416,165 +543,201 @@ func WriteBlockReceipts(db ethdb.Database, hash common.Hash, number uint64, rece
 	return nil
 }
 
+// WriteStateDiff stores the changes a block made to the state into the database.
+func WriteStateDiff(db ethdb.Putter, hash common.Hash, number uint64, diff []*state.AccountDiff) error {
+	data, err := rlp.EncodeToBytes(diff)
+	if err != nil {
+		return err
+	}
+	if err := db.Put(stateDiffKey(hash, number), data); err != nil {
+		log.Crit("Failed to store state diff", "err", err)
+	}
+	return nil
+}
+
 // WriteTransactions stores the transactions associated with a specific block
 // into the given database. Beside writing the transaction, the function also
 // stores a metadata entry along with the transaction, detailing the position
 // of this within the blockchain.
 func WriteTransactions(db ethdb.Database, block *types.Block) error {
 	batch := db.NewBatch()
+	if err := writeTxLookupEntries(batch, block.Hash(), block.NumberU64(), block.Transactions()); err != nil {
+		return err
+	}
+	// Write the scheduled data into the database
+	if err := batch.Write(); err != nil {
+		log.Crit("Failed to store transactions", "err", err)
+	}
+	return nil
+}
 
+// writeTxLookupEntries queues up the transactions of a block along with their
+// positional metadata for storage.
+func writeTxLookupEntries(db ethdb.Putter, hash common.Hash, number uint64, txs types.Transactions) error {
 	// Iterate over each transaction and encode it with its metadata
-	for i, tx := range block.Transactions() {
+	for i, tx := range txs {
 		// Encode and queue up the transaction for storage
 		data, err := rlp.EncodeToBytes(tx)
 		if err != nil {
 			return err
 		}
-		if err = batch.Put(tx.Hash().Bytes(), data); err != nil {
+		if err = db.Put(tx.Hash().Bytes(), data); err != nil {
 			return err
 		}
 		// Encode and queue up the transaction metadata for storage
-		meta := struct {
-			BlockHash  common.Hash
-			BlockIndex uint64
-			Index      uint64
-		}{
-			BlockHash:  block.Hash(),
-			BlockIndex: block.NumberU64(),
+		meta := txLookupEntry{
+			BlockHash:  hash,
+			BlockIndex: number,
 			Index:      uint64(i),
 		}
 		data, err = rlp.EncodeToBytes(meta)
 		if err != nil {
 			return err
 		}
-		if err := batch.Put(append(tx.Hash().Bytes(), txMetaSuffix...), data); err != nil {
+		if err := db.Put(append(tx.Hash().Bytes(), txMetaSuffix...), data); err != nil {
 			return err
 		}
 	}
-	// Write the scheduled data into the database
-	if err := batch.Write(); err != nil {
-		log.Crit("Failed to store transactions", "err", err)
-	}
 	return nil
 }
 
-// WriteReceipt stores a single transaction receipt into the database.
-func WriteReceipt(db ethdb.Database, receipt *types.Receipt) error {
-	storageReceipt := (*types.ReceiptForStorage)(receipt)
-	data, err := rlp.EncodeToBytes(storageReceipt)
-	if err != nil {
-		return err
+// GetTxIndexTail retrieves the number of the oldest block whose transactions are
+// indexed, or nil if the index has never been bounded (all blocks are indexed).
+func GetTxIndexTail(db ethdb.Database) *uint64 {
+	data, _ := db.Get(txIndexTailKey)
+	if len(data) != 8 {
+		return nil
 	}
-	return db.Put(append(receiptsPrefix, receipt.TxHash.Bytes()...), data)
+	number := binary.BigEndian.Uint64(data)
+	return &number
 }
 
-// WriteReceipts stores a batch of transaction receipts into the database.
-func WriteReceipts(db ethdb.Database, receipts types.Receipts) error {
-	batch := db.NewBatch()
-
-	// Iterate over all the receipts and queue them for database injection
-	for _, receipt := range receipts {
-		storageReceipt := (*types.ReceiptForStorage)(receipt)
-		data, err := rlp.EncodeToBytes(storageReceipt)
-		if err != nil {
-			return err
-		}
-		if err := batch.Put(append(receiptsPrefix, receipt.TxHash.Bytes()...), data); err != nil {
-			return err
-		}
-	}
-	// Write the scheduled data into the database
-	if err := batch.Write(); err != nil {
-		log.Crit("Failed to store receipts", "err", err)
+// WriteTxIndexTail stores the number of the oldest block whose transactions are
+// indexed.
+func WriteTxIndexTail(db ethdb.Putter, number uint64) error {
+	if err := db.Put(txIndexTailKey, encodeBlockNumber(number)); err != nil {
+		log.Crit("Failed to store transaction index tail", "err", err)
 	}
 	return nil
 }
 
+// TxIndexComplete reports whether the transaction lookup index covers the whole
+// chain, meaning that a missing lookup entry denotes an unknown transaction.
+func TxIndexComplete(db ethdb.Database) bool {
+	tail := GetTxIndexTail(db)
+	return tail == nil || *tail == 0
+}
+
 // DeleteCanonicalHash removes the number to hash canonical mapping.
-func DeleteCanonicalHash(db ethdb.Database, number uint64) {
+func DeleteCanonicalHash(db ethdb.Deleter, number uint64) {
 	db.Delete(append(append(headerPrefix, encodeBlockNumber(number)...), numSuffix...))
 }
 
 // DeleteHeader removes all block header data associated with a hash.
-func DeleteHeader(db ethdb.Database, hash common.Hash, number uint64) {
+func DeleteHeader(db ethdb.Deleter, hash common.Hash, number uint64) {
 	db.Delete(append(blockHashPrefix, hash.Bytes()...))
 	db.Delete(append(append(headerPrefix, encodeBlockNumber(number)...), hash.Bytes()...))
 }
 
 // DeleteBody removes all block body data associated with a hash.
-func DeleteBody(db ethdb.Database, hash common.Hash, number uint64) {
+func DeleteBody(db ethdb.Deleter, hash common.Hash, number uint64) {
 	db.Delete(append(append(bodyPrefix, encodeBlockNumber(number)...), hash.Bytes()...))
 }
 
 // DeleteTd removes all block total difficulty data associated with a hash.
-func DeleteTd(db ethdb.Database, hash common.Hash, number uint64) {
+func DeleteTd(db ethdb.Deleter, hash common.Hash, number uint64) {
 	db.Delete(append(append(append(headerPrefix, encodeBlockNumber(number)...), hash.Bytes()...), tdSuffix...))
 }
 
-// DeleteBlock removes all block data associated with a hash.
+// DeleteBlock removes all block data associated with a hash in one batch.
 func DeleteBlock(db ethdb.Database, hash common.Hash, number uint64) {
-	DeleteBlockReceipts(db, hash, number)
-	DeleteHeader(db, hash, number)
-	DeleteBody(db, hash, number)
-	DeleteTd(db, hash, number)
+	batch := db.NewBatch()
+	DeleteBlockReceipts(batch, hash, number)
+	DeleteHeader(batch, hash, number)
+	DeleteBody(batch, hash, number)
+	DeleteTd(batch, hash, number)
+	if err := batch.Write(); err != nil {
+		log.Crit("Failed to delete block", "err", err)
+	}
 }
 
 // DeleteBlockReceipts removes all receipt data associated with a block hash.
-func DeleteBlockReceipts(db ethdb.Database, hash common.Hash, number uint64) {
+func DeleteBlockReceipts(db ethdb.Deleter, hash common.Hash, number uint64) {
 	db.Delete(append(append(blockReceiptsPrefix, encodeBlockNumber(number)...), hash.Bytes()...))
 }
 
-// DeleteTransaction removes all transaction data associated with a hash.
-func DeleteTransaction(db ethdb.Database, hash common.Hash) {
-	db.Delete(hash.Bytes())
-	db.Delete(append(hash.Bytes(), txMetaSuffix...))
+// GetStateDiffTail retrieves the number of the oldest block whose state diff may
+// be retained, or nil if the state diffs have never been pruned.
+func GetStateDiffTail(db ethdb.Database) *uint64 {
+	data, _ := db.Get(stateDiffTailKey)
+	if len(data) != 8 {
+		return nil
+	}
+	number := binary.BigEndian.Uint64(data)
+	return &number
 }
 
-// DeleteReceipt removes all receipt data associated with a transaction hash.
-func DeleteReceipt(db ethdb.Database, hash common.Hash) {
-	db.Delete(append(receiptsPrefix, hash.Bytes()...))
+// WriteStateDiffTail stores the number of the oldest block whose state diff may
+// be retained.
+func WriteStateDiffTail(db ethdb.Putter, number uint64) error {
+	if err := db.Put(stateDiffTailKey, encodeBlockNumber(number)); err != nil {
+		log.Crit("Failed to store state diff tail", "err", err)
+	}
+	return nil
 }
 
-// returns a formatted MIP mapped key by adding prefix, canonical number and level
-//
-// ex. fn(98, 1000) = (prefix || 1000 || 0)
-func mipmapKey(num, level uint64) []byte {
-	lkey := make([]byte, 8)
-	binary.BigEndian.PutUint64(lkey, level)
-	key := new(big.Int).SetUint64(num / level * level)
+// DeleteStateDiffsBelow removes the state diffs of all the blocks numbered below
+// limit, canonical or not, and advances the tail to limit. Only the blocks from
+// the previous tail on are iterated, so pruning a window moving a block at a time
+// deletes the diffs of a single block number.
+func DeleteStateDiffsBelow(db ethdb.Database, limit uint64) error {
+	var tail uint64
+	if stored := GetStateDiffTail(db); stored != nil {
+		if *stored >= limit {
+			return nil
+		}
+		tail = *stored
+	}
+	if err := db.DeleteRange(stateDiffKey(common.Hash{}, tail), stateDiffKey(common.Hash{}, limit)); err != nil {
+		return err
+	}
+	return WriteStateDiffTail(db, limit)
+}
 
-	return append(mipmapPre, append(lkey, key.Bytes()...)...)
+// stateDiffKey returns the database key of the state diff of a block.
+func stateDiffKey(hash common.Hash, number uint64) []byte {
+	return append(append(stateDiffPrefix, encodeBlockNumber(number)...), hash.Bytes()...)
 }
 
-// WriteMipmapBloom writes each address included in the receipts' logs to the
-// MIP bloom bin.
-func WriteMipmapBloom(db ethdb.Database, number uint64, receipts types.Receipts) error {
-	mipmapBloomMu.Lock()
-	defer mipmapBloomMu.Unlock()
+// DeleteTransaction removes all transaction data associated with a hash.
+func DeleteTransaction(db ethdb.Deleter, hash common.Hash) {
+	db.Delete(hash.Bytes())
+	db.Delete(append(hash.Bytes(), txMetaSuffix...))
+}
 
-	batch := db.NewBatch()
-	for _, level := range MIPMapLevels {
-		key := mipmapKey(number, level)
-		bloomDat, _ := db.Get(key)
-		bloom := types.BytesToBloom(bloomDat)
-		for _, receipt := range receipts {
-			for _, log := range receipt.Logs {
-				bloom.Add(log.Address.Big())
-			}
-		}
-		batch.Put(key, bloom.Bytes())
-	}
-	if err := batch.Write(); err != nil {
-		return fmt.Errorf("mipmap write fail for: %d: %v", number, err)
+// GetBloomBits retrieves the compressed bloom bit vector belonging to the given
+// section and bit index from the database.
+func GetBloomBits(db ethdb.Database, bit uint, section uint64, head common.Hash) ([]byte, error) {
+	return db.Get(bloomBitsKey(bit, section, head))
+}
+
+// WriteBloomBits writes the compressed bloom bits vector belonging to the given
+// section and bit index.
+func WriteBloomBits(db ethdb.Putter, bit uint, section uint64, head common.Hash, bits []byte) {
+	if err := db.Put(bloomBitsKey(bit, section, head), bits); err != nil {
+		log.Crit("Failed to store bloom bits", "err", err)
 	}
-	return nil
 }
 
-// GetMipmapBloom returns a bloom filter using the number and level as input
-// parameters. For available levels see MIPMapLevels.
-func GetMipmapBloom(db ethdb.Database, number, level uint64) types.Bloom {
-	bloomDat, _ := db.Get(mipmapKey(number, level))
-	return types.BytesToBloom(bloomDat)
+// bloomBitsKey returns the database key of a bloom bit vector of a section,
+// identified by the hash of its last block.
+func bloomBitsKey(bit uint, section uint64, head common.Hash) []byte {
+	key := append(append(bloomBitsPrefix, make([]byte, 10)...), head.Bytes()...)
+
+	binary.BigEndian.PutUint16(key[1:], uint16(bit))
+	binary.BigEndian.PutUint64(key[3:], section)
+
+	return key
 }
 
 // PreimageTable returns a Database instance with the key prefix for preimage entries.
@@ -589,7 +752,7 @@ func WritePreimages(db ethdb.Database, number uint64, preimages map[common.Hash]
 	batch := table.NewBatch()
 	hitCount := 0
 	for hash, preimage := range preimages {
-		if _, err := table.Get(hash.Bytes()); err != nil {
+		if has, _ := table.Has(hash.Bytes()); !has {
 			batch.Put(hash.Bytes(), preimage)
 			hitCount++
 		}
@@ -607,7 +770,7 @@ func WritePreimages(db ethdb.Database, number uint64, preimages map[common.Hash]
 // GetBlockChainVersion reads the version number from db.
 func GetBlockChainVersion(db ethdb.Database) int {
 	var vsn uint
-	enc, _ := db.Get([]byte("BlockchainVersion"))
+	enc, _ := db.Get(blockChainVersionKey)
 	rlp.DecodeBytes(enc, &vsn)
 	return int(vsn)
 }
@@ -615,7 +778,7 @@ func GetBlockChainVersion(db ethdb.Database) int {
 // WriteBlockChainVersion writes vsn as the version number to db.
 func WriteBlockChainVersion(db ethdb.Database, vsn int) {
 	enc, _ := rlp.EncodeToBytes(uint(vsn))
-	db.Put([]byte("BlockchainVersion"), enc)
+	db.Put(blockChainVersionKey, enc)
 }
 
 // WriteChainConfig writes the chain config settings to the database.
@@ -18,17 +18,16 @@ package core
 
 import (
 	"bytes"
-	"io/ioutil"
+	"encoding/json"
 	"math/big"
-	"os"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/crypto/sha3"
 	"github.com/ethereum/go-ethereum/ethdb"
-	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/rlp"
 )
 
@@ -332,33 +331,71 @@ func TestTransactionStorage(t *testing.T) {
 	}
 }
 
-// Tests that receipts can be stored and retrieved.
-func TestReceiptStorage(t *testing.T) {
-	db, _ := ethdb.NewMemDatabase()
+// makeReceiptsBlock creates a block with a contract creation and a plain
+// transaction, along with their receipts with all the derived fields set.
+func makeReceiptsBlock(t *testing.T) (*types.Block, types.Receipts) {
+	key, _ := crypto.GenerateKey()
+	signer := types.NewEIP155Signer(big.NewInt(1))
 
+	tx1, err := types.SignTx(types.NewContractCreation(0, big.NewInt(0), big.NewInt(100000), big.NewInt(1), []byte{0x60}), signer, key)
+	if err != nil {
+		t.Fatalf("failed to sign transaction: %v", err)
+	}
+	tx2, err := types.SignTx(types.NewTransaction(1, common.Address{0x22}, big.NewInt(1), big.NewInt(21000), big.NewInt(1), nil), types.HomesteadSigner{}, key)
+	if err != nil {
+		t.Fatalf("failed to sign transaction: %v", err)
+	}
 	receipt1 := &types.Receipt{
 		PostState:         []byte{0x01},
-		CumulativeGasUsed: big.NewInt(1),
+		CumulativeGasUsed: big.NewInt(53000),
 		Logs: []*types.Log{
-			{Address: common.BytesToAddress([]byte{0x11})},
-			{Address: common.BytesToAddress([]byte{0x01, 0x11})},
+			{Address: common.BytesToAddress([]byte{0x11}), Topics: []common.Hash{{0x11}}},
+			{Address: common.BytesToAddress([]byte{0x01, 0x11}), Topics: []common.Hash{}, Data: []byte{0x11}},
 		},
-		TxHash:          common.BytesToHash([]byte{0x11, 0x11}),
-		ContractAddress: common.BytesToAddress([]byte{0x01, 0x11, 0x11}),
-		GasUsed:         big.NewInt(111111),
 	}
 	receipt2 := &types.Receipt{
 		PostState:         []byte{0x02},
-		CumulativeGasUsed: big.NewInt(2),
+		CumulativeGasUsed: big.NewInt(74000),
 		Logs: []*types.Log{
-			{Address: common.BytesToAddress([]byte{0x22})},
-			{Address: common.BytesToAddress([]byte{0x02, 0x22})},
+			{Address: common.BytesToAddress([]byte{0x22}), Topics: []common.Hash{{0x22}}},
 		},
-		TxHash:          common.BytesToHash([]byte{0x22, 0x22}),
-		ContractAddress: common.BytesToAddress([]byte{0x02, 0x22, 0x22}),
-		GasUsed:         big.NewInt(222222),
 	}
-	receipts := []*types.Receipt{receipt1, receipt2}
+	receipts := types.Receipts{receipt1, receipt2}
+	for _, receipt := range receipts {
+		receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+	}
+	block := types.NewBlock(&types.Header{Number: big.NewInt(314)}, []*types.Transaction{tx1, tx2}, nil, receipts)
+
+	// Fill the derived fields the way the block processor does
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	receipt1.TxHash, receipt1.ContractAddress, receipt1.GasUsed = tx1.Hash(), crypto.CreateAddress(from, 0), big.NewInt(53000)
+	receipt2.TxHash, receipt2.GasUsed = tx2.Hash(), big.NewInt(21000)
+
+	logIndex := uint(0)
+	for i, receipt := range receipts {
+		for _, log := range receipt.Logs {
+			log.BlockNumber, log.BlockHash = block.NumberU64(), block.Hash()
+			log.TxHash, log.TxIndex, log.Index = receipt.TxHash, uint(i), logIndex
+			logIndex++
+		}
+	}
+	return block, receipts
+}
+
+// checkReceipt checks that a retrieved receipt matches the expected one in both
+// the consensus and the derived fields.
+func checkReceipt(t *testing.T, have, want *types.Receipt) {
+	blobHave, _ := json.Marshal(have)
+	blobWant, _ := json.Marshal(want)
+	if !bytes.Equal(blobHave, blobWant) {
+		t.Fatalf("receipt mismatch: have %s, want %s", blobHave, blobWant)
+	}
+}
+
+// Tests that receipts can be looked up by transaction hash.
+func TestReceiptStorage(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	block, receipts := makeReceiptsBlock(t)
 
 	// Check that no receipt entries are in a pristine database
 	for i, receipt := range receipts {
@@ -366,191 +403,259 @@ func TestReceiptStorage(t *testing.T) {
 			t.Fatalf("receipt #%d [%x]: non existent receipt returned: %v", i, receipt.TxHash, r)
 		}
 	}
-	// Insert all the receipts into the database, and verify contents
-	if err := WriteReceipts(db, receipts); err != nil {
-		t.Fatalf("failed to write receipts: %v", err)
+	// Insert the block with its lookup entries and receipts, and verify contents
+	if err := WriteBlock(db, block); err != nil {
+		t.Fatalf("failed to write block: %v", err)
+	}
+	if err := WriteTransactions(db, block); err != nil {
+		t.Fatalf("failed to write transactions: %v", err)
+	}
+	if err := WriteBlockReceipts(db, block.Hash(), block.NumberU64(), receipts); err != nil {
+		t.Fatalf("failed to write block receipts: %v", err)
 	}
 	for i, receipt := range receipts {
 		if r := GetReceipt(db, receipt.TxHash); r == nil {
 			t.Fatalf("receipt #%d [%x]: receipt not found", i, receipt.TxHash)
 		} else {
-			rlpHave, _ := rlp.EncodeToBytes(r)
-			rlpWant, _ := rlp.EncodeToBytes(receipt)
-
-			if !bytes.Equal(rlpHave, rlpWant) {
-				t.Fatalf("receipt #%d [%x]: receipt mismatch: have %v, want %v", i, receipt.TxHash, r, receipt)
-			}
+			checkReceipt(t, r, receipt)
 		}
 	}
-	// Delete the receipts and check purge
+	// Delete the lookup entries and check purge
 	for i, receipt := range receipts {
-		DeleteReceipt(db, receipt.TxHash)
+		DeleteTransaction(db, receipt.TxHash)
 		if r := GetReceipt(db, receipt.TxHash); r != nil {
 			t.Fatalf("receipt #%d [%x]: deleted receipt returned: %v", i, receipt.TxHash, r)
 		}
 	}
 }
 
-// Tests that receipts associated with a single block can be stored and retrieved.
+// Tests that receipts associated with a single block can be stored and retrieved,
+// with the fields derivable from the block dropped from storage.
 func TestBlockReceiptStorage(t *testing.T) {
 	db, _ := ethdb.NewMemDatabase()
-
-	receipt1 := &types.Receipt{
-		PostState:         []byte{0x01},
-		CumulativeGasUsed: big.NewInt(1),
-		Logs: []*types.Log{
-			{Address: common.BytesToAddress([]byte{0x11})},
-			{Address: common.BytesToAddress([]byte{0x01, 0x11})},
-		},
-		TxHash:          common.BytesToHash([]byte{0x11, 0x11}),
-		ContractAddress: common.BytesToAddress([]byte{0x01, 0x11, 0x11}),
-		GasUsed:         big.NewInt(111111),
-	}
-	receipt2 := &types.Receipt{
-		PostState:         []byte{0x02},
-		CumulativeGasUsed: big.NewInt(2),
-		Logs: []*types.Log{
-			{Address: common.BytesToAddress([]byte{0x22})},
-			{Address: common.BytesToAddress([]byte{0x02, 0x22})},
-		},
-		TxHash:          common.BytesToHash([]byte{0x22, 0x22}),
-		ContractAddress: common.BytesToAddress([]byte{0x02, 0x22, 0x22}),
-		GasUsed:         big.NewInt(222222),
-	}
-	receipts := []*types.Receipt{receipt1, receipt2}
+	block, receipts := makeReceiptsBlock(t)
+	hash, number := block.Hash(), block.NumberU64()
 
 	// Check that no receipt entries are in a pristine database
-	hash := common.BytesToHash([]byte{0x03, 0x14})
-	if rs := GetBlockReceipts(db, hash, 0); len(rs) != 0 {
+	if rs := GetBlockReceipts(db, hash, number); len(rs) != 0 {
 		t.Fatalf("non existent receipts returned: %v", rs)
 	}
-	// Insert the receipt slice into the database and check presence
-	if err := WriteBlockReceipts(db, hash, 0, receipts); err != nil {
+	// Insert the receipt slice into the database and check that it needs the body
+	if err := WriteBlockReceipts(db, hash, number, receipts); err != nil {
 		t.Fatalf("failed to write block receipts: %v", err)
 	}
-	if rs := GetBlockReceipts(db, hash, 0); len(rs) == 0 {
-		t.Fatalf("no receipts returned")
+	if rs := GetBlockReceipts(db, hash, number); rs != nil {
+		t.Fatalf("receipts returned without block body: %v", rs)
+	}
+	if rs := GetRawBlockReceipts(db, hash, number); len(rs) != len(receipts) {
+		t.Fatalf("raw receipt count mismatch: have %d, want %d", len(rs), len(receipts))
+	} else if rs[0].TxHash != (common.Hash{}) || rs[0].Bloom != (types.Bloom{}) || rs[0].Logs[1].Index != 0 {
+		t.Fatalf("derived fields stored: %v", rs[0])
+	}
+	if err := WriteBody(db, hash, number, block.Body()); err != nil {
+		t.Fatalf("failed to write block body: %v", err)
+	}
+	if rs := GetBlockReceipts(db, hash, number); len(rs) != len(receipts) {
+		t.Fatalf("receipt count mismatch: have %d, want %d", len(rs), len(receipts))
 	} else {
-		for i := 0; i < len(receipts); i++ {
-			rlpHave, _ := rlp.EncodeToBytes(rs[i])
-			rlpWant, _ := rlp.EncodeToBytes(receipts[i])
-
-			if !bytes.Equal(rlpHave, rlpWant) {
-				t.Fatalf("receipt #%d: receipt mismatch: have %v, want %v", i, rs[i], receipts[i])
-			}
+		for i := range receipts {
+			checkReceipt(t, rs[i], receipts[i])
 		}
 	}
 	// Delete the receipt slice and check purge
-	DeleteBlockReceipts(db, hash, 0)
-	if rs := GetBlockReceipts(db, hash, 0); len(rs) != 0 {
+	DeleteBlockReceipts(db, hash, number)
+	if rs := GetBlockReceipts(db, hash, number); len(rs) != 0 {
 		t.Fatalf("deleted receipts returned: %v", rs)
 	}
 }
 
-func TestMipmapBloom(t *testing.T) {
+// Tests that receipts stored in the legacy encoding, including all the derived
+// fields, can still be retrieved.
+func TestLegacyBlockReceiptStorage(t *testing.T) {
 	db, _ := ethdb.NewMemDatabase()
-
-	receipt1 := new(types.Receipt)
-	receipt1.Logs = []*types.Log{
-		{Address: common.BytesToAddress([]byte("test"))},
-		{Address: common.BytesToAddress([]byte("address"))},
+	block, receipts := makeReceiptsBlock(t)
+	hash, number := block.Hash(), block.NumberU64()
+
+	legacy := make([]interface{}, len(receipts))
+	for i, r := range receipts {
+		logs := make([]*types.LogForStorage, len(r.Logs))
+		for j, log := range r.Logs {
+			logs[j] = (*types.LogForStorage)(log)
+		}
+		legacy[i] = []interface{}{r.PostState, r.CumulativeGasUsed, r.Bloom, r.TxHash, r.ContractAddress, logs, r.GasUsed}
 	}
-	receipt2 := new(types.Receipt)
-	receipt2.Logs = []*types.Log{
-		{Address: common.BytesToAddress([]byte("test"))},
-		{Address: common.BytesToAddress([]byte("address1"))},
+	blob, err := rlp.EncodeToBytes(legacy)
+	if err != nil {
+		t.Fatalf("failed to encode legacy receipts: %v", err)
 	}
+	db.Put(append(append(blockReceiptsPrefix, encodeBlockNumber(number)...), hash.Bytes()...), blob)
+	WriteBody(db, hash, number, block.Body())
 
-	WriteMipmapBloom(db, 1, types.Receipts{receipt1})
-	WriteMipmapBloom(db, 2, types.Receipts{receipt2})
-
-	for _, level := range MIPMapLevels {
-		bloom := GetMipmapBloom(db, 2, level)
-		if !bloom.Test(new(big.Int).SetBytes([]byte("address1"))) {
-			t.Error("expected test to be included on level:", level)
+	if rs := GetBlockReceipts(db, hash, number); len(rs) != len(receipts) {
+		t.Fatalf("receipt count mismatch: have %d, want %d", len(rs), len(receipts))
+	} else {
+		for i := range receipts {
+			checkReceipt(t, rs[i], receipts[i])
 		}
 	}
+	// Legacy receipts frozen before the compaction must be retrievable too
+	fdb, _ := ethdb.NewMemDatabase()
+	WriteBody(fdb, hash, number, block.Body())
 
-	// reset
-	db, _ = ethdb.NewMemDatabase()
-	receipt := new(types.Receipt)
-	receipt.Logs = []*types.Log{
-		{Address: common.BytesToAddress([]byte("test"))},
+	frozen := &frozenReceiptsDB{Database: fdb, hash: hash, number: number, receipts: blob}
+	if rs := GetBlockReceipts(frozen, hash, number); len(rs) != len(receipts) {
+		t.Fatalf("frozen receipt count mismatch: have %d, want %d", len(rs), len(receipts))
+	} else {
+		for i := range receipts {
+			checkReceipt(t, rs[i], receipts[i])
+		}
 	}
-	WriteMipmapBloom(db, 999, types.Receipts{receipt1})
+}
 
-	receipt = new(types.Receipt)
-	receipt.Logs = []*types.Log{
-		{Address: common.BytesToAddress([]byte("test 1"))},
-	}
-	WriteMipmapBloom(db, 1000, types.Receipts{receipt})
+// frozenReceiptsDB is a database serving the receipts of a single block out of
+// a stubbed ancient store.
+type frozenReceiptsDB struct {
+	ethdb.Database
+	hash     common.Hash
+	number   uint64
+	receipts []byte
+}
 
-	bloom := GetMipmapBloom(db, 1000, 1000)
-	if bloom.TestBytes([]byte("test")) {
-		t.Error("test should not have been included")
+func (db *frozenReceiptsDB) HasAncient(kind string, number uint64) (bool, error) {
+	blob, err := db.Ancient(kind, number)
+	return blob != nil, err
+}
+
+func (db *frozenReceiptsDB) Ancient(kind string, number uint64) ([]byte, error) {
+	if number != db.number {
+		return nil, nil
+	}
+	switch kind {
+	case freezerHashTable:
+		return db.hash[:], nil
+	case freezerReceiptTable:
+		return db.receipts, nil
 	}
+	return nil, nil
 }
 
-func TestMipmapChain(t *testing.T) {
-	dir, err := ioutil.TempDir("", "mipmap")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer os.RemoveAll(dir)
-
-	var (
-		db, _   = ethdb.NewLDBDatabase(dir, 0, 0)
-		key1, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
-		addr    = crypto.PubkeyToAddress(key1.PublicKey)
-		addr2   = common.BytesToAddress([]byte("jeff"))
-
-		hash1 = common.BytesToHash([]byte("topic1"))
-	)
-	defer db.Close()
-
-	gspec := &Genesis{
-		Config: params.TestChainConfig,
-		Alloc:  GenesisAlloc{addr: {Balance: big.NewInt(1000000)}},
-	}
-	genesis := gspec.MustCommit(db)
-	chain, receipts := GenerateChain(params.TestChainConfig, genesis, db, 1010, func(i int, gen *BlockGen) {
-		var receipts types.Receipts
-		switch i {
-		case 1:
-			receipt := types.NewReceipt(nil, new(big.Int))
-			receipt.Logs = []*types.Log{{Address: addr, Topics: []common.Hash{hash1}}}
-			gen.AddUncheckedReceipt(receipt)
-			receipts = types.Receipts{receipt}
-		case 1000:
-			receipt := types.NewReceipt(nil, new(big.Int))
-			receipt.Logs = []*types.Log{{Address: addr2}}
-			gen.AddUncheckedReceipt(receipt)
-			receipts = types.Receipts{receipt}
+func (db *frozenReceiptsDB) Ancients() (uint64, error) {
+	return db.number + 1, nil
+}
 
-		}
+// Tests that the bloom bit vectors of index sections are stored and retrieved
+// by section head.
+func TestBloomBitsStorage(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
 
-		// store the receipts
-		err := WriteReceipts(db, receipts)
-		if err != nil {
-			t.Fatal(err)
-		}
-		WriteMipmapBloom(db, uint64(i+1), receipts)
-	})
-	for i, block := range chain {
-		WriteBlock(db, block)
-		if err := WriteCanonicalHash(db, block.Hash(), block.NumberU64()); err != nil {
-			t.Fatalf("failed to insert block number: %v", err)
+	head := common.HexToHash("0x01")
+	if _, err := GetBloomBits(db, 7, 3, head); err == nil {
+		t.Fatalf("non existent bloom bits returned")
+	}
+	bits := []byte{0x01, 0x02, 0x03}
+	WriteBloomBits(db, 7, 3, head, bits)
+
+	if entry, err := GetBloomBits(db, 7, 3, head); err != nil {
+		t.Fatalf("stored bloom bits not found: %v", err)
+	} else if !bytes.Equal(entry, bits) {
+		t.Fatalf("bloom bits mismatch: have %x, want %x", entry, bits)
+	}
+	// Different bits, sections or heads must not collide
+	if _, err := GetBloomBits(db, 8, 3, head); err == nil {
+		t.Fatalf("bloom bits returned for different bit")
+	}
+	if _, err := GetBloomBits(db, 7, 4, head); err == nil {
+		t.Fatalf("bloom bits returned for different section")
+	}
+	if _, err := GetBloomBits(db, 7, 3, common.HexToHash("0x02")); err == nil {
+		t.Fatalf("bloom bits returned for different head")
+	}
+}
+
+// Tests that state diffs are pruned from the persisted tail on, which only moves
+// forward.
+func TestStateDiffPruning(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	for i := uint64(0); i < 8; i++ {
+		if err := WriteStateDiff(db, common.Hash{byte(i)}, i, []*state.AccountDiff{}); err != nil {
+			t.Fatalf("failed to write state diff #%d: %v", i, err)
 		}
-		if err := WriteHeadBlockHash(db, block.Hash()); err != nil {
-			t.Fatalf("failed to insert block number: %v", err)
+	}
+	if tail := GetStateDiffTail(db); tail != nil {
+		t.Fatalf("tail set before pruning: %d", *tail)
+	}
+	check := func(limit uint64) {
+		if tail := GetStateDiffTail(db); tail == nil || *tail != limit {
+			t.Fatalf("tail mismatch: have %v, want %d", tail, limit)
 		}
-		if err := WriteBlockReceipts(db, block.Hash(), block.NumberU64(), receipts[i]); err != nil {
-			t.Fatal("error writing block receipts:", err)
+		for i := uint64(0); i < 8; i++ {
+			if diff := GetStateDiff(db, common.Hash{byte(i)}, i); (diff == nil) != (i < limit) {
+				t.Errorf("state diff #%d: retained %v, want %v", i, diff != nil, i >= limit)
+			}
 		}
 	}
+	if err := DeleteStateDiffsBelow(db, 4); err != nil {
+		t.Fatalf("failed to prune state diffs: %v", err)
+	}
+	check(4)
+
+	// Pruning below the tail must be a noop
+	if err := DeleteStateDiffsBelow(db, 2); err != nil {
+		t.Fatalf("failed to prune state diffs: %v", err)
+	}
+	check(4)
+
+	if err := DeleteStateDiffsBelow(db, 5); err != nil {
+		t.Fatalf("failed to prune state diffs: %v", err)
+	}
+	check(5)
+}
+
+// Tests that database inspection attributes the stored entries to the correct
+// data categories.
+func TestInspectDatabase(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
 
-	bloom := GetMipmapBloom(db, 0, 1000)
-	if bloom.TestBytes(addr2[:]) {
-		t.Error("address was included in bloom and should not have")
+	block, receipts := makeReceiptsBlock(t)
+	hash, number := block.Hash(), block.NumberU64()
+
+	WriteBlock(db, block)
+	WriteTd(db, hash, number, big.NewInt(1))
+	WriteCanonicalHash(db, hash, number)
+	WriteBlockReceipts(db, hash, number, receipts)
+	WriteTransactions(db, block)
+	WriteHeadBlockHash(db, hash)
+	WriteTxIndexTail(db, 0)
+	WritePreimages(db, number, map[common.Hash][]byte{crypto.Keccak256Hash([]byte{0x01}): {0x01}})
+
+	node, _ := rlp.EncodeToBytes([][]byte{{0x01}, {0x02}})
+	db.Put(crypto.Keccak256(node), node)
+	db.Put(crypto.Keccak256([]byte{0x60, 0x00}), []byte{0x60, 0x00})
+	db.Put([]byte("mipmap-log-bloom-0123"), []byte{0x01})
+	db.Put([]byte("unknown"), []byte{0x01})
+
+	want := map[string]uint64{
+		StatHeaders:       1,
+		StatBodies:        1,
+		StatReceipts:      1,
+		StatDifficulties:  1,
+		StatCanonicalHash: 1,
+		StatBlockNumbers:  1,
+		StatTxLookups:     2,
+		StatTransactions:  2,
+		StatTrieNodes:     1,
+		StatContractCodes: 1,
+		StatPreimages:     1,
+		StatMipmaps:       1,
+		StatMetadata:      2,
+		StatUnaccounted:   1,
+	}
+	for _, stat := range InspectDatabase(db) {
+		if stat.Count != want[stat.Category] {
+			t.Errorf("%s: item count mismatch: have %d, want %d", stat.Category, stat.Count, want[stat.Category])
+		}
+		if (stat.Count == 0) != (stat.Size == 0) {
+			t.Errorf("%s: size %v inconsistent with item count %d", stat.Category, stat.Size, stat.Count)
+		}
 	}
 }
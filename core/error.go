@@ -28,4 +28,8 @@ var (
 
 	// ErrBlacklistedHash is returned if a block to import is on the blacklist.
 	ErrBlacklistedHash = errors.New("blacklisted hash")
+
+	// ErrTxIndexIncomplete is returned if a transaction lookup fails while the
+	// lookup entries of older blocks are still being created.
+	ErrTxIndexIncomplete = errors.New("transaction indexing is in progress")
 )
@@ -18,6 +18,7 @@ package core
 
 import (
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
 )
 
@@ -52,3 +53,11 @@ type ChainSideEvent struct {
 }
 
 type ChainHeadEvent struct{ Block *types.Block }
+
+// StateDiffEvent is posted when a block with a recorded state diff becomes part
+// of the canonical chain, during import or by a reorg.
+type StateDiffEvent struct {
+	Hash   common.Hash
+	Number uint64
+	Diff   []*state.AccountDiff
+}
@@ -58,8 +58,19 @@ func NewEVMContext(msg Message, header *types.Header, chain ChainContext, author
 	}
 }
 
+// ancestorHashContext is implemented by the chain contexts knowing the hashes
+// of the ancestor blocks without their headers, e.g. the environment of a state
+// transition executed outside of any chain.
+type ancestorHashContext interface {
+	// GetAncestorHash returns the hash of the ancestor block with the given number.
+	GetAncestorHash(number uint64) common.Hash
+}
+
 // GetHashFn returns a GetHashFunc which retrieves header hashes by number
 func GetHashFn(ref *types.Header, chain ChainContext) func(n uint64) common.Hash {
+	if ac, ok := chain.(ancestorHashContext); ok {
+		return ac.GetAncestorHash
+	}
 	return func(n uint64) common.Hash {
 		for header := chain.GetHeader(ref.ParentHash, ref.Number.Uint64()-1); header != nil; header = chain.GetHeader(header.ParentHash, header.Number.Uint64()-1) {
 			if header.Number.Uint64() == n {
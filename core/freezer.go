@@ -0,0 +1,447 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+const (
+	freezerHeaderTable     = "headers"  // Block headers in RLP encoding
+	freezerHashTable       = "hashes"   // Canonical block hashes
+	freezerBodiesTable     = "bodies"   // Block bodies in RLP encoding
+	freezerReceiptTable    = "receipts" // Block receipts in storage RLP encoding
+	freezerDifficultyTable = "diffs"    // Total difficulties in RLP encoding
+)
+
+// freezerNoCompression lists the tables whose content doesn't compress, hence
+// are stored raw.
+var freezerNoCompression = map[string]bool{
+	freezerHashTable:       true,
+	freezerDifficultyTable: true,
+}
+
+const (
+	// freezerRecheckInterval is the frequency to check the key-value database for
+	// chain progression that might permit new blocks to be frozen into immutable
+	// storage.
+	freezerRecheckInterval = time.Minute
+
+	// freezerBatchLimit is the maximum number of blocks to freeze in one batch
+	// before doing an fsync and deleting it from the key-value store.
+	freezerBatchLimit = 30000
+)
+
+var (
+	// errUnknownTable is returned if the user attempts to read from a table that
+	// is not tracked by the freezer.
+	errUnknownTable = errors.New("unknown table")
+
+	// errAncientMismatch is returned if the key-value store and the freezer were
+	// created for different chains.
+	errAncientMismatch = errors.New("ancient chain segment belongs to a different database")
+)
+
+// freezer is an append-only database to store immutable chain data into flat
+// files. The append only nature ensures that disk writes are minimized, and the
+// immutability of the data allows storing it on cheaper disks outside of the
+// key-value store, keeping its compactions lean.
+type freezer struct {
+	frozen    uint64 // Number of blocks already frozen, accessed atomically
+	threshold uint64 // Number of recent blocks to keep in the key-value store
+	readonly  bool   // Whether to leave the tables as found when opening
+
+	tables map[string]*freezerTable // Data tables for storing everything
+	lock   sync.Mutex               // Serializes freezing and truncation
+
+	quit      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// newFreezer creates a chain freezer that moves the chain data older than the
+// given number of recent blocks into append-only flat file containers, checking
+// and repairing their integrity. A read-only freezer doesn't create nor modify
+// any file: it fails on a table corrupted by a crash, and ignores the trailing
+// blocks missing from some of the tables instead of dropping them.
+func newFreezer(datadir string, threshold uint64, readonly bool) (*freezer, error) {
+	f := &freezer{
+		threshold: threshold,
+		readonly:  readonly,
+		tables:    make(map[string]*freezerTable),
+		quit:      make(chan struct{}),
+	}
+	for _, name := range []string{freezerHashTable, freezerHeaderTable, freezerBodiesTable, freezerReceiptTable, freezerDifficultyTable} {
+		table, err := newTable(datadir, name, freezerNoCompression[name], readonly)
+		if err != nil {
+			for _, table := range f.tables {
+				table.Close()
+			}
+			return nil, err
+		}
+		f.tables[name] = table
+	}
+	if err := f.repair(); err != nil {
+		for _, table := range f.tables {
+			table.Close()
+		}
+		return nil, err
+	}
+	log.Info("Opened ancient database", "database", datadir, "frozen", f.frozen)
+	return f, nil
+}
+
+// repair truncates all data tables to the same length, and drops any trailing
+// blocks missing from any of the tables, not matching their checksums, or whose
+// header doesn't match the frozen canonical hash. A read-only freezer only
+// excludes them from the frozen blocks.
+func (f *freezer) repair() error {
+	min := uint64(1<<64 - 1)
+	for _, table := range f.tables {
+		if items := table.Items(); items < min {
+			min = items
+		}
+	}
+	for min > 0 {
+		err := f.verifyBlock(min - 1)
+		if err == nil {
+			break
+		}
+		log.Warn("Dropping corrupted ancient block", "number", min-1, "err", err)
+		min--
+	}
+	if f.readonly {
+		atomic.StoreUint64(&f.frozen, min)
+		return nil
+	}
+	for _, table := range f.tables {
+		if err := table.truncate(min); err != nil {
+			return err
+		}
+	}
+	atomic.StoreUint64(&f.frozen, min)
+	return nil
+}
+
+// verifyBlock checks that the items of a frozen block are retrievable from all
+// the tables, matching their checksums, and that its header matches the frozen
+// canonical hash.
+func (f *freezer) verifyBlock(number uint64) error {
+	for name, table := range f.tables {
+		if _, err := table.Retrieve(number); err != nil {
+			return fmt.Errorf("table %s: %v", name, err)
+		}
+	}
+	hash, _ := f.tables[freezerHashTable].Retrieve(number)
+	header, _ := f.tables[freezerHeaderTable].Retrieve(number)
+	if have := crypto.Keccak256Hash(header); have != common.BytesToHash(hash) {
+		return fmt.Errorf("header hash mismatch: have %x, want %x", have, hash)
+	}
+	return nil
+}
+
+// Close terminates the chain freezer, closing all the data files.
+func (f *freezer) Close() error {
+	f.closeOnce.Do(func() { close(f.quit) })
+	f.wg.Wait()
+
+	var errs []error
+	for _, table := range f.tables {
+		if err := table.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if errs != nil {
+		return fmt.Errorf("%v", errs)
+	}
+	return nil
+}
+
+// HasAncient returns an indicator whether the specified ancient data exists
+// in the freezer.
+func (f *freezer) HasAncient(kind string, number uint64) (bool, error) {
+	if table := f.tables[kind]; table != nil {
+		return number < table.Items(), nil
+	}
+	return false, nil
+}
+
+// Ancient retrieves an ancient binary blob from the append-only immutable files.
+func (f *freezer) Ancient(kind string, number uint64) ([]byte, error) {
+	if table := f.tables[kind]; table != nil {
+		return table.Retrieve(number)
+	}
+	return nil, errUnknownTable
+}
+
+// Ancients returns the length of the frozen items.
+func (f *freezer) Ancients() (uint64, error) {
+	return atomic.LoadUint64(&f.frozen), nil
+}
+
+// AppendAncient injects all binary blobs belonging to a block at the end of the
+// append-only immutable table files. If any of the tables fails to accept the
+// data, all of them are rolled back to their previous length.
+func (f *freezer) AppendAncient(number uint64, hash, header, body, receipts, td []byte) (err error) {
+	defer func() {
+		if err != nil {
+			rerr := f.truncate(number)
+			if rerr != nil {
+				log.Error("Failed to roll back ancient block", "number", number, "err", rerr)
+			}
+			log.Error("Failed to append ancient block", "number", number, "hash", common.BytesToHash(hash), "err", err)
+		}
+	}()
+	if err := f.tables[freezerHashTable].Append(number, hash); err != nil {
+		return err
+	}
+	if err := f.tables[freezerHeaderTable].Append(number, header); err != nil {
+		return err
+	}
+	if err := f.tables[freezerBodiesTable].Append(number, body); err != nil {
+		return err
+	}
+	if err := f.tables[freezerReceiptTable].Append(number, receipts); err != nil {
+		return err
+	}
+	if err := f.tables[freezerDifficultyTable].Append(number, td); err != nil {
+		return err
+	}
+	atomic.AddUint64(&f.frozen, 1)
+	return nil
+}
+
+// TruncateAncients discards any recent data above the provided threshold number.
+func (f *freezer) TruncateAncients(items uint64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.truncate(items)
+}
+
+// truncate discards any recent data above the provided threshold number. The
+// caller must hold the lock or otherwise ensure exclusive access.
+func (f *freezer) truncate(items uint64) error {
+	for _, table := range f.tables {
+		if err := table.truncate(items); err != nil {
+			return err
+		}
+	}
+	if atomic.LoadUint64(&f.frozen) > items {
+		atomic.StoreUint64(&f.frozen, items)
+	}
+	return nil
+}
+
+// Sync flushes all data tables to disk.
+func (f *freezer) Sync() error {
+	var errs []error
+	for _, table := range f.tables {
+		if err := table.Sync(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if errs != nil {
+		return fmt.Errorf("%v", errs)
+	}
+	return nil
+}
+
+// freeze is a background thread that periodically checks the blockchain for any
+// import progress and moves ancient data from the fast database into the freezer.
+func (f *freezer) freeze(db ethdb.Database) {
+	defer f.wg.Done()
+
+	for {
+		select {
+		case <-f.quit:
+			return
+		default:
+		}
+		frozen, err := f.freezeBatch(db)
+		if err != nil {
+			log.Error("Failed to freeze ancient blocks", "err", err)
+		}
+		// Keep going while there's progress, otherwise wait for the chain to grow
+		if frozen > 0 && err == nil {
+			continue
+		}
+		select {
+		case <-f.quit:
+			return
+		case <-time.After(freezerRecheckInterval):
+		}
+	}
+}
+
+// freezeBatch moves the next batch of blocks that fell below the immutability
+// threshold from the key-value store into the freezer, returning the number of
+// blocks frozen. Any side chain blocks at the frozen heights are pruned.
+func (f *freezer) freezeBatch(db ethdb.Database) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	// Retrieve the freezing threshold based on the current head block
+	head := GetHeadBlockHash(db)
+	if head == (common.Hash{}) {
+		return 0, nil
+	}
+	number := GetBlockNumber(db, head)
+	if number == missingNumber {
+		return 0, fmt.Errorf("current head block %x missing", head)
+	}
+	if number < f.threshold {
+		return 0, nil
+	}
+	var (
+		first = atomic.LoadUint64(&f.frozen)
+		limit = number - f.threshold
+	)
+	if first > limit {
+		return 0, nil
+	}
+	if limit-first >= freezerBatchLimit {
+		limit = first + freezerBatchLimit - 1
+	}
+	// Copy the canonical blocks into the freezer and flush them to disk
+	var (
+		start  = time.Now()
+		hashes []common.Hash
+		err    error
+	)
+	for n := first; n <= limit; n++ {
+		hash := GetCanonicalHash(db, n)
+		if hash == (common.Hash{}) {
+			err = fmt.Errorf("canonical hash missing, can't freeze block %d", n)
+			break
+		}
+		var (
+			enc      = encodeBlockNumber(n)
+			header   = GetHeaderRLP(db, hash, n)
+			body     = GetBodyRLP(db, hash, n)
+			receipts []byte
+			td       []byte
+		)
+		receipts, _ = db.Get(append(append(blockReceiptsPrefix, enc...), hash[:]...))
+		td, _ = db.Get(append(append(append(headerPrefix, enc...), hash[:]...), tdSuffix...))
+
+		if len(header) == 0 || len(body) == 0 || len(receipts) == 0 || len(td) == 0 {
+			err = fmt.Errorf("block data missing, can't freeze block %d", n)
+			break
+		}
+		if err = f.AppendAncient(n, hash[:], header, body, receipts, td); err != nil {
+			break
+		}
+		hashes = append(hashes, hash)
+	}
+	if len(hashes) == 0 {
+		return 0, err
+	}
+	if serr := f.Sync(); serr != nil {
+		return 0, serr
+	}
+	// Wipe the frozen data from the key-value store, keeping the genesis and the
+	// hash to number mappings of the canonical blocks
+	batch := db.NewBatch()
+	for i, canonical := range hashes {
+		n := first + uint64(i)
+		if n == 0 {
+			continue
+		}
+		prefix := append(append([]byte{}, headerPrefix...), encodeBlockNumber(n)...)
+		it := db.NewIteratorWithPrefix(prefix)
+		for it.Next() {
+			if len(it.Key()) != len(prefix)+common.HashLength {
+				continue // Not a header entry
+			}
+			hash := common.BytesToHash(it.Key()[len(prefix):])
+			if hash == canonical {
+				batch.Delete(common.CopyBytes(it.Key()))
+			} else {
+				DeleteHeader(batch, hash, n)
+			}
+			DeleteBody(batch, hash, n)
+			DeleteBlockReceipts(batch, hash, n)
+			DeleteTd(batch, hash, n)
+		}
+		it.Release()
+
+		if batch.ValueSize() > ethdb.IdealBatchSize {
+			if werr := batch.Write(); werr != nil {
+				return i, werr
+			}
+			batch.Reset()
+		}
+	}
+	if werr := batch.Write(); werr != nil {
+		return len(hashes), werr
+	}
+	log.Info("Moved ancient blocks into freezer", "number", first+uint64(len(hashes))-1, "count", len(hashes), "elapsed", common.PrettyDuration(time.Since(start)))
+	return len(hashes), err
+}
+
+// freezerdb is a database wrapper that enables freezer data retrievals.
+type freezerdb struct {
+	ethdb.Database
+	*freezer
+}
+
+// Close implements ethdb.Database, closing both the fast key-value store as
+// well as the slow ancient tables.
+func (db *freezerdb) Close() {
+	if err := db.freezer.Close(); err != nil {
+		log.Error("Failed to close ancient database", "err", err)
+	}
+	db.Database.Close()
+}
+
+// NewDatabaseWithFreezer creates a high level database on top of a given key-
+// value data store with a freezer moving the chain segments older than the given
+// number of recent blocks into cold storage at the given directory. A read-only
+// freezer, meant for offline tools, serves the ancient chain segments without
+// moving blocks or repairing the tables on its own, ignoring the threshold.
+func NewDatabaseWithFreezer(db ethdb.Database, freezerdir string, threshold uint64, readonly bool) (ethdb.Database, error) {
+	frdb, err := newFreezer(freezerdir, threshold, readonly)
+	if err != nil {
+		return nil, err
+	}
+	// Ensure the key-value store and the freezer belong to the same chain
+	if frozen, _ := frdb.Ancients(); frozen > 0 {
+		ancient, _ := frdb.Ancient(freezerHashTable, 0)
+		if kvgenesis := GetCanonicalHash(db, 0); kvgenesis != common.BytesToHash(ancient) {
+			frdb.Close()
+			return nil, fmt.Errorf("%v: genesis %x, ancient genesis %x", errAncientMismatch, kvgenesis, ancient)
+		}
+	}
+	if !readonly {
+		frdb.wg.Add(1)
+		go frdb.freeze(db)
+	}
+	return &freezerdb{
+		Database: db,
+		freezer:  frdb,
+	}, nil
+}
@@ -0,0 +1,368 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/golang/snappy"
+)
+
+var (
+	// errClosed is returned if an operation attempts to read from or write to the
+	// freezer table after it has already been closed.
+	errClosed = errors.New("closed")
+
+	// errOutOfBounds is returned if the item requested is not contained within the
+	// freezer table.
+	errOutOfBounds = errors.New("out of bounds")
+
+	// errOutOrderInsertion is returned if the user attempts to inject out-of-order
+	// binary blobs into the freezer.
+	errOutOrderInsertion = errors.New("the append operation is out-order")
+
+	// errReadOnly is returned if the user attempts to modify a freezer table
+	// opened in read-only mode.
+	errReadOnly = errors.New("read-only freezer table")
+
+	// errChecksumMismatch is returned if the data of an item doesn't match the
+	// checksum recorded for it in the index.
+	errChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// indexEntrySize is the size of a single index entry: the big endian offset of
+// the end of an item within the data file, followed by the big endian CRC32 of
+// the item as stored in the data file.
+const indexEntrySize = 12
+
+// crcTable is the CRC32 polynomial table used to checksum the stored items.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// freezerTable represents a single chained data table within the freezer (e.g.
+// blocks). It consists of an append-only data file containing the items one
+// after the other, and an index file containing the end offset and checksum of
+// each item. Items are optionally snappy compressed.
+type freezerTable struct {
+	items    uint64 // Number of items stored in the table
+	dataSize uint64 // Number of bytes stored in the data file
+
+	noCompression bool     // if true, disables snappy compression
+	readonly      bool     // if true, the files are neither created nor modified
+	index         *os.File // File descriptor for the item offsets
+	data          *os.File // File descriptor for the item contents
+
+	logger log.Logger
+	lock   sync.RWMutex // Mutex protecting the file descriptors and counters
+}
+
+// newTable opens a freezer table, creating the data and index files if they
+// don't exist yet and repairing any inconsistency left behind by a crash. A
+// read-only table must exist already, and fails to open if inconsistent.
+func newTable(path string, name string, noCompression bool, readonly bool) (*freezerTable, error) {
+	flag := os.O_RDONLY
+	if !readonly {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return nil, err
+		}
+		flag = os.O_RDWR | os.O_CREATE
+	}
+	ext := "cdat"
+	if noCompression {
+		ext = "rdat"
+	}
+	index, err := os.OpenFile(filepath.Join(path, name+".ridx"), flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.OpenFile(filepath.Join(path, fmt.Sprintf("%s.%s", name, ext)), flag, 0644)
+	if err != nil {
+		index.Close()
+		return nil, err
+	}
+	tab := &freezerTable{
+		noCompression: noCompression,
+		readonly:      readonly,
+		index:         index,
+		data:          data,
+		logger:        log.New("table", name),
+	}
+	if err := tab.repair(); err != nil {
+		tab.Close()
+		return nil, fmt.Errorf("freezer table %s: %v", name, err)
+	}
+	return tab, nil
+}
+
+// repair cross checks the index and data files, truncating them to be in sync
+// with each other after a potential crash. A partially written index entry is
+// dropped, as is any data not referenced by the index and any trailing index
+// entry pointing beyond the end of the data file or to an item not matching its
+// checksum. A read-only table fails instead.
+func (t *freezerTable) repair() error {
+	stat, err := t.index.Stat()
+	if err != nil {
+		return err
+	}
+	indexSize := stat.Size()
+	if overflow := indexSize % indexEntrySize; overflow != 0 {
+		if t.readonly {
+			return fmt.Errorf("partial index entry: %d bytes", overflow)
+		}
+		t.logger.Warn("Truncating partial index entry", "size", indexSize, "overflow", overflow)
+		indexSize -= overflow
+	}
+	if stat, err = t.data.Stat(); err != nil {
+		return err
+	}
+	dataSize := stat.Size()
+
+	// Drop index entries until the last one points within the data file and
+	// matches the checksum of the item it points to
+	var offset uint64
+	for indexSize > 0 {
+		item := uint64(indexSize/indexEntrySize) - 1
+		if offset, _, err = t.readEntry(item); err != nil {
+			return err
+		}
+		if offset <= uint64(dataSize) {
+			var ierr error
+			if _, ierr = t.readItem(item, uint64(dataSize)); ierr == nil {
+				break
+			}
+			if t.readonly {
+				return fmt.Errorf("corrupted last item %d: %v", item, ierr)
+			}
+			t.logger.Warn("Truncating corrupted last item", "item", item, "err", ierr)
+		} else {
+			if t.readonly {
+				return fmt.Errorf("dangling index entry: offset %d, data %d", offset, dataSize)
+			}
+			t.logger.Warn("Truncating dangling index entry", "offset", offset, "data", dataSize)
+		}
+		indexSize -= indexEntrySize
+		offset = 0
+	}
+	if t.readonly {
+		if uint64(dataSize) != offset {
+			return fmt.Errorf("unindexed data: indexed %d, data %d", offset, dataSize)
+		}
+		t.items, t.dataSize = uint64(indexSize/indexEntrySize), offset
+		return nil
+	}
+	if err := t.index.Truncate(indexSize); err != nil {
+		return err
+	}
+	if uint64(dataSize) != offset {
+		t.logger.Warn("Truncating unindexed data", "indexed", offset, "data", dataSize)
+	}
+	if err := t.data.Truncate(int64(offset)); err != nil {
+		return err
+	}
+	t.items, t.dataSize = uint64(indexSize/indexEntrySize), offset
+
+	t.logger.Debug("Opened freezer table", "items", t.items, "size", t.dataSize)
+	return t.sync()
+}
+
+// readEntry retrieves the end offset and the checksum of an item from the index
+// file. The caller must ensure the item is within bounds.
+func (t *freezerTable) readEntry(item uint64) (uint64, uint32, error) {
+	buf := make([]byte, indexEntrySize)
+	if _, err := t.index.ReadAt(buf, int64(item*indexEntrySize)); err != nil {
+		return 0, 0, err
+	}
+	return binary.BigEndian.Uint64(buf), binary.BigEndian.Uint32(buf[8:]), nil
+}
+
+// readItem retrieves the stored blob of an item from the data file of the given
+// size, verifying it against its checksum. The caller must ensure the item is
+// within bounds.
+func (t *freezerTable) readItem(item uint64, dataSize uint64) ([]byte, error) {
+	var start uint64
+	if item > 0 {
+		var err error
+		if start, _, err = t.readEntry(item - 1); err != nil {
+			return nil, err
+		}
+	}
+	end, checksum, err := t.readEntry(item)
+	if err != nil {
+		return nil, err
+	}
+	if end < start || end > dataSize {
+		return nil, fmt.Errorf("corrupt index entry %d: start %d, end %d, data %d", item, start, end, dataSize)
+	}
+	blob := make([]byte, end-start)
+	if _, err := t.data.ReadAt(blob, int64(start)); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(blob, crcTable) != checksum {
+		return nil, errChecksumMismatch
+	}
+	return blob, nil
+}
+
+// Items returns the number of items stored in the table.
+func (t *freezerTable) Items() uint64 {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.items
+}
+
+// truncate discards any recent data above the provided threshold number.
+func (t *freezerTable) truncate(items uint64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.index == nil {
+		return errClosed
+	}
+	if t.items <= items {
+		return nil
+	}
+	if t.readonly {
+		return errReadOnly
+	}
+	var offset uint64
+	if items > 0 {
+		var err error
+		if offset, _, err = t.readEntry(items - 1); err != nil {
+			return err
+		}
+	}
+	t.logger.Warn("Truncating freezer table", "items", t.items, "limit", items)
+	if err := t.index.Truncate(int64(items * indexEntrySize)); err != nil {
+		return err
+	}
+	if err := t.data.Truncate(int64(offset)); err != nil {
+		return err
+	}
+	t.items, t.dataSize = items, offset
+	return nil
+}
+
+// Append injects a binary blob at the end of the freezer table. The item number
+// is a precautionary parameter to ensure data correctness, but the table will
+// reject already existing data.
+func (t *freezerTable) Append(item uint64, blob []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.index == nil {
+		return errClosed
+	}
+	if t.readonly {
+		return errReadOnly
+	}
+	if t.items != item {
+		return fmt.Errorf("%v: have %d, want %d", errOutOrderInsertion, item, t.items)
+	}
+	if !t.noCompression {
+		blob = snappy.Encode(nil, blob)
+	}
+	if _, err := t.data.WriteAt(blob, int64(t.dataSize)); err != nil {
+		return err
+	}
+	entry := make([]byte, indexEntrySize)
+	binary.BigEndian.PutUint64(entry, t.dataSize+uint64(len(blob)))
+	binary.BigEndian.PutUint32(entry[8:], crc32.Checksum(blob, crcTable))
+	if _, err := t.index.WriteAt(entry, int64(t.items*indexEntrySize)); err != nil {
+		return err
+	}
+	t.items, t.dataSize = t.items+1, t.dataSize+uint64(len(blob))
+	return nil
+}
+
+// Retrieve looks up the data offset of an item with the given number and
+// retrieves the raw binary blob from the data file, failing if it doesn't match
+// its checksum.
+func (t *freezerTable) Retrieve(item uint64) ([]byte, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if t.index == nil {
+		return nil, errClosed
+	}
+	if item >= t.items {
+		return nil, errOutOfBounds
+	}
+	blob, err := t.readItem(item, t.dataSize)
+	if err != nil {
+		t.logger.Error("Corrupted freezer item", "item", item, "err", err)
+		return nil, err
+	}
+	if t.noCompression {
+		return blob, nil
+	}
+	return snappy.Decode(nil, blob)
+}
+
+// Sync pushes any pending data from memory out to disk. This is an expensive
+// operation, so use it with care.
+func (t *freezerTable) Sync() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.index == nil {
+		return errClosed
+	}
+	if t.readonly {
+		return nil
+	}
+	return t.sync()
+}
+
+// sync flushes the data file before the index, so that an index entry never
+// references unsynced data. The caller must hold the lock.
+func (t *freezerTable) sync() error {
+	if err := t.data.Sync(); err != nil {
+		return err
+	}
+	return t.index.Sync()
+}
+
+// Close closes all opened files.
+func (t *freezerTable) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var errs []error
+	if t.index != nil {
+		if err := t.index.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		t.index = nil
+	}
+	if t.data != nil {
+		if err := t.data.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		t.data = nil
+	}
+	if errs != nil {
+		return fmt.Errorf("%v", errs)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// getChunk returns a deterministic blob of the given size and content byte.
+func getChunk(size int, b int) []byte {
+	return bytes.Repeat([]byte{byte(b)}, size)
+}
+
+// Tests that items appended to a table can be retrieved, both before and after
+// reopening it, and that out of order operations are rejected.
+func TestFreezerTableBasics(t *testing.T) {
+	for _, noCompression := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "freezer")
+		if err != nil {
+			t.Fatalf("failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		table, err := newTable(dir, "test", noCompression, false)
+		if err != nil {
+			t.Fatalf("failed to create table: %v", err)
+		}
+		for i := 0; i < 255; i++ {
+			if err := table.Append(uint64(i), getChunk(i, i)); err != nil {
+				t.Fatalf("failed to append item %d: %v", i, err)
+			}
+		}
+		if err := table.Append(1000, getChunk(1, 1)); err == nil {
+			t.Errorf("out of order append succeeded")
+		}
+		if _, err := table.Retrieve(255); err != errOutOfBounds {
+			t.Errorf("out of bounds retrieval error mismatch: have %v, want %v", err, errOutOfBounds)
+		}
+		table.Close()
+
+		if table, err = newTable(dir, "test", noCompression, false); err != nil {
+			t.Fatalf("failed to reopen table: %v", err)
+		}
+		if items := table.Items(); items != 255 {
+			t.Fatalf("item count mismatch: have %d, want %d", items, 255)
+		}
+		for i := 0; i < 255; i++ {
+			blob, err := table.Retrieve(uint64(i))
+			if err != nil {
+				t.Fatalf("failed to retrieve item %d: %v", i, err)
+			}
+			if !bytes.Equal(blob, getChunk(i, i)) {
+				t.Fatalf("item %d mismatch: have %x, want %x", i, blob, getChunk(i, i))
+			}
+		}
+		if err := table.truncate(10); err != nil {
+			t.Fatalf("failed to truncate table: %v", err)
+		}
+		if _, err := table.Retrieve(10); err != errOutOfBounds {
+			t.Errorf("truncated retrieval error mismatch: have %v, want %v", err, errOutOfBounds)
+		}
+		if err := table.Append(10, getChunk(20, 0xff)); err != nil {
+			t.Fatalf("failed to append after truncation: %v", err)
+		}
+		if blob, _ := table.Retrieve(10); !bytes.Equal(blob, getChunk(20, 0xff)) {
+			t.Errorf("item after truncation mismatch: have %x, want %x", blob, getChunk(20, 0xff))
+		}
+		table.Close()
+	}
+}
+
+// Tests that a table with a partially written index or data file is repaired
+// on startup to the last consistent item, unless opened read-only.
+func TestFreezerTableRepair(t *testing.T) {
+	// A read-only table must not create any file
+	missing := filepath.Join(os.TempDir(), "freezer-missing")
+	if _, err := newTable(missing, "test", true, true); err == nil {
+		t.Fatalf("read-only table created")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatalf("read-only table created its directory: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "freezer")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	table, err := newTable(dir, "test", true, false)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		table.Append(uint64(i), getChunk(15, i))
+	}
+	table.Close()
+
+	// Append a partial index entry, which should be dropped
+	index, _ := os.OpenFile(filepath.Join(dir, "test.ridx"), os.O_WRONLY|os.O_APPEND, 0644)
+	index.Write([]byte{0x00, 0x01, 0x02})
+	index.Close()
+
+	if table, err = newTable(dir, "test", true, false); err != nil {
+		t.Fatalf("failed to reopen table: %v", err)
+	}
+	if items := table.Items(); items != 10 {
+		t.Fatalf("item count mismatch after index corruption: have %d, want %d", items, 10)
+	}
+	table.Close()
+
+	// Chop off the end of the data file, which a read-only table must refuse to
+	// open without modifying it, and which should otherwise drop the last item
+	os.Truncate(filepath.Join(dir, "test.rdat"), 15*10-1)
+
+	if _, err := newTable(dir, "test", true, true); err == nil {
+		t.Fatalf("read-only table opened with corrupted data")
+	}
+	if stat, _ := os.Stat(filepath.Join(dir, "test.ridx")); stat.Size() != 10*indexEntrySize {
+		t.Fatalf("read-only table modified the index: have %d bytes, want %d", stat.Size(), 10*indexEntrySize)
+	}
+
+	if table, err = newTable(dir, "test", true, false); err != nil {
+		t.Fatalf("failed to reopen table: %v", err)
+	}
+	defer table.Close()
+
+	if items := table.Items(); items != 9 {
+		t.Fatalf("item count mismatch after data corruption: have %d, want %d", items, 9)
+	}
+	for i := 0; i < 9; i++ {
+		if blob, err := table.Retrieve(uint64(i)); err != nil || !bytes.Equal(blob, getChunk(15, i)) {
+			t.Errorf("item %d mismatch: have %x (%v), want %x", i, blob, err, getChunk(15, i))
+		}
+	}
+	if err := table.Append(9, getChunk(15, 9)); err != nil {
+		t.Fatalf("failed to append to repaired table: %v", err)
+	}
+}
+
+// Tests that items not matching their checksums are reported on retrieval, and
+// that a corrupted last item is dropped on startup unless opened read-only.
+func TestFreezerTableChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freezer")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	table, err := newTable(dir, "test", true, false)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		table.Append(uint64(i), getChunk(15, i))
+	}
+	table.Close()
+
+	// Flip a byte of an item in the middle, which must be caught on retrieval
+	corrupt := func(offset int64) {
+		data, _ := os.OpenFile(filepath.Join(dir, "test.rdat"), os.O_RDWR, 0644)
+		data.WriteAt([]byte{0xff}, offset)
+		data.Close()
+	}
+	corrupt(15*4 + 7)
+
+	if table, err = newTable(dir, "test", true, false); err != nil {
+		t.Fatalf("failed to reopen table: %v", err)
+	}
+	if items := table.Items(); items != 10 {
+		t.Fatalf("item count mismatch after middle corruption: have %d, want %d", items, 10)
+	}
+	if _, err := table.Retrieve(4); err != errChecksumMismatch {
+		t.Errorf("corrupted item error mismatch: have %v, want %v", err, errChecksumMismatch)
+	}
+	if blob, err := table.Retrieve(5); err != nil || !bytes.Equal(blob, getChunk(15, 5)) {
+		t.Errorf("intact item mismatch: have %x (%v), want %x", blob, err, getChunk(15, 5))
+	}
+	table.Close()
+
+	// Flip a byte of the last item, which must be dropped on startup
+	corrupt(15*9 + 3)
+
+	if _, err := newTable(dir, "test", true, true); err == nil {
+		t.Fatalf("read-only table opened with corrupted last item")
+	}
+	if table, err = newTable(dir, "test", true, false); err != nil {
+		t.Fatalf("failed to reopen table: %v", err)
+	}
+	defer table.Close()
+
+	if items := table.Items(); items != 9 {
+		t.Fatalf("item count mismatch after tail corruption: have %d, want %d", items, 9)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// Tests that blocks below the immutability threshold are moved into the freezer,
+// remain accessible through the database accessors, and that side chains at the
+// frozen heights are pruned.
+func TestFreezerMigration(t *testing.T) {
+	var (
+		db, _     = ethdb.NewMemDatabase()
+		gendb, _  = ethdb.NewMemDatabase()
+		gspec     = &Genesis{Config: params.TestChainConfig}
+		genesis   = gspec.MustCommit(gendb)
+		blocks, _ = GenerateChain(gspec.Config, genesis, gendb, 20, func(i int, b *BlockGen) { b.SetCoinbase(common.Address{0x01}) })
+		forks, _  = GenerateChain(gspec.Config, genesis, gendb, 3, func(i int, b *BlockGen) { b.SetCoinbase(common.Address{0x02}) })
+	)
+	gspec.MustCommit(db)
+	chain, _ := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if _, err := chain.InsertChain(forks); err != nil {
+		t.Fatalf("failed to insert side chain: %v", err)
+	}
+	chain.Stop()
+
+	dir, err := ioutil.TempDir("", "freezer")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := newFreezer(dir, 10, false)
+	if err != nil {
+		t.Fatalf("failed to create freezer: %v", err)
+	}
+	if n, err := f.freezeBatch(db); n != 11 || err != nil {
+		t.Fatalf("frozen block count mismatch: have %d (%v), want %d", n, err, 11)
+	}
+	if n, err := f.freezeBatch(db); n != 0 || err != nil {
+		t.Fatalf("refrozen block count mismatch: have %d (%v), want %d", n, err, 0)
+	}
+	fdb := &freezerdb{Database: db, freezer: f}
+
+	for _, block := range blocks {
+		hash, number := block.Hash(), block.NumberU64()
+		if stored := GetBlock(fdb, hash, number); stored == nil || stored.Hash() != hash {
+			t.Fatalf("block %d: not retrievable", number)
+		}
+		if receipts := GetBlockReceipts(fdb, hash, number); receipts == nil {
+			t.Errorf("block %d: receipts not retrievable", number)
+		}
+		if td := GetTd(fdb, hash, number); td == nil {
+			t.Errorf("block %d: total difficulty not retrievable", number)
+		}
+		if !HasHeader(fdb, hash, number) || !HasBody(fdb, hash, number) {
+			t.Errorf("block %d: existence check failed", number)
+		}
+		if frozen := number <= 10; frozen == (len(GetHeaderRLP(db, hash, number)) > 0) {
+			t.Errorf("block %d: key-value presence mismatch, frozen %v", number, frozen)
+		}
+		if GetBlockNumber(db, hash) != number {
+			t.Errorf("block %d: number mapping missing", number)
+		}
+	}
+	for _, block := range forks {
+		if HasHeader(fdb, block.Hash(), block.NumberU64()) {
+			t.Errorf("side block %d: not pruned", block.NumberU64())
+		}
+	}
+	// The compression layer wrapping the freezer must keep the ancients reachable
+	cdb := NewCompressedDatabase(fdb, true)
+	if _, ok := cdb.(ethdb.AncientReader); !ok {
+		t.Fatalf("compressed database hides the ancient store")
+	}
+	if stored := GetBlock(cdb, blocks[0].Hash(), blocks[0].NumberU64()); stored == nil || stored.Hash() != blocks[0].Hash() {
+		t.Fatalf("frozen block not retrievable through the compression layer")
+	}
+	f.Close()
+
+	// Corrupt the last frozen header and ensure it's dropped on startup
+	path := filepath.Join(dir, freezerHeaderTable+".cdat")
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat header table: %v", err)
+	}
+	os.Truncate(path, stat.Size()-1)
+
+	// A read-only freezer must refuse the corrupted table without touching it
+	if _, err := newFreezer(dir, 0, true); err == nil {
+		t.Fatalf("read-only freezer opened a corrupted table")
+	}
+	if corrupted, _ := os.Stat(path); corrupted.Size() != stat.Size()-1 {
+		t.Fatalf("read-only freezer repaired the header table: have %d bytes, want %d", corrupted.Size(), stat.Size()-1)
+	}
+	if f, err = newFreezer(dir, 10, false); err != nil {
+		t.Fatalf("failed to reopen freezer: %v", err)
+	}
+	defer f.Close()
+
+	if frozen, _ := f.Ancients(); frozen != 10 {
+		t.Fatalf("frozen block count mismatch after corruption: have %d, want %d", frozen, 10)
+	}
+}
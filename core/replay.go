@@ -0,0 +1,317 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// ReplayDivergence is a difference between the stored outcome of a block and the
+// outcome of its re-execution.
+type ReplayDivergence struct {
+	Number uint64       `json:"number"`           // Number of the diverging block
+	Hash   common.Hash  `json:"hash"`             // Hash of the diverging block
+	TxHash *common.Hash `json:"txHash,omitempty"` // Transaction of a diverging receipt
+	Field  string       `json:"field"`            // Name of the diverging field
+	Have   string       `json:"have"`             // Value produced by the re-execution
+	Want   string       `json:"want"`             // Value stored in the database
+}
+
+// ReplayReport is the outcome of the re-execution of a range of blocks.
+type ReplayReport struct {
+	From        uint64              `json:"from"`        // First block of the replayed range
+	To          uint64              `json:"to"`          // Last block of the replayed range
+	Replayed    uint64              `json:"replayed"`    // Number of blocks re-executed
+	Unverified  uint64              `json:"unverified"`  // Number of blocks not re-executed for lack of a parent state
+	Divergences []*ReplayDivergence `json:"divergences"` // Differences found, ordered by block
+}
+
+// ReplayChain re-executes the canonical blocks in the range [from, to] on top of
+// their stored parent states, comparing the gas used, the receipts, the logs and
+// the state roots with the stored ones. The range is split into segments which
+// are replayed by the given number of parallel workers, each segment starting
+// at a block whose parent state is available in the database. Blocks following
+// a failed one can't be re-executed until a stored parent state is reached, they
+// are counted as unverified.
+//
+// The replay doesn't modify the database: the regenerated states are held in
+// memory, and the blocks are processed over a header chain rather than a full
+// blockchain, which would maintain its indexes.
+func ReplayChain(db ethdb.Database, config *params.ChainConfig, engine consensus.Engine, from, to uint64, workers int) (*ReplayReport, error) {
+	if from == 0 {
+		from = 1 // The genesis block has nothing to replay
+	}
+	if from > to {
+		return nil, fmt.Errorf("invalid replay range: #%d - #%d", from, to)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	hc, err := NewHeaderChain(db, config, engine, func() bool { return false })
+	if err != nil {
+		return nil, err
+	}
+	replayer := &chainReplayer{
+		db:        db,
+		config:    config,
+		processor: NewStateProcessor(config, hc, engine),
+	}
+	if !replayer.hasParentState(from) {
+		return nil, fmt.Errorf("missing parent state of block #%d", from)
+	}
+	// Cut the range into segments starting at blocks with their parent state available
+	var (
+		segments [][2]uint64
+		length   = (to-from)/uint64(workers) + 1
+		first    = from
+	)
+	for number := from + length; number <= to; number++ {
+		if number-first >= length && replayer.hasParentState(number) {
+			segments = append(segments, [2]uint64{first, number - 1})
+			first = number
+		}
+	}
+	segments = append(segments, [2]uint64{first, to})
+
+	// Replay the segments concurrently, collecting the divergences in order
+	var (
+		tasks   = make(chan int, len(segments))
+		results = make([][]*ReplayDivergence, len(segments))
+		failure error
+		lock    sync.Mutex
+		wg      sync.WaitGroup
+
+		start = time.Now()
+	)
+	for i := range segments {
+		tasks <- i
+	}
+	close(tasks)
+
+	for i := 0; i < workers && i < len(segments); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range tasks {
+				divergences, err := replayer.replaySegment(segments[task][0], segments[task][1])
+				lock.Lock()
+				if err != nil && failure == nil {
+					failure = err
+				}
+				results[task] = divergences
+				lock.Unlock()
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(8 * time.Second)
+	defer ticker.Stop()
+wait:
+	for {
+		select {
+		case <-ticker.C:
+			log.Info("Replaying chain", "replayed", atomic.LoadUint64(&replayer.replayed), "total", to-from+1, "elapsed", common.PrettyDuration(time.Since(start)))
+		case <-done:
+			break wait
+		}
+	}
+	if failure != nil {
+		return nil, failure
+	}
+	report := &ReplayReport{
+		From:        from,
+		To:          to,
+		Replayed:    replayer.replayed,
+		Unverified:  replayer.unverified,
+		Divergences: []*ReplayDivergence{},
+	}
+	for _, divergences := range results {
+		report.Divergences = append(report.Divergences, divergences...)
+	}
+	log.Info("Replayed chain", "from", from, "to", to, "segments", len(segments), "unverified", report.Unverified, "divergences", len(report.Divergences), "elapsed", common.PrettyDuration(time.Since(start)))
+	return report, nil
+}
+
+// chainReplayer re-executes the blocks of a stored chain.
+type chainReplayer struct {
+	db        ethdb.Database
+	config    *params.ChainConfig
+	processor Processor
+
+	replayed   uint64 // Number of blocks replayed, accessed atomically
+	unverified uint64 // Number of blocks without a parent state, accessed atomically
+}
+
+// hasParentState reports whether the state of the parent of a canonical block is
+// available in the database.
+func (r *chainReplayer) hasParentState(number uint64) bool {
+	parent := GetHeader(r.db, GetCanonicalHash(r.db, number-1), number-1)
+	if parent == nil {
+		return false
+	}
+	ok, _ := r.db.Has(parent.Root[:])
+	return ok
+}
+
+// replaySegment re-executes the canonical blocks in the range [from, to]. Each
+// block is processed on top of its stored parent state if available, or else
+// on top of the state produced by the re-execution of its parent. Blocks having
+// neither are counted as unverified, without being reported as divergences.
+func (r *chainReplayer) replaySegment(from, to uint64) ([]*ReplayDivergence, error) {
+	var (
+		divergences []*ReplayDivergence
+		cache       state.Database // Memory database of the regenerated states
+		computed    common.Hash    // Root of the state regenerated for the last block
+	)
+	for number := from; number <= to; number++ {
+		block := GetBlock(r.db, GetCanonicalHash(r.db, number), number)
+		if block == nil {
+			return divergences, fmt.Errorf("missing block #%d", number)
+		}
+		parent := GetHeader(r.db, block.ParentHash(), number-1)
+		if parent == nil {
+			return divergences, fmt.Errorf("missing parent header of block #%d", number)
+		}
+		// Prefer the stored parent state, dropping the regenerated ones
+		root := computed
+		if ok, _ := r.db.Has(parent.Root[:]); ok {
+			cache, root, computed = state.NewDatabase(r.db), parent.Root, common.Hash{}
+		}
+		if root == (common.Hash{}) {
+			atomic.AddUint64(&r.unverified, 1)
+			continue
+		}
+		statedb, err := state.New(root, cache)
+		if err != nil {
+			return divergences, fmt.Errorf("parent state of block #%d: %v", number, err)
+		}
+		receipts, _, usedGas, err := r.processor.Process(block, statedb, vm.Config{})
+		atomic.AddUint64(&r.replayed, 1)
+		if err != nil {
+			divergences = append(divergences, newReplayDivergence(block, nil, "error", err.Error(), ""))
+			computed = common.Hash{}
+			continue
+		}
+		divergences = append(divergences, r.compareBlock(block, receipts, usedGas)...)
+
+		// Retain the regenerated state in memory for the next block
+		have, err := statedb.Commit(r.config.IsEIP158(block.Number()))
+		if err != nil {
+			return divergences, fmt.Errorf("failed to commit state of block #%d: %v", number, err)
+		}
+		if have != block.Root() {
+			divergences = append(divergences, newReplayDivergence(block, nil, "stateRoot", have.Hex(), block.Root().Hex()))
+		}
+		triedb := cache.TrieDB()
+		triedb.Reference(have)
+		if computed != (common.Hash{}) {
+			triedb.Dereference(computed)
+		}
+		computed = have
+	}
+	return divergences, nil
+}
+
+// compareBlock compares the gas used and the receipts produced by the re-execution
+// of a block with the ones stored in the database.
+func (r *chainReplayer) compareBlock(block *types.Block, receipts types.Receipts, usedGas *big.Int) []*ReplayDivergence {
+	var divergences []*ReplayDivergence
+	diverge := func(tx *common.Hash, field string, have, want interface{}) {
+		divergences = append(divergences, newReplayDivergence(block, tx, field, fmt.Sprint(have), fmt.Sprint(want)))
+	}
+	if usedGas.Cmp(block.GasUsed()) != 0 {
+		diverge(nil, "gasUsed", usedGas, block.GasUsed())
+	}
+	if root := types.DeriveSha(receipts); root != block.ReceiptHash() {
+		diverge(nil, "receiptRoot", root.Hex(), block.ReceiptHash().Hex())
+	}
+	stored := GetBlockReceipts(r.db, block.Hash(), block.NumberU64())
+	if stored == nil && len(receipts) > 0 {
+		diverge(nil, "receipts", len(receipts), "missing")
+		return divergences
+	}
+	if len(receipts) != len(stored) {
+		diverge(nil, "receipts", len(receipts), len(stored))
+	}
+	for i := 0; i < len(receipts) && i < len(stored); i++ {
+		have, want := receipts[i], stored[i]
+		tx := &want.TxHash
+
+		if !bytes.Equal(have.PostState, want.PostState) {
+			diverge(tx, "postState", common.ToHex(have.PostState), common.ToHex(want.PostState))
+		}
+		if have.CumulativeGasUsed.Cmp(want.CumulativeGasUsed) != 0 {
+			diverge(tx, "cumulativeGasUsed", have.CumulativeGasUsed, want.CumulativeGasUsed)
+		}
+		if have.GasUsed.Cmp(want.GasUsed) != 0 {
+			diverge(tx, "gasUsed", have.GasUsed, want.GasUsed)
+		}
+		if have.ContractAddress != want.ContractAddress {
+			diverge(tx, "contractAddress", have.ContractAddress.Hex(), want.ContractAddress.Hex())
+		}
+		if have.Bloom != want.Bloom {
+			diverge(tx, "logsBloom", common.ToHex(have.Bloom[:]), common.ToHex(want.Bloom[:]))
+		}
+		if len(have.Logs) != len(want.Logs) {
+			diverge(tx, "logs", len(have.Logs), len(want.Logs))
+		}
+		for j := 0; j < len(have.Logs) && j < len(want.Logs); j++ {
+			hlog, wlog := have.Logs[j], want.Logs[j]
+			if hlog.Address != wlog.Address {
+				diverge(tx, fmt.Sprintf("logs[%d].address", j), hlog.Address.Hex(), wlog.Address.Hex())
+			}
+			if fmt.Sprint(hlog.Topics) != fmt.Sprint(wlog.Topics) {
+				diverge(tx, fmt.Sprintf("logs[%d].topics", j), hlog.Topics, wlog.Topics)
+			}
+			if !bytes.Equal(hlog.Data, wlog.Data) {
+				diverge(tx, fmt.Sprintf("logs[%d].data", j), common.ToHex(hlog.Data), common.ToHex(wlog.Data))
+			}
+		}
+	}
+	return divergences
+}
+
+// newReplayDivergence creates a divergence of a block, or of the receipt of one
+// of its transactions if tx is set.
+func newReplayDivergence(block *types.Block, tx *common.Hash, field, have, want string) *ReplayDivergence {
+	return &ReplayDivergence{
+		Number: block.NumberU64(),
+		Hash:   block.Hash(),
+		TxHash: tx,
+		Field:  field,
+		Have:   have,
+		Want:   want,
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// replayTestDatabase is a database failing the test on any modification.
+type replayTestDatabase struct {
+	ethdb.Database
+	t *testing.T
+}
+
+func (db *replayTestDatabase) Put(key []byte, value []byte) error {
+	db.t.Errorf("database modified: put %x", key)
+	return nil
+}
+
+func (db *replayTestDatabase) Delete(key []byte) error {
+	db.t.Errorf("database modified: delete %x", key)
+	return nil
+}
+
+func (db *replayTestDatabase) NewBatch() ethdb.Batch {
+	db.t.Errorf("database modified: new batch")
+	return db.Database.NewBatch()
+}
+
+// replayTestEngine is a consensus engine paying an extra wei of reward in a
+// block, simulating a change of the block processing rules.
+type replayTestEngine struct {
+	consensus.Engine
+	number uint64
+}
+
+func (e *replayTestEngine) Finalize(chain consensus.ChainReader, header *types.Header, state *state.StateDB, txs []*types.Transaction, uncles []*types.Header, receipts []*types.Receipt) (*types.Block, error) {
+	if header.Number.Uint64() == e.number {
+		state.AddBalance(header.Coinbase, big.NewInt(1))
+	}
+	return e.Engine.Finalize(chain, header, state, txs, uncles, receipts)
+}
+
+// Tests that replaying an intact chain doesn't find any divergence nor modify the
+// database, and that divergent receipts and states are reported.
+func TestReplayChain(t *testing.T) {
+	db, blockchain, blocks := newTxIndexTestChain(t, 32, 0)
+	blockchain.Stop()
+
+	readonly := &replayTestDatabase{Database: db, t: t}
+	report, err := ReplayChain(readonly, params.TestChainConfig, ethash.NewFaker(), 0, 32, 4)
+	if err != nil {
+		t.Fatalf("failed to replay chain: %v", err)
+	}
+	if report.From != 1 || report.To != 32 || report.Replayed != 32 {
+		t.Errorf("report range mismatch: have #%d-#%d (%d blocks), want #1-#32 (32 blocks)", report.From, report.To, report.Replayed)
+	}
+	if len(report.Divergences) != 0 {
+		t.Fatalf("divergences found in intact chain: %v", report.Divergences[0])
+	}
+	// Tamper with the stored receipts of a block
+	block := blocks[9]
+	receipts := GetBlockReceipts(db, block.Hash(), block.NumberU64())
+	tampered := GetBlockReceipts(db, block.Hash(), block.NumberU64())
+	tampered[0].PostState = common.Hash{1}.Bytes()
+	WriteBlockReceipts(db, block.Hash(), block.NumberU64(), tampered)
+
+	// Replay with modified processing rules in another block
+	engine := &replayTestEngine{Engine: ethash.NewFaker(), number: 20}
+	if report, err = ReplayChain(readonly, params.TestChainConfig, engine, 5, 25, 4); err != nil {
+		t.Fatalf("failed to replay chain: %v", err)
+	}
+	WriteBlockReceipts(db, block.Hash(), block.NumberU64(), receipts)
+
+	want := []struct {
+		number uint64
+		tx     bool
+		field  string
+	}{
+		{10, true, "postState"},
+		{20, false, "stateRoot"},
+	}
+	if len(report.Divergences) != len(want) {
+		t.Fatalf("divergence count mismatch: have %d, want %d", len(report.Divergences), len(want))
+	}
+	for i, divergence := range report.Divergences {
+		if divergence.Number != want[i].number || (divergence.TxHash != nil) != want[i].tx || divergence.Field != want[i].field {
+			t.Errorf("divergence %d: have #%d %s (tx %v), want #%d %s (tx %v)", i, divergence.Number, divergence.Field, divergence.TxHash != nil, want[i].number, want[i].field, want[i].tx)
+		}
+	}
+	if tx := report.Divergences[0].TxHash; tx != nil && *tx != block.Transactions()[0].Hash() {
+		t.Errorf("divergent transaction mismatch: have %x, want %x", *tx, block.Transactions()[0].Hash())
+	}
+}
+
+// Tests that blocks without their parent state stored are replayed on top of the
+// states regenerated for their ancestors.
+func TestReplayPrunedChain(t *testing.T) {
+	var (
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  GenesisAlloc{address: {Balance: big.NewInt(1000000000)}},
+		}
+		gendb, _ = ethdb.NewMemDatabase()
+		db, _    = ethdb.NewMemDatabase()
+	)
+	// Generate the chain in a separate database, as the generator persists all states
+	blocks, _ := GenerateChain(gspec.Config, gspec.MustCommit(gendb), gendb, 32, func(i int, block *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.Address{1}, big.NewInt(1000), big.NewInt(21000), new(big.Int), nil), types.HomesteadSigner{}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.AddTx(tx)
+	})
+	gspec.MustCommit(db)
+	blockchain, _ := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	blockchain.Stop()
+
+	if ok, _ := db.Has(blocks[15].Root().Bytes()); ok {
+		t.Fatalf("state of block #%d not pruned", blocks[15].NumberU64())
+	}
+	report, err := ReplayChain(db, params.TestChainConfig, ethash.NewFaker(), 1, 32, 4)
+	if err != nil {
+		t.Fatalf("failed to replay chain: %v", err)
+	}
+	if report.Replayed != 32 {
+		t.Errorf("replayed block count mismatch: have %d, want 32", report.Replayed)
+	}
+	if len(report.Divergences) != 0 {
+		t.Errorf("divergences found in intact chain: %v", report.Divergences[0])
+	}
+	// Blocks following a failed one can't be verified until a parent state is stored
+	block := blocks[9]
+	poor, _ := crypto.GenerateKey()
+	tx, err := types.SignTx(types.NewTransaction(0, common.Address{1}, big.NewInt(1000), big.NewInt(21000), new(big.Int), nil), types.HomesteadSigner{}, poor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := GetBody(db, block.Hash(), block.NumberU64())
+	WriteBody(db, block.Hash(), block.NumberU64(), &types.Body{Transactions: types.Transactions{tx}})
+	report, err = ReplayChain(db, params.TestChainConfig, ethash.NewFaker(), 1, 32, 4)
+	WriteBody(db, block.Hash(), block.NumberU64(), body)
+	if err != nil {
+		t.Fatalf("failed to replay chain: %v", err)
+	}
+	if report.Unverified == 0 || report.Replayed+report.Unverified != 32 {
+		t.Errorf("block count mismatch: have %d replayed and %d unverified, want 32 in total", report.Replayed, report.Unverified)
+	}
+	if len(report.Divergences) != 1 || report.Divergences[0].Number != 10 || report.Divergences[0].Field != "error" {
+		t.Fatalf("failure not reported alone: %v", report.Divergences)
+	}
+	// The replay can't start without the parent state
+	if _, err := ReplayChain(db, params.TestChainConfig, ethash.NewFaker(), 16, 32, 4); err == nil {
+		t.Errorf("replay started without parent state")
+	}
+}
@@ -22,6 +22,7 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
 	lru "github.com/hashicorp/golang-lru"
 )
@@ -50,6 +51,9 @@ type Database interface {
 	ContractCodeSize(addrHash, codeHash common.Hash) (int, error)
 	// CopyTrie returns an independent copy of the given trie.
 	CopyTrie(Trie) Trie
+	// TrieDB retrieves the intermediate trie node database tries are
+	// committed to.
+	TrieDB() *trie.NodeDatabase
 }
 
 // Trie is a Ethereum Merkle Trie.
@@ -61,17 +65,33 @@ type Trie interface {
 	Hash() common.Hash
 	NodeIterator(startKey []byte) trie.NodeIterator
 	GetKey([]byte) []byte // TODO(fjl): remove this when SecureTrie is removed
+	TryProve(key []byte) ([]rlp.RawValue, error)
 }
 
 // NewDatabase creates a backing store for state. The returned database is safe for
-// concurrent use and retains cached trie nodes in memory.
+// concurrent use and retains cached trie nodes in memory. Committed tries are
+// held in an intermediate node database until flushed to db.
 func NewDatabase(db ethdb.Database) Database {
 	csc, _ := lru.New(codeSizeCacheSize)
-	return &cachingDB{db: db, codeSizeCache: csc}
+	return &cachingDB{
+		db:            trie.NewNodeDatabase(db, accountReferences),
+		codeSizeCache: csc,
+	}
+}
+
+// accountReferences links the leaves of the account trie to the storage trie
+// and the code of the accounts, so that they are garbage collected together.
+// Leaves of the storage tries don't decode as accounts.
+func accountReferences(value []byte) []common.Hash {
+	var account Account
+	if err := rlp.DecodeBytes(value, &account); err != nil {
+		return nil
+	}
+	return []common.Hash{account.Root, common.BytesToHash(account.CodeHash)}
 }
 
 type cachingDB struct {
-	db            ethdb.Database
+	db            *trie.NodeDatabase
 	mu            sync.Mutex
 	pastTries     []*trie.SecureTrie
 	codeSizeCache *lru.Cache
@@ -128,6 +148,10 @@ func (db *cachingDB) ContractCode(addrHash, codeHash common.Hash) ([]byte, error
 	return code, err
 }
 
+func (db *cachingDB) TrieDB() *trie.NodeDatabase {
+	return db.db
+}
+
 func (db *cachingDB) ContractCodeSize(addrHash, codeHash common.Hash) (int, error) {
 	if cached, ok := db.codeSizeCache.Get(codeHash); ok {
 		return cached.(int), nil
@@ -0,0 +1,132 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// DiffAccount is the content of an account as recorded in a state diff, without
+// its storage.
+type DiffAccount struct {
+	Nonce    uint64
+	Balance  *big.Int
+	CodeHash common.Hash
+}
+
+// StorageDiff is the change of a single storage slot.
+type StorageDiff struct {
+	Key  common.Hash
+	Pre  common.Hash
+	Post common.Hash
+}
+
+// AccountDiff is the change of a single account along with its modified storage
+// slots. Pre is nil for accounts which didn't exist before the change and Post
+// for the ones which were deleted.
+type AccountDiff struct {
+	Address common.Address
+	Pre     *DiffAccount `rlp:"nil"`
+	Post    *DiffAccount `rlp:"nil"`
+	Storage []StorageDiff
+}
+
+// Diff computes the changes made to the accounts and storage slots of the state
+// relative to origin, which must be the state it was started from. Only the
+// accounts and slots modified since the state was last committed are compared,
+// so the intermediate root needs to be computed beforehand, but not committed.
+// The diffs are sorted by address and storage key.
+//
+// The storage of deleted accounts is implicitly cleared, but only the slots
+// accessed before the deletion are listed.
+func (self *StateDB) Diff(origin *StateDB) []*AccountDiff {
+	var diffs []*AccountDiff
+	for addr := range self.stateObjectsDirty {
+		diff := &AccountDiff{
+			Address: addr,
+			Pre:     origin.diffAccount(addr),
+			Post:    self.diffAccount(addr),
+		}
+		// Compare all the cached slots, they contain the modified ones
+		var keys []common.Hash
+		if obj := self.stateObjects[addr]; obj != nil {
+			for key := range obj.cachedStorage {
+				keys = append(keys, key)
+			}
+		}
+		sort.Sort(hashes(keys))
+
+		for _, key := range keys {
+			var pre, post common.Hash
+			if diff.Pre != nil {
+				pre = origin.GetState(addr, key)
+			}
+			if diff.Post != nil {
+				post = self.GetState(addr, key)
+			}
+			if pre != post {
+				diff.Storage = append(diff.Storage, StorageDiff{Key: key, Pre: pre, Post: post})
+			}
+		}
+		if len(diff.Storage) == 0 && equalDiffAccounts(diff.Pre, diff.Post) {
+			continue
+		}
+		diffs = append(diffs, diff)
+	}
+	sort.Sort(accountDiffs(diffs))
+	return diffs
+}
+
+// diffAccount retrieves the current content of an account, or nil if it does
+// not exist.
+func (self *StateDB) diffAccount(addr common.Address) *DiffAccount {
+	obj := self.getStateObject(addr)
+	if obj == nil {
+		return nil
+	}
+	return &DiffAccount{
+		Nonce:    obj.Nonce(),
+		Balance:  new(big.Int).Set(obj.Balance()),
+		CodeHash: common.BytesToHash(obj.CodeHash()),
+	}
+}
+
+// equalDiffAccounts reports whether two (possibly missing) accounts are equal.
+func equalDiffAccounts(a, b *DiffAccount) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Nonce == b.Nonce && a.Balance.Cmp(b.Balance) == 0 && a.CodeHash == b.CodeHash
+}
+
+type hashes []common.Hash
+
+func (h hashes) Len() int           { return len(h) }
+func (h hashes) Less(i, j int) bool { return bytes.Compare(h[i][:], h[j][:]) < 0 }
+func (h hashes) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+type accountDiffs []*AccountDiff
+
+func (d accountDiffs) Len() int { return len(d) }
+func (d accountDiffs) Less(i, j int) bool {
+	return bytes.Compare(d[i].Address[:], d[j].Address[:]) < 0
+}
+func (d accountDiffs) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
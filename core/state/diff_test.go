@@ -0,0 +1,95 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Tests that the diff of a state lists exactly the modified accounts and slots
+// with their original and new values.
+func TestStateDiff(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	sdb := NewDatabase(db)
+
+	// Create an origin state with a few accounts
+	origin, _ := New(common.Hash{}, sdb)
+	origin.SetBalance(common.Address{0x01}, big.NewInt(100))
+	origin.SetNonce(common.Address{0x02}, 1)
+	origin.SetState(common.Address{0x02}, common.Hash{0x01}, common.Hash{0x01})
+	origin.SetState(common.Address{0x02}, common.Hash{0x02}, common.Hash{0x02})
+	origin.SetBalance(common.Address{0x03}, big.NewInt(300))
+	root, _ := origin.CommitTo(db, false)
+
+	// Modify some of them, touching some without changes
+	statedb, _ := New(root, sdb)
+	statedb.AddBalance(common.Address{0x01}, big.NewInt(0))
+	statedb.SetState(common.Address{0x02}, common.Hash{0x01}, common.Hash{0x01})
+	statedb.SetState(common.Address{0x02}, common.Hash{0x02}, common.Hash{0x03})
+	statedb.SetState(common.Address{0x02}, common.Hash{0x03}, common.Hash{0x04})
+	statedb.Suicide(common.Address{0x03})
+	statedb.SetCode(common.Address{0x04}, []byte{0x00})
+	statedb.IntermediateRoot(false)
+
+	origin, _ = New(root, sdb)
+	want := []*AccountDiff{
+		{
+			Address: common.Address{0x02},
+			Pre:     &DiffAccount{Nonce: 1, Balance: new(big.Int), CodeHash: crypto.Keccak256Hash(nil)},
+			Post:    &DiffAccount{Nonce: 1, Balance: new(big.Int), CodeHash: crypto.Keccak256Hash(nil)},
+			Storage: []StorageDiff{
+				{Key: common.Hash{0x02}, Pre: common.Hash{0x02}, Post: common.Hash{0x03}},
+				{Key: common.Hash{0x03}, Pre: common.Hash{}, Post: common.Hash{0x04}},
+			},
+		},
+		{
+			Address: common.Address{0x03},
+			Pre:     &DiffAccount{Balance: big.NewInt(300), CodeHash: crypto.Keccak256Hash(nil)},
+		},
+		{
+			Address: common.Address{0x04},
+			Post:    &DiffAccount{Balance: new(big.Int), CodeHash: crypto.Keccak256Hash([]byte{0x00})},
+		},
+	}
+	diff := statedb.Diff(origin)
+	if !reflect.DeepEqual(diff, want) {
+		t.Fatalf("diff mismatch:\nhave %+v\nwant %+v", diff, want)
+	}
+	// Ensure the diff survives an RLP round trip
+	blob, err := rlp.EncodeToBytes(diff)
+	if err != nil {
+		t.Fatalf("failed to encode diff: %v", err)
+	}
+	var dec []*AccountDiff
+	if err := rlp.DecodeBytes(blob, &dec); err != nil {
+		t.Fatalf("failed to decode diff: %v", err)
+	}
+	if len(dec) != len(want) || dec[1].Post != nil || dec[2].Pre != nil {
+		t.Fatalf("decoded diff mismatch: have %+v, want %+v", dec, want)
+	}
+	if reenc, _ := rlp.EncodeToBytes(dec); !bytes.Equal(reenc, blob) {
+		t.Fatalf("decoded diff re-encoding mismatch: have %x, want %x", reenc, blob)
+	}
+}
@@ -17,14 +17,28 @@
 package state
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
 )
 
+// DumpConfig selects the accounts of the state to dump, and the data to include.
+// Accounts are dumped in the order of their keys, the hashes of their addresses.
+type DumpConfig struct {
+	SkipCode    bool   // Whether to leave out the contract codes
+	SkipStorage bool   // Whether to leave out the contract storages
+	Start       []byte // Key of the first account to dump, nil to start at the first one
+	Limit       []byte // Key of the account to stop before, nil to dump until the last one
+	Max         uint64 // Maximum number of accounts to dump, 0 for no limit
+}
+
 type DumpAccount struct {
 	Balance  string            `json:"balance"`
 	Nonce    uint64            `json:"nonce"`
@@ -32,6 +46,8 @@ type DumpAccount struct {
 	CodeHash string            `json:"codeHash"`
 	Code     string            `json:"code"`
 	Storage  map[string]string `json:"storage"`
+	Address  *common.Address   `json:"address,omitempty"` // Only set in iterative dumps, if the preimage is known
+	Key      string            `json:"key,omitempty"`     // Only set in iterative dumps
 }
 
 type Dump struct {
@@ -39,38 +55,99 @@ type Dump struct {
 	Accounts map[string]DumpAccount `json:"accounts"`
 }
 
-func (self *StateDB) RawDump() Dump {
-	dump := Dump{
-		Root:     fmt.Sprintf("%x", self.trie.Hash()),
-		Accounts: make(map[string]DumpAccount),
-	}
+// IteratorDump is a page of the accounts of the state, along with the key of the
+// account to continue the iteration at.
+type IteratorDump struct {
+	Root     string        `json:"root"`
+	Accounts []DumpAccount `json:"accounts"`
+	Next     hexutil.Bytes `json:"next,omitempty"` // Nil if no accounts are left
+}
 
-	it := trie.NewIterator(self.trie.NodeIterator(nil))
+// dump iterates over the accounts of the state selected by the config, passing
+// them to the callback. It returns the key of the account the iteration stopped
+// at due to the account limit, or nil if all selected accounts were dumped.
+func (self *StateDB) dump(conf *DumpConfig, onAccount func(key, addr []byte, account DumpAccount) error) ([]byte, error) {
+	if conf == nil {
+		conf = new(DumpConfig)
+	}
+	var (
+		count uint64
+		it    = trie.NewIterator(self.trie.NodeIterator(conf.Start))
+	)
 	for it.Next() {
-		addr := self.trie.GetKey(it.Key)
+		if conf.Limit != nil && bytes.Compare(it.Key, conf.Limit) >= 0 {
+			return nil, nil
+		}
+		if conf.Max > 0 && count >= conf.Max {
+			return common.CopyBytes(it.Key), nil
+		}
 		var data Account
 		if err := rlp.DecodeBytes(it.Value, &data); err != nil {
-			panic(err)
+			return nil, fmt.Errorf("invalid account %x: %v", it.Key, err)
 		}
-
-		obj := newObject(nil, common.BytesToAddress(addr), data)
+		addrHash := common.BytesToHash(it.Key)
 		account := DumpAccount{
 			Balance:  data.Balance.String(),
 			Nonce:    data.Nonce,
 			Root:     common.Bytes2Hex(data.Root[:]),
 			CodeHash: common.Bytes2Hex(data.CodeHash),
-			Code:     common.Bytes2Hex(obj.Code(self.db)),
-			Storage:  make(map[string]string),
 		}
-		storageIt := trie.NewIterator(obj.getTrie(self.db).NodeIterator(nil))
-		for storageIt.Next() {
-			account.Storage[common.Bytes2Hex(self.trie.GetKey(storageIt.Key))] = common.Bytes2Hex(storageIt.Value)
+		if !conf.SkipCode && !bytes.Equal(data.CodeHash, emptyCodeHash) {
+			code, err := self.db.ContractCode(addrHash, common.BytesToHash(data.CodeHash))
+			if err != nil {
+				return nil, fmt.Errorf("code of account %x: %v", it.Key, err)
+			}
+			account.Code = common.Bytes2Hex(code)
 		}
-		dump.Accounts[common.Bytes2Hex(addr)] = account
+		if !conf.SkipStorage {
+			st, err := self.db.OpenStorageTrie(addrHash, data.Root)
+			if err != nil {
+				return nil, fmt.Errorf("storage of account %x: %v", it.Key, err)
+			}
+			account.Storage = make(map[string]string)
+			storageIt := trie.NewIterator(st.NodeIterator(nil))
+			for storageIt.Next() {
+				account.Storage[common.Bytes2Hex(self.trie.GetKey(storageIt.Key))] = common.Bytes2Hex(storageIt.Value)
+			}
+			if storageIt.Err != nil {
+				return nil, fmt.Errorf("storage of account %x: %v", it.Key, storageIt.Err)
+			}
+		}
+		if err := onAccount(it.Key, self.trie.GetKey(it.Key), account); err != nil {
+			return nil, err
+		}
+		count++
+	}
+	return nil, it.Err
+}
+
+// RawDump returns all the accounts of the state, collected in memory. The dump
+// stops at the first account which can't be dumped, logging the error, and only
+// the accounts dumped until then are returned.
+func (self *StateDB) RawDump() Dump {
+	dump, err := self.RawDumpWithConfig(nil)
+	if err != nil {
+		log.Error("Failed to dump state", "root", dump.Root, "err", err)
 	}
 	return dump
 }
 
+// RawDumpWithConfig returns the accounts of the state selected by the config, all
+// of them if nil, collected in memory. Large states should be dumped with
+// IterativeDump. The accounts dumped until an error occurred are returned along
+// with it.
+func (self *StateDB) RawDumpWithConfig(conf *DumpConfig) (Dump, error) {
+	dump := Dump{
+		Root:     fmt.Sprintf("%x", self.trie.Hash()),
+		Accounts: make(map[string]DumpAccount),
+	}
+	_, err := self.dump(conf, func(key, addr []byte, account DumpAccount) error {
+		dump.Accounts[common.Bytes2Hex(addr)] = account
+		return nil
+	})
+	return dump, err
+}
+
 func (self *StateDB) Dump() []byte {
 	json, err := json.MarshalIndent(self.RawDump(), "", "    ")
 	if err != nil {
@@ -79,3 +156,59 @@ func (self *StateDB) Dump() []byte {
 
 	return json
 }
+
+// DumpWithConfig returns the accounts of the state selected by the config as
+// indented JSON.
+func (self *StateDB) DumpWithConfig(conf *DumpConfig) ([]byte, error) {
+	dump, err := self.RawDumpWithConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(dump, "", "    ")
+}
+
+// iterativeAccount fills in the identity of an account dumped iteratively.
+func iterativeAccount(key, addr []byte, account DumpAccount) DumpAccount {
+	if addr != nil {
+		address := common.BytesToAddress(addr)
+		account.Address = &address
+	}
+	account.Key = common.Bytes2Hex(key)
+	return account
+}
+
+// IteratorDump returns the accounts of the state selected by the config, along
+// with the key to set as the start of the config to dump the next accounts.
+func (self *StateDB) IteratorDump(conf *DumpConfig) (IteratorDump, error) {
+	dump := IteratorDump{
+		Root:     fmt.Sprintf("%x", self.trie.Hash()),
+		Accounts: []DumpAccount{},
+	}
+	next, err := self.dump(conf, func(key, addr []byte, account DumpAccount) error {
+		dump.Accounts = append(dump.Accounts, iterativeAccount(key, addr, account))
+		return nil
+	})
+	if err != nil {
+		return IteratorDump{}, err
+	}
+	dump.Next = next
+	return dump, nil
+}
+
+// IterativeDump streams the accounts of the state selected by the config to the
+// writer as JSON lines: a first line holding the state root, followed by a line
+// per account. It returns the key to set as the start of the config to dump the
+// next accounts, nil if no accounts are left.
+func (self *StateDB) IterativeDump(conf *DumpConfig, w io.Writer) ([]byte, error) {
+	enc := json.NewEncoder(w)
+	root := struct {
+		Root string `json:"root"`
+	}{fmt.Sprintf("%x", self.trie.Hash())}
+
+	if err := enc.Encode(root); err != nil {
+		return nil, err
+	}
+	return self.dump(conf, func(key, addr []byte, account DumpAccount) error {
+		return enc.Encode(iterativeAccount(key, addr, account))
+	})
+}
@@ -0,0 +1,153 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+var (
+	snapshotRootKey      = []byte("SnapshotRoot")      // snapshotRootKey -> state root of the persisted snapshot
+	snapshotGeneratorKey = []byte("SnapshotGenerator") // snapshotGeneratorKey -> RLP encoded generator progress
+
+	snapshotAccountPrefix = []byte("a") // snapshotAccountPrefix + account hash -> account RLP
+	snapshotStoragePrefix = []byte("o") // snapshotStoragePrefix + account hash + storage hash -> storage slot RLP
+)
+
+// generatorStatus is the progress of the snapshot generation persisted to
+// disk, so that it can be resumed after a restart.
+type generatorStatus struct {
+	Done   bool
+	Marker []byte // Hash of the last account generated
+}
+
+// accountKey = snapshotAccountPrefix + hash
+func accountKey(hash common.Hash) []byte {
+	return append(append([]byte{}, snapshotAccountPrefix...), hash[:]...)
+}
+
+// storageKey = snapshotStoragePrefix + account hash + storage hash
+func storageKey(accountHash, storageHash common.Hash) []byte {
+	key := append(append([]byte{}, snapshotStoragePrefix...), accountHash[:]...)
+	return append(key, storageHash[:]...)
+}
+
+// readSnapshotRoot retrieves the state root the persisted snapshot represents,
+// or the empty hash if there is no usable snapshot on disk.
+func readSnapshotRoot(db ethdb.Database) common.Hash {
+	data, _ := db.Get(snapshotRootKey)
+	if len(data) != common.HashLength {
+		return common.Hash{}
+	}
+	return common.BytesToHash(data)
+}
+
+// writeSnapshotRoot stores the state root the persisted snapshot represents.
+func writeSnapshotRoot(db trie.DatabaseWriter, root common.Hash) error {
+	return db.Put(snapshotRootKey, root[:])
+}
+
+// readGeneratorStatus retrieves the progress of the snapshot generation, or nil
+// if none was persisted.
+func readGeneratorStatus(db ethdb.Database) *generatorStatus {
+	data, _ := db.Get(snapshotGeneratorKey)
+	if len(data) == 0 {
+		return nil
+	}
+	status := new(generatorStatus)
+	if err := rlp.DecodeBytes(data, status); err != nil {
+		return nil
+	}
+	return status
+}
+
+// writeGeneratorStatus stores the progress of the snapshot generation.
+func writeGeneratorStatus(db trie.DatabaseWriter, marker []byte) error {
+	data, err := rlp.EncodeToBytes(&generatorStatus{Done: marker == nil, Marker: marker})
+	if err != nil {
+		return err
+	}
+	return db.Put(snapshotGeneratorKey, data)
+}
+
+// deletePrefix schedules the deletion of every key of the given length starting
+// with prefix into the batch, writing it out whenever it grows beyond the ideal
+// size. The length filters out the trie nodes and contract codes whose hashes
+// happen to start with the prefix.
+func deletePrefix(db ethdb.Iteratee, batch ethdb.Batch, prefix []byte, length int) error {
+	it := db.NewIteratorWithPrefix(prefix)
+	defer it.Release()
+
+	for it.Next() {
+		if len(it.Key()) != length {
+			continue
+		}
+		if err := batch.Delete(common.CopyBytes(it.Key())); err != nil {
+			return err
+		}
+		if batch.ValueSize() > ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	return it.Error()
+}
+
+// wipeSnapshot removes the entire persisted snapshot from the database. The root
+// and generator status are deleted in the first write, so a crash midway leaves
+// behind only unreferenced data, which is wiped again by the next rebuild.
+func wipeSnapshot(db ethdb.Database) error {
+	batch := db.NewBatch()
+	if err := batch.Delete(snapshotRootKey); err != nil {
+		return err
+	}
+	if err := batch.Delete(snapshotGeneratorKey); err != nil {
+		return err
+	}
+	if err := deletePrefix(db, batch, snapshotAccountPrefix, len(snapshotAccountPrefix)+common.HashLength); err != nil {
+		return err
+	}
+	if err := deletePrefix(db, batch, snapshotStoragePrefix, len(snapshotStoragePrefix)+2*common.HashLength); err != nil {
+		return err
+	}
+	return batch.Write()
+}
+
+// wipeStorage schedules the deletion of all the storage slots of an account
+// from the persisted snapshot into the batch. Unlike the whole snapshot wipe,
+// the batch is never written midway, keeping the flattening atomic.
+func wipeStorage(db ethdb.Iteratee, batch ethdb.Deleter, accountHash common.Hash) error {
+	prefix := append(append([]byte{}, snapshotStoragePrefix...), accountHash[:]...)
+
+	it := db.NewIteratorWithPrefix(prefix)
+	defer it.Release()
+
+	for it.Next() {
+		if len(it.Key()) != len(prefix)+common.HashLength {
+			continue
+		}
+		if err := batch.Delete(common.CopyBytes(it.Key())); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
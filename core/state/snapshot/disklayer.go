@@ -0,0 +1,200 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// diskLayer is a low level persistent snapshot built on top of a key-value store.
+type diskLayer struct {
+	diskdb ethdb.Database     // Key-value store containing the base snapshot
+	triedb *trie.NodeDatabase // Trie node cache for reconstructing the snapshot
+	root   common.Hash        // Root hash of the base snapshot
+
+	genMarker []byte // Hash of the last account generated, nil if generation finished
+	isStale   bool   // Signals that the layer became stale (state progressed)
+
+	lock sync.RWMutex
+}
+
+// Root returns the root hash for which this snapshot was made.
+func (dl *diskLayer) Root() common.Hash {
+	return dl.root
+}
+
+// parent always returns nil as there's no layer below the disk.
+func (dl *diskLayer) parent() snapshot {
+	return nil
+}
+
+// stale returns whether this layer has become stale (was flattened across) or
+// if it's still live.
+func (dl *diskLayer) stale() bool {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	return dl.isStale
+}
+
+// markStale invalidates the layer, failing all subsequent reads.
+func (dl *diskLayer) markStale() {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	dl.isStale = true
+}
+
+// covered returns whether the data of an account was already generated. The
+// caller must hold the layer lock.
+func (dl *diskLayer) covered(hash common.Hash) bool {
+	return dl.genMarker == nil || bytes.Compare(hash[:], dl.genMarker) <= 0
+}
+
+// Account directly retrieves the consensus RLP encoding of the account
+// associated with a particular hash in the snapshot.
+func (dl *diskLayer) Account(hash common.Hash) ([]byte, error) {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	if dl.isStale {
+		return nil, ErrSnapshotStale
+	}
+	if !dl.covered(hash) {
+		return nil, ErrNotCoveredYet
+	}
+	blob, _ := dl.diskdb.Get(accountKey(hash))
+	if len(blob) == 0 {
+		return nil, nil
+	}
+	return blob, nil
+}
+
+// Storage directly retrieves the storage data associated with a particular
+// hash, within a particular account.
+func (dl *diskLayer) Storage(accountHash, storageHash common.Hash) ([]byte, error) {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	if dl.isStale {
+		return nil, ErrSnapshotStale
+	}
+	if !dl.covered(accountHash) {
+		return nil, ErrNotCoveredYet
+	}
+	blob, _ := dl.diskdb.Get(storageKey(accountHash, storageHash))
+	if len(blob) == 0 {
+		return nil, nil
+	}
+	return blob, nil
+}
+
+// flatten writes a chain of diff layers, ordered from newest to oldest, into
+// the persistent database, returning the new disk layer. Data not covered by
+// the generation yet is skipped, it will be picked up from the tries.
+func (dl *diskLayer) flatten(diffs []*diffLayer) (*diskLayer, error) {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	// Merge the diffs into a single change set, oldest first
+	var (
+		destructs = make(map[common.Hash]struct{})
+		accounts  = make(map[common.Hash][]byte)
+		storage   = make(map[common.Hash]map[common.Hash][]byte)
+	)
+	for i := len(diffs) - 1; i >= 0; i-- {
+		diff := diffs[i]
+		for hash := range diff.destructs {
+			destructs[hash] = struct{}{}
+			delete(accounts, hash)
+			delete(storage, hash)
+		}
+		for hash, data := range diff.accounts {
+			accounts[hash] = data
+		}
+		for hash, slots := range diff.storage {
+			if _, ok := storage[hash]; !ok {
+				storage[hash] = make(map[common.Hash][]byte)
+			}
+			for slot, data := range slots {
+				storage[hash][slot] = data
+			}
+		}
+	}
+	// Write all the changes in a single batch, so a crash midway can't leave a
+	// partially flattened snapshot behind
+	batch := dl.diskdb.NewBatch()
+	for hash := range destructs {
+		if !dl.covered(hash) {
+			continue
+		}
+		if err := batch.Delete(accountKey(hash)); err != nil {
+			return nil, err
+		}
+		if err := wipeStorage(dl.diskdb, batch, hash); err != nil {
+			return nil, err
+		}
+	}
+	for hash, data := range accounts {
+		if !dl.covered(hash) {
+			continue
+		}
+		if len(data) == 0 {
+			if err := batch.Delete(accountKey(hash)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := batch.Put(accountKey(hash), data); err != nil {
+			return nil, err
+		}
+	}
+	for hash, slots := range storage {
+		if !dl.covered(hash) {
+			continue
+		}
+		for slot, data := range slots {
+			if len(data) == 0 {
+				if err := batch.Delete(storageKey(hash, slot)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err := batch.Put(storageKey(hash, slot), data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	root := diffs[0].root
+	if err := writeSnapshotRoot(batch, root); err != nil {
+		return nil, err
+	}
+	if err := batch.Write(); err != nil {
+		return nil, err
+	}
+	return &diskLayer{
+		diskdb:    dl.diskdb,
+		triedb:    dl.triedb,
+		root:      root,
+		genMarker: dl.genMarker,
+	}, nil
+}
@@ -0,0 +1,282 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// generatorBatchSize is the number of snapshot entries generated in one go
+// before persisting them.
+const generatorBatchSize = 10000
+
+// generatorRetries is the number of consecutive batches dropped due to the disk
+// layer being flattened meanwhile, after which the disk layer is pinned for the
+// next batch, so that the generation can't be starved.
+const generatorRetries = 3
+
+// emptyRoot is the known root hash of an empty trie.
+var emptyRoot = common.HexToHash("56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421")
+
+// account mirrors the consensus representation of accounts, needed to find the
+// storage tries belonging to them.
+type account struct {
+	Nonce    uint64
+	Balance  *big.Int
+	Root     common.Hash
+	CodeHash []byte
+}
+
+// startGeneration launches the background generation of the snapshot from the
+// tries. The caller must hold the tree lock.
+func (t *Tree) startGeneration() {
+	quit := make(chan struct{})
+	t.genAbort = quit
+	go t.generate(quit)
+}
+
+// stopGeneration terminates the background generation of the snapshot and
+// unpins the disk layer. As the generator only persists data while holding the
+// tree lock, which the caller must hold, no more data is written after this
+// method returns.
+func (t *Tree) stopGeneration() {
+	if t.genAbort != nil {
+		close(t.genAbort)
+		t.genAbort = nil
+	}
+	t.genPinned = false
+}
+
+// generate iterates the state tries of the disk layer in batches, writing the
+// accounts and storage slots into the snapshot until all of it is covered. The
+// tries are iterated without holding the tree lock, which is only taken to
+// persist a batch. A batch generated from a disk layer which was flattened into
+// a new one meanwhile is outdated, so it's dropped and generated again from the
+// new disk layer, whose covered range was maintained by the flattening. If the
+// disk layer keeps being flattened faster than a batch is generated, it's pinned
+// for the next batch instead, deferring the flattening until the batch is done.
+func (t *Tree) generate(quit chan struct{}) {
+	var (
+		start    = time.Now()
+		accounts int
+		slots    int
+		dropped  int
+	)
+	for {
+		t.lock.Lock()
+		select {
+		case <-quit:
+			t.lock.Unlock()
+			return
+		default:
+		}
+		dl := t.disk
+		t.genPinned = dropped >= generatorRetries
+		t.lock.Unlock()
+
+		batch, marker, a, s, err := t.generateBatch(dl, generatorBatchSize)
+
+		t.lock.Lock()
+		select {
+		case <-quit:
+			t.lock.Unlock()
+			return
+		default:
+		}
+		t.genPinned = false
+		if t.disk != dl {
+			t.lock.Unlock()
+			dropped++
+			continue
+		}
+		dropped = 0
+		if err == nil {
+			err = t.finishBatch(dl, batch, marker)
+		}
+		t.lock.Unlock()
+
+		if err != nil {
+			log.Error("State snapshot generation failed", "accounts", accounts, "slots", slots, "err", err)
+			return
+		}
+		accounts, slots = accounts+a, slots+s
+		if marker == nil {
+			log.Info("Generated state snapshot", "accounts", accounts, "slots", slots, "elapsed", common.PrettyDuration(time.Since(start)))
+			return
+		}
+		log.Debug("Generating state snapshot", "accounts", accounts, "slots", slots, "elapsed", common.PrettyDuration(time.Since(start)))
+	}
+}
+
+// generateBatch generates roughly limit snapshot entries of a disk layer after
+// its generation marker into a batch, returning it along with the marker to
+// move to, nil if the snapshot is complete, and the number of accounts and
+// storage slots generated. Nothing is persisted.
+func (t *Tree) generateBatch(dl *diskLayer, limit int) (ethdb.Batch, []byte, int, int, error) {
+	dl.lock.RLock()
+	root, marker := dl.root, dl.genMarker
+	dl.lock.RUnlock()
+
+	batch := t.diskdb.NewBatch()
+	if marker == nil {
+		return batch, nil, 0, 0, nil
+	}
+	// Resume iterating the account trie right after the marker
+	var origin []byte
+	if len(marker) > 0 {
+		if origin = increment(marker); origin == nil {
+			return batch, nil, 0, 0, nil
+		}
+	}
+	accTrie, err := trie.New(root, t.triedb)
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	var (
+		it       = trie.NewIterator(accTrie.NodeIterator(origin))
+		accounts int
+		slots    int
+		last     []byte
+	)
+	for accounts+slots < limit {
+		if !it.Next() {
+			if it.Err != nil {
+				return nil, nil, accounts, slots, it.Err
+			}
+			// Reached the end of the account trie, the snapshot is complete
+			return batch, nil, accounts, slots, nil
+		}
+		hash := common.BytesToHash(it.Key)
+		if err := batch.Put(accountKey(hash), common.CopyBytes(it.Value)); err != nil {
+			return nil, nil, accounts, slots, err
+		}
+		accounts++
+
+		var acc account
+		if err := rlp.DecodeBytes(it.Value, &acc); err != nil {
+			return nil, nil, accounts, slots, fmt.Errorf("invalid account %x: %v", hash, err)
+		}
+		if acc.Root != emptyRoot {
+			storeTrie, err := trie.New(acc.Root, t.triedb)
+			if err != nil {
+				return nil, nil, accounts, slots, err
+			}
+			storeIt := trie.NewIterator(storeTrie.NodeIterator(nil))
+			for storeIt.Next() {
+				if err := batch.Put(storageKey(hash, common.BytesToHash(storeIt.Key)), common.CopyBytes(storeIt.Value)); err != nil {
+					return nil, nil, accounts, slots, err
+				}
+				slots++
+			}
+			if storeIt.Err != nil {
+				return nil, nil, accounts, slots, storeIt.Err
+			}
+		}
+		last = hash[:]
+	}
+	return batch, last, accounts, slots, nil
+}
+
+// finishBatch persists a generated batch along with the new generation marker,
+// and moves the marker of the disk layer forward. The caller must hold the tree
+// lock.
+func (t *Tree) finishBatch(dl *diskLayer, batch ethdb.Batch, marker []byte) error {
+	if err := writeGeneratorStatus(batch, marker); err != nil {
+		return err
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	dl.lock.Lock()
+	dl.genMarker = marker
+	dl.lock.Unlock()
+
+	return nil
+}
+
+// increment returns the key following the given one in iteration order, or nil
+// if there is none.
+func increment(key []byte) []byte {
+	next := common.CopyBytes(key)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next
+		}
+	}
+	return nil
+}
+
+// Verify iterates the state tries belonging to the given root and checks that
+// every account and storage slot is present in the snapshot with the same
+// content.
+func (t *Tree) Verify(root common.Hash) error {
+	snap := t.Snapshot(root)
+	if snap == nil {
+		return fmt.Errorf("snapshot [%#x] missing", root)
+	}
+	accTrie, err := trie.New(root, t.triedb)
+	if err != nil {
+		return err
+	}
+	it := trie.NewIterator(accTrie.NodeIterator(nil))
+	for it.Next() {
+		hash := common.BytesToHash(it.Key)
+		blob, err := snap.Account(hash)
+		if err != nil {
+			return fmt.Errorf("account %x: %v", hash, err)
+		}
+		if !bytes.Equal(blob, it.Value) {
+			return fmt.Errorf("account %x: snapshot %x != trie %x", hash, blob, it.Value)
+		}
+		var acc account
+		if err := rlp.DecodeBytes(it.Value, &acc); err != nil {
+			return fmt.Errorf("invalid account %x: %v", hash, err)
+		}
+		if acc.Root == emptyRoot {
+			continue
+		}
+		storeTrie, err := trie.New(acc.Root, t.triedb)
+		if err != nil {
+			return err
+		}
+		storeIt := trie.NewIterator(storeTrie.NodeIterator(nil))
+		for storeIt.Next() {
+			slot := common.BytesToHash(storeIt.Key)
+			blob, err := snap.Storage(hash, slot)
+			if err != nil {
+				return fmt.Errorf("storage %x of account %x: %v", slot, hash, err)
+			}
+			if !bytes.Equal(blob, storeIt.Value) {
+				return fmt.Errorf("storage %x of account %x: snapshot %x != trie %x", slot, hash, blob, storeIt.Value)
+			}
+		}
+		if storeIt.Err != nil {
+			return storeIt.Err
+		}
+	}
+	return it.Err
+}
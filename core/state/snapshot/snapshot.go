@@ -0,0 +1,280 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package snapshot implements a flat key-value dump of the Ethereum state,
+// accelerating account and storage reads which would otherwise walk the
+// Merkle tries.
+//
+// The snapshot consists of a persisted disk layer representing the state at an
+// older block, and a tree of in-memory diff layers on top, one for each recent
+// block. Diff layers are flattened into the disk layer as they fall out of the
+// reorg window.
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+var (
+	// ErrSnapshotStale is returned from data accessors if the underlying snapshot
+	// layer had been flattened and is not valid any more.
+	ErrSnapshotStale = errors.New("snapshot stale")
+
+	// ErrNotCoveredYet is returned from data accessors if the underlying snapshot
+	// is being generated and the requested data is not yet covered by it.
+	ErrNotCoveredYet = errors.New("not covered yet")
+
+	// errSnapshotCycle is returned if a snapshot is attempted to be inserted
+	// that forms a cycle in the snapshot tree.
+	errSnapshotCycle = errors.New("snapshot cycle")
+)
+
+// Snapshot represents the functionality supported by a snapshot storage layer.
+// Missing data is reported with a nil value and a nil error, whereas an error
+// means the snapshot can't answer and the tries need to be consulted instead.
+type Snapshot interface {
+	// Root returns the root hash for which this snapshot was made.
+	Root() common.Hash
+
+	// Account directly retrieves the consensus RLP encoding of the account
+	// associated with a particular hash in the snapshot.
+	Account(hash common.Hash) ([]byte, error)
+
+	// Storage directly retrieves the storage data associated with a particular
+	// hash, within a particular account, in the same encoding as the storage
+	// trie leaves.
+	Storage(accountHash, storageHash common.Hash) ([]byte, error)
+}
+
+// snapshot is the internal version of the snapshot data layer that supports
+// the tree maintenance operations.
+type snapshot interface {
+	Snapshot
+
+	// parent returns the subsequent layer of a snapshot, or nil for the disk
+	// layer.
+	parent() snapshot
+
+	// stale returns whether this layer has become stale, i.e. it was flattened
+	// into another one or dropped from the tree.
+	stale() bool
+
+	// markStale invalidates the layer, failing all subsequent reads.
+	markStale()
+}
+
+// Tree is an Ethereum state snapshot tree. It consists of one persistent base
+// layer backed by a key-value store, on top of which arbitrarily many in-memory
+// diff layers are topped. The memory diffs can form a tree with branching, but
+// the disk layer is singleton and common to all. Only a fully flattened chain of
+// diffs is persisted to disk.
+type Tree struct {
+	diskdb ethdb.Database           // Persistent database to store the snapshot
+	triedb *trie.NodeDatabase       // In-memory cache to access the tries through
+	layers map[common.Hash]snapshot // Collection of all known layers
+	disk   *diskLayer               // Current persistent base layer
+
+	genAbort  chan struct{} // Channel to stop the background generation
+	genPinned bool          // Whether flattening into the disk layer is deferred for the generator
+	lock      sync.RWMutex
+}
+
+// New attempts to load an already existing snapshot from a persistent key-value
+// store, ensuring that it belongs to the expected state root. If the snapshot is
+// missing or inconsistent, it is wiped and regenerated in the background from
+// the tries. Diff layers aren't persisted, so the snapshot needs to be flattened
+// into the disk layer with Cap before shutting down.
+func New(diskdb ethdb.Database, triedb *trie.NodeDatabase, root common.Hash) (*Tree, error) {
+	t := &Tree{
+		diskdb: diskdb,
+		triedb: triedb,
+		layers: make(map[common.Hash]snapshot),
+	}
+	status := readGeneratorStatus(diskdb)
+	if readSnapshotRoot(diskdb) != root || status == nil {
+		log.Info("Rebuilding state snapshot", "root", root)
+		if err := t.rebuild(root); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+	t.disk = &diskLayer{diskdb: diskdb, triedb: triedb, root: root}
+	t.layers[root] = t.disk
+	if !status.Done {
+		log.Info("Resuming state snapshot generation", "root", root, "at", common.BytesToHash(status.Marker))
+		t.disk.genMarker = append([]byte{}, status.Marker...)
+		t.startGeneration()
+	}
+	return t, nil
+}
+
+// Snapshot retrieves a snapshot belonging to the given block root, or nil if no
+// snapshot is maintained for that block.
+func (t *Tree) Snapshot(root common.Hash) Snapshot {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if layer, ok := t.layers[root]; ok {
+		return layer
+	}
+	return nil
+}
+
+// Update adds a new snapshot into the tree, if that can be linked to an existing
+// old parent. It is disallowed to insert a disk layer (the origin of all).
+func (t *Tree) Update(blockRoot common.Hash, parentRoot common.Hash, destructs map[common.Hash]struct{}, accounts map[common.Hash][]byte, storage map[common.Hash]map[common.Hash][]byte) error {
+	if blockRoot == parentRoot {
+		return errSnapshotCycle
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	parent, ok := t.layers[parentRoot]
+	if !ok {
+		return fmt.Errorf("parent [%#x] snapshot missing", parentRoot)
+	}
+	if _, ok := t.layers[blockRoot]; ok {
+		// Same state reached by a sibling block, nothing new to track
+		return nil
+	}
+	t.layers[blockRoot] = newDiffLayer(parent, blockRoot, destructs, accounts, storage)
+	return nil
+}
+
+// Cap traverses downwards the snapshot tree from a head block hash until the
+// number of allowed layers are crossed. All layers beyond the permitted number
+// are flattened downwards into the disk layer, and any layer not descending
+// from the new disk layer is dropped as stale. While the generator pins the
+// disk layer, the surplus layers are kept until a later call.
+func (t *Tree) Cap(root common.Hash, layers int) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	snap, ok := t.layers[root]
+	if !ok {
+		return fmt.Errorf("snapshot [%#x] missing", root)
+	}
+	// Collect the diff layers from the requested root down to the disk layer
+	var diffs []*diffLayer
+	for layer := snap; layer != nil; layer = layer.parent() {
+		if diff, ok := layer.(*diffLayer); ok {
+			diffs = append(diffs, diff)
+		}
+	}
+	if len(diffs) <= layers || t.genPinned {
+		return nil
+	}
+	// Flatten the surplus layers, oldest first, into the disk layer
+	flatten := diffs[layers:]
+	disk, err := t.disk.flatten(flatten)
+	if err != nil {
+		return err
+	}
+	for _, diff := range flatten {
+		diff.markStale()
+	}
+	t.disk.markStale()
+	t.disk = disk
+	if layers > 0 {
+		diffs[layers-1].setParent(disk)
+	}
+	// Drop all the layers not descending from the new disk layer
+	layerSet := map[common.Hash]snapshot{disk.root: disk}
+	for hash, layer := range t.layers {
+		if descendsFrom(layer, disk) {
+			layerSet[hash] = layer
+		}
+	}
+	for hash, layer := range t.layers {
+		if _, ok := layerSet[hash]; !ok {
+			layer.markStale()
+		}
+	}
+	t.layers = layerSet
+	return nil
+}
+
+// descendsFrom returns whether a layer is built on top of the given disk layer.
+func descendsFrom(layer snapshot, disk *diskLayer) bool {
+	for ; layer != nil; layer = layer.parent() {
+		if layer == snapshot(disk) {
+			return true
+		}
+		if layer.stale() {
+			return false
+		}
+	}
+	return false
+}
+
+// Rebuild wipes all available snapshot data from the persistent database and
+// discards all the in-memory layers, regenerating the snapshot for the given
+// root in the background.
+func (t *Tree) Rebuild(root common.Hash) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.rebuild(root)
+}
+
+// rebuild is the non-locking version of Rebuild.
+func (t *Tree) rebuild(root common.Hash) error {
+	t.stopGeneration()
+	for _, layer := range t.layers {
+		layer.markStale()
+	}
+	if err := wipeSnapshot(t.diskdb); err != nil {
+		return err
+	}
+	if err := writeGeneratorStatus(t.diskdb, []byte{}); err != nil {
+		return err
+	}
+	if err := writeSnapshotRoot(t.diskdb, root); err != nil {
+		return err
+	}
+	t.disk = &diskLayer{diskdb: t.diskdb, triedb: t.triedb, root: root, genMarker: []byte{}}
+	t.layers = map[common.Hash]snapshot{root: t.disk}
+	t.startGeneration()
+	return nil
+}
+
+// Close terminates the background generation of the snapshot, persisting its
+// progress so it can be resumed on the next start.
+func (t *Tree) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.stopGeneration()
+}
+
+// Generating returns whether the snapshot is still being generated, along with
+// the hash of the last account covered so far.
+func (t *Tree) Generating() (bool, common.Hash) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	t.disk.lock.RLock()
+	defer t.disk.lock.RUnlock()
+
+	return t.disk.genMarker != nil, common.BytesToHash(t.disk.genMarker)
+}
@@ -0,0 +1,378 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// makeTestState commits a state of a few accounts into a trie node database,
+// every second of them holding some storage.
+func makeTestState(t *testing.T, triedb *trie.NodeDatabase, accounts int) common.Hash {
+	accTrie, _ := trie.New(common.Hash{}, triedb)
+	for i := 0; i < accounts; i++ {
+		blob, _ := makeTestAccount(t, triedb, i)
+		accTrie.Update(testHash(i, 0).Bytes(), blob)
+	}
+	root, err := accTrie.CommitTo(triedb)
+	if err != nil {
+		t.Fatalf("failed to commit account trie: %v", err)
+	}
+	return root
+}
+
+// makeTestAccount commits the storage of the i-th account of a test state into
+// a trie node database, returning the account along with its storage slots.
+func makeTestAccount(t *testing.T, triedb *trie.NodeDatabase, i int) ([]byte, map[common.Hash][]byte) {
+	acc := account{Nonce: uint64(i), Balance: big.NewInt(int64(i)), Root: emptyRoot, CodeHash: crypto.Keccak256(nil)}
+	var storage map[common.Hash][]byte
+	if i%2 == 0 {
+		storage = make(map[common.Hash][]byte)
+		storeTrie, _ := trie.New(common.Hash{}, triedb)
+		for j := 0; j < 5; j++ {
+			value, _ := rlp.EncodeToBytes([]byte{byte(i), byte(j + 1)})
+			storeTrie.Update(testHash(i, j+1).Bytes(), value)
+			storage[testHash(i, j+1)] = value
+		}
+		root, err := storeTrie.CommitTo(triedb)
+		if err != nil {
+			t.Fatalf("failed to commit storage trie: %v", err)
+		}
+		acc.Root = root
+	}
+	blob, _ := rlp.EncodeToBytes(&acc)
+	return blob, storage
+}
+
+// testHash derives a deterministic hash from a pair of indexes.
+func testHash(i, j int) common.Hash {
+	return crypto.Keccak256Hash([]byte{byte(i), byte(j)})
+}
+
+// waitGeneration blocks until the snapshot is fully generated.
+func waitGeneration(t *testing.T, snaps *Tree) {
+	for i := 0; i < 500; i++ {
+		if generating, _ := snaps.Generating(); !generating {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("snapshot generation timed out")
+}
+
+// Tests that a snapshot generated from the tries matches their content and is
+// reused after a restart.
+func TestGeneration(t *testing.T) {
+	diskdb, _ := ethdb.NewMemDatabase()
+	triedb := trie.NewNodeDatabase(diskdb, nil)
+	root := makeTestState(t, triedb, 32)
+
+	snaps, err := New(diskdb, triedb, root)
+	if err != nil {
+		t.Fatalf("failed to create snapshot: %v", err)
+	}
+	waitGeneration(t, snaps)
+	if err := snaps.Verify(root); err != nil {
+		t.Fatalf("generated snapshot inconsistent: %v", err)
+	}
+	if blob, err := snaps.Snapshot(root).Account(testHash(100, 0)); blob != nil || err != nil {
+		t.Fatalf("missing account mismatch: have %x (%v), want nil", blob, err)
+	}
+	snaps.Close()
+
+	snaps, err = New(diskdb, triedb, root)
+	if err != nil {
+		t.Fatalf("failed to reload snapshot: %v", err)
+	}
+	if generating, _ := snaps.Generating(); generating {
+		t.Fatalf("generated snapshot regenerated after reload")
+	}
+	if err := snaps.Verify(root); err != nil {
+		t.Fatalf("reloaded snapshot inconsistent: %v", err)
+	}
+}
+
+// flattenTestDatabase is a key-value store flattening a new layer into the disk
+// layer of a snapshot tree whenever the generator starts a batch.
+type flattenTestDatabase struct {
+	ethdb.Database
+	flatten func()
+}
+
+func (db *flattenTestDatabase) NewBatch() ethdb.Batch {
+	// Flatten synchronously, the generator must not hold the tree lock meanwhile
+	db.flatten()
+	return db.Database.NewBatch()
+}
+
+// Tests that the generation completes even if the disk layer is flattened into
+// a new one before every batch is finished, without blocking the flattening.
+func TestGenerationDuringFlattening(t *testing.T) {
+	diskdb, _ := ethdb.NewMemDatabase()
+	triedb := trie.NewNodeDatabase(diskdb, nil)
+	root := makeTestState(t, triedb, 32)
+
+	// Create a series of states adding an account each
+	type layer struct {
+		root, parent common.Hash
+		accounts     map[common.Hash][]byte
+		storage      map[common.Hash]map[common.Hash][]byte
+	}
+	var layers []layer
+	accTrie, _ := trie.New(root, triedb)
+	for i, parent := 32, root; i < 48; i++ {
+		blob, storage := makeTestAccount(t, triedb, i)
+		accTrie.Update(testHash(i, 0).Bytes(), blob)
+		next, err := accTrie.CommitTo(triedb)
+		if err != nil {
+			t.Fatalf("failed to commit account trie: %v", err)
+		}
+		l := layer{root: next, parent: parent, accounts: map[common.Hash][]byte{testHash(i, 0): blob}}
+		if storage != nil {
+			l.storage = map[common.Hash]map[common.Hash][]byte{testHash(i, 0): storage}
+		}
+		layers, parent = append(layers, l), next
+	}
+	// Generate the snapshot, flattening a layer into the disk whenever a batch starts
+	dl := &diskLayer{diskdb: diskdb, triedb: triedb, root: root, genMarker: []byte{}}
+	snaps := &Tree{triedb: triedb, layers: map[common.Hash]snapshot{root: dl}, disk: dl}
+
+	var (
+		lock      sync.Mutex
+		flattened int
+	)
+	db := &flattenTestDatabase{Database: diskdb, flatten: func() {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if flattened == len(layers) {
+			return
+		}
+		l := layers[flattened]
+		if err := snaps.Update(l.root, l.parent, nil, l.accounts, l.storage); err != nil {
+			t.Errorf("failed to add snapshot layer: %v", err)
+		}
+		if err := snaps.Cap(l.root, 0); err != nil {
+			t.Errorf("failed to flatten snapshot layer: %v", err)
+		}
+		flattened++
+	}}
+	snaps.diskdb = db
+
+	snaps.lock.Lock()
+	snaps.startGeneration()
+	snaps.lock.Unlock()
+
+	waitGeneration(t, snaps)
+
+	if flattened == len(layers) {
+		t.Fatalf("snapshot generation starved by the flattening")
+	}
+	if err := snaps.Verify(layers[flattened-1].root); err != nil {
+		t.Fatalf("generated snapshot inconsistent: %v", err)
+	}
+	// Layers kept while the disk layer was pinned must be flattened afterwards
+	if err := snaps.Cap(layers[flattened-1].root, 0); err != nil {
+		t.Fatalf("failed to flatten snapshot layers: %v", err)
+	}
+	if root := snaps.disk.Root(); root != layers[flattened-1].root {
+		t.Fatalf("disk layer root mismatch: have %x, want %x", root, layers[flattened-1].root)
+	}
+	if err := snaps.Verify(layers[flattened-1].root); err != nil {
+		t.Fatalf("flattened snapshot inconsistent: %v", err)
+	}
+}
+
+// Tests that the generated batches are only persisted when finished, as the
+// tries are iterated without holding the tree lock.
+func TestGenerationBatch(t *testing.T) {
+	diskdb, _ := ethdb.NewMemDatabase()
+	triedb := trie.NewNodeDatabase(diskdb, nil)
+	root := makeTestState(t, triedb, 32)
+
+	dl := &diskLayer{diskdb: diskdb, triedb: triedb, root: root, genMarker: []byte{}}
+	snaps := &Tree{diskdb: diskdb, triedb: triedb, layers: map[common.Hash]snapshot{root: dl}, disk: dl}
+
+	keys := len(diskdb.Keys())
+	batch, marker, accounts, _, err := snaps.generateBatch(dl, 10)
+	if err != nil {
+		t.Fatalf("failed to generate batch: %v", err)
+	}
+	if marker == nil || accounts == 0 {
+		t.Fatalf("batch progress mismatch: marker %x, %d accounts", marker, accounts)
+	}
+	if len(dl.genMarker) != 0 || len(diskdb.Keys()) != keys {
+		t.Fatalf("generated batch persisted before finished")
+	}
+	if err := snaps.finishBatch(dl, batch, marker); err != nil {
+		t.Fatalf("failed to finish batch: %v", err)
+	}
+	if !bytes.Equal(dl.genMarker, marker) {
+		t.Fatalf("generation marker mismatch: have %x, want %x", dl.genMarker, marker)
+	}
+	if blob, err := dl.Account(common.BytesToHash(marker)); err != nil || blob == nil {
+		t.Fatalf("generated account missing: %x (%v)", blob, err)
+	}
+}
+
+// countingDatabase is a key-value store counting the batches written into it.
+type countingDatabase struct {
+	ethdb.Database
+	writes int
+}
+
+type countingBatch struct {
+	ethdb.Batch
+	db *countingDatabase
+}
+
+func (db *countingDatabase) NewBatch() ethdb.Batch {
+	return &countingBatch{Batch: db.Database.NewBatch(), db: db}
+}
+
+func (b *countingBatch) Write() error {
+	b.db.writes++
+	return b.Batch.Write()
+}
+
+// Tests that wiping a snapshot too large for a single batch deletes all of it,
+// writing the deletions out in multiple batches.
+func TestWipeSnapshot(t *testing.T) {
+	diskdb, _ := ethdb.NewMemDatabase()
+	for i := 0; i < ethdb.IdealBatchSize+100; i++ {
+		diskdb.Put(storageKey(common.Hash{0x01}, common.BigToHash(big.NewInt(int64(i)))), []byte{0x01})
+	}
+	diskdb.Put(accountKey(common.Hash{0x01}), []byte{0x01})
+	writeSnapshotRoot(diskdb, common.Hash{0x02})
+	writeGeneratorStatus(diskdb, nil)
+
+	db := &countingDatabase{Database: diskdb}
+	if err := wipeSnapshot(db); err != nil {
+		t.Fatalf("failed to wipe snapshot: %v", err)
+	}
+	if db.writes < 2 {
+		t.Errorf("wipe written in %d batches, want at least 2", db.writes)
+	}
+	if keys := diskdb.Len(); keys != 0 {
+		t.Errorf("%d keys left after wipe", keys)
+	}
+}
+
+// Tests that the data of a disk layer beyond the generation marker is reported
+// as not covered.
+func TestDiskLayerCoverage(t *testing.T) {
+	diskdb, _ := ethdb.NewMemDatabase()
+	marker := common.Hash{0x80}
+	dl := &diskLayer{diskdb: diskdb, genMarker: marker[:]}
+
+	diskdb.Put(accountKey(common.Hash{0x10}), []byte{0x01})
+	if blob, err := dl.Account(common.Hash{0x10}); err != nil || !bytes.Equal(blob, []byte{0x01}) {
+		t.Errorf("covered account mismatch: have %x (%v), want 01", blob, err)
+	}
+	if _, err := dl.Account(common.Hash{0x90}); err != ErrNotCoveredYet {
+		t.Errorf("uncovered account error mismatch: have %v, want %v", err, ErrNotCoveredYet)
+	}
+	if _, err := dl.Storage(common.Hash{0x90}, common.Hash{}); err != ErrNotCoveredYet {
+		t.Errorf("uncovered storage error mismatch: have %v, want %v", err, ErrNotCoveredYet)
+	}
+	dl.markStale()
+	if _, err := dl.Account(common.Hash{0x10}); err != ErrSnapshotStale {
+		t.Errorf("stale account error mismatch: have %v, want %v", err, ErrSnapshotStale)
+	}
+}
+
+// Tests that diff layers shadow the layers below them, and that flattening them
+// into the disk layer retains the same view while invalidating the old layers.
+func TestDiffLayersCap(t *testing.T) {
+	diskdb, _ := ethdb.NewMemDatabase()
+	triedb := trie.NewNodeDatabase(diskdb, nil)
+	root := makeTestState(t, triedb, 8)
+
+	snaps, err := New(diskdb, triedb, root)
+	if err != nil {
+		t.Fatalf("failed to create snapshot: %v", err)
+	}
+	waitGeneration(t, snaps)
+
+	// Modify an account, destruct one with storage, then write new storage
+	var (
+		root1 = common.Hash{0x01}
+		root2 = common.Hash{0x02}
+		root3 = common.Hash{0x03}
+	)
+	snaps.Update(root1, root, nil, map[common.Hash][]byte{testHash(1, 0): {0x01}}, nil)
+	snaps.Update(root2, root1, map[common.Hash]struct{}{testHash(2, 0): {}}, nil, nil)
+	snaps.Update(root3, root2, nil, nil, map[common.Hash]map[common.Hash][]byte{
+		testHash(4, 0): {testHash(4, 1): nil, testHash(4, 9): {0x09}},
+	})
+	check := func(snap Snapshot) {
+		if blob, err := snap.Account(testHash(1, 0)); err != nil || !bytes.Equal(blob, []byte{0x01}) {
+			t.Errorf("modified account mismatch: have %x (%v), want 01", blob, err)
+		}
+		if blob, err := snap.Account(testHash(2, 0)); err != nil || blob != nil {
+			t.Errorf("destructed account mismatch: have %x (%v), want nil", blob, err)
+		}
+		if blob, err := snap.Storage(testHash(2, 0), testHash(2, 1)); err != nil || blob != nil {
+			t.Errorf("destructed storage mismatch: have %x (%v), want nil", blob, err)
+		}
+		if blob, err := snap.Storage(testHash(4, 0), testHash(4, 1)); err != nil || blob != nil {
+			t.Errorf("deleted slot mismatch: have %x (%v), want nil", blob, err)
+		}
+		if blob, err := snap.Storage(testHash(4, 0), testHash(4, 9)); err != nil || !bytes.Equal(blob, []byte{0x09}) {
+			t.Errorf("written slot mismatch: have %x (%v), want 09", blob, err)
+		}
+		if blob, err := snap.Storage(testHash(4, 0), testHash(4, 2)); err != nil || blob == nil {
+			t.Errorf("untouched slot missing: %v", err)
+		}
+	}
+	check(snaps.Snapshot(root3))
+
+	// Flatten the bottom two layers and ensure the view is retained
+	old := snaps.Snapshot(root1)
+	if err := snaps.Cap(root3, 1); err != nil {
+		t.Fatalf("failed to cap snapshot tree: %v", err)
+	}
+	if _, err := old.Account(testHash(1, 0)); err != ErrSnapshotStale {
+		t.Errorf("flattened layer error mismatch: have %v, want %v", err, ErrSnapshotStale)
+	}
+	if snaps.Snapshot(root1) != nil || snaps.Snapshot(root) != nil {
+		t.Errorf("flattened layers still tracked")
+	}
+	check(snaps.Snapshot(root3))
+
+	// Flatten everything and ensure it's persisted
+	if err := snaps.Cap(root3, 0); err != nil {
+		t.Fatalf("failed to cap snapshot tree: %v", err)
+	}
+	check(snaps.Snapshot(root3))
+	if have := readSnapshotRoot(diskdb); have != root3 {
+		t.Errorf("persisted root mismatch: have %x, want %x", have, root3)
+	}
+	if blob, _ := diskdb.Get(storageKey(testHash(2, 0), testHash(2, 1))); blob != nil {
+		t.Errorf("destructed storage persisted: %x", blob)
+	}
+}
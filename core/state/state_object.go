@@ -87,6 +87,13 @@ type stateObject struct {
 	dirtyCode bool // true if the code was updated
 	suicided  bool
 	deleted   bool
+
+	// Snapshot flags.
+	// Objects created within the state don't have their storage in the snapshot
+	// of the parent state, and a created object overwriting an existing account
+	// needs to clear the storage of the old one from the snapshot.
+	created bool
+	reset   bool
 }
 
 // empty returns whether the account is considered empty.
@@ -166,8 +173,17 @@ func (self *stateObject) GetState(db Database, key common.Hash) common.Hash {
 	if exists {
 		return value
 	}
-	// Load from DB in case it is missing.
-	enc, err := self.getTrie(db).TryGet(key[:])
+	// Load from the snapshot if available, falling back to the trie.
+	var (
+		enc []byte
+		err error
+	)
+	if self.db.snap != nil && !self.created {
+		enc, err = self.db.snap.Storage(self.addrHash, crypto.Keccak256Hash(key[:]))
+	}
+	if self.db.snap == nil || self.created || err != nil {
+		enc, err = self.getTrie(db).TryGet(key[:])
+	}
 	if err != nil {
 		self.setError(err)
 		return common.Hash{}
@@ -204,15 +220,36 @@ func (self *stateObject) setState(key, value common.Hash) {
 // updateTrie writes cached storage modifications into the object's storage trie.
 func (self *stateObject) updateTrie(db Database) Trie {
 	tr := self.getTrie(db)
+
+	// Track the storage changes for the snapshot, dropping the storage of any
+	// overwritten account first
+	var slots map[common.Hash][]byte
+	if self.db.snap != nil {
+		if self.reset {
+			self.db.snapDestructs[self.addrHash] = struct{}{}
+			delete(self.db.snapStorage, self.addrHash)
+			self.reset = false
+		}
+		if slots = self.db.snapStorage[self.addrHash]; slots == nil && len(self.dirtyStorage) > 0 {
+			slots = make(map[common.Hash][]byte)
+			self.db.snapStorage[self.addrHash] = slots
+		}
+	}
 	for key, value := range self.dirtyStorage {
 		delete(self.dirtyStorage, key)
 		if (value == common.Hash{}) {
 			self.setError(tr.TryDelete(key[:]))
+			if slots != nil {
+				slots[crypto.Keccak256Hash(key[:])] = nil
+			}
 			continue
 		}
 		// Encoding []byte cannot fail, ok to ignore the error.
 		v, _ := rlp.EncodeToBytes(bytes.TrimLeft(value[:], "\x00"))
 		self.setError(tr.TryUpdate(key[:], v))
+		if slots != nil {
+			slots[crypto.Keccak256Hash(key[:])] = v
+		}
 	}
 	return tr
 }
@@ -287,6 +324,8 @@ func (self *stateObject) deepCopy(db *StateDB) *stateObject {
 	stateObject.suicided = self.suicided
 	stateObject.dirtyCode = self.dirtyCode
 	stateObject.deleted = self.deleted
+	stateObject.created = self.created
+	stateObject.reset = self.reset
 	return stateObject
 }
 
@@ -18,6 +18,7 @@ package state
 
 import (
 	"bytes"
+	"encoding/json"
 	"math/big"
 	"testing"
 
@@ -86,6 +87,108 @@ func (s *StateSuite) TestDump(c *checker.C) {
 	}
 }
 
+func (s *StateSuite) TestIterativeDump(c *checker.C) {
+	for i := byte(1); i <= 10; i++ {
+		s.state.AddBalance(toAddr([]byte{i}), big.NewInt(int64(i)))
+	}
+	s.state.SetCode(toAddr([]byte{3}), []byte{3, 3, 3})
+	s.state.SetState(toAddr([]byte{3}), common.Hash{1}, common.Hash{2})
+	s.state.Commit(false)
+
+	full := s.state.RawDump()
+
+	// Stream the state, each account must match the in-memory dump
+	buf := new(bytes.Buffer)
+	next, err := s.state.IterativeDump(nil, buf)
+	c.Assert(err, checker.IsNil)
+	c.Assert(next, checker.IsNil)
+
+	dec := json.NewDecoder(buf)
+	var root Dump
+	c.Assert(dec.Decode(&root), checker.IsNil)
+	c.Assert(root.Root, checker.Equals, full.Root)
+
+	var accounts []DumpAccount
+	for dec.More() {
+		var account DumpAccount
+		c.Assert(dec.Decode(&account), checker.IsNil)
+		accounts = append(accounts, account)
+	}
+	c.Assert(accounts, checker.HasLen, 10)
+	for i, account := range accounts {
+		c.Assert(account.Address, checker.NotNil)
+		c.Assert(account.Key, checker.Equals, common.Bytes2Hex(crypto.Keccak256(account.Address[:])))
+		if i > 0 {
+			c.Assert(accounts[i-1].Key < account.Key, checker.Equals, true)
+		}
+		want := full.Accounts[common.Bytes2Hex(account.Address[:])]
+		want.Address, want.Key = account.Address, account.Key
+		c.Assert(account, checker.DeepEquals, want)
+	}
+	// Page through the state, the pages must add up to the full dump
+	var (
+		paged []DumpAccount
+		conf  = &DumpConfig{Max: 3}
+	)
+	for pages := 1; ; pages++ {
+		page, err := s.state.IteratorDump(conf)
+		c.Assert(err, checker.IsNil)
+		paged = append(paged, page.Accounts...)
+		if page.Next == nil {
+			c.Assert(pages, checker.Equals, 4)
+			break
+		}
+		conf.Start = page.Next
+	}
+	c.Assert(paged, checker.DeepEquals, accounts)
+
+	// Dump a range of keys, without codes nor storages
+	page, err := s.state.IteratorDump(&DumpConfig{
+		SkipCode:    true,
+		SkipStorage: true,
+		Start:       common.Hex2Bytes(accounts[2].Key),
+		Limit:       common.Hex2Bytes(accounts[6].Key),
+	})
+	c.Assert(err, checker.IsNil)
+	c.Assert(page.Accounts, checker.HasLen, 4)
+	c.Assert(page.Next, checker.IsNil)
+	for i, account := range page.Accounts {
+		c.Assert(account.Key, checker.Equals, accounts[i+2].Key)
+		c.Assert(account.Code, checker.Equals, "")
+		c.Assert(account.Storage, checker.IsNil)
+	}
+	code := full.Accounts[common.Bytes2Hex(toAddr([]byte{3}).Bytes())]
+	c.Assert(code.Code, checker.Equals, "030303")
+	c.Assert(code.Storage, checker.HasLen, 1)
+}
+
+func (s *StateSuite) TestDumpMissingCode(c *checker.C) {
+	s.state.AddBalance(toAddr([]byte{1}), big.NewInt(1))
+	s.state.SetCode(toAddr([]byte{2}), []byte{2, 2, 2})
+	root, err := s.state.CommitTo(s.db, false)
+	c.Assert(err, checker.IsNil)
+
+	// Dumping the codes of a corrupted state must fail instead of panicking
+	s.db.Delete(crypto.Keccak256([]byte{2, 2, 2}))
+	state, err := New(root, NewDatabase(s.db))
+	c.Assert(err, checker.IsNil)
+
+	_, err = state.RawDumpWithConfig(nil)
+	c.Assert(err, checker.NotNil)
+	_, err = state.DumpWithConfig(nil)
+	c.Assert(err, checker.NotNil)
+	_, err = state.IteratorDump(nil)
+	c.Assert(err, checker.NotNil)
+	_, err = state.IterativeDump(nil, new(bytes.Buffer))
+	c.Assert(err, checker.NotNil)
+	state.RawDump()
+
+	// The accounts must still be dumpable without their codes
+	dump, err := state.RawDumpWithConfig(&DumpConfig{SkipCode: true})
+	c.Assert(err, checker.IsNil)
+	c.Assert(dump.Accounts, checker.HasLen, 2)
+}
+
 func (s *StateSuite) SetUpTest(c *checker.C) {
 	s.db, _ = ethdb.NewMemDatabase()
 	s.state, _ = New(common.Hash{}, NewDatabase(s.db))
@@ -24,6 +24,7 @@ import (
 	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
@@ -46,6 +47,14 @@ type StateDB struct {
 	trie       Trie
 	stateTrace StateTrace
 
+	// Flat snapshot of the state for accelerated reads, along with the changes
+	// to track in a new snapshot layer on commit.
+	snaps         *snapshot.Tree
+	snap          snapshot.Snapshot
+	snapDestructs map[common.Hash]struct{}
+	snapAccounts  map[common.Hash][]byte
+	snapStorage   map[common.Hash]map[common.Hash][]byte
+
 	// This map holds 'live' objects, which will get modified while processing a state transition.
 	stateObjects           map[common.Address]*stateObject
 	stateObjectsDirty      map[common.Address]struct{}
@@ -89,13 +98,22 @@ type StateTrace interface {
 
 // Create a new state from a given trie
 func New(root common.Hash, db Database) (*StateDB, error) {
+	return NewWithSnapshot(root, db, nil)
+}
+
+// NewWithSnapshot creates a new state from a given trie, reading accounts and
+// storage from the flat snapshot of the state if one is maintained for root.
+// The committed changes are added as a new layer to the snapshot tree with
+// UpdateSnapshot.
+func NewWithSnapshot(root common.Hash, db Database, snaps *snapshot.Tree) (*StateDB, error) {
 	tr, err := db.OpenTrie(root)
 	if err != nil {
 		return nil, err
 	}
-	return &StateDB{
+	sdb := &StateDB{
 		db:                     db,
 		trie:                   tr,
+		snaps:                  snaps,
 		stateObjects:           make(map[common.Address]*stateObject),
 		stateObjectsDirty:      make(map[common.Address]struct{}),
 		stateObjectsDestructed: make(map[common.Address]struct{}),
@@ -103,7 +121,23 @@ func New(root common.Hash, db Database) (*StateDB, error) {
 		logs:                   make(map[common.Hash][]*types.Log),
 		preimages:              make(map[common.Hash][]byte),
 		journal:                newJournal(),
-	}, nil
+	}
+	sdb.resetSnapshot(root)
+	return sdb, nil
+}
+
+// resetSnapshot looks up the snapshot layer belonging to root and clears the
+// tracked snapshot changes.
+func (self *StateDB) resetSnapshot(root common.Hash) {
+	self.snap, self.snapDestructs, self.snapAccounts, self.snapStorage = nil, nil, nil, nil
+	if self.snaps == nil {
+		return
+	}
+	if self.snap = self.snaps.Snapshot(root); self.snap != nil {
+		self.snapDestructs = make(map[common.Hash]struct{})
+		self.snapAccounts = make(map[common.Hash][]byte)
+		self.snapStorage = make(map[common.Hash]map[common.Hash][]byte)
+	}
 }
 
 func (self *StateDB) SetStateTrace(trace StateTrace) {
@@ -138,6 +172,7 @@ func (self *StateDB) Reset(root common.Hash) error {
 	self.logs = make(map[common.Hash][]*types.Log)
 	self.logSize = 0
 	self.preimages = make(map[common.Hash][]byte)
+	self.resetSnapshot(root)
 	self.clearJournalAndRefund()
 	return nil
 }
@@ -267,6 +302,31 @@ func (self *StateDB) GetState(a common.Address, b common.Hash) common.Hash {
 	return common.Hash{}
 }
 
+// GetProof returns the Merkle proof of an account against the state root.
+func (self *StateDB) GetProof(a common.Address) ([]rlp.RawValue, error) {
+	return self.trie.TryProve(a[:])
+}
+
+// GetStorageProof returns the Merkle proof of a storage slot against the
+// storage root of the account. Non-existent accounts have an empty proof.
+func (self *StateDB) GetStorageProof(a common.Address, key common.Hash) ([]rlp.RawValue, error) {
+	stateObject := self.getStateObject(a)
+	if stateObject == nil {
+		return nil, nil
+	}
+	return stateObject.getTrie(self.db).TryProve(key[:])
+}
+
+// GetStorageRoot retrieves the storage root of an account, or the empty root
+// hash if the account doesn't exist.
+func (self *StateDB) GetStorageRoot(a common.Address) common.Hash {
+	stateObject := self.getStateObject(a)
+	if stateObject == nil {
+		return types.EmptyRootHash
+	}
+	return stateObject.data.Root
+}
+
 // StorageTrie returns the storage trie of an account.
 // The return value is a copy and is nil for non-existent accounts.
 func (self *StateDB) StorageTrie(a common.Address) Trie {
@@ -387,6 +447,10 @@ func (self *StateDB) updateStateObject(stateObject *stateObject) {
 		panic(fmt.Errorf("can't encode object at %x: %v", addr[:], err))
 	}
 	self.setError(self.trie.TryUpdate(addr[:], data))
+
+	if self.snap != nil {
+		self.snapAccounts[stateObject.addrHash] = data
+	}
 }
 
 // deleteStateObject removes the given object from the state trie.
@@ -394,6 +458,12 @@ func (self *StateDB) deleteStateObject(stateObject *stateObject) {
 	stateObject.deleted = true
 	addr := stateObject.Address()
 	self.setError(self.trie.TryDelete(addr[:]))
+
+	if self.snap != nil {
+		self.snapDestructs[stateObject.addrHash] = struct{}{}
+		delete(self.snapAccounts, stateObject.addrHash)
+		delete(self.snapStorage, stateObject.addrHash)
+	}
 }
 
 // Retrieve a state object given my the address. Returns nil if not found.
@@ -406,8 +476,17 @@ func (self *StateDB) getStateObject(addr common.Address) (stateObject *stateObje
 		return obj
 	}
 
-	// Load the object from the database.
-	enc, err := self.trie.TryGet(addr[:])
+	// Load the object from the snapshot if available, falling back to the trie.
+	var (
+		enc []byte
+		err error
+	)
+	if self.snap != nil {
+		enc, err = self.snap.Account(crypto.Keccak256Hash(addr[:]))
+	}
+	if self.snap == nil || err != nil {
+		enc, err = self.trie.TryGet(addr[:])
+	}
 	if len(enc) == 0 {
 		self.setError(err)
 		return nil
@@ -442,6 +521,8 @@ func (self *StateDB) createObject(addr common.Address) (newobj, prev *stateObjec
 	prev = self.getStateObject(addr)
 	newobj = newObject(self, addr, Account{})
 	newobj.setNonce(0) // sets the object to dirty
+	newobj.created = true
+	newobj.reset = prev != nil
 	if prev == nil {
 		self.journal.append(createObjectChange{account: &addr})
 	} else {
@@ -507,6 +588,8 @@ func (self *StateDB) Copy() *StateDB {
 		logSize:                self.logSize,
 		preimages:              make(map[common.Hash][]byte),
 		journal:                newJournal(),
+		snaps:                  self.snaps,
+		snap:                   self.snap,
 	}
 	// Copy the dirty states, logs, and preimages
 	for addr := range self.journal.dirties {
@@ -523,6 +606,24 @@ func (self *StateDB) Copy() *StateDB {
 	for hash, preimage := range self.preimages {
 		state.preimages[hash] = preimage
 	}
+	// Copy the snapshot changes tracked so far
+	if self.snap != nil {
+		state.snapDestructs = make(map[common.Hash]struct{}, len(self.snapDestructs))
+		for hash := range self.snapDestructs {
+			state.snapDestructs[hash] = struct{}{}
+		}
+		state.snapAccounts = make(map[common.Hash][]byte, len(self.snapAccounts))
+		for hash, data := range self.snapAccounts {
+			state.snapAccounts[hash] = data
+		}
+		state.snapStorage = make(map[common.Hash]map[common.Hash][]byte, len(self.snapStorage))
+		for hash, slots := range self.snapStorage {
+			state.snapStorage[hash] = make(map[common.Hash][]byte, len(slots))
+			for slot, data := range slots {
+				state.snapStorage[hash][slot] = data
+			}
+		}
+	}
 	return state
 }
 
@@ -624,6 +725,29 @@ func (s *StateDB) clearJournalAndRefund() {
 	s.refund = new(big.Int)
 }
 
+// Commit writes the state to the intermediate trie node database of the
+// underlying state database.
+func (s *StateDB) Commit(deleteEmptyObjects bool) (root common.Hash, err error) {
+	return s.CommitTo(s.db.TrieDB(), deleteEmptyObjects)
+}
+
+// UpdateSnapshot adds the changes committed since the state was opened, or the
+// snapshot last updated, as a new layer on top of the snapshot tree backing the
+// state. The root is the one the state was last committed to. States not backed
+// by a snapshot are ignored.
+func (s *StateDB) UpdateSnapshot(root common.Hash) error {
+	if s.snap == nil {
+		return nil
+	}
+	if parent := s.snap.Root(); parent != root {
+		if err := s.snaps.Update(root, parent, s.snapDestructs, s.snapAccounts, s.snapStorage); err != nil {
+			return err
+		}
+	}
+	s.resetSnapshot(root)
+	return nil
+}
+
 // CommitTo writes the state to the given database.
 func (s *StateDB) CommitTo(dbw trie.DatabaseWriter, deleteEmptyObjects bool) (root common.Hash, err error) {
 	defer s.clearJournalAndRefund()
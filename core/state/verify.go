@@ -0,0 +1,207 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// errVerifyAborted is returned by the trie walkers if the verification was
+// cancelled due to a corruption found elsewhere.
+var errVerifyAborted = errors.New("verification aborted")
+
+// verifyTask is the storage trie and contract code of an account, queued for
+// verification by the storage workers.
+type verifyTask struct {
+	owner    common.Hash // Hash of the account address
+	root     common.Hash // Root of the storage trie
+	codeHash []byte      // Hash of the contract code
+}
+
+// VerifyStats contains the number of state entries checked by VerifyState.
+type VerifyStats struct {
+	Accounts uint64 // Number of accounts in the account trie
+	Nodes    uint64 // Number of account and storage trie nodes checked
+	Codes    uint64 // Number of contract codes checked
+}
+
+// VerifyState walks the account trie of the given state root, along with all the
+// storage tries and contract codes it references, checking that every entry is
+// present in the database and hashes to its key. The storage tries are checked by
+// the given number of parallel workers. The first corruption found is returned,
+// detailing the owner account, the trie path and the hash of the damaged entry.
+func VerifyState(db ethdb.Database, root common.Hash, workers int) (*VerifyStats, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		stats   = new(VerifyStats)
+		statedb = NewDatabase(db)
+
+		tasks   = make(chan verifyTask, workers)
+		abort   = make(chan struct{})
+		failure error
+		once    sync.Once
+		wg      sync.WaitGroup
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			failure = err
+			close(abort)
+		})
+	}
+	accTrie, err := statedb.OpenTrie(root)
+	if err != nil {
+		return stats, fmt.Errorf("account trie root %x: %v", root, err)
+	}
+	// Start the storage verifiers and feed them from the account trie walk
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range tasks {
+				if err := verifyStorage(db, statedb, task, stats, abort); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+	var (
+		start  = time.Now()
+		logged = time.Now()
+	)
+	onLeaf := func(owner common.Hash, path []byte, blob []byte) error {
+		var account Account
+		if err := rlp.DecodeBytes(blob, &account); err != nil {
+			return fmt.Errorf("account %x (path %x): invalid account: %v", owner, path, err)
+		}
+		atomic.AddUint64(&stats.Accounts, 1)
+
+		if time.Since(logged) > 8*time.Second {
+			log.Info("Verifying state", "root", root, "accounts", atomic.LoadUint64(&stats.Accounts),
+				"nodes", atomic.LoadUint64(&stats.Nodes), "codes", atomic.LoadUint64(&stats.Codes), "elapsed", common.PrettyDuration(time.Since(start)))
+			logged = time.Now()
+		}
+		if account.Root == types.EmptyRootHash && bytes.Equal(account.CodeHash, emptyCodeHash) {
+			return nil
+		}
+		task := verifyTask{owner: owner, root: account.Root, codeHash: account.CodeHash}
+		select {
+		case tasks <- task:
+			return nil
+		case <-abort:
+			return errVerifyAborted
+		}
+	}
+	if err := verifyTrie(db, common.Hash{}, accTrie.NodeIterator(nil), stats, abort, onLeaf); err != nil && err != errVerifyAborted {
+		fail(err)
+	}
+	close(tasks)
+	wg.Wait()
+
+	if failure != nil {
+		return stats, failure
+	}
+	log.Info("Verified state", "root", root, "accounts", stats.Accounts, "nodes", stats.Nodes, "codes", stats.Codes, "elapsed", common.PrettyDuration(time.Since(start)))
+	return stats, nil
+}
+
+// verifyStorage checks the storage trie and the contract code of an account.
+func verifyStorage(db ethdb.Database, statedb Database, task verifyTask, stats *VerifyStats, abort chan struct{}) error {
+	if !bytes.Equal(task.codeHash, emptyCodeHash) {
+		hash := common.BytesToHash(task.codeHash)
+		code, err := db.Get(hash[:])
+		if err != nil || len(code) == 0 {
+			return fmt.Errorf("account %x: missing code %x", task.owner, hash)
+		}
+		if have := crypto.Keccak256Hash(code); have != hash {
+			return fmt.Errorf("account %x: code %x hash mismatch: have %x", task.owner, hash, have)
+		}
+		atomic.AddUint64(&stats.Codes, 1)
+	}
+	if task.root == types.EmptyRootHash {
+		return nil
+	}
+	storage, err := statedb.OpenStorageTrie(task.owner, task.root)
+	if err != nil {
+		return fmt.Errorf("account %x: storage trie root %x: %v", task.owner, task.root, err)
+	}
+	return verifyTrie(db, task.owner, storage.NodeIterator(nil), stats, abort, nil)
+}
+
+// verifyTrie iterates over all the nodes of a trie, checking that each is stored
+// in the database under its hash, and invokes onLeaf for every leaf. The owner
+// is the hash of the account the trie belongs to, zero for the account trie.
+func verifyTrie(db ethdb.Database, owner common.Hash, it trie.NodeIterator, stats *VerifyStats, abort chan struct{}, onLeaf func(owner common.Hash, path []byte, blob []byte) error) (err error) {
+	describe := func(path []byte) string {
+		if owner == (common.Hash{}) {
+			return fmt.Sprintf("account trie (path %x)", path)
+		}
+		return fmt.Sprintf("storage trie of account %x (path %x)", owner, path)
+	}
+	// Nodes failing to decode crash the iterator, report them below the last one
+	var path []byte
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s: undecodable child node: %v", describe(path), r)
+		}
+	}()
+	for it.Next(true) {
+		select {
+		case <-abort:
+			return errVerifyAborted
+		default:
+		}
+		path = common.CopyBytes(it.Path())
+
+		if hash := it.Hash(); hash != (common.Hash{}) {
+			blob, err := db.Get(hash[:])
+			if err != nil || len(blob) == 0 {
+				return fmt.Errorf("%s: missing node %x", describe(path), hash)
+			}
+			if have := crypto.Keccak256Hash(blob); have != hash {
+				return fmt.Errorf("%s: node %x hash mismatch: have %x", describe(path), hash, have)
+			}
+			atomic.AddUint64(&stats.Nodes, 1)
+		}
+		if it.Leaf() && onLeaf != nil {
+			if err := onLeaf(common.BytesToHash(it.LeafKey()), path, it.LeafBlob()); err != nil {
+				return err
+			}
+		}
+	}
+	if err := it.Error(); err != nil {
+		if missing, ok := err.(*trie.MissingNodeError); ok {
+			return fmt.Errorf("%s: missing node %x", describe(missing.Path), missing.NodeHash)
+		}
+		return fmt.Errorf("%s: %v", describe(path), err)
+	}
+	return nil
+}
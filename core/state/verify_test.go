@@ -0,0 +1,88 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// makeVerifyTestState creates a test state with accounts holding code and storage.
+func makeVerifyTestState(t *testing.T) (*ethdb.MemDatabase, common.Hash) {
+	mem, _ := ethdb.NewMemDatabase()
+	state, _ := New(common.Hash{}, NewDatabase(mem))
+
+	for i := byte(0); i < 64; i++ {
+		addr := common.BytesToAddress([]byte{i})
+		state.AddBalance(addr, big.NewInt(int64(i)+1))
+		if i%4 == 0 {
+			state.SetCode(addr, []byte{i, i, i})
+		}
+		if i%3 == 0 {
+			for j := byte(1); j < 16; j++ {
+				state.SetState(addr, common.BytesToHash([]byte{j}), common.BytesToHash([]byte{i, j}))
+			}
+		}
+	}
+	root, err := state.CommitTo(mem, false)
+	if err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	return mem, root
+}
+
+// Tests that a complete state passes verification, and that every missing or
+// corrupted trie node and contract code is detected.
+func TestVerifyState(t *testing.T) {
+	db, root := makeVerifyTestState(t)
+
+	stats, err := VerifyState(db, root, 4)
+	if err != nil {
+		t.Fatalf("failed to verify intact state: %v", err)
+	}
+	if stats.Accounts != 64 || stats.Codes != 16 {
+		t.Fatalf("stats mismatch: have %d accounts, %d codes, want 64 accounts, 16 codes", stats.Accounts, stats.Codes)
+	}
+	// Gather all the entries of the state, apart from the root
+	state, _ := New(root, NewDatabase(db))
+
+	var hashes []common.Hash
+	for it := NewNodeIterator(state); it.Next(); {
+		if it.Hash != (common.Hash{}) && it.Hash != root {
+			hashes = append(hashes, it.Hash)
+		}
+	}
+	if len(hashes) <= int(stats.Codes) {
+		t.Fatalf("too few state entries: %d", len(hashes))
+	}
+	for _, hash := range hashes {
+		blob, _ := db.Get(hash[:])
+
+		db.Delete(hash[:])
+		if _, err := VerifyState(db, root, 4); err == nil {
+			t.Errorf("missing entry %x not detected", hash)
+		}
+		db.Put(hash[:], append(common.CopyBytes(blob), 0x00))
+		if _, err := VerifyState(db, root, 4); err == nil {
+			t.Errorf("corrupted entry %x not detected", hash)
+		}
+		db.Put(hash[:], blob)
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// txIndexLogInterval is the time between progress reports of long running
+// transaction (un)indexing runs.
+const txIndexLogInterval = 8 * time.Second
+
+// maintainTxIndex keeps the transaction lookup index in line with the configured
+// limit, indexing or unindexing old blocks in the background whenever the chain
+// head moves. Progress is tracked in the database via the index tail, so that an
+// interrupted run is resumed on the next startup. It is only started if a limit
+// is configured, so that tools opening the chain leave the index alone.
+//
+// This method must be run in its own goroutine.
+func (bc *BlockChain) maintainTxIndex() {
+	defer bc.wg.Done()
+
+	sub := bc.eventMux.Subscribe(ChainHeadEvent{})
+	defer sub.Unsubscribe()
+
+	var (
+		done      chan struct{} // Non-nil while a background run is active
+		interrupt chan struct{} // Channel to abort the active background run
+	)
+	run := func(head uint64) {
+		done, interrupt = make(chan struct{}), make(chan struct{})
+		go bc.updateTxIndex(head, done, interrupt)
+	}
+	run(bc.CurrentBlock().NumberU64())
+
+	for {
+		select {
+		case ev, ok := <-sub.Chan():
+			if !ok {
+				return
+			}
+			if done == nil {
+				run(ev.Data.(ChainHeadEvent).Block.NumberU64())
+			}
+		case <-done:
+			done = nil
+
+		case <-bc.quit:
+			if done != nil {
+				close(interrupt)
+				<-done
+			}
+			return
+		}
+	}
+}
+
+// TxIndexInProgress reports whether the lookup entries of older blocks are being
+// created in the background, meaning that a missing entry doesn't necessarily
+// denote an unknown transaction.
+func (bc *BlockChain) TxIndexInProgress() bool {
+	return atomic.LoadInt32(&bc.txIndexing) == 1
+}
+
+// updateTxIndex indexes or unindexes the blocks between the current index tail
+// and the oldest block that should be indexed based on the given head.
+func (bc *BlockChain) updateTxIndex(head uint64, done chan struct{}, interrupt chan struct{}) {
+	defer close(done)
+
+	// Calculate the oldest block to keep the lookup entries of
+	var from uint64
+	if limit := *bc.cacheConfig.TxLookupLimit; limit != 0 && head >= limit {
+		from = head - limit + 1
+	}
+	// Databases predating the bounded index have every block indexed
+	tail := GetTxIndexTail(bc.chainDb)
+	if tail == nil {
+		WriteTxIndexTail(bc.chainDb, 0)
+		tail = new(uint64)
+	}
+	switch {
+	case *tail > from:
+		atomic.StoreInt32(&bc.txIndexing, 1)
+		defer atomic.StoreInt32(&bc.txIndexing, 0)
+
+		indexTransactions(bc.chainDb, from, *tail, interrupt)
+	case *tail < from:
+		unindexTransactions(bc.chainDb, *tail, from, interrupt)
+	}
+}
+
+// indexTransactions creates the lookup entries of the canonical blocks in the
+// [from, to) range, newest first, lowering the index tail as it progresses.
+func indexTransactions(db ethdb.Database, from uint64, to uint64, interrupt chan struct{}) {
+	var (
+		batch  = db.NewBatch()
+		start  = time.Now()
+		logged = time.Now()
+		tail   = to
+		txs    int
+	)
+	flush := func() {
+		WriteTxIndexTail(batch, tail)
+		if err := batch.Write(); err != nil {
+			log.Crit("Failed to write transaction lookups", "err", err)
+		}
+		batch.Reset()
+	}
+	for tail > from {
+		select {
+		case <-interrupt:
+			flush()
+			log.Debug("Transaction indexing interrupted", "tail", tail, "elapsed", common.PrettyDuration(time.Since(start)))
+			return
+		default:
+		}
+		number := tail - 1
+		hash := GetCanonicalHash(db, number)
+		body := GetBody(db, hash, number)
+		if body == nil {
+			log.Error("Missing block body for transaction indexing", "number", number, "hash", hash)
+			break
+		}
+		if err := writeTxLookupEntries(batch, hash, number, body.Transactions); err != nil {
+			log.Crit("Failed to encode transaction lookups", "err", err)
+		}
+		tail, txs = number, txs+len(body.Transactions)
+
+		if batch.ValueSize() > ethdb.IdealBatchSize {
+			flush()
+		}
+		if time.Since(logged) > txIndexLogInterval {
+			log.Info("Indexing transactions", "blocks", to-tail, "txs", txs, "tail", tail, "elapsed", common.PrettyDuration(time.Since(start)))
+			logged = time.Now()
+		}
+	}
+	flush()
+	log.Info("Indexed transactions", "blocks", to-tail, "txs", txs, "tail", tail, "elapsed", common.PrettyDuration(time.Since(start)))
+}
+
+// unindexTransactions deletes the lookup entries of the canonical blocks in the
+// [from, to) range, oldest first, raising the index tail as it progresses.
+func unindexTransactions(db ethdb.Database, from uint64, to uint64, interrupt chan struct{}) {
+	var (
+		batch  = db.NewBatch()
+		start  = time.Now()
+		logged = time.Now()
+		tail   = from
+		txs    int
+	)
+	flush := func() {
+		WriteTxIndexTail(batch, tail)
+		if err := batch.Write(); err != nil {
+			log.Crit("Failed to delete transaction lookups", "err", err)
+		}
+		batch.Reset()
+	}
+	for tail < to {
+		select {
+		case <-interrupt:
+			flush()
+			log.Debug("Transaction unindexing interrupted", "tail", tail, "elapsed", common.PrettyDuration(time.Since(start)))
+			return
+		default:
+		}
+		hash := GetCanonicalHash(db, tail)
+		if body := GetBody(db, hash, tail); body != nil {
+			for _, tx := range body.Transactions {
+				DeleteTransaction(batch, tx.Hash())
+			}
+			txs += len(body.Transactions)
+		}
+		tail++
+
+		if batch.ValueSize() > ethdb.IdealBatchSize {
+			flush()
+		}
+		if time.Since(logged) > txIndexLogInterval {
+			log.Info("Unindexing transactions", "blocks", tail-from, "txs", txs, "tail", tail, "elapsed", common.PrettyDuration(time.Since(start)))
+			logged = time.Now()
+		}
+	}
+	flush()
+	log.Info("Unindexed transactions", "blocks", tail-from, "txs", txs, "tail", tail, "elapsed", common.PrettyDuration(time.Since(start)))
+}
@@ -0,0 +1,150 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// newTxIndexTestChain creates a database with a chain of blocks containing one
+// transaction each, imported into a blockchain bounding its lookup index to the
+// given limit.
+func newTxIndexTestChain(t *testing.T, n int, limit uint64) (ethdb.Database, *BlockChain, []*types.Block) {
+	var (
+		db, _   = ethdb.NewMemDatabase()
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  GenesisAlloc{address: {Balance: big.NewInt(1000000000)}},
+		}
+		genesis = gspec.MustCommit(db)
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, db, n, func(i int, block *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.Address{1}, big.NewInt(1000), big.NewInt(21000), new(big.Int), nil), types.HomesteadSigner{}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.AddTx(tx)
+	})
+	cacheConfig := *DefaultCacheConfig
+	cacheConfig.TxLookupLimit = &limit
+
+	blockchain, _ := NewBlockChain(db, &cacheConfig, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	return db, blockchain, blocks
+}
+
+// checkTxIndex verifies that exactly the transactions of the blocks at or above
+// the given tail are indexed, and that the tail is recorded in the database.
+func checkTxIndex(t *testing.T, db ethdb.Database, blocks []*types.Block, tail uint64) {
+	if have := GetTxIndexTail(db); have == nil || *have != tail {
+		t.Fatalf("index tail mismatch: have %v, want %d", have, tail)
+	}
+	for _, block := range blocks {
+		for i, tx := range block.Transactions() {
+			hash, number, index := GetTxLookupEntry(db, tx.Hash())
+			if block.NumberU64() < tail {
+				if hash != (common.Hash{}) {
+					t.Errorf("block #%d: transaction %d not unindexed", block.NumberU64(), i)
+				}
+				continue
+			}
+			if hash != block.Hash() || number != block.NumberU64() || index != uint64(i) {
+				t.Errorf("block #%d: transaction %d lookup mismatch: have %x/%d/%d", block.NumberU64(), i, hash, number, index)
+			}
+		}
+	}
+}
+
+// waitTxIndexTail waits until the background indexer reaches the given tail.
+func waitTxIndexTail(t *testing.T, db ethdb.Database, tail uint64) {
+	for i := 0; i < 200; i++ {
+		if have := GetTxIndexTail(db); have != nil && *have == tail {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("index tail not reached: want %d", tail)
+}
+
+// Tests that the background indexer bounds the lookup index to the most recent
+// blocks, and that changing the limit reindexes or unindexes old blocks.
+func TestTxIndexLimit(t *testing.T) {
+	db, blockchain, blocks := newTxIndexTestChain(t, 32, 8)
+	defer blockchain.Stop()
+
+	waitTxIndexTail(t, db, 25)
+	checkTxIndex(t, db, blocks, 25)
+
+	// Raising the limit must rebuild the index of the older blocks
+	for _, test := range []struct {
+		limit uint64
+		tail  uint64
+	}{{16, 17}, {4, 29}, {0, 0}, {64, 0}, {1, 32}} {
+		limit := test.limit
+		blockchain.cacheConfig.TxLookupLimit = &limit
+
+		done := make(chan struct{})
+		blockchain.updateTxIndex(blockchain.CurrentBlock().NumberU64(), done, make(chan struct{}))
+		checkTxIndex(t, db, blocks, test.tail)
+	}
+}
+
+// Tests that databases predating the bounded index are considered fully indexed
+// and that interrupted runs leave a consistent tail behind.
+func TestTxIndexInterrupt(t *testing.T) {
+	db, blockchain, blocks := newTxIndexTestChain(t, 16, 0)
+	blockchain.Stop()
+
+	// Drop the tail to simulate a legacy database
+	db.Delete(txIndexTailKey)
+	if !TxIndexComplete(db) {
+		t.Fatalf("legacy index reported incomplete")
+	}
+	// An interrupted run must not move the tail
+	interrupt := make(chan struct{})
+	close(interrupt)
+
+	WriteTxIndexTail(db, 0)
+	unindexTransactions(db, 0, 8, interrupt)
+	checkTxIndex(t, db, blocks, 0)
+
+	unindexTransactions(db, 0, 8, make(chan struct{}))
+	checkTxIndex(t, db, blocks, 8)
+	if TxIndexComplete(db) {
+		t.Fatalf("bounded index reported complete")
+	}
+	indexTransactions(db, 0, 8, interrupt)
+	checkTxIndex(t, db, blocks, 8)
+
+	indexTransactions(db, 4, 8, make(chan struct{}))
+	checkTxIndex(t, db, blocks, 4)
+}
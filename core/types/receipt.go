@@ -17,6 +17,7 @@
 package types
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"math/big"
@@ -80,43 +81,85 @@ func (r *Receipt) String() string {
 	return fmt.Sprintf("receipt{med=%x cgas=%v bloom=%x logs=%v}", r.PostState, r.CumulativeGasUsed, r.Bloom, r.Logs)
 }
 
-// ReceiptForStorage is a wrapper around a Receipt that flattens and parses the
-// entire content of a receipt, as opposed to only the consensus fields originally.
+// ReceiptForStorage is a wrapper around a Receipt used for database storage.
+// Only the consensus fields of the receipt are stored, the fields derivable from
+// the block (transaction hash, contract address, gas used, bloom and the log
+// positions) have to be recomputed after loading.
 type ReceiptForStorage Receipt
 
-// EncodeRLP implements rlp.Encoder, and flattens all content fields of a receipt
-// into an RLP stream.
+// receiptFormatCompact is the format byte of the compact storage encoding. Compact
+// receipts are stored as RLP strings holding the format byte followed by the
+// encoded fields, telling them apart from the legacy receipts stored as lists.
+const receiptFormatCompact = 0x01
+
+// storedReceiptRLP is the compact storage encoding of a receipt.
+type storedReceiptRLP struct {
+	PostState         []byte
+	CumulativeGasUsed *big.Int
+	Logs              []*Log
+}
+
+// legacyStoredReceiptRLP is the original storage encoding of a receipt, which
+// also contained all the derived fields.
+type legacyStoredReceiptRLP struct {
+	PostState         []byte
+	CumulativeGasUsed *big.Int
+	Bloom             Bloom
+	TxHash            common.Hash
+	ContractAddress   common.Address
+	Logs              []*LogForStorage
+	GasUsed           *big.Int
+}
+
+// EncodeRLP implements rlp.Encoder, and flattens the consensus fields of a
+// receipt into an RLP stream using the compact storage encoding.
 func (r *ReceiptForStorage) EncodeRLP(w io.Writer) error {
-	logs := make([]*LogForStorage, len(r.Logs))
-	for i, log := range r.Logs {
-		logs[i] = (*LogForStorage)(log)
+	blob, err := rlp.EncodeToBytes(&storedReceiptRLP{
+		PostState:         r.PostState,
+		CumulativeGasUsed: r.CumulativeGasUsed,
+		Logs:              r.Logs,
+	})
+	if err != nil {
+		return err
 	}
-	return rlp.Encode(w, []interface{}{r.PostState, r.CumulativeGasUsed, r.Bloom, r.TxHash, r.ContractAddress, logs, r.GasUsed})
+	return rlp.Encode(w, append([]byte{receiptFormatCompact}, blob...))
 }
 
-// DecodeRLP implements rlp.Decoder, and loads both consensus and implementation
-// fields of a receipt from an RLP stream.
+// DecodeRLP implements rlp.Decoder, and loads a receipt from an RLP stream in
+// either the compact or the legacy storage encoding. Receipts in the legacy
+// encoding also have their derived fields set.
 func (r *ReceiptForStorage) DecodeRLP(s *rlp.Stream) error {
-	var receipt struct {
-		PostState         []byte
-		CumulativeGasUsed *big.Int
-		Bloom             Bloom
-		TxHash            common.Hash
-		ContractAddress   common.Address
-		Logs              []*LogForStorage
-		GasUsed           *big.Int
+	kind, _, err := s.Kind()
+	if err != nil {
+		return err
 	}
-	if err := s.Decode(&receipt); err != nil {
+	if kind != rlp.List {
+		blob, err := s.Bytes()
+		if err != nil {
+			return err
+		}
+		if len(blob) == 0 || blob[0] != receiptFormatCompact {
+			return errors.New("unknown receipt storage format")
+		}
+		var stored storedReceiptRLP
+		if err := rlp.DecodeBytes(blob[1:], &stored); err != nil {
+			return err
+		}
+		r.PostState, r.CumulativeGasUsed, r.Logs = stored.PostState, stored.CumulativeGasUsed, stored.Logs
+		return nil
+	}
+	var legacy legacyStoredReceiptRLP
+	if err := s.Decode(&legacy); err != nil {
 		return err
 	}
 	// Assign the consensus fields
-	r.PostState, r.CumulativeGasUsed, r.Bloom = receipt.PostState, receipt.CumulativeGasUsed, receipt.Bloom
-	r.Logs = make([]*Log, len(receipt.Logs))
-	for i, log := range receipt.Logs {
+	r.PostState, r.CumulativeGasUsed, r.Bloom = legacy.PostState, legacy.CumulativeGasUsed, legacy.Bloom
+	r.Logs = make([]*Log, len(legacy.Logs))
+	for i, log := range legacy.Logs {
 		r.Logs[i] = (*Log)(log)
 	}
 	// Assign the implementation fields
-	r.TxHash, r.ContractAddress, r.GasUsed = receipt.TxHash, receipt.ContractAddress, receipt.GasUsed
+	r.TxHash, r.ContractAddress, r.GasUsed = legacy.TxHash, legacy.ContractAddress, legacy.GasUsed
 
 	return nil
 }
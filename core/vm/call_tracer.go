@@ -0,0 +1,112 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// CallFrame is a single message call or contract creation recorded by the
+// CallTracer, along with all the calls it made in turn.
+type CallFrame struct {
+	Type    string         `json:"type"`
+	From    common.Address `json:"from"`
+	To      common.Address `json:"to"`
+	Value   *hexutil.Big   `json:"value,omitempty"`
+	Gas     hexutil.Uint64 `json:"gas"`
+	GasUsed hexutil.Uint64 `json:"gasUsed"`
+	Input   hexutil.Bytes  `json:"input"`
+	Output  hexutil.Bytes  `json:"output,omitempty"`
+	Error   string         `json:"error,omitempty"`
+	Calls   []*CallFrame   `json:"calls,omitempty"`
+}
+
+// CallTracer is a Tracer which reconstructs the tree of message calls made
+// during execution. Opcode level steps are ignored, making it considerably
+// cheaper than the StructLogger.
+//
+// A single CallTracer may be reused across multiple transactions, every
+// outermost call being recorded as a separate root frame.
+type CallTracer struct {
+	calls []*CallFrame // finished outermost call frames
+	stack []*CallFrame // call frames currently being executed
+}
+
+// NewCallTracer returns a new call tree tracer.
+func NewCallTracer() *CallTracer {
+	return &CallTracer{}
+}
+
+// CaptureEnter opens a new call frame, nested into the currently executing
+// one if there is any.
+func (t *CallTracer) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) error {
+	frame := &CallFrame{
+		Type:  typ.String(),
+		From:  from,
+		To:    to,
+		Gas:   hexutil.Uint64(gas),
+		Input: common.CopyBytes(input),
+	}
+	if value != nil {
+		frame.Value = (*hexutil.Big)(new(big.Int).Set(value))
+	}
+	t.stack = append(t.stack, frame)
+	return nil
+}
+
+// CaptureState is called for each step of the VM and is ignored.
+func (t *CallTracer) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, memory *Memory, stack *Stack, contract *Contract, depth int, err error) error {
+	return nil
+}
+
+// CaptureExit closes the currently executing call frame and attaches it to
+// its parent.
+func (t *CallTracer) CaptureExit(output []byte, gasUsed uint64, err error) error {
+	size := len(t.stack)
+	if size == 0 {
+		return nil
+	}
+	frame := t.stack[size-1]
+	t.stack = t.stack[:size-1]
+
+	frame.GasUsed = hexutil.Uint64(gasUsed)
+	frame.Output = common.CopyBytes(output)
+	if err != nil {
+		frame.Error = err.Error()
+	}
+	if size == 1 {
+		t.calls = append(t.calls, frame)
+	} else {
+		parent := t.stack[size-2]
+		parent.Calls = append(parent.Calls, frame)
+	}
+	return nil
+}
+
+// CaptureEnd is called after the execution finishes.
+func (t *CallTracer) CaptureEnd(output []byte, gasUsed uint64, d time.Duration) error {
+	return nil
+}
+
+// Calls returns the outermost call frames finished so far, in execution order.
+func (t *CallTracer) Calls() []*CallFrame {
+	return t.calls
+}
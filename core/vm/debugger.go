@@ -0,0 +1,369 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// Stepping modes the Debugger can be resumed with.
+const (
+	StepInto     = "into"     // pause at the next instruction
+	StepOver     = "over"     // pause at the next instruction outside of nested calls
+	StepOut      = "out"      // pause at the next instruction of the calling frame
+	StepContinue = "continue" // pause at the next breakpoint
+	StepStore    = "sstore"   // pause at the next SSTORE or breakpoint
+)
+
+// Breakpoint kinds.
+const (
+	BreakPC    = "pc"    // break when reaching a program counter
+	BreakOp    = "op"    // break when reaching an opcode
+	BreakDepth = "depth" // break when reaching a call depth
+)
+
+var (
+	errDebugFinished   = errors.New("execution finished")
+	errDebugNotStarted = errors.New("execution not started")
+)
+
+// Breakpoint pauses the Debugger whenever an instruction matching it is about
+// to be executed. Value holds the program counter, the opcode or the call depth
+// depending on the kind of breakpoint.
+type Breakpoint struct {
+	ID    int    `json:"id"`
+	Kind  string `json:"kind"`
+	Value uint64 `json:"value"`
+}
+
+// matches reports whether the breakpoint is hit by the given instruction.
+func (bp *Breakpoint) matches(pc uint64, op OpCode, depth int) bool {
+	switch bp.Kind {
+	case BreakPC:
+		return pc == bp.Value
+	case BreakOp:
+		return uint64(op) == bp.Value
+	case BreakDepth:
+		return uint64(depth) == bp.Value
+	}
+	return false
+}
+
+// DebugState is the state of the execution the Debugger paused at, or the
+// outcome of the execution once it finished.
+type DebugState struct {
+	PC         uint64         `json:"pc"`
+	Op         string         `json:"op"`
+	Gas        uint64         `json:"gas"`
+	Cost       uint64         `json:"gasCost"`
+	Depth      int            `json:"depth"`
+	Address    common.Address `json:"address"`
+	Stack      []*hexutil.Big `json:"stack"`
+	Memory     hexutil.Bytes  `json:"memory"`
+	ReturnData hexutil.Bytes  `json:"returnData"`
+	Breakpoint int            `json:"breakpoint,omitempty"` // ID of the breakpoint hit, if any
+
+	Done   bool          `json:"done"`
+	Output hexutil.Bytes `json:"output,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// debugRequest is a command sent to the paused execution.
+type debugRequest struct {
+	mode  string // stepping mode to resume with, empty for queries
+	stop  bool   // whether to abort the execution
+	query func() // inspection to run on the paused execution
+	done  chan struct{}
+}
+
+// Debugger is a Tracer which pauses the execution on request, allowing it to be
+// stepped through and inspected. The execution runs on its own goroutine,
+// started by Start, and is driven by the Resume, Storage and Stop methods.
+//
+// The execution is initially paused at its first instruction.
+type Debugger struct {
+	lock        sync.Mutex // protects the breakpoints
+	breakpoints []*Breakpoint
+	nextID      int
+
+	ctrl     sync.Mutex // serialises the controlling methods
+	started  bool
+	finished bool
+	current  *DebugState
+	paused   chan *DebugState
+	requests chan *debugRequest
+
+	// Fields below are only accessed by the execution goroutine, or while it
+	// is paused.
+	mode       string
+	depth      int      // call depth the execution was last resumed at
+	stopping   bool     // whether the execution is being aborted
+	returnData [][]byte // output of the last call per active call frame
+	env        *EVM
+	contract   *Contract
+}
+
+// NewDebugger creates a debugger pausing at the first instruction.
+func NewDebugger() *Debugger {
+	return &Debugger{
+		mode:     StepInto,
+		paused:   make(chan *DebugState),
+		requests: make(chan *debugRequest),
+	}
+}
+
+// Start runs exec, which is expected to drive an EVM traced by the debugger, on
+// a new goroutine and waits for the execution to pause or finish.
+func (d *Debugger) Start(exec func() ([]byte, error)) *DebugState {
+	d.ctrl.Lock()
+	defer d.ctrl.Unlock()
+
+	d.started = true
+	go func() {
+		output, err := exec()
+		state := &DebugState{Done: true, Output: output}
+		if err != nil {
+			state.Error = err.Error()
+		}
+		d.paused <- state
+	}()
+	return d.wait()
+}
+
+// wait blocks until the execution pauses or finishes.
+func (d *Debugger) wait() *DebugState {
+	d.current = <-d.paused
+	if d.current.Done {
+		d.finished = true
+	}
+	return d.current
+}
+
+// send delivers a request to the paused execution.
+func (d *Debugger) send(req *debugRequest) error {
+	if !d.started {
+		return errDebugNotStarted
+	}
+	if d.finished {
+		return errDebugFinished
+	}
+	d.requests <- req
+	return nil
+}
+
+// State returns the state the execution is currently paused at, or its outcome
+// if it finished.
+func (d *Debugger) State() *DebugState {
+	d.ctrl.Lock()
+	defer d.ctrl.Unlock()
+
+	return d.current
+}
+
+// Resume continues the execution in the given stepping mode, and waits for it
+// to pause again or finish.
+func (d *Debugger) Resume(mode string) (*DebugState, error) {
+	switch mode {
+	case StepInto, StepOver, StepOut, StepContinue, StepStore:
+	default:
+		return nil, fmt.Errorf("unknown stepping mode %q", mode)
+	}
+	d.ctrl.Lock()
+	defer d.ctrl.Unlock()
+
+	if err := d.send(&debugRequest{mode: mode}); err != nil {
+		return nil, err
+	}
+	return d.wait(), nil
+}
+
+// Stop aborts the execution and waits for it to finish.
+func (d *Debugger) Stop() *DebugState {
+	d.ctrl.Lock()
+	defer d.ctrl.Unlock()
+
+	if d.send(&debugRequest{stop: true}) != nil {
+		return d.current
+	}
+	return d.wait()
+}
+
+// Storage retrieves a storage slot of the contract the execution is paused in.
+func (d *Debugger) Storage(key common.Hash) (common.Hash, error) {
+	d.ctrl.Lock()
+	defer d.ctrl.Unlock()
+
+	var value common.Hash
+	req := &debugRequest{
+		query: func() { value = d.env.StateDB.GetState(d.contract.Address(), key) },
+		done:  make(chan struct{}),
+	}
+	if err := d.send(req); err != nil {
+		return common.Hash{}, err
+	}
+	<-req.done
+	return value, nil
+}
+
+// AddBreakpoint registers a new breakpoint, returning its ID.
+func (d *Debugger) AddBreakpoint(kind string, value uint64) (int, error) {
+	switch kind {
+	case BreakPC, BreakOp, BreakDepth:
+	default:
+		return 0, fmt.Errorf("unknown breakpoint kind %q", kind)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.nextID++
+	d.breakpoints = append(d.breakpoints, &Breakpoint{ID: d.nextID, Kind: kind, Value: value})
+	return d.nextID, nil
+}
+
+// RemoveBreakpoint deletes the breakpoint with the given ID.
+func (d *Debugger) RemoveBreakpoint(id int) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for i, bp := range d.breakpoints {
+		if bp.ID == id {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown breakpoint %d", id)
+}
+
+// Breakpoints returns the registered breakpoints.
+func (d *Debugger) Breakpoints() []Breakpoint {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	bps := make([]Breakpoint, len(d.breakpoints))
+	for i, bp := range d.breakpoints {
+		bps[i] = *bp
+	}
+	return bps
+}
+
+// hitBreakpoint returns the ID of the first breakpoint matching the given
+// instruction, or zero if there is none.
+func (d *Debugger) hitBreakpoint(pc uint64, op OpCode, depth int) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, bp := range d.breakpoints {
+		if bp.matches(pc, op, depth) {
+			return bp.ID
+		}
+	}
+	return 0
+}
+
+// CaptureEnter opens a new call frame without any return data.
+func (d *Debugger) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) error {
+	d.returnData = append(d.returnData, nil)
+	return nil
+}
+
+// CaptureState pauses the execution if the instruction about to be executed
+// matches a breakpoint or the current stepping mode, and serves the requests
+// of the controller until resumed.
+func (d *Debugger) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, memory *Memory, stack *Stack, contract *Contract, depth int, err error) error {
+	if err != nil || d.stopping {
+		return nil
+	}
+	breakpoint := d.hitBreakpoint(pc, op, depth)
+	if breakpoint == 0 {
+		switch d.mode {
+		case StepOver:
+			if depth > d.depth {
+				return nil
+			}
+		case StepOut:
+			if depth >= d.depth {
+				return nil
+			}
+		case StepStore:
+			if op != SSTORE {
+				return nil
+			}
+		case StepContinue:
+			return nil
+		}
+	}
+	d.env, d.contract = env, contract
+
+	state := &DebugState{
+		PC:         pc,
+		Op:         op.String(),
+		Gas:        gas,
+		Cost:       cost,
+		Depth:      depth,
+		Address:    contract.Address(),
+		Stack:      make([]*hexutil.Big, len(stack.Data())),
+		Memory:     common.CopyBytes(memory.Data()),
+		Breakpoint: breakpoint,
+	}
+	for i, value := range stack.Data() {
+		state.Stack[i] = (*hexutil.Big)(new(big.Int).Set(value))
+	}
+	if len(d.returnData) > 0 {
+		state.ReturnData = common.CopyBytes(d.returnData[len(d.returnData)-1])
+	}
+	d.paused <- state
+
+	for req := range d.requests {
+		switch {
+		case req.query != nil:
+			req.query()
+			close(req.done)
+			continue
+		case req.stop:
+			d.stopping = true
+			env.Cancel()
+		default:
+			d.mode, d.depth = req.mode, depth
+		}
+		break
+	}
+	return nil
+}
+
+// CaptureExit closes the current call frame, handing its output to the caller
+// as return data.
+func (d *Debugger) CaptureExit(output []byte, gasUsed uint64, err error) error {
+	if size := len(d.returnData); size > 0 {
+		d.returnData = d.returnData[:size-1]
+		if size > 1 {
+			d.returnData[size-2] = common.CopyBytes(output)
+		}
+	}
+	return nil
+}
+
+// CaptureEnd is called after the execution finishes.
+func (d *Debugger) CaptureEnd(output []byte, gasUsed uint64, t time.Duration) error {
+	return nil
+}
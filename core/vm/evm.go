@@ -130,6 +130,11 @@ func (evm *EVM) Call(caller ContractRef, addr common.Address, input []byte, gas
 		return nil, gas, nil
 	}
 
+	// Report the call to the tracer, failed ones included
+	if evm.vmConfig.Debug {
+		evm.vmConfig.Tracer.CaptureEnter(CALL, caller.Address(), addr, input, gas, value)
+		defer func() { evm.vmConfig.Tracer.CaptureExit(ret, gas-leftOverGas, err) }()
+	}
 	// Depth check execution. Fail if we're trying to execute above the
 	// limit.
 	if evm.depth > int(params.CallCreateDepth) {
@@ -180,6 +185,11 @@ func (evm *EVM) CallCode(caller ContractRef, addr common.Address, input []byte,
 		return nil, gas, nil
 	}
 
+	// Report the call to the tracer, failed ones included
+	if evm.vmConfig.Debug {
+		evm.vmConfig.Tracer.CaptureEnter(CALLCODE, caller.Address(), addr, input, gas, value)
+		defer func() { evm.vmConfig.Tracer.CaptureExit(ret, gas-leftOverGas, err) }()
+	}
 	// Depth check execution. Fail if we're trying to execute above the
 	// limit.
 	if evm.depth > int(params.CallCreateDepth) {
@@ -218,6 +228,11 @@ func (evm *EVM) DelegateCall(caller ContractRef, addr common.Address, input []by
 		return nil, gas, nil
 	}
 
+	// Report the call to the tracer, failed ones included
+	if evm.vmConfig.Debug {
+		evm.vmConfig.Tracer.CaptureEnter(DELEGATECALL, caller.Address(), addr, input, gas, nil)
+		defer func() { evm.vmConfig.Tracer.CaptureExit(ret, gas-leftOverGas, err) }()
+	}
 	// Depth check execution. Fail if we're trying to execute above the
 	// limit.
 	if evm.depth > int(params.CallCreateDepth) {
@@ -248,6 +263,12 @@ func (evm *EVM) Create(caller ContractRef, code []byte, gas uint64, value *big.I
 		return nil, common.Address{}, gas, nil
 	}
 
+	// Report the creation to the tracer, failed ones included
+	nonce := evm.StateDB.GetNonce(caller.Address())
+	if evm.vmConfig.Debug {
+		evm.vmConfig.Tracer.CaptureEnter(CREATE, caller.Address(), crypto.CreateAddress(caller.Address(), nonce), code, gas, value)
+		defer func() { evm.vmConfig.Tracer.CaptureExit(ret, gas-leftOverGas, err) }()
+	}
 	// Depth check execution. Fail if we're trying to execute above the
 	// limit.
 	if evm.depth > int(params.CallCreateDepth) {
@@ -258,7 +279,6 @@ func (evm *EVM) Create(caller ContractRef, code []byte, gas uint64, value *big.I
 	}
 
 	// Create a new account on the state
-	nonce := evm.StateDB.GetNonce(caller.Address())
 	evm.StateDB.SetNonce(caller.Address(), nonce+1)
 
 	snapshot := evm.StateDB.Snapshot()
@@ -0,0 +1,216 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bytes"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+)
+
+// PrestateAccount is the state of a single account as seen by a transaction.
+// It is encoded in the same format as the accounts of a genesis allocation,
+// so the output of the PrestateTracer can be loaded back as a genesis alloc.
+type PrestateAccount struct {
+	Balance *math.HexOrDecimal256       `json:"balance"`
+	Nonce   math.HexOrDecimal64         `json:"nonce,omitempty"`
+	Code    hexutil.Bytes               `json:"code,omitempty"`
+	Storage map[common.Hash]common.Hash `json:"storage,omitempty"`
+}
+
+// PrestateAlloc is a set of accounts in genesis allocation format.
+type PrestateAlloc map[common.Address]*PrestateAccount
+
+// StateDiff is the list of changes a transaction made to the state. Pre holds
+// the original values of the modified accounts and storage slots, Post the
+// new ones. Accounts created by the transaction are missing from Pre, the ones
+// deleted are missing from Post.
+type StateDiff struct {
+	Pre  PrestateAlloc `json:"pre"`
+	Post PrestateAlloc `json:"post"`
+}
+
+// PrestateTracer is a Tracer which records the minimal set of accounts and
+// storage slots a transaction needs to be replayed: every account it touched
+// and every storage slot it read or wrote, with their values prior to the
+// execution. Optionally it can also compute the changes the transaction made
+// to these values.
+type PrestateTracer struct {
+	statedb StateDB
+
+	pre     PrestateAlloc                               // original state of the touched accounts that existed
+	touched map[common.Address]map[common.Hash]struct{} // all touched accounts and accessed storage slots
+}
+
+// NewPrestateTracer creates a tracer recording the state accessed by a single
+// transaction executed on top of statedb. Accounts modified before the EVM is
+// entered, such as the sender buying gas or the coinbase collecting the fees,
+// are invisible to the tracer and must be passed in before execution starts.
+func NewPrestateTracer(statedb StateDB, accounts ...common.Address) *PrestateTracer {
+	t := &PrestateTracer{
+		statedb: statedb,
+		pre:     make(PrestateAlloc),
+		touched: make(map[common.Address]map[common.Hash]struct{}),
+	}
+	for _, addr := range accounts {
+		t.lookupAccount(addr)
+	}
+	return t
+}
+
+// CaptureEnter records the caller and callee of a new call frame.
+func (t *PrestateTracer) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) error {
+	t.lookupAccount(from)
+	t.lookupAccount(to)
+	return nil
+}
+
+// CaptureState records the accounts and storage slots accessed by the
+// current opcode.
+func (t *PrestateTracer) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, memory *Memory, stack *Stack, contract *Contract, depth int, err error) error {
+	if err != nil {
+		return nil
+	}
+	switch op {
+	case SLOAD, SSTORE:
+		t.lookupStorage(contract.Address(), common.BigToHash(stack.Back(0)))
+	case BALANCE, EXTCODESIZE, EXTCODECOPY, SELFDESTRUCT:
+		t.lookupAccount(common.BigToAddress(stack.Back(0)))
+	}
+	return nil
+}
+
+// CaptureExit is called when the EVM leaves a call frame.
+func (t *PrestateTracer) CaptureExit(output []byte, gasUsed uint64, err error) error {
+	return nil
+}
+
+// CaptureEnd is called after the execution finishes.
+func (t *PrestateTracer) CaptureEnd(output []byte, gasUsed uint64, d time.Duration) error {
+	return nil
+}
+
+// lookupAccount records the current state of an account if it's the first
+// time it is being touched.
+func (t *PrestateTracer) lookupAccount(addr common.Address) {
+	if _, ok := t.touched[addr]; ok {
+		return
+	}
+	t.touched[addr] = make(map[common.Hash]struct{})
+	if account := t.currentAccount(addr); account != nil {
+		t.pre[addr] = account
+	}
+}
+
+// lookupStorage records the current value of a storage slot if it's the first
+// time it is being accessed.
+func (t *PrestateTracer) lookupStorage(addr common.Address, key common.Hash) {
+	t.lookupAccount(addr)
+	if _, ok := t.touched[addr][key]; ok {
+		return
+	}
+	t.touched[addr][key] = struct{}{}
+	if account := t.pre[addr]; account != nil {
+		account.Storage[key] = t.statedb.GetState(addr, key)
+	}
+}
+
+// currentAccount retrieves the present state of an account, without any of its
+// storage, or nil if the account does not exist.
+func (t *PrestateTracer) currentAccount(addr common.Address) *PrestateAccount {
+	if !t.statedb.Exist(addr) {
+		return nil
+	}
+	return &PrestateAccount{
+		Balance: (*math.HexOrDecimal256)(new(big.Int).Set(t.statedb.GetBalance(addr))),
+		Nonce:   math.HexOrDecimal64(t.statedb.GetNonce(addr)),
+		Code:    common.CopyBytes(t.statedb.GetCode(addr)),
+		Storage: make(map[common.Hash]common.Hash),
+	}
+}
+
+// Prestate returns the original state of every account and storage slot the
+// transaction has touched. Accounts which did not exist are omitted.
+func (t *PrestateTracer) Prestate() PrestateAlloc {
+	return t.pre
+}
+
+// Diff returns the changes made by the transaction to the touched accounts.
+// It compares the recorded prestate with the current content of the state,
+// which thus needs to be finalised by the caller beforehand in order for the
+// deleted accounts to be reported.
+func (t *PrestateTracer) Diff() *StateDiff {
+	diff := &StateDiff{
+		Pre:  make(PrestateAlloc),
+		Post: make(PrestateAlloc),
+	}
+	for addr, keys := range t.touched {
+		pre, post := t.pre[addr], t.currentAccount(addr)
+		if post != nil {
+			for key := range keys {
+				post.Storage[key] = t.statedb.GetState(addr, key)
+			}
+		}
+		switch {
+		case pre == nil && post == nil:
+			continue
+		case pre == nil:
+			diff.Post[addr] = trimAccount(post, nil)
+		case post == nil:
+			diff.Pre[addr] = trimAccount(pre, nil)
+		default:
+			changed := (*big.Int)(pre.Balance).Cmp((*big.Int)(post.Balance)) != 0 ||
+				pre.Nonce != post.Nonce || !bytes.Equal(pre.Code, post.Code)
+			for key := range keys {
+				if pre.Storage[key] != post.Storage[key] {
+					changed = true
+				}
+			}
+			if changed {
+				diff.Pre[addr] = trimAccount(pre, post)
+				diff.Post[addr] = trimAccount(post, pre)
+			}
+		}
+	}
+	return diff
+}
+
+// trimAccount returns a copy of account without the storage slots which have
+// the same value in other, or which are empty if there's nothing to compare
+// against.
+func trimAccount(account, other *PrestateAccount) *PrestateAccount {
+	trimmed := &PrestateAccount{
+		Balance: account.Balance,
+		Nonce:   account.Nonce,
+		Code:    account.Code,
+		Storage: make(map[common.Hash]common.Hash),
+	}
+	for key, value := range account.Storage {
+		if other == nil && value == (common.Hash{}) {
+			continue
+		}
+		if other != nil && other.Storage[key] == value {
+			continue
+		}
+		trimmed.Storage[key] = value
+	}
+	return trimmed
+}
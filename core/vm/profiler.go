@@ -0,0 +1,298 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ProfileStat is the aggregated execution cost of an opcode or a single
+// instruction of a contract.
+type ProfileStat struct {
+	Count uint64        `json:"count"`
+	Gas   uint64        `json:"gas"`
+	Time  time.Duration `json:"time"`
+}
+
+// Coverage lists the JUMPDEST blocks of a contract's code that were reached
+// during execution, out of all the ones present in the code.
+type Coverage struct {
+	Blocks  int      `json:"blocks"`
+	Reached []uint64 `json:"reached"`
+}
+
+// ProfileResult is the outcome of a profiling run.
+type ProfileResult struct {
+	Opcodes  map[string]*ProfileStat                    `json:"opcodes"`
+	PCs      map[common.Address]map[uint64]*ProfileStat `json:"pcs"`
+	Coverage map[common.Address]*Coverage               `json:"coverage"`
+	Folded   []string                                   `json:"folded"`
+}
+
+// profileFrame is a call frame currently being executed by the profiled EVM.
+type profileFrame struct {
+	path    string // folded stack of contract addresses leading to this frame
+	callGas uint64 // gas used by the frames called from this one
+}
+
+// Profiler is a Tracer which aggregates the gas consumption and wall time of
+// the executed instructions per opcode and per program counter, records which
+// JUMPDEST blocks of each contract were reached, and accounts the gas used by
+// each call stack for flame graph generation.
+//
+// Gas forwarded to a called contract is attributed to the callee, not to the
+// calling instruction. The wall time of an instruction lasts until the next
+// one starts, so it is only indicative.
+type Profiler struct {
+	opcodes  map[OpCode]*ProfileStat
+	pcs      map[common.Address]map[uint64]*ProfileStat
+	jumpdest map[common.Address][]byte          // JUMPDEST analysis of the profiled contracts
+	reached  map[common.Address]map[uint64]bool // JUMPDEST locations executed per contract
+	folded   map[string]uint64                  // gas used per call stack, excluding nested calls
+
+	frames   []*profileFrame
+	lastOp   *ProfileStat // opcode stat of the instruction being timed
+	lastPC   *ProfileStat // pc stat of the instruction being timed
+	lastTime time.Time    // start of the instruction being timed
+}
+
+// NewProfiler returns a new gas profiler.
+func NewProfiler() *Profiler {
+	return &Profiler{
+		opcodes:  make(map[OpCode]*ProfileStat),
+		pcs:      make(map[common.Address]map[uint64]*ProfileStat),
+		jumpdest: make(map[common.Address][]byte),
+		reached:  make(map[common.Address]map[uint64]bool),
+		folded:   make(map[string]uint64),
+	}
+}
+
+// CaptureEnter pushes a new frame onto the profiled call stack.
+func (p *Profiler) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) error {
+	p.stopTimer()
+
+	path := to.Hex()
+	if len(p.frames) > 0 {
+		path = p.frames[len(p.frames)-1].path + ";" + path
+	}
+	p.frames = append(p.frames, &profileFrame{path: path})
+	return nil
+}
+
+// CaptureState accounts the cost of the instruction about to be executed.
+func (p *Profiler) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, memory *Memory, stack *Stack, contract *Contract, depth int, err error) error {
+	p.stopTimer()
+	if err != nil {
+		return nil
+	}
+	// The cost of calls includes the gas handed over to the callee, which the
+	// interpreter left on the stack. Attribute it to the callee instead.
+	switch op {
+	case CALL, CALLCODE, DELEGATECALL:
+		if forwarded := stack.Back(0); forwarded.BitLen() <= 64 && forwarded.Uint64() <= cost {
+			cost -= forwarded.Uint64()
+		}
+	}
+	addr := contract.Address()
+	if contract.CodeAddr != nil {
+		addr = *contract.CodeAddr
+	}
+	opStat := p.opcodes[op]
+	if opStat == nil {
+		opStat = new(ProfileStat)
+		p.opcodes[op] = opStat
+	}
+	if p.pcs[addr] == nil {
+		p.pcs[addr] = make(map[uint64]*ProfileStat)
+		p.jumpdest[addr] = jumpdests(contract.Code)
+		p.reached[addr] = make(map[uint64]bool)
+	}
+	pcStat := p.pcs[addr][pc]
+	if pcStat == nil {
+		pcStat = new(ProfileStat)
+		p.pcs[addr][pc] = pcStat
+	}
+	for _, stat := range []*ProfileStat{opStat, pcStat} {
+		stat.Count++
+		stat.Gas += cost
+	}
+	if op == JUMPDEST {
+		p.reached[addr][pc] = true
+	}
+	p.lastOp, p.lastPC, p.lastTime = opStat, pcStat, time.Now()
+	return nil
+}
+
+// CaptureExit pops the current frame off the profiled call stack, accounting
+// the gas it used itself to its call stack.
+func (p *Profiler) CaptureExit(output []byte, gasUsed uint64, err error) error {
+	p.stopTimer()
+
+	size := len(p.frames)
+	if size == 0 {
+		return nil
+	}
+	frame := p.frames[size-1]
+	p.frames = p.frames[:size-1]
+
+	if gasUsed > frame.callGas {
+		p.folded[frame.path] += gasUsed - frame.callGas
+	}
+	if size > 1 {
+		p.frames[size-2].callGas += gasUsed
+	}
+	return nil
+}
+
+// CaptureEnd is called after the execution finishes.
+func (p *Profiler) CaptureEnd(output []byte, gasUsed uint64, t time.Duration) error {
+	return nil
+}
+
+// stopTimer accounts the time elapsed since the last instruction started.
+func (p *Profiler) stopTimer() {
+	if p.lastOp == nil {
+		return
+	}
+	elapsed := time.Since(p.lastTime)
+	p.lastOp.Time += elapsed
+	p.lastPC.Time += elapsed
+	p.lastOp, p.lastPC = nil, nil
+}
+
+// Coverage returns the JUMPDEST coverage of every profiled contract.
+func (p *Profiler) Coverage() map[common.Address]*Coverage {
+	coverage := make(map[common.Address]*Coverage)
+	for addr, analysis := range p.jumpdest {
+		cov := &Coverage{Reached: []uint64{}}
+		for _, bits := range analysis {
+			for ; bits != 0; bits &= bits - 1 {
+				cov.Blocks++
+			}
+		}
+		for pc := range p.reached[addr] {
+			cov.Reached = append(cov.Reached, pc)
+		}
+		sort.Sort(uint64s(cov.Reached))
+		coverage[addr] = cov
+	}
+	return coverage
+}
+
+// FoldedStacks returns the gas used per call stack in the folded stacks format
+// understood by flame graph generators, sorted by stack.
+func (p *Profiler) FoldedStacks() []string {
+	lines := make([]string, 0, len(p.folded))
+	for path, gas := range p.folded {
+		lines = append(lines, fmt.Sprintf("%s %d", path, gas))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// Result returns the aggregated profile.
+func (p *Profiler) Result() *ProfileResult {
+	result := &ProfileResult{
+		Opcodes:  make(map[string]*ProfileStat),
+		PCs:      p.pcs,
+		Coverage: p.Coverage(),
+		Folded:   p.FoldedStacks(),
+	}
+	for op, stat := range p.opcodes {
+		result.Opcodes[op.String()] = stat
+	}
+	return result
+}
+
+// WriteProfile writes the aggregated opcode and program counter profiles
+// along with the code coverage report in a readable format to the given writer.
+func (p *Profiler) WriteProfile(writer io.Writer) {
+	fmt.Fprintln(writer, "#### OPCODES ####")
+	ops := make(opcodeStats, 0, len(p.opcodes))
+	for op, stat := range p.opcodes {
+		ops = append(ops, opcodeStat{op, stat})
+	}
+	sort.Sort(ops)
+	for _, op := range ops {
+		fmt.Fprintf(writer, "%-14v count=%-10d gas=%-12d time=%v\n", op.op, op.stat.Count, op.stat.Gas, op.stat.Time)
+	}
+	coverage := p.Coverage()
+	for _, addr := range sortedAddresses(p.pcs) {
+		fmt.Fprintf(writer, "\n#### CONTRACT %x ####\n", addr)
+
+		pcs := make([]uint64, 0, len(p.pcs[addr]))
+		for pc := range p.pcs[addr] {
+			pcs = append(pcs, pc)
+		}
+		sort.Sort(uint64s(pcs))
+		for _, pc := range pcs {
+			stat := p.pcs[addr][pc]
+			fmt.Fprintf(writer, "pc=%08d count=%-10d gas=%-12d time=%v\n", pc, stat.Count, stat.Gas, stat.Time)
+		}
+		cov := coverage[addr]
+		fmt.Fprintf(writer, "coverage: %d/%d JUMPDEST blocks reached %v\n", len(cov.Reached), cov.Blocks, cov.Reached)
+	}
+}
+
+// WriteFoldedStacks writes the gas used per call stack in the folded stacks
+// format to the given writer.
+func (p *Profiler) WriteFoldedStacks(writer io.Writer) error {
+	_, err := io.WriteString(writer, strings.Join(p.FoldedStacks(), "\n")+"\n")
+	return err
+}
+
+// sortedAddresses returns the keys of the per contract profile in order.
+func sortedAddresses(pcs map[common.Address]map[uint64]*ProfileStat) []common.Address {
+	addrs := make(addresses, 0, len(pcs))
+	for addr := range pcs {
+		addrs = append(addrs, addr)
+	}
+	sort.Sort(addrs)
+	return addrs
+}
+
+// opcodeStat is the profile of an opcode, sortable by descending gas usage.
+type opcodeStat struct {
+	op   OpCode
+	stat *ProfileStat
+}
+
+type opcodeStats []opcodeStat
+
+func (s opcodeStats) Len() int           { return len(s) }
+func (s opcodeStats) Less(i, j int) bool { return s[i].stat.Gas > s[j].stat.Gas }
+func (s opcodeStats) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type addresses []common.Address
+
+func (s addresses) Len() int           { return len(s) }
+func (s addresses) Less(i, j int) bool { return bytes.Compare(s[i][:], s[j][:]) < 0 }
+func (s addresses) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type uint64s []uint64
+
+func (s uint64s) Len() int           { return len(s) }
+func (s uint64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -17,6 +17,7 @@
 package runtime
 
 import (
+	"fmt"
 	"math/big"
 	"strings"
 	"testing"
@@ -117,6 +118,203 @@ func TestCall(t *testing.T) {
 	}
 }
 
+func TestCallTracer(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	state, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	var (
+		caller   = common.HexToAddress("0x0a")
+		callee   = common.HexToAddress("0x0b")
+		identity = common.BytesToAddress([]byte{4})
+	)
+	state.SetCode(callee, []byte{
+		byte(vm.PUSH1), 10,
+		byte(vm.PUSH1), 0,
+		byte(vm.MSTORE),
+		byte(vm.PUSH1), 32,
+		byte(vm.PUSH1), 0,
+		byte(vm.RETURN),
+	})
+	state.SetCode(caller, []byte{
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0,
+		byte(vm.PUSH1), 0x0b, byte(vm.GAS), byte(vm.CALL), byte(vm.POP),
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0,
+		byte(vm.PUSH1), 0x04, byte(vm.GAS), byte(vm.CALL), byte(vm.POP),
+		byte(vm.STOP),
+	})
+
+	tracer := vm.NewCallTracer()
+	_, _, err := Call(caller, nil, &Config{State: state, EVMConfig: vm.Config{Debug: true, Tracer: tracer}})
+	if err != nil {
+		t.Fatal("didn't expect error", err)
+	}
+	calls := tracer.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("root frame count mismatch: have %d, want 1", len(calls))
+	}
+	root := calls[0]
+	if root.Type != "CALL" || root.To != caller {
+		t.Errorf("root frame mismatch: have %s to %x, want CALL to %x", root.Type, root.To, caller)
+	}
+	if len(root.Calls) != 2 {
+		t.Fatalf("nested frame count mismatch: have %d, want 2", len(root.Calls))
+	}
+	if call := root.Calls[0]; call.From != caller || call.To != callee || new(big.Int).SetBytes(call.Output).Cmp(big.NewInt(10)) != 0 {
+		t.Errorf("contract call mismatch: have %x -> %x output %x", call.From, call.To, call.Output)
+	}
+	if call := root.Calls[1]; call.To != identity || call.GasUsed == 0 {
+		t.Errorf("precompile call mismatch: have to %x, gas used %d", call.To, call.GasUsed)
+	}
+}
+
+// Tests that calls and creations failing before their execution, such as value
+// transfers exceeding the balance, are reported to the tracer too.
+func TestCallTracerFailedTransfers(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	state, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	caller := common.HexToAddress("0x0a")
+	state.SetCode(caller, []byte{
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 1, byte(vm.CREATE), byte(vm.POP),
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 1,
+		byte(vm.PUSH1), 0x0b, byte(vm.GAS), byte(vm.CALL), byte(vm.POP),
+		byte(vm.STOP),
+	})
+	tracer := vm.NewCallTracer()
+	if _, _, err := Call(caller, nil, &Config{State: state, EVMConfig: vm.Config{Debug: true, Tracer: tracer}}); err != nil {
+		t.Fatal("didn't expect error", err)
+	}
+	calls := tracer.Calls()
+	if len(calls) != 1 || len(calls[0].Calls) != 2 {
+		t.Fatalf("frame count mismatch: have %d root frames, want 1 with 2 nested frames", len(calls))
+	}
+	for i, typ := range []string{"CREATE", "CALL"} {
+		frame := calls[0].Calls[i]
+		if frame.Type != typ || frame.Error != vm.ErrInsufficientBalance.Error() || frame.GasUsed != 0 {
+			t.Errorf("frame %d mismatch: have %s, error %q, gas used %d, want %s, error %q, no gas used", i, frame.Type, frame.Error, frame.GasUsed, typ, vm.ErrInsufficientBalance)
+		}
+	}
+}
+
+func TestPrestateTracer(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	state, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	address := common.HexToAddress("0x0a")
+	state.SetCode(address, []byte{
+		byte(vm.PUSH1), 1,
+		byte(vm.SLOAD),
+		byte(vm.PUSH1), 0,
+		byte(vm.SSTORE),
+		byte(vm.STOP),
+	})
+	state.SetState(address, common.BigToHash(big.NewInt(1)), common.BigToHash(big.NewInt(5)))
+
+	tracer := vm.NewPrestateTracer(state)
+	_, _, err := Call(address, nil, &Config{State: state, EVMConfig: vm.Config{Debug: true, Tracer: tracer}})
+	if err != nil {
+		t.Fatal("didn't expect error", err)
+	}
+	var (
+		zero, one, five = common.Hash{}, common.BigToHash(big.NewInt(1)), common.BigToHash(big.NewInt(5))
+	)
+	pre := tracer.Prestate()[address]
+	if pre == nil {
+		t.Fatalf("contract missing from prestate")
+	}
+	if len(pre.Storage) != 2 || pre.Storage[zero] != zero || pre.Storage[one] != five {
+		t.Errorf("prestate storage mismatch: have %v", pre.Storage)
+	}
+	diff := tracer.Diff()
+	if len(diff.Pre) != 1 || len(diff.Post) != 1 {
+		t.Fatalf("diff size mismatch: have %d pre, %d post accounts, want 1, 1", len(diff.Pre), len(diff.Post))
+	}
+	if post := diff.Post[address]; post == nil || len(post.Storage) != 1 || post.Storage[zero] != five {
+		t.Errorf("poststate storage mismatch: have %v", post)
+	}
+}
+
+func TestProfiler(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	state, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	address := common.HexToAddress("0x0a")
+	state.SetCode(address, []byte{
+		byte(vm.PUSH1), 5,
+		byte(vm.JUMP),
+		byte(vm.JUMPDEST),
+		byte(vm.STOP),
+		byte(vm.JUMPDEST),
+		byte(vm.STOP),
+	})
+
+	profiler := vm.NewProfiler()
+	_, leftOverGas, err := Call(address, nil, &Config{State: state, GasLimit: 100000, EVMConfig: vm.Config{Debug: true, Tracer: profiler}})
+	if err != nil {
+		t.Fatal("didn't expect error", err)
+	}
+	result := profiler.Result()
+	if stat := result.Opcodes["PUSH1"]; stat == nil || stat.Count != 1 || stat.Gas != 3 {
+		t.Errorf("PUSH1 profile mismatch: have %+v", stat)
+	}
+	if stat := result.PCs[address][2]; stat == nil || stat.Count != 1 || stat.Gas != 8 {
+		t.Errorf("JUMP profile mismatch: have %+v", stat)
+	}
+	if cov := result.Coverage[address]; cov == nil || cov.Blocks != 2 || len(cov.Reached) != 1 || cov.Reached[0] != 5 {
+		t.Errorf("coverage mismatch: have %+v", cov)
+	}
+	want := fmt.Sprintf("%s %d", address.Hex(), 100000-leftOverGas)
+	if len(result.Folded) != 1 || result.Folded[0] != want {
+		t.Errorf("folded stacks mismatch: have %v, want [%s]", result.Folded, want)
+	}
+}
+
+func TestDebugger(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	state, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	address := common.HexToAddress("0x0a")
+	state.SetCode(address, []byte{
+		byte(vm.PUSH1), 1,
+		byte(vm.PUSH1), 0,
+		byte(vm.SSTORE),
+		byte(vm.PUSH1), 2,
+		byte(vm.PUSH1), 1,
+		byte(vm.SSTORE),
+		byte(vm.STOP),
+	})
+	debugger := vm.NewDebugger()
+	cfg := &Config{State: state, GasLimit: 100000, EVMConfig: vm.Config{Debug: true, Tracer: debugger}}
+
+	exec := func() ([]byte, error) {
+		ret, _, err := Call(address, nil, cfg)
+		return ret, err
+	}
+	if st := debugger.Start(exec); st.Done || st.PC != 0 {
+		t.Fatalf("expected pause at first instruction, have %+v", st)
+	}
+	id, _ := debugger.AddBreakpoint(vm.BreakPC, 5)
+	st, err := debugger.Resume(vm.StepContinue)
+	if err != nil || st.PC != 5 || st.Breakpoint != id {
+		t.Fatalf("expected breakpoint %d at pc 5, have %+v (%v)", id, st, err)
+	}
+	if value, err := debugger.Storage(common.Hash{}); err != nil || value != common.BigToHash(big.NewInt(1)) {
+		t.Errorf("storage mismatch: have %x (%v), want 1", value, err)
+	}
+	st, err = debugger.Resume(vm.StepStore)
+	if err != nil || st.PC != 9 || len(st.Stack) != 2 || st.Stack[1].ToInt().Uint64() != 1 {
+		t.Fatalf("expected pause at SSTORE of slot 1, have %+v (%v)", st, err)
+	}
+	if st, err = debugger.Resume(vm.StepContinue); err != nil || !st.Done || st.Error != "" {
+		t.Fatalf("expected successful end of execution, have %+v (%v)", st, err)
+	}
+	if _, err := debugger.Resume(vm.StepInto); err == nil {
+		t.Errorf("expected error resuming finished execution")
+	}
+	// Aborting the execution should end it right away
+	debugger = vm.NewDebugger()
+	cfg.EVMConfig.Tracer = debugger
+	debugger.Start(exec)
+	if st := debugger.Stop(); !st.Done {
+		t.Errorf("expected end of execution after stop, have %+v", st)
+	}
+}
+
 func BenchmarkCall(b *testing.B) {
 	var definition = `[{"constant":true,"inputs":[],"name":"seller","outputs":[{"name":"","type":"address"}],"type":"function"},{"constant":false,"inputs":[],"name":"abort","outputs":[],"type":"function"},{"constant":true,"inputs":[],"name":"value","outputs":[{"name":"","type":"uint256"}],"type":"function"},{"constant":false,"inputs":[],"name":"refund","outputs":[],"type":"function"},{"constant":true,"inputs":[],"name":"buyer","outputs":[{"name":"","type":"address"}],"type":"function"},{"constant":false,"inputs":[],"name":"confirmReceived","outputs":[],"type":"function"},{"constant":true,"inputs":[],"name":"state","outputs":[{"name":"","type":"uint8"}],"type":"function"},{"constant":false,"inputs":[],"name":"confirmPurchase","outputs":[],"type":"function"},{"inputs":[],"type":"constructor"},{"anonymous":false,"inputs":[],"name":"Aborted","type":"event"},{"anonymous":false,"inputs":[],"name":"PurchaseConfirmed","type":"event"},{"anonymous":false,"inputs":[],"name":"ItemReceived","type":"event"},{"anonymous":false,"inputs":[],"name":"Refunded","type":"event"}]`
 
@@ -20,12 +20,14 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/big"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -45,6 +47,18 @@ import (
 
 const defaultTraceTimeout = 5 * time.Second
 
+const (
+	// maxDebugSessions is the number of transaction debugging sessions allowed to
+	// be open at the same time.
+	maxDebugSessions = 16
+
+	// debugSessionTimeout is the time after which an unused transaction debugging
+	// session is aborted and closed.
+	debugSessionTimeout = 5 * time.Minute
+)
+
+var errTooManyDebugSessions = errors.New("too many debugging sessions")
+
 // PublicEthereumAPI provides an API to access Ethereum full node-related
 // information.
 type PublicEthereumAPI struct {
@@ -318,12 +332,48 @@ func NewPublicDebugAPI(eth *Ethereum) *PublicDebugAPI {
 
 // DumpBlock retrieves the entire state of the database at a given block.
 func (api *PublicDebugAPI) DumpBlock(blockNr rpc.BlockNumber) (state.Dump, error) {
+	stateDb, err := api.stateAt(blockNr)
+	if err != nil {
+		return state.Dump{}, err
+	}
+	return stateDb.RawDumpWithConfig(nil)
+}
+
+// AccountRangeMaxResults is the maximum number of accounts returned by a single
+// debug_accountRange call.
+const AccountRangeMaxResults = 256
+
+// AccountRange enumerates the accounts of the state at a given block in the order
+// of their keys (address hashes), starting at the given key. At most maxResults
+// accounts are returned, along with the key to continue the enumeration at.
+func (api *PublicDebugAPI) AccountRange(blockNr rpc.BlockNumber, start hexutil.Bytes, maxResults int, nocode, nostorage bool) (state.IteratorDump, error) {
+	stateDb, err := api.stateAt(blockNr)
+	if err != nil {
+		return state.IteratorDump{}, err
+	}
+	return accountRange(stateDb, start, maxResults, nocode, nostorage)
+}
+
+func accountRange(stateDb *state.StateDB, start []byte, maxResults int, nocode, nostorage bool) (state.IteratorDump, error) {
+	if maxResults <= 0 || maxResults > AccountRangeMaxResults {
+		maxResults = AccountRangeMaxResults
+	}
+	return stateDb.IteratorDump(&state.DumpConfig{
+		SkipCode:    nocode,
+		SkipStorage: nostorage,
+		Start:       start,
+		Max:         uint64(maxResults),
+	})
+}
+
+// stateAt retrieves the state of the database at a given block.
+func (api *PublicDebugAPI) stateAt(blockNr rpc.BlockNumber) (*state.StateDB, error) {
 	if blockNr == rpc.PendingBlockNumber {
 		// If we're dumping the pending state, we need to request
 		// both the pending block as well as the pending state from
 		// the miner and operate on those
 		_, stateDb := api.eth.miner.Pending()
-		return stateDb.RawDump(), nil
+		return stateDb, nil
 	}
 	var block *types.Block
 	if blockNr == rpc.LatestBlockNumber {
@@ -332,13 +382,9 @@ func (api *PublicDebugAPI) DumpBlock(blockNr rpc.BlockNumber) (state.Dump, error
 		block = api.eth.blockchain.GetBlockByNumber(uint64(blockNr))
 	}
 	if block == nil {
-		return state.Dump{}, fmt.Errorf("block #%d not found", blockNr)
-	}
-	stateDb, err := api.eth.BlockChain().StateAt(block.Root())
-	if err != nil {
-		return state.Dump{}, err
+		return nil, fmt.Errorf("block #%d not found", blockNr)
 	}
-	return stateDb.RawDump(), nil
+	return api.eth.BlockChain().StateAt(block.Root())
 }
 
 // PrivateDebugAPI is the collection of Etheruem full node APIs exposed over
@@ -346,12 +392,27 @@ func (api *PublicDebugAPI) DumpBlock(blockNr rpc.BlockNumber) (state.Dump, error
 type PrivateDebugAPI struct {
 	config *params.ChainConfig
 	eth    *Ethereum
+
+	debuggers    map[rpc.ID]*debugSession // active transaction debugging sessions
+	debugTimeout time.Duration            // idle time after which a session is closed
+	lock         sync.Mutex               // protects the debugging sessions
+}
+
+// debugSession is an open transaction debugging session.
+type debugSession struct {
+	debugger *vm.Debugger
+	timer    *time.Timer // closes the session once it's idle for too long
 }
 
 // NewPrivateDebugAPI creates a new API definition for the full node-related
 // private debug methods of the Ethereum service.
 func NewPrivateDebugAPI(config *params.ChainConfig, eth *Ethereum) *PrivateDebugAPI {
-	return &PrivateDebugAPI{config: config, eth: eth}
+	return &PrivateDebugAPI{
+		config:       config,
+		eth:          eth,
+		debuggers:    make(map[rpc.ID]*debugSession),
+		debugTimeout: debugSessionTimeout,
+	}
 }
 
 // BlockTraceResult is the returned value when replaying a block to check for
@@ -359,6 +420,7 @@ func NewPrivateDebugAPI(config *params.ChainConfig, eth *Ethereum) *PrivateDebug
 type BlockTraceResult struct {
 	Validated  bool                  `json:"validated"`
 	StructLogs []ethapi.StructLogRes `json:"structLogs"`
+	Traces     []interface{}         `json:"traces,omitempty"`
 	Error      string                `json:"error"`
 }
 
@@ -369,26 +431,83 @@ type TraceArgs struct {
 	Timeout *string
 }
 
+// Names of the native tracers which need access to the state the traced
+// transaction is executed on, and can thus only be used for single transactions.
+const (
+	prestateTracer  = "prestateTracer"  // state accessed by the transaction
+	stateDiffTracer = "stateDiffTracer" // state changes made by the transaction
+)
+
+// nativeTracers are the tracers implemented in Go which can be selected by
+// name through TraceArgs.Tracer instead of supplying Javascript code.
+var nativeTracers = map[string]func() vm.Tracer{
+	"callTracer": func() vm.Tracer { return vm.NewCallTracer() },
+	"profiler":   func() vm.Tracer { return vm.NewProfiler() },
+}
+
+// newBlockTracer creates the tracer to use when reprocessing a whole block.
+// Only the struct logger and the native tracers are supported.
+func newBlockTracer(config *TraceArgs) (vm.Tracer, error) {
+	if config == nil {
+		return vm.NewStructLogger(nil), nil
+	}
+	if config.Tracer == nil {
+		return vm.NewStructLogger(config.LogConfig), nil
+	}
+	constructor, ok := nativeTracers[*config.Tracer]
+	if !ok {
+		return nil, fmt.Errorf("tracer %q not supported for block tracing", *config.Tracer)
+	}
+	return constructor(), nil
+}
+
+// txTraceResult is the trace result of a single transaction of a block, tagged
+// with the hash of the transaction it belongs to.
+type txTraceResult struct {
+	TxHash common.Hash `json:"txHash"`
+	Result interface{} `json:"result"`
+}
+
+// newBlockTraceResult assembles the trace result of a block out of the
+// tracer that was used to reprocess it.
+func newBlockTraceResult(block *types.Block, validated bool, tracer vm.Tracer, err error) BlockTraceResult {
+	result := BlockTraceResult{
+		Validated: validated,
+		Error:     formatError(err),
+	}
+	switch tracer := tracer.(type) {
+	case *vm.StructLogger:
+		result.StructLogs = ethapi.FormatLogs(tracer.StructLogs())
+	case *vm.CallTracer:
+		// Every transaction executes exactly one outermost call, in order
+		txs := block.Transactions()
+		for i, call := range tracer.Calls() {
+			if i >= len(txs) {
+				break
+			}
+			result.Traces = append(result.Traces, txTraceResult{TxHash: txs[i].Hash(), Result: call})
+		}
+	case *vm.Profiler:
+		result.Traces = append(result.Traces, tracer.Result())
+	}
+	return result
+}
+
 // TraceBlock processes the given block'api RLP but does not import the block in to
 // the chain.
-func (api *PrivateDebugAPI) TraceBlock(blockRlp []byte, config *vm.LogConfig) BlockTraceResult {
+func (api *PrivateDebugAPI) TraceBlock(blockRlp []byte, config *TraceArgs) BlockTraceResult {
 	var block types.Block
 	err := rlp.Decode(bytes.NewReader(blockRlp), &block)
 	if err != nil {
 		return BlockTraceResult{Error: fmt.Sprintf("could not decode block: %v", err)}
 	}
 
-	validated, logs, err := api.traceBlock(&block, config)
-	return BlockTraceResult{
-		Validated:  validated,
-		StructLogs: ethapi.FormatLogs(logs),
-		Error:      formatError(err),
-	}
+	return api.traceBlock(&block, config)
 }
 
 // TraceBlockFromFile loads the block'api RLP from the given file name and attempts to
 // process it but does not import the block in to the chain.
-func (api *PrivateDebugAPI) TraceBlockFromFile(file string, config *vm.LogConfig) BlockTraceResult {
+func (api *PrivateDebugAPI) TraceBlockFromFile(file string, config *TraceArgs) BlockTraceResult {
 	blockRlp, err := ioutil.ReadFile(file)
 	if err != nil {
 		return BlockTraceResult{Error: fmt.Sprintf("could not read file: %v", err)}
@@ -397,7 +516,7 @@ func (api *PrivateDebugAPI) TraceBlockFromFile(file string, config *vm.LogConfig
 }
 
 // TraceBlockByNumber processes the block by canonical block number.
-func (api *PrivateDebugAPI) TraceBlockByNumber(blockNr rpc.BlockNumber, config *vm.LogConfig) BlockTraceResult {
+func (api *PrivateDebugAPI) TraceBlockByNumber(blockNr rpc.BlockNumber, config *TraceArgs) BlockTraceResult {
 	// Fetch the block that we aim to reprocess
 	var block *types.Block
 	switch blockNr {
@@ -414,32 +533,22 @@ func (api *PrivateDebugAPI) TraceBlockByNumber(blockNr rpc.BlockNumber, config *
 		return BlockTraceResult{Error: fmt.Sprintf("block #%d not found", blockNr)}
 	}
 
-	validated, logs, err := api.traceBlock(block, config)
-	return BlockTraceResult{
-		Validated:  validated,
-		StructLogs: ethapi.FormatLogs(logs),
-		Error:      formatError(err),
-	}
+	return api.traceBlock(block, config)
 }
 
 // TraceBlockByHash processes the block by hash.
-func (api *PrivateDebugAPI) TraceBlockByHash(hash common.Hash, config *vm.LogConfig) BlockTraceResult {
+func (api *PrivateDebugAPI) TraceBlockByHash(hash common.Hash, config *TraceArgs) BlockTraceResult {
 	// Fetch the block that we aim to reprocess
 	block := api.eth.BlockChain().GetBlockByHash(hash)
 	if block == nil {
 		return BlockTraceResult{Error: fmt.Sprintf("block #%x not found", hash)}
 	}
 
-	validated, logs, err := api.traceBlock(block, config)
-	return BlockTraceResult{
-		Validated:  validated,
-		StructLogs: ethapi.FormatLogs(logs),
-		Error:      formatError(err),
-	}
+	return api.traceBlock(block, config)
 }
 
 // traceBlock processes the given block but does not save the state.
-func (api *PrivateDebugAPI) traceBlock(block *types.Block, logConfig *vm.LogConfig) (bool, []vm.StructLog, error) {
+func (api *PrivateDebugAPI) traceBlock(block *types.Block, traceConfig *TraceArgs) BlockTraceResult {
 	// Validate and reprocess the block
 	var (
 		blockchain = api.eth.BlockChain()
@@ -447,28 +556,31 @@ func (api *PrivateDebugAPI) traceBlock(block *types.Block, logConfig *vm.LogConf
 		processor  = blockchain.Processor()
 	)
 
-	structLogger := vm.NewStructLogger(logConfig)
-
+	tracer, err := newBlockTracer(traceConfig)
+	if err != nil {
+		return BlockTraceResult{Error: formatError(err)}
+	}
 	config := vm.Config{
 		Debug:  true,
-		Tracer: structLogger,
+		Tracer: tracer,
 	}
 	if err := api.eth.engine.VerifyHeader(blockchain, block.Header(), true); err != nil {
-		return false, structLogger.StructLogs(), err
+		return newBlockTraceResult(block, false, tracer, err)
 	}
-	statedb, err := blockchain.StateAt(blockchain.GetBlock(block.ParentHash(), block.NumberU64()-1).Root())
+	statedb, release, err := api.eth.stateRegen.stateAt(blockchain.GetBlock(block.ParentHash(), block.NumberU64()-1))
 	if err != nil {
-		return false, structLogger.StructLogs(), err
+		return newBlockTraceResult(block, false, tracer, err)
 	}
+	defer release()
 
 	receipts, _, usedGas, err := processor.Process(block, statedb, config)
 	if err != nil {
-		return false, structLogger.StructLogs(), err
+		return newBlockTraceResult(block, false, tracer, err)
 	}
 	if err := validator.ValidateState(block, blockchain.GetBlock(block.ParentHash(), block.NumberU64()-1), statedb, receipts, usedGas); err != nil {
-		return false, structLogger.StructLogs(), err
+		return newBlockTraceResult(block, false, tracer, err)
 	}
-	return true, structLogger.StructLogs(), nil
+	return newBlockTraceResult(block, true, tracer, nil)
 }
 
 // callmsg is the message type used for call transitions.
@@ -509,17 +621,31 @@ func (t *timeoutError) Error() string {
 // TraceTransaction returns the structured logs created during the execution of EVM
 // and returns them as a JSON object.
 func (api *PrivateDebugAPI) TraceTransaction(ctx context.Context, txHash common.Hash, config *TraceArgs) (interface{}, error) {
+	// Retrieve the tx from the chain and the containing block
+	tx, blockHash, _, txIndex := core.GetTransaction(api.eth.ChainDb(), txHash)
+	if tx == nil {
+		return nil, fmt.Errorf("transaction %x not found", txHash)
+	}
+	msg, vmctx, statedb, release, err := api.computeTxEnv(blockHash, int(txIndex))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
 	var tracer vm.Tracer
-	if config != nil && config.Tracer != nil {
+	if config != nil && config.Tracer != nil && nativeTracers[*config.Tracer] != nil {
+		tracer = nativeTracers[*config.Tracer]()
+	} else if config != nil && config.Tracer != nil && (*config.Tracer == prestateTracer || *config.Tracer == stateDiffTracer) {
+		// The sender and the coinbase are modified outside of the EVM
+		tracer = vm.NewPrestateTracer(statedb, vmctx.Origin, vmctx.Coinbase)
+	} else if config != nil && config.Tracer != nil {
 		timeout := defaultTraceTimeout
 		if config.Timeout != nil {
-			var err error
 			if timeout, err = time.ParseDuration(*config.Timeout); err != nil {
 				return nil, err
 			}
 		}
 
-		var err error
 		if tracer, err = ethapi.NewJavascriptTracer(*config.Tracer); err != nil {
 			return nil, err
 		}
@@ -537,18 +663,8 @@ func (api *PrivateDebugAPI) TraceTransaction(ctx context.Context, txHash common.
 		tracer = vm.NewStructLogger(config.LogConfig)
 	}
 
-	// Retrieve the tx from the chain and the containing block
-	tx, blockHash, _, txIndex := core.GetTransaction(api.eth.ChainDb(), txHash)
-	if tx == nil {
-		return nil, fmt.Errorf("transaction %x not found", txHash)
-	}
-	msg, context, statedb, err := api.computeTxEnv(blockHash, int(txIndex))
-	if err != nil {
-		return nil, err
-	}
-
 	// Run the transaction with tracing enabled.
-	vmenv := vm.NewEVM(context, statedb, api.config, vm.Config{Debug: true, Tracer: tracer})
+	vmenv := vm.NewEVM(vmctx, statedb, api.config, vm.Config{Debug: true, Tracer: tracer})
 	ret, gas, err := core.ApplyMessage(vmenv, msg, new(core.GasPool).AddGas(tx.Gas()))
 	if err != nil {
 		return nil, fmt.Errorf("tracing failed: %v", err)
@@ -560,6 +676,20 @@ func (api *PrivateDebugAPI) TraceTransaction(ctx context.Context, txHash common.
 			ReturnValue: fmt.Sprintf("%x", ret),
 			StructLogs:  ethapi.FormatLogs(tracer.StructLogs()),
 		}, nil
+	case *vm.CallTracer:
+		if calls := tracer.Calls(); len(calls) > 0 {
+			return calls[0], nil
+		}
+		return nil, nil
+	case *vm.Profiler:
+		return tracer.Result(), nil
+	case *vm.PrestateTracer:
+		if *config.Tracer == stateDiffTracer {
+			// Finalise the state so that deleted accounts are reported
+			statedb.IntermediateRoot(api.config.IsEIP158(vmctx.BlockNumber))
+			return tracer.Diff(), nil
+		}
+		return tracer.Prestate(), nil
 	case *ethapi.JavascriptTracer:
 		return tracer.GetResult()
 	default:
@@ -567,20 +697,169 @@ func (api *PrivateDebugAPI) TraceTransaction(ctx context.Context, txHash common.
 	}
 }
 
-// computeTxEnv returns the execution environment of a certain transaction.
-func (api *PrivateDebugAPI) computeTxEnv(blockHash common.Hash, txIndex int) (core.Message, vm.Context, *state.StateDB, error) {
+// DebugTransaction starts an interactive debugging session of a historical
+// transaction, paused at its first instruction. The returned session ID is
+// used to step through and inspect the execution until it finishes or the
+// session is stopped. Sessions left unused for 5 minutes are stopped.
+func (api *PrivateDebugAPI) DebugTransaction(ctx context.Context, txHash common.Hash) (rpc.ID, error) {
+	api.lock.Lock()
+	full := len(api.debuggers) >= maxDebugSessions
+	api.lock.Unlock()
+
+	if full {
+		return "", errTooManyDebugSessions
+	}
+	tx, blockHash, _, txIndex := core.GetTransaction(api.eth.ChainDb(), txHash)
+	if tx == nil {
+		return "", fmt.Errorf("transaction %x not found", txHash)
+	}
+	msg, vmctx, statedb, release, err := api.computeTxEnv(blockHash, int(txIndex))
+	if err != nil {
+		return "", err
+	}
+	debugger := vm.NewDebugger()
+	vmenv := vm.NewEVM(vmctx, statedb, api.config, vm.Config{Debug: true, Tracer: debugger})
+
+	// The state is in use until the execution finishes or is stopped
+	debugger.Start(func() ([]byte, error) {
+		defer release()
+		ret, _, err := core.ApplyMessage(vmenv, msg, new(core.GasPool).AddGas(tx.Gas()))
+		return ret, err
+	})
+	return api.openDebugSession(debugger)
+}
+
+// openDebugSession registers a started debugger as a new debugging session,
+// unless too many sessions are open already.
+func (api *PrivateDebugAPI) openDebugSession(debugger *vm.Debugger) (rpc.ID, error) {
+	api.lock.Lock()
+	if len(api.debuggers) >= maxDebugSessions {
+		api.lock.Unlock()
+		debugger.Stop()
+		return "", errTooManyDebugSessions
+	}
+	id := rpc.NewID()
+	api.debuggers[id] = &debugSession{
+		debugger: debugger,
+		timer: time.AfterFunc(api.debugTimeout, func() {
+			if debugger := api.closeDebugSession(id); debugger != nil {
+				log.Debug("Closing idle debugging session", "id", id)
+				debugger.Stop()
+			}
+		}),
+	}
+	api.lock.Unlock()
+
+	return id, nil
+}
+
+// closeDebugSession removes a debugging session, returning its debugger if the
+// session was still open.
+func (api *PrivateDebugAPI) closeDebugSession(id rpc.ID) *vm.Debugger {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+
+	session, ok := api.debuggers[id]
+	if !ok {
+		return nil
+	}
+	session.timer.Stop()
+	delete(api.debuggers, id)
+	return session.debugger
+}
+
+// debugger retrieves the debugger of a transaction debugging session, resetting
+// its idle timeout.
+func (api *PrivateDebugAPI) debugger(id rpc.ID) (*vm.Debugger, error) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+
+	session, ok := api.debuggers[id]
+	if !ok || !session.timer.Reset(api.debugTimeout) {
+		// A session whose timer fired already is being closed
+		return nil, fmt.Errorf("debugging session %s not found", id)
+	}
+	return session.debugger, nil
+}
+
+// DebugState returns the state a debugged transaction is paused at.
+func (api *PrivateDebugAPI) DebugState(id rpc.ID) (*vm.DebugState, error) {
+	debugger, err := api.debugger(id)
+	if err != nil {
+		return nil, err
+	}
+	return debugger.State(), nil
+}
+
+// DebugStep resumes a debugged transaction in the given stepping mode (into,
+// over, out, continue or sstore) until it pauses again or finishes. Once the
+// execution finished, the session is closed.
+func (api *PrivateDebugAPI) DebugStep(id rpc.ID, mode string) (*vm.DebugState, error) {
+	debugger, err := api.debugger(id)
+	if err != nil {
+		return nil, err
+	}
+	state, err := debugger.Resume(mode)
+	if err == nil && state.Done {
+		api.closeDebugSession(id)
+	}
+	return state, err
+}
+
+// DebugAddBreakpoint adds a breakpoint on a program counter, an opcode or a
+// call depth to a debugging session, returning the ID of the breakpoint.
+func (api *PrivateDebugAPI) DebugAddBreakpoint(id rpc.ID, kind string, value uint64) (int, error) {
+	debugger, err := api.debugger(id)
+	if err != nil {
+		return 0, err
+	}
+	return debugger.AddBreakpoint(kind, value)
+}
+
+// DebugRemoveBreakpoint removes a breakpoint from a debugging session.
+func (api *PrivateDebugAPI) DebugRemoveBreakpoint(id rpc.ID, breakpoint int) error {
+	debugger, err := api.debugger(id)
+	if err != nil {
+		return err
+	}
+	return debugger.RemoveBreakpoint(breakpoint)
+}
+
+// DebugStorage retrieves a storage slot of the contract a debugged transaction
+// is paused in.
+func (api *PrivateDebugAPI) DebugStorage(id rpc.ID, key common.Hash) (common.Hash, error) {
+	debugger, err := api.debugger(id)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return debugger.Storage(key)
+}
+
+// DebugStop aborts a debugged transaction if it's still running and closes
+// the debugging session.
+func (api *PrivateDebugAPI) DebugStop(id rpc.ID) (*vm.DebugState, error) {
+	debugger := api.closeDebugSession(id)
+	if debugger == nil {
+		return nil, fmt.Errorf("debugging session %s not found", id)
+	}
+	return debugger.Stop(), nil
+}
+
+// computeTxEnv returns the execution environment of a certain transaction, along
+// with the function releasing its state once the caller is done with it.
+func (api *PrivateDebugAPI) computeTxEnv(blockHash common.Hash, txIndex int) (core.Message, vm.Context, *state.StateDB, func(), error) {
 	// Create the parent state.
 	block := api.eth.BlockChain().GetBlockByHash(blockHash)
 	if block == nil {
-		return nil, vm.Context{}, nil, fmt.Errorf("block %x not found", blockHash)
+		return nil, vm.Context{}, nil, nil, fmt.Errorf("block %x not found", blockHash)
 	}
 	parent := api.eth.BlockChain().GetBlock(block.ParentHash(), block.NumberU64()-1)
 	if parent == nil {
-		return nil, vm.Context{}, nil, fmt.Errorf("block parent %x not found", block.ParentHash())
+		return nil, vm.Context{}, nil, nil, fmt.Errorf("block parent %x not found", block.ParentHash())
 	}
-	statedb, err := api.eth.BlockChain().StateAt(parent.Root())
+	statedb, release, err := api.eth.stateRegen.stateAt(parent)
 	if err != nil {
-		return nil, vm.Context{}, nil, err
+		return nil, vm.Context{}, nil, nil, err
 	}
 	txs := block.Transactions()
 
@@ -591,18 +870,20 @@ func (api *PrivateDebugAPI) computeTxEnv(blockHash common.Hash, txIndex int) (co
 		msg, _ := tx.AsMessage(signer)
 		context := core.NewEVMContext(msg, block.Header(), api.eth.BlockChain(), nil)
 		if idx == txIndex {
-			return msg, context, statedb, nil
+			return msg, context, statedb, release, nil
 		}
 
 		vmenv := vm.NewEVM(context, statedb, api.config, vm.Config{})
 		gp := new(core.GasPool).AddGas(tx.Gas())
 		_, _, err := core.ApplyMessage(vmenv, msg, gp)
 		if err != nil {
-			return nil, vm.Context{}, nil, fmt.Errorf("tx %x failed: %v", tx.Hash(), err)
+			release()
+			return nil, vm.Context{}, nil, nil, fmt.Errorf("tx %x failed: %v", tx.Hash(), err)
 		}
 		statedb.DeleteSuicides()
 	}
-	return nil, vm.Context{}, nil, fmt.Errorf("tx index %d out of range for block %x", txIndex, blockHash)
+	release()
+	return nil, vm.Context{}, nil, nil, fmt.Errorf("tx index %d out of range for block %x", txIndex, blockHash)
 }
 
 // Preimage is a debug API function that returns the preimage for a sha3 hash, if known.
@@ -632,10 +913,11 @@ type storageEntry struct {
 
 // StorageRangeAt returns the storage at the given block height and transaction index.
 func (api *PrivateDebugAPI) StorageRangeAt(ctx context.Context, blockHash common.Hash, txIndex int, contractAddress common.Address, keyStart hexutil.Bytes, maxResult int) (StorageRangeResult, error) {
-	_, _, statedb, err := api.computeTxEnv(blockHash, txIndex)
+	_, _, statedb, release, err := api.computeTxEnv(blockHash, txIndex)
 	if err != nil {
 		return StorageRangeResult{}, err
 	}
+	defer release()
 	st := statedb.StorageTrie(contractAddress)
 	if st == nil {
 		return StorageRangeResult{}, fmt.Errorf("account %x doesn't exist", contractAddress)
@@ -661,3 +943,118 @@ func storageRangeAt(st state.Trie, start []byte, maxResult int) StorageRangeResu
 	}
 	return result
 }
+
+// StateDiffResult is the result of a debug_getStateDiff API call and the payload
+// of the state diff subscription: the accounts and storage slots changed by a
+// block, with their values before and after it.
+type StateDiffResult struct {
+	BlockHash   common.Hash        `json:"blockHash"`
+	BlockNumber hexutil.Uint64     `json:"blockNumber"`
+	Accounts    []stateDiffAccount `json:"accounts"`
+}
+
+type stateDiffAccount struct {
+	Address common.Address     `json:"address"`
+	Pre     *stateDiffValues   `json:"pre"`  // nil if the account was created
+	Post    *stateDiffValues   `json:"post"` // nil if the account was deleted
+	Storage []stateDiffStorage `json:"storage"`
+}
+
+type stateDiffValues struct {
+	Nonce    hexutil.Uint64 `json:"nonce"`
+	Balance  *hexutil.Big   `json:"balance"`
+	CodeHash common.Hash    `json:"codeHash"`
+}
+
+type stateDiffStorage struct {
+	Key  common.Hash `json:"key"`
+	Pre  common.Hash `json:"pre"`
+	Post common.Hash `json:"post"`
+}
+
+// newStateDiffResult converts a state diff into its RPC representation.
+func newStateDiffResult(hash common.Hash, number uint64, diff []*state.AccountDiff) *StateDiffResult {
+	values := func(account *state.DiffAccount) *stateDiffValues {
+		if account == nil {
+			return nil
+		}
+		return &stateDiffValues{
+			Nonce:    hexutil.Uint64(account.Nonce),
+			Balance:  (*hexutil.Big)(account.Balance),
+			CodeHash: account.CodeHash,
+		}
+	}
+	result := &StateDiffResult{
+		BlockHash:   hash,
+		BlockNumber: hexutil.Uint64(number),
+		Accounts:    make([]stateDiffAccount, len(diff)),
+	}
+	for i, account := range diff {
+		result.Accounts[i] = stateDiffAccount{
+			Address: account.Address,
+			Pre:     values(account.Pre),
+			Post:    values(account.Post),
+			Storage: make([]stateDiffStorage, len(account.Storage)),
+		}
+		for j, slot := range account.Storage {
+			result.Accounts[i].Storage[j] = stateDiffStorage{Key: slot.Key, Pre: slot.Pre, Post: slot.Post}
+		}
+	}
+	return result
+}
+
+// GetStateDiff returns the changes a canonical block made to the state, as
+// recorded during its import. State diffs are only recorded if enabled, and
+// are only retained for the configured number of recent blocks.
+func (api *PrivateDebugAPI) GetStateDiff(ctx context.Context, blockNr rpc.BlockNumber) (*StateDiffResult, error) {
+	var header *types.Header
+	switch blockNr {
+	case rpc.PendingBlockNumber:
+		return nil, errors.New("pending block has no state diff")
+	case rpc.LatestBlockNumber:
+		header = api.eth.blockchain.CurrentHeader()
+	default:
+		header = api.eth.blockchain.GetHeaderByNumber(uint64(blockNr))
+	}
+	if header == nil {
+		return nil, fmt.Errorf("block #%d not found", blockNr)
+	}
+	hash, number := header.Hash(), header.Number.Uint64()
+
+	diff := core.GetStateDiff(api.eth.ChainDb(), hash, number)
+	if diff == nil {
+		return nil, fmt.Errorf("state diff of block #%d not available", number)
+	}
+	return newStateDiffResult(hash, number, diff), nil
+}
+
+// StateDiffs creates a subscription that fires the state diff of each block
+// imported into the canonical chain, if state diffs are enabled.
+func (api *PrivateDebugAPI) StateDiffs(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+	rpcSub := notifier.CreateSubscription()
+
+	go func() {
+		sub := api.eth.EventMux().Subscribe(core.StateDiffEvent{})
+		defer sub.Unsubscribe()
+
+		for {
+			select {
+			case ev, ok := <-sub.Chan():
+				if !ok {
+					return
+				}
+				diff := ev.Data.(core.StateDiffEvent)
+				notifier.Notify(rpcSub.ID, newStateDiffResult(diff.Hash, diff.Number, diff.Diff))
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	}()
+	return rpcSub, nil
+}
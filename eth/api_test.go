@@ -17,13 +17,19 @@
 package eth
 
 import (
+	"math/big"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/core/vm/runtime"
 	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rpc"
 )
 
 var dumper = spew.ConfigState{Indent: "    "}
@@ -86,3 +92,154 @@ func TestStorageRangeAt(t *testing.T) {
 		}
 	}
 }
+
+func TestAccountRange(t *testing.T) {
+	var (
+		db, _       = ethdb.NewMemDatabase()
+		statedb, _  = state.New(common.Hash{}, state.NewDatabase(db))
+		addrs       = make(map[common.Address]bool)
+		numAccounts = AccountRangeMaxResults + 44
+	)
+	for i := 0; i < numAccounts; i++ {
+		addr := common.BigToAddress(big.NewInt(int64(i + 1)))
+		statedb.AddBalance(addr, big.NewInt(1))
+		addrs[addr] = true
+	}
+	statedb.Commit(false)
+
+	// The page size is capped, page through the state with the returned keys
+	var (
+		start []byte
+		pages int
+		seen  = make(map[common.Address]bool)
+	)
+	for {
+		result, err := accountRange(statedb, start, 0, true, true)
+		if err != nil {
+			t.Fatalf("page %d: failed to retrieve accounts: %v", pages, err)
+		}
+		if len(result.Accounts) > AccountRangeMaxResults {
+			t.Fatalf("page %d: result count above cap: %d", pages, len(result.Accounts))
+		}
+		for _, account := range result.Accounts {
+			if account.Address == nil || !addrs[*account.Address] || seen[*account.Address] {
+				t.Fatalf("page %d: unexpected account %v", pages, account.Address)
+			}
+			seen[*account.Address] = true
+		}
+		if pages++; result.Next == nil {
+			break
+		}
+		start = result.Next
+	}
+	if pages != 2 || len(seen) != numAccounts {
+		t.Fatalf("paging mismatch: have %d pages with %d accounts, want 2 pages with %d accounts", pages, len(seen), numAccounts)
+	}
+	// Smaller pages must be honoured
+	result, err := accountRange(statedb, nil, 10, false, false)
+	if err != nil {
+		t.Fatalf("failed to retrieve accounts: %v", err)
+	}
+	if len(result.Accounts) != 10 || result.Next == nil {
+		t.Fatalf("page mismatch: have %d accounts, next %x", len(result.Accounts), result.Next)
+	}
+}
+
+// Tests that the transaction debugging sessions are capped, and closed once their
+// execution finished or they are left unused.
+func TestDebugSessions(t *testing.T) {
+	api := &PrivateDebugAPI{debuggers: make(map[rpc.ID]*debugSession), debugTimeout: time.Hour}
+
+	open := func() (rpc.ID, error) {
+		db, _ := ethdb.NewMemDatabase()
+		statedb, _ := state.New(common.Hash{}, state.NewDatabase(db))
+		address := common.HexToAddress("0x0a")
+		statedb.SetCode(address, []byte{byte(vm.PUSH1), 1, byte(vm.STOP)})
+
+		debugger := vm.NewDebugger()
+		cfg := &runtime.Config{State: statedb, GasLimit: 100000, EVMConfig: vm.Config{Debug: true, Tracer: debugger}}
+		debugger.Start(func() ([]byte, error) {
+			ret, _, err := runtime.Call(address, nil, cfg)
+			return ret, err
+		})
+		return api.openDebugSession(debugger)
+	}
+	ids := make([]rpc.ID, maxDebugSessions)
+	for i := range ids {
+		id, err := open()
+		if err != nil {
+			t.Fatalf("session %d: failed to open: %v", i, err)
+		}
+		ids[i] = id
+	}
+	if _, err := open(); err != errTooManyDebugSessions {
+		t.Fatalf("session count above cap: have %v, want %v", err, errTooManyDebugSessions)
+	}
+	// Finished and stopped sessions must be closed
+	if state, err := api.DebugStep(ids[0], vm.StepContinue); err != nil || !state.Done {
+		t.Fatalf("expected end of execution, have %+v (%v)", state, err)
+	}
+	if _, err := api.DebugState(ids[0]); err == nil {
+		t.Errorf("finished session not closed")
+	}
+	if state, err := api.DebugStop(ids[1]); err != nil || !state.Done {
+		t.Fatalf("expected end of execution after stop, have %+v (%v)", state, err)
+	}
+	if _, err := api.DebugStop(ids[1]); err == nil {
+		t.Errorf("stopped session not closed")
+	}
+	// Idle sessions must be stopped and closed
+	api.debugTimeout = 10 * time.Millisecond
+	id, err := open()
+	if err != nil {
+		t.Fatalf("failed to open session: %v", err)
+	}
+	api.lock.Lock()
+	debugger := api.debuggers[id].debugger
+	api.lock.Unlock()
+
+	for i := 0; !debugger.State().Done; i++ {
+		if i == 100 {
+			t.Fatalf("idle session not stopped")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, err := api.DebugState(id); err == nil {
+		t.Errorf("idle session not closed")
+	}
+	for _, id := range ids[2:] {
+		api.DebugStop(id)
+	}
+}
+
+// Tests that the call trees of a traced block are tagged with the hashes of the
+// transactions they were executed by.
+func TestBlockTraceResultCallTracer(t *testing.T) {
+	txs := []*types.Transaction{
+		types.NewTransaction(0, common.Address{1}, big.NewInt(1), big.NewInt(21000), big.NewInt(1), nil),
+		types.NewTransaction(1, common.Address{2}, big.NewInt(2), big.NewInt(21000), big.NewInt(1), nil),
+	}
+	block := types.NewBlock(&types.Header{Number: big.NewInt(1)}, txs, nil, nil)
+
+	tracer := vm.NewCallTracer()
+	for _, tx := range txs {
+		tracer.CaptureEnter(vm.CALL, common.Address{}, *tx.To(), nil, tx.Gas().Uint64(), tx.Value())
+		tracer.CaptureExit(nil, 21000, nil)
+	}
+	result := newBlockTraceResult(block, true, tracer, nil)
+	if len(result.Traces) != len(txs) {
+		t.Fatalf("trace count mismatch: have %d, want %d", len(result.Traces), len(txs))
+	}
+	for i, trace := range result.Traces {
+		res, ok := trace.(txTraceResult)
+		if !ok {
+			t.Fatalf("trace %d: unexpected type %T", i, trace)
+		}
+		if res.TxHash != txs[i].Hash() {
+			t.Errorf("trace %d: tx hash mismatch: have %x, want %x", i, res.TxHash, txs[i].Hash())
+		}
+		if frame := res.Result.(*vm.CallFrame); frame.To != *txs[i].To() {
+			t.Errorf("trace %d: call recipient mismatch: have %x, want %x", i, frame.To, *txs[i].To())
+		}
+	}
+}
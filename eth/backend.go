@@ -21,6 +21,8 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"os"
+	"path/filepath"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -32,6 +34,7 @@ import (
 	"github.com/ethereum/go-ethereum/consensus/clique"
 	"github.com/ethereum/go-ethereum/consensus/ethash"
 	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/bloombits"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/eth/downloader"
@@ -63,9 +66,15 @@ type Ethereum struct {
 	// Channel for shutting down the service
 	shutdownChan  chan bool // Channel for shutting down the ethereum
 	stopDbUpgrade func()    // stop chain db sequential key upgrade
+
+	closeBloomHandler chan struct{}                  // Channel to stop the bloom bits handlers
+	bloomRequests     chan chan *bloombits.Retrieval // Channel receiving bloom data retrieval requests
+	bloomIndexer      *core.ChainIndexer             // Bloom indexer operating during block imports
+
 	// Handlers
 	txPool          *core.TxPool
 	blockchain      *core.BlockChain
+	stateRegen      *stateRegenerator
 	protocolManager *ProtocolManager
 	lesServer       LesServer
 	// DB interfaces
@@ -105,7 +114,13 @@ func New(ctx *node.ServiceContext, config *Config, pending miner.Pending) (*Ethe
 	if err != nil {
 		return nil, err
 	}
+	if chainDb, err = createFreezer(ctx, config, chainDb); err != nil {
+		return nil, err
+	}
 	stopDbUpgrade := upgradeSequentialKeys(chainDb)
+	if stopDbUpgrade == nil {
+		stopDbUpgrade = upgradeCompactReceipts(chainDb)
+	}
 	chainConfig, genesisHash, genesisErr := core.SetupGenesisBlock(chainDb, config.Genesis)
 	if _, ok := genesisErr.(*params.ConfigCompatError); genesisErr != nil && !ok {
 		return nil, genesisErr
@@ -123,9 +138,13 @@ func New(ctx *node.ServiceContext, config *Config, pending miner.Pending) (*Ethe
 		networkId:      config.NetworkId,
 		gasPrice:       config.GasPrice,
 		etherbase:      config.Etherbase,
+
+		closeBloomHandler: make(chan struct{}),
+		bloomRequests:     make(chan chan *bloombits.Retrieval),
+		bloomIndexer:      core.NewBloomIndexer(chainDb, params.BloomBitsBlocks),
 	}
 
-	if err := addMipmapBloomBins(chainDb); err != nil {
+	if err := deleteMipmapBloomBins(chainDb); err != nil {
 		return nil, err
 	}
 	log.Info("Initialising Ethereum protocol", "versions", ProtocolVersions, "network", config.NetworkId)
@@ -138,8 +157,18 @@ func New(ctx *node.ServiceContext, config *Config, pending miner.Pending) (*Ethe
 		core.WriteBlockChainVersion(chainDb, core.BlockChainVersion)
 	}
 
-	vmConfig := vm.Config{EnablePreimageRecording: config.EnablePreimageRecording}
-	eth.blockchain, err = core.NewBlockChain(chainDb, eth.chainConfig, eth.engine, eth.eventMux, vmConfig)
+	var (
+		vmConfig    = vm.Config{EnablePreimageRecording: config.EnablePreimageRecording}
+		cacheConfig = *core.DefaultCacheConfig
+	)
+	cacheConfig.Disabled = config.NoPruning
+	cacheConfig.Snapshot = config.Snapshot
+	cacheConfig.StateDiffs = config.StateDiffs
+	cacheConfig.TxLookupLimit = &config.TxLookupLimit
+	if config.TrieFlushInterval > 0 {
+		cacheConfig.TrieFlushInterval = config.TrieFlushInterval
+	}
+	eth.blockchain, err = core.NewBlockChain(chainDb, &cacheConfig, eth.chainConfig, eth.engine, eth.eventMux, vmConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -149,6 +178,8 @@ func New(ctx *node.ServiceContext, config *Config, pending miner.Pending) (*Ethe
 		eth.blockchain.SetHead(compat.RewindTo)
 		core.WriteChainConfig(chainDb, genesisHash, chainConfig)
 	}
+	eth.bloomIndexer.Start(eth.blockchain.CurrentHeader(), eth.eventMux)
+	eth.stateRegen = newStateRegenerator(eth.blockchain, config.StateReexec)
 
 	newPool := core.NewTxPool(config.TxPool, eth.chainConfig, eth.EventMux(), eth.blockchain.State, eth.blockchain.GasLimit)
 	eth.txPool = newPool
@@ -220,6 +251,40 @@ func CreateDB(ctx *node.ServiceContext, config *Config, name string) (ethdb.Data
 	return db, nil
 }
 
+// createFreezer layers the compression of block bodies and trie nodes over the
+// chain database, and moves the ancient segment of a persistent one into an
+// append-only freezer if enabled, located in the configured directory or inside
+// the database by default.
+func createFreezer(ctx *node.ServiceContext, config *Config, db ethdb.Database) (ethdb.Database, error) {
+	ldb, ok := db.(*ethdb.LDBDatabase)
+	db = core.NewCompressedDatabase(db, config.DatabaseCompress)
+	if !ok {
+		return db, nil
+	}
+	freezer := filepath.Join(ldb.Path(), "ancient")
+	if config.DatabaseFreezer != "" {
+		freezer = ctx.ResolvePath(config.DatabaseFreezer)
+	}
+	if !config.Freezer {
+		// Blocks already moved into the freezer would be missing without it
+		if _, err := os.Stat(freezer); err == nil {
+			ldb.Close()
+			return nil, fmt.Errorf("ancient chain segments found in %s, the freezer must stay enabled", freezer)
+		}
+		return db, nil
+	}
+	threshold := config.FreezerThreshold
+	if threshold == 0 {
+		threshold = params.ImmutabilityThreshold
+	}
+	frdb, err := core.NewDatabaseWithFreezer(db, freezer, threshold, false)
+	if err != nil {
+		ldb.Close()
+		return nil, err
+	}
+	return frdb, nil
+}
+
 // CreateConsensusEngine creates the required type of consensus engine instance for an Ethereum service
 func CreateConsensusEngine(ctx *node.ServiceContext, config *Config, chainConfig *params.ChainConfig, db ethdb.Database) consensus.Engine {
 	// If proof-of-authority is requested, set it up
@@ -384,6 +449,9 @@ func (s *Ethereum) Protocols() []p2p.Protocol {
 // Start implements node.Service, starting all internal goroutines needed by the
 // Ethereum protocol implementation.
 func (s *Ethereum) Start(srvr *p2p.Server) error {
+	// Start the bloom bits servicing goroutines
+	s.startBloomHandlers()
+
 	s.netRPCService = ethapi.NewPublicNetAPI(srvr, s.NetVersion())
 
 	s.protocolManager.Start()
@@ -399,6 +467,7 @@ func (s *Ethereum) Stop() error {
 	if s.stopDbUpgrade != nil {
 		s.stopDbUpgrade()
 	}
+	s.bloomIndexer.Close()
 	s.blockchain.Stop()
 	s.protocolManager.Stop()
 	if s.lesServer != nil {
@@ -411,6 +480,7 @@ func (s *Ethereum) Stop() error {
 	}
 	s.eventMux.Stop()
 
+	close(s.closeBloomHandler)
 	s.chainDb.Close()
 	close(s.shutdownChan)
 
@@ -17,67 +17,111 @@
 package eth
 
 import (
+	"bytes"
 	"math/big"
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethdb"
-	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
 )
 
-func TestMipmapUpgrade(t *testing.T) {
+func TestCompactReceiptsUpgrade(t *testing.T) {
 	db, _ := ethdb.NewMemDatabase()
-	addr := common.BytesToAddress([]byte("jeff"))
-	genesis := new(core.Genesis).MustCommit(db)
 
-	chain, receipts := core.GenerateChain(params.TestChainConfig, genesis, db, 10, func(i int, gen *core.BlockGen) {
-		var receipts types.Receipts
-		switch i {
-		case 1:
-			receipt := types.NewReceipt(nil, new(big.Int))
-			receipt.Logs = []*types.Log{{Address: addr}}
-			gen.AddUncheckedReceipt(receipt)
-			receipts = types.Receipts{receipt}
-		case 2:
-			receipt := types.NewReceipt(nil, new(big.Int))
-			receipt.Logs = []*types.Log{{Address: addr}}
-			gen.AddUncheckedReceipt(receipt)
-			receipts = types.Receipts{receipt}
-		}
+	// Store some receipts in the legacy encoding, along with their copies by
+	// transaction hash
+	receipt := &types.Receipt{
+		PostState:         []byte{0x01},
+		CumulativeGasUsed: big.NewInt(21000),
+		Logs:              []*types.Log{{Address: common.Address{0x11}, Topics: []common.Hash{{0x11}}}},
+		TxHash:            common.Hash{0x22},
+		GasUsed:           big.NewInt(21000),
+	}
+	receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
 
-		// store the receipts
-		err := core.WriteReceipts(db, receipts)
-		if err != nil {
-			t.Fatal(err)
-		}
-	})
-	for i, block := range chain {
-		core.WriteBlock(db, block)
-		if err := core.WriteCanonicalHash(db, block.Hash(), block.NumberU64()); err != nil {
-			t.Fatalf("failed to insert block number: %v", err)
-		}
-		if err := core.WriteHeadBlockHash(db, block.Hash()); err != nil {
-			t.Fatalf("failed to insert block number: %v", err)
+	logs := []*types.LogForStorage{(*types.LogForStorage)(receipt.Logs[0])}
+	legacy, _ := rlp.EncodeToBytes([]interface{}{receipt.PostState, receipt.CumulativeGasUsed, receipt.Bloom, receipt.TxHash, receipt.ContractAddress, logs, receipt.GasUsed})
+	blockReceipts, _ := rlp.EncodeToBytes([]rlp.RawValue{legacy})
+
+	hash, number := common.Hash{0x33}, uint64(7)
+	key := append(append([]byte("r"), 0, 0, 0, 0, 0, 0, 0, byte(number)), hash.Bytes()...)
+	db.Put(key, blockReceipts)
+	db.Put(append([]byte("receipts-"), receipt.TxHash.Bytes()...), legacy)
+	db.Put([]byte("LastHeader"), hash.Bytes())
+	db.Put(useSequentialKeys, []byte{42})
+
+	// Run the upgrade and wait for it to finish
+	stop := upgradeCompactReceipts(db)
+	if stop == nil {
+		t.Fatalf("receipts upgrade not started")
+	}
+	for i := 0; ; i++ {
+		if data, _ := db.Get(useCompactReceipts); len(data) > 0 {
+			break
 		}
-		if err := core.WriteBlockReceipts(db, block.Hash(), block.NumberU64(), receipts[i]); err != nil {
-			t.Fatal("error writing block receipts:", err)
+		if i == 500 {
+			t.Fatalf("receipts upgrade didn't finish")
 		}
+		time.Sleep(10 * time.Millisecond)
 	}
+	stop()
 
-	err := addMipmapBloomBins(db)
-	if err != nil {
-		t.Fatal(err)
+	// Check that the block receipts got compacted and the copies deleted
+	compact, _ := rlp.EncodeToBytes([]*types.ReceiptForStorage{(*types.ReceiptForStorage)(receipt)})
+	if data, _ := db.Get(key); !bytes.Equal(data, compact) {
+		t.Errorf("block receipts not compacted: have %x, want %x", data, compact)
+	}
+	if receipts := core.GetRawBlockReceipts(db, hash, number); len(receipts) != 1 || receipts[0].CumulativeGasUsed.Cmp(receipt.CumulativeGasUsed) != 0 {
+		t.Errorf("compacted receipts mismatch: %v", receipts)
 	}
+	if has, _ := db.Has(append([]byte("receipts-"), receipt.TxHash.Bytes()...)); has {
+		t.Errorf("transaction receipt copy not deleted")
+	}
+	if upgradeCompactReceipts(db) != nil {
+		t.Errorf("receipts upgrade restarted")
+	}
+}
 
-	bloom := core.GetMipmapBloom(db, 1, core.MIPMapLevels[0])
-	if (bloom == types.Bloom{}) {
-		t.Error("got empty bloom filter")
+func TestMipmapCleanup(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+
+	// Populate the database with some legacy mipmap bins and unrelated data
+	bins := [][]byte{
+		append([]byte("mipmap-log-bloom-"), 0x00, 0x01),
+		append([]byte("mipmap-log-bloom-"), 0xff, 0xff),
+	}
+	for _, key := range bins {
+		db.Put(key, []byte{0x01})
 	}
+	db.Put([]byte("mipmap-log-bloom."), []byte{0x02})
+	db.Put([]byte("LastHeader"), []byte{0x03})
 
-	data, _ := db.Get([]byte("setting-mipmap-version"))
-	if len(data) == 0 {
-		t.Error("setting-mipmap-version not written to database")
+	// Without the version marker the database is left untouched
+	if err := deleteMipmapBloomBins(db); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range bins {
+		if has, _ := db.Has(key); !has {
+			t.Fatalf("mipmap bin %x deleted without version marker", key)
+		}
+	}
+	// With the version marker all the bins and the marker are deleted
+	db.Put([]byte("setting-mipmap-version"), []byte{0x02})
+	if err := deleteMipmapBloomBins(db); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range append(bins, []byte("setting-mipmap-version")) {
+		if has, _ := db.Has(key); has {
+			t.Errorf("legacy key %x not deleted", key)
+		}
+	}
+	for _, key := range []string{"mipmap-log-bloom.", "LastHeader"} {
+		if has, _ := db.Has([]byte(key)); !has {
+			t.Errorf("unrelated key %q deleted", key)
+		}
 	}
 }
@@ -42,6 +42,9 @@ var DefaultConfig = Config{
 	NetworkId:            1,
 	LightPeers:           20,
 	DatabaseCache:        128,
+	FreezerThreshold:     params.ImmutabilityThreshold,
+	StateReexec:          1024,
+	TrieFlushInterval:    1024,
 	GasPrice:             big.NewInt(18 * params.Shannon),
 
 	TxPool: core.DefaultTxPoolConfig,
@@ -85,6 +88,16 @@ type Config struct {
 	SkipBcVersionCheck bool `toml:"-"`
 	DatabaseHandles    int  `toml:"-"`
 	DatabaseCache      int
+	DatabaseFreezer    string // Directory of the ancient chain segments, inside the database by default
+	Freezer            bool   // Whether to move the ancient chain segments out of the key-value store
+	FreezerThreshold   uint64 // Number of recent blocks to keep in the key-value store when freezing
+	NoPruning          bool   // Whether to disable the pruning of old states and flush every state to disk
+	Snapshot           bool   // Whether to maintain a flat snapshot of the state for fast reads
+	DatabaseCompress   bool   // Whether to store block bodies and trie nodes compressed
+	StateDiffs         uint64 // Number of recent blocks to record state diffs for (0 = disabled)
+	TxLookupLimit      uint64 // Number of recent blocks to maintain transaction lookup indices for (0 = entire chain)
+	StateReexec        uint64 // Maximum number of blocks to re-execute to regenerate pruned historical states
+	TrieFlushInterval  uint64 // Number of blocks between flushing a full state to disk when pruning
 
 	// Mining-related options
 	Etherbase    common.Address `toml:",omitempty"`
@@ -20,19 +20,20 @@ package eth
 import (
 	"bytes"
 	"encoding/binary"
-	"fmt"
 	"math/big"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/rlp"
 )
 
-var useSequentialKeys = []byte("dbUpgrade_20160530sequentialKeys")
+var (
+	useSequentialKeys  = []byte("dbUpgrade_20160530sequentialKeys")
+	useCompactReceipts = []byte("dbUpgrade_compactReceipts")
+)
 
 // upgradeSequentialKeys checks the chain database version and
 // starts a background process to make upgrades if necessary.
@@ -91,20 +92,21 @@ func upgradeSequentialKeys(db ethdb.Database) (stopFn func()) {
 // the database, writes them in new format and deletes the old ones if successful.
 func upgradeSequentialCanonicalNumbers(db ethdb.Database, stopFn func() bool) (error, bool) {
 	prefix := []byte("block-num-")
-	it := db.(*ethdb.LDBDatabase).NewIterator()
+	it := db.NewIteratorWithPrefix(prefix)
 	defer func() {
 		it.Release()
 	}()
-	it.Seek(prefix)
 	cnt := 0
-	for bytes.HasPrefix(it.Key(), prefix) {
+	for it.Next() && bytes.HasPrefix(it.Key(), prefix) {
 		keyPtr := it.Key()
 		if len(keyPtr) < 20 {
 			cnt++
 			if cnt%100000 == 0 {
+				key := common.CopyBytes(keyPtr)
 				it.Release()
-				it = db.(*ethdb.LDBDatabase).NewIterator()
-				it.Seek(keyPtr)
+				it = db.NewIteratorWithRange(key, nil)
+				it.Next()
+				keyPtr = it.Key()
 				log.Info("Converting canonical numbers", "count", cnt)
 			}
 			number := big.NewInt(0).SetBytes(keyPtr[10:]).Uint64()
@@ -121,7 +123,6 @@ func upgradeSequentialCanonicalNumbers(db ethdb.Database, stopFn func() bool) (e
 		if stopFn() {
 			return nil, true
 		}
-		it.Next()
 	}
 	if cnt > 0 {
 		log.Info("converted canonical numbers", "count", cnt)
@@ -134,20 +135,22 @@ func upgradeSequentialCanonicalNumbers(db ethdb.Database, stopFn func() bool) (e
 // if successful.
 func upgradeSequentialBlocks(db ethdb.Database, stopFn func() bool) (error, bool) {
 	prefix := []byte("block-")
-	it := db.(*ethdb.LDBDatabase).NewIterator()
+	it := db.NewIteratorWithPrefix(prefix)
 	defer func() {
 		it.Release()
 	}()
-	it.Seek(prefix)
+	valid := it.Next()
 	cnt := 0
-	for bytes.HasPrefix(it.Key(), prefix) {
+	for valid && bytes.HasPrefix(it.Key(), prefix) {
 		keyPtr := it.Key()
 		if len(keyPtr) >= 38 {
 			cnt++
 			if cnt%10000 == 0 {
+				key := common.CopyBytes(keyPtr)
 				it.Release()
-				it = db.(*ethdb.LDBDatabase).NewIterator()
-				it.Seek(keyPtr)
+				it = db.NewIteratorWithRange(key, nil)
+				it.Next()
+				keyPtr = it.Key()
 				log.Info("Converting blocks", "count", cnt)
 			}
 			// convert header, body, td and block receipts
@@ -158,17 +161,16 @@ func upgradeSequentialBlocks(db ethdb.Database, stopFn func() bool) (error, bool
 				return err, false
 			}
 			// delete old db entries belonging to this hash
-			for bytes.HasPrefix(it.Key(), keyPrefix[:]) {
+			for valid = true; valid && bytes.HasPrefix(it.Key(), keyPrefix[:]); valid = it.Next() {
 				if err := db.Delete(it.Key()); err != nil {
 					return err, false
 				}
-				it.Next()
 			}
 			if err := db.Delete(append([]byte("receipts-block-"), hash...)); err != nil {
 				return err, false
 			}
 		} else {
-			it.Next()
+			valid = it.Next()
 		}
 
 		if stopFn() {
@@ -185,11 +187,10 @@ func upgradeSequentialBlocks(db ethdb.Database, stopFn func() bool) (error, bool
 // database that did not have a corresponding block
 func upgradeSequentialOrphanedReceipts(db ethdb.Database, stopFn func() bool) (error, bool) {
 	prefix := []byte("receipts-block-")
-	it := db.(*ethdb.LDBDatabase).NewIterator()
+	it := db.NewIteratorWithPrefix(prefix)
 	defer it.Release()
-	it.Seek(prefix)
 	cnt := 0
-	for bytes.HasPrefix(it.Key(), prefix) {
+	for it.Next() {
 		// phase 2 already converted receipts belonging to existing
 		// blocks, just remove if there's anything left
 		cnt++
@@ -200,7 +201,6 @@ func upgradeSequentialOrphanedReceipts(db ethdb.Database, stopFn func() bool) (e
 		if stopFn() {
 			return nil, true
 		}
-		it.Next()
 	}
 	if cnt > 0 {
 		log.Info("Removed orphaned block receipts", "count", cnt)
@@ -252,45 +252,162 @@ func upgradeSequentialBlockData(db ethdb.Database, hash []byte) error {
 	return nil
 }
 
-func addMipmapBloomBins(db ethdb.Database) (err error) {
-	const mipmapVersion uint = 2
+// upgradeCompactReceipts checks whether the block receipts of the chain database
+// are stored in the compact encoding and starts a background process converting
+// them if necessary, dropping the per transaction receipt copies too. The upgrade
+// only runs after the sequential keys conversion finished. Returns a stop function
+// that blocks until the process has been safely stopped.
+func upgradeCompactReceipts(db ethdb.Database) (stopFn func()) {
+	if data, _ := db.Get(useCompactReceipts); len(data) > 0 && data[0] == 42 {
+		return nil // already converted
+	}
+	if data, _ := db.Get(useSequentialKeys); len(data) == 0 || data[0] != 42 {
+		return nil // sequential keys upgrade still pending
+	}
+	if data, _ := db.Get([]byte("LastHeader")); len(data) == 0 {
+		db.Put(useCompactReceipts, []byte{42})
+		return nil // empty database, nothing to do
+	}
+
+	log.Warn("Upgrading chain database to use compact receipts")
+
+	stopChn := make(chan struct{})
+	stoppedChn := make(chan struct{})
+
+	go func() {
+		stopFn := func() bool {
+			select {
+			case <-time.After(time.Microsecond * 100): // make sure other processes don't get starved
+			case <-stopChn:
+				return true
+			}
+			return false
+		}
 
-	// check if the version is set. We ignore data for now since there's
-	// only one version so we can easily ignore it for now
-	var data []byte
-	data, _ = db.Get([]byte("setting-mipmap-version"))
-	if len(data) > 0 {
-		var version uint
-		if err := rlp.DecodeBytes(data, &version); err == nil && version == mipmapVersion {
-			return nil
+		err, stopped := upgradeCompactBlockReceipts(db, stopFn)
+		if err == nil && !stopped {
+			err, stopped = deleteTxReceipts(db, stopFn)
+		}
+		if err == nil && !stopped {
+			log.Info("Receipts conversion successful")
+			db.Put(useCompactReceipts, []byte{42})
 		}
+		if err != nil {
+			log.Error("Receipts conversion failed", "err", err)
+		}
+		close(stoppedChn)
+	}()
+
+	return func() {
+		close(stopChn)
+		<-stoppedChn
 	}
+}
 
-	defer func() {
-		if err == nil {
-			var val []byte
-			val, err = rlp.EncodeToBytes(mipmapVersion)
-			if err == nil {
-				err = db.Put([]byte("setting-mipmap-version"), val)
+// upgradeCompactBlockReceipts reads all the block receipts from the database and
+// rewrites the ones stored in the legacy encoding with the compact one. Receipts
+// already moved into the append-only freezer keep the legacy encoding, which the
+// format byte of the compact one tells apart.
+func upgradeCompactBlockReceipts(db ethdb.Database, stopFn func() bool) (error, bool) {
+	prefix := []byte("r")
+	it := db.NewIteratorWithPrefix(prefix)
+	defer it.Release()
+
+	batch := db.NewBatch()
+	cnt := 0
+	for it.Next() {
+		// Block receipts are keyed by number and hash, skip anything else
+		key := it.Key()
+		if len(key) != len(prefix)+8+common.HashLength || bytes.HasPrefix(key, []byte("receipts-")) {
+			continue
+		}
+		var receipts []*types.ReceiptForStorage
+		if err := rlp.DecodeBytes(it.Value(), &receipts); err != nil {
+			continue
+		}
+		blob, err := rlp.EncodeToBytes(receipts)
+		if err != nil {
+			return err, false
+		}
+		if !bytes.Equal(blob, it.Value()) {
+			cnt++
+			if err := batch.Put(common.CopyBytes(key), blob); err != nil {
+				return err, false
+			}
+			if batch.ValueSize() >= ethdb.IdealBatchSize {
+				if err := batch.Write(); err != nil {
+					return err, false
+				}
+				batch.Reset()
+				log.Info("Converting block receipts", "count", cnt)
 			}
-			return
 		}
-	}()
-	latestHash := core.GetHeadBlockHash(db)
-	latestBlock := core.GetBlock(db, latestHash, core.GetBlockNumber(db, latestHash))
-	if latestBlock == nil { // clean database
-		return
+		if stopFn() {
+			return batch.Write(), true
+		}
 	}
+	if err := batch.Write(); err != nil {
+		return err, false
+	}
+	if cnt > 0 {
+		log.Info("Converted block receipts", "count", cnt)
+	}
+	return nil, false
+}
 
-	tstart := time.Now()
-	log.Warn("Upgrading db log bloom bins")
-	for i := uint64(0); i <= latestBlock.NumberU64(); i++ {
-		hash := core.GetCanonicalHash(db, i)
-		if (hash == common.Hash{}) {
-			return fmt.Errorf("chain db corrupted. Could not find block %d.", i)
+// deleteTxReceipts removes the copies of the receipts stored by transaction hash
+// from the database, which got replaced by the transaction lookup entries.
+func deleteTxReceipts(db ethdb.Database, stopFn func() bool) (error, bool) {
+	prefix := []byte("receipts-")
+	it := db.NewIteratorWithPrefix(prefix)
+	defer it.Release()
+
+	batch := db.NewBatch()
+	cnt := 0
+	for it.Next() {
+		key := it.Key()
+		if len(key) != len(prefix)+common.HashLength || bytes.HasPrefix(key, []byte("receipts-block-")) {
+			continue
+		}
+		cnt++
+		if err := batch.Delete(common.CopyBytes(key)); err != nil {
+			return err, false
+		}
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err, false
+			}
+			batch.Reset()
 		}
-		core.WriteMipmapBloom(db, i, core.GetBlockReceipts(db, hash, i))
+		if stopFn() {
+			return batch.Write(), true
+		}
+	}
+	if err := batch.Write(); err != nil {
+		return err, false
+	}
+	if cnt > 0 {
+		log.Info("Removed transaction receipts", "count", cnt)
+	}
+	return nil, false
+}
+
+// deleteMipmapBloomBins removes the legacy mipmap log bloom bins from the chain
+// database, which got superseded by the bloom bits index.
+func deleteMipmapBloomBins(db ethdb.Database) error {
+	versionKey := []byte("setting-mipmap-version")
+	if has, err := db.Has(versionKey); err != nil || !has {
+		return err
+	}
+	tstart := time.Now()
+	log.Warn("Deleting legacy db log bloom bins")
+
+	if err := db.DeleteRange([]byte("mipmap-log-bloom-"), []byte("mipmap-log-bloom.")); err != nil {
+		return err
+	}
+	if err := db.Delete(versionKey); err != nil {
+		return err
 	}
-	log.Info("Bloom-bin upgrade completed", "elapsed", common.PrettyDuration(time.Since(tstart)))
+	log.Info("Legacy bloom bins deleted", "elapsed", common.PrettyDuration(time.Since(tstart)))
 	return nil
 }
@@ -18,12 +18,11 @@ package filters
 
 import (
 	"context"
-	"math"
 	"math/big"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/bloombits"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/event"
@@ -35,12 +34,19 @@ type Backend interface {
 	EventMux() *event.TypeMux
 	HeaderByNumber(ctx context.Context, blockNr rpc.BlockNumber) (*types.Header, error)
 	GetReceipts(ctx context.Context, blockHash common.Hash) (types.Receipts, error)
+
+	// BloomStatus returns the section size and the number of sections of the
+	// bloom bits index available for filtering.
+	BloomStatus() (uint64, uint64)
+
+	// ServiceFilter starts servicing the bloom bit retrievals of a matcher
+	// session for the lifetime of the session.
+	ServiceFilter(ctx context.Context, session *bloombits.MatcherSession)
 }
 
 // Filter can be used to retrieve and filter logs.
 type Filter struct {
-	backend   Backend
-	useMipMap bool
+	backend Backend
 
 	created time.Time
 
@@ -50,15 +56,13 @@ type Filter struct {
 	topics     [][]common.Hash
 }
 
-// New creates a new filter which uses a bloom filter on blocks to figure out whether
-// a particular block is interesting or not.
-// MipMaps allow past blocks to be searched much more efficiently, but are not available
-// to light clients.
-func New(backend Backend, useMipMap bool) *Filter {
+// New creates a new filter which uses the bloom bits index to figure out which
+// blocks are interesting or not, falling back to the bloom filters of the single
+// headers for the blocks not yet indexed.
+func New(backend Backend) *Filter {
 	return &Filter{
-		backend:   backend,
-		useMipMap: useMipMap,
-		db:        backend.ChainDb(),
+		backend: backend,
+		db:      backend.ChainDb(),
 	}
 }
 
@@ -90,9 +94,27 @@ func (f *Filter) SetTopics(topics [][]common.Hash) {
 // updating the start point of the filter accordingly. If no results are
 // found, a nil slice is returned.
 func (f *Filter) FindOnce(ctx context.Context) ([]*types.Log, error) {
+	logs, blockNumber, err := f.find(ctx, true)
+	f.begin = int64(blockNumber + 1)
+	return logs, err
+}
+
+// Find retrieves all the log entries matching the filter criteria, updating
+// the start point of the filter past the searched range.
+func (f *Filter) Find(ctx context.Context) ([]*types.Log, error) {
+	logs, blockNumber, err := f.find(ctx, false)
+	f.begin = int64(blockNumber + 1)
+	return logs, err
+}
+
+// find searches the filtered range for matching logs, using the bloom bits
+// index for the indexed sections and the header blooms for the remaining tail.
+// If once is set, it stops at the first block containing matches. The last
+// block searched is returned along with the logs.
+func (f *Filter) find(ctx context.Context, once bool) ([]*types.Log, uint64, error) {
 	head, _ := f.backend.HeaderByNumber(ctx, rpc.LatestBlockNumber)
 	if head == nil {
-		return nil, nil
+		return nil, 0, nil
 	}
 	headBlockNumber := head.Number.Uint64()
 
@@ -104,98 +126,130 @@ func (f *Filter) FindOnce(ctx context.Context) ([]*types.Log, error) {
 	if f.end == -1 {
 		endBlockNo = headBlockNumber
 	}
+	// Gather the logs from the indexed sections first
+	var logs []*types.Log
+
+	size, sections := f.backend.BloomStatus()
+	if indexed := sections * size; indexed > beginBlockNo && beginBlockNo <= endBlockNo {
+		last := endBlockNo
+		if indexed-1 < last {
+			last = indexed - 1
+		}
+		found, blockNumber, err := f.indexedLogs(ctx, beginBlockNo, last, once)
+		logs = append(logs, found...)
+		if err != nil || (once && len(found) > 0) {
+			return logs, blockNumber, err
+		}
+		beginBlockNo = last + 1
+	}
+	// Check the unindexed tail of the range header by header
+	found, blockNumber, err := f.getLogs(ctx, beginBlockNo, endBlockNo, once)
+	return append(logs, found...), blockNumber, err
+}
 
-	// if no addresses are present we can't make use of fast search which
-	// uses the mipmap bloom filters to check for fast inclusion and uses
-	// higher range probability in order to ensure at least a false positive
-	if !f.useMipMap || len(f.addresses) == 0 {
-		logs, blockNumber, err := f.getLogs(ctx, beginBlockNo, endBlockNo)
-		f.begin = int64(blockNumber + 1)
-		return logs, err
+// indexedLogs returns the logs matching the filter criteria in the given range
+// of blocks covered by the bloom bits index.
+func (f *Filter) indexedLogs(ctx context.Context, start, end uint64, once bool) (logs []*types.Log, blockNumber uint64, err error) {
+	size, _ := f.backend.BloomStatus()
+
+	// Create a matcher session and request servicing from the backend
+	matches := make(chan uint64, 64)
+	session, err := bloombits.NewMatcher(size, f.bloomFilters()).Start(start, end, matches)
+	if err != nil {
+		return nil, end, err
 	}
+	defer session.Close()
 
-	logs, blockNumber := f.mipFind(beginBlockNo, endBlockNo, 0)
-	f.begin = int64(blockNumber + 1)
-	return logs, nil
-}
+	f.backend.ServiceFilter(ctx, session)
 
-// Run filters logs with the current parameters set
-func (f *Filter) Find(ctx context.Context) (logs []*types.Log, err error) {
 	for {
-		newLogs, err := f.FindOnce(ctx)
-		if len(newLogs) == 0 || err != nil {
-			return logs, err
+		select {
+		case number, ok := <-matches:
+			// Abort if all matches have been fulfilled
+			if !ok {
+				return logs, end, session.Error()
+			}
+			// Retrieve the logs of the potential match, filtering out false positives
+			header, err := f.backend.HeaderByNumber(ctx, rpc.BlockNumber(number))
+			if header == nil || err != nil {
+				return logs, end, err
+			}
+			found, err := f.blockLogs(ctx, header)
+			if err != nil {
+				return logs, end, err
+			}
+			logs = append(logs, found...)
+			if once && len(found) > 0 {
+				return logs, number, nil
+			}
+
+		case <-ctx.Done():
+			return logs, end, ctx.Err()
 		}
-		logs = append(logs, newLogs...)
 	}
 }
 
-func (f *Filter) mipFind(start, end uint64, depth int) (logs []*types.Log, blockNumber uint64) {
-	level := core.MIPMapLevels[depth]
-	// normalise numerator so we can work in level specific batches and
-	// work with the proper range checks
-	for num := start / level * level; num <= end; num += level {
-		// find addresses in bloom filters
-		bloom := core.GetMipmapBloom(f.db, num, level)
-		// Don't bother checking the first time through the loop - we're probably picking
-		// up where a previous run left off.
-		first := true
-		for _, addr := range f.addresses {
-			if first || bloom.TestBytes(addr[:]) {
-				first = false
-				// range check normalised values and make sure that
-				// we're resolving the correct range instead of the
-				// normalised values.
-				start := uint64(math.Max(float64(num), float64(start)))
-				end := uint64(math.Min(float64(num+level-1), float64(end)))
-				if depth+1 == len(core.MIPMapLevels) {
-					l, blockNumber, _ := f.getLogs(context.Background(), start, end)
-					if len(l) > 0 {
-						return l, blockNumber
-					}
-				} else {
-					l, blockNumber := f.mipFind(start, end, depth+1)
-					if len(l) > 0 {
-						return l, blockNumber
-					}
-				}
+// bloomFilters converts the filter criteria into the key groups of a bloom bits
+// matcher. Wildcard topics match everything.
+func (f *Filter) bloomFilters() [][][]byte {
+	var filters [][][]byte
+	if len(f.addresses) > 0 {
+		filter := make([][]byte, len(f.addresses))
+		for i, address := range f.addresses {
+			filter[i] = address.Bytes()
+		}
+		filters = append(filters, filter)
+	}
+	for _, topicList := range f.topics {
+		filter := make([][]byte, len(topicList))
+		for i, topic := range topicList {
+			if topic != (common.Hash{}) {
+				filter[i] = topic.Bytes()
 			}
 		}
+		filters = append(filters, filter)
 	}
-
-	return nil, end
+	return filters
 }
 
-func (f *Filter) getLogs(ctx context.Context, start, end uint64) (logs []*types.Log, blockNumber uint64, err error) {
+// getLogs returns the logs matching the filter criteria in the given range of
+// blocks, checking the bloom filter of every header.
+func (f *Filter) getLogs(ctx context.Context, start, end uint64, once bool) (logs []*types.Log, blockNumber uint64, err error) {
 	for i := start; i <= end; i++ {
 		blockNumber := rpc.BlockNumber(i)
 		header, err := f.backend.HeaderByNumber(ctx, blockNumber)
 		if header == nil || err != nil {
 			return logs, end, err
 		}
-
 		// Use bloom filtering to see if this block is interesting given the
 		// current parameters
 		if f.bloomFilter(header.Bloom) {
-			// Get the logs of the block
-			receipts, err := f.backend.GetReceipts(ctx, header.Hash())
+			found, err := f.blockLogs(ctx, header)
 			if err != nil {
-				return nil, end, err
+				return logs, end, err
 			}
-			var unfiltered []*types.Log
-			for _, receipt := range receipts {
-				unfiltered = append(unfiltered, ([]*types.Log)(receipt.Logs)...)
-			}
-			logs = filterLogs(unfiltered, nil, nil, f.addresses, f.topics)
-			if len(logs) > 0 {
+			logs = append(logs, found...)
+			if once && len(found) > 0 {
 				return logs, uint64(blockNumber), nil
 			}
 		}
 	}
-
 	return logs, end, nil
 }
 
+// blockLogs returns the logs of a block matching the filter criteria.
+func (f *Filter) blockLogs(ctx context.Context, header *types.Header) ([]*types.Log, error) {
+	receipts, err := f.backend.GetReceipts(ctx, header.Hash())
+	if err != nil {
+		return nil, err
+	}
+	var unfiltered []*types.Log
+	for _, receipt := range receipts {
+		unfiltered = append(unfiltered, ([]*types.Log)(receipt.Logs)...)
+	}
+	return filterLogs(unfiltered, nil, nil, f.addresses, f.topics), nil
+}
+
 func includes(addresses []common.Address, a common.Address) bool {
 	for _, addr := range addresses {
 		if addr == a {
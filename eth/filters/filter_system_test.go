@@ -25,6 +25,7 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/bloombits"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/event"
@@ -32,9 +33,15 @@ import (
 	"github.com/ethereum/go-ethereum/rpc"
 )
 
+const (
+	testBloomBitsSection  = 256 // Section size of the bloom bits index in the tests
+	testBloomBitsSections = 3   // Number of sections indexed in the tests
+)
+
 type testBackend struct {
-	mux *event.TypeMux
-	db  ethdb.Database
+	mux      *event.TypeMux
+	db       ethdb.Database
+	sections uint64
 }
 
 func (b *testBackend) ChainDb() ethdb.Database {
@@ -63,6 +70,21 @@ func (b *testBackend) GetReceipts(ctx context.Context, blockHash common.Hash) (t
 	return core.GetBlockReceipts(b.db, blockHash, num), nil
 }
 
+func (b *testBackend) BloomStatus() (uint64, uint64) {
+	return testBloomBitsSection, b.sections
+}
+
+func (b *testBackend) ServiceFilter(ctx context.Context, session *bloombits.MatcherSession) {
+	requests := make(chan chan *bloombits.Retrieval)
+	quit := make(chan struct{})
+
+	go core.ServeBloomBits(b.db, testBloomBitsSection, requests, quit)
+	go func() {
+		session.Multiplex(requests)
+		close(quit)
+	}()
+}
+
 // TestBlockSubscription tests if a block subscription returns block hashes for posted chain events.
 // It creates multiple subscriptions:
 // - one at the start and should receive all posted chain events and a second (blockHashes)
@@ -74,7 +96,7 @@ func TestBlockSubscription(t *testing.T) {
 	var (
 		mux         = new(event.TypeMux)
 		db, _       = ethdb.NewMemDatabase()
-		backend     = &testBackend{mux, db}
+		backend     = &testBackend{mux: mux, db: db}
 		api         = NewPublicFilterAPI(backend, false)
 		genesis     = new(core.Genesis).MustCommit(db)
 		chain, _    = core.GenerateChain(params.TestChainConfig, genesis, db, 10, func(i int, gen *core.BlockGen) {})
@@ -127,7 +149,7 @@ func TestPendingTxFilter(t *testing.T) {
 	var (
 		mux     = new(event.TypeMux)
 		db, _   = ethdb.NewMemDatabase()
-		backend = &testBackend{mux, db}
+		backend = &testBackend{mux: mux, db: db}
 		api     = NewPublicFilterAPI(backend, false)
 
 		transactions = []*types.Transaction{
@@ -177,7 +199,7 @@ func TestLogFilterCreation(t *testing.T) {
 	var (
 		mux     = new(event.TypeMux)
 		db, _   = ethdb.NewMemDatabase()
-		backend = &testBackend{mux, db}
+		backend = &testBackend{mux: mux, db: db}
 		api     = NewPublicFilterAPI(backend, false)
 
 		testCases = []struct {
@@ -222,7 +244,7 @@ func TestInvalidLogFilterCreation(t *testing.T) {
 	var (
 		mux     = new(event.TypeMux)
 		db, _   = ethdb.NewMemDatabase()
-		backend = &testBackend{mux, db}
+		backend = &testBackend{mux: mux, db: db}
 		api     = NewPublicFilterAPI(backend, false)
 	)
 
@@ -248,7 +270,7 @@ func TestLogFilter(t *testing.T) {
 	var (
 		mux     = new(event.TypeMux)
 		db, _   = ethdb.NewMemDatabase()
-		backend = &testBackend{mux, db}
+		backend = &testBackend{mux: mux, db: db}
 		api     = NewPublicFilterAPI(backend, false)
 
 		firstAddr      = common.HexToAddress("0x1111111111111111111111111111111111111111")
@@ -356,7 +378,7 @@ func TestPendingLogsSubscription(t *testing.T) {
 	var (
 		mux     = new(event.TypeMux)
 		db, _   = ethdb.NewMemDatabase()
-		backend = &testBackend{mux, db}
+		backend = &testBackend{mux: mux, db: db}
 		api     = NewPublicFilterAPI(backend, false)
 
 		firstAddr      = common.HexToAddress("0x1111111111111111111111111111111111111111")
@@ -18,13 +18,17 @@ package filters
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"fmt"
 	"io/ioutil"
 	"math/big"
 	"os"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/bitutil"
 	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/bloombits"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
@@ -41,8 +45,17 @@ func makeReceipt(addr common.Address) *types.Receipt {
 	return receipt
 }
 
-func BenchmarkMipmaps(b *testing.B) {
-	dir, err := ioutil.TempDir("", "mipmap")
+// makeTx creates a signed transaction to back an unchecked receipt.
+func makeTx(t testing.TB, key *ecdsa.PrivateKey, nonce uint64) *types.Transaction {
+	tx, err := types.SignTx(types.NewTransaction(nonce, common.Address{}, big.NewInt(0), big.NewInt(0), big.NewInt(0), nil), types.HomesteadSigner{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func BenchmarkFilters(b *testing.B) {
+	dir, err := ioutil.TempDir("", "filtertest")
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -51,7 +64,7 @@ func BenchmarkMipmaps(b *testing.B) {
 	var (
 		db, _   = ethdb.NewLDBDatabase(dir, 0, 0)
 		mux     = new(event.TypeMux)
-		backend = &testBackend{mux, db}
+		backend = &testBackend{mux: mux, db: db}
 		key1, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
 		addr1   = crypto.PubkeyToAddress(key1.PublicKey)
 		addr2   = common.BytesToAddress([]byte("jeff"))
@@ -62,33 +75,24 @@ func BenchmarkMipmaps(b *testing.B) {
 
 	genesis := core.GenesisBlockForTesting(db, addr1, big.NewInt(1000000))
 	chain, receipts := core.GenerateChain(params.TestChainConfig, genesis, db, 100010, func(i int, gen *core.BlockGen) {
-		var receipts types.Receipts
 		switch i {
 		case 2403:
 			receipt := makeReceipt(addr1)
-			receipts = types.Receipts{receipt}
 			gen.AddUncheckedReceipt(receipt)
+			gen.AddUncheckedTx(makeTx(b, key1, uint64(i)))
 		case 1034:
 			receipt := makeReceipt(addr2)
-			receipts = types.Receipts{receipt}
 			gen.AddUncheckedReceipt(receipt)
+			gen.AddUncheckedTx(makeTx(b, key1, uint64(i)))
 		case 34:
 			receipt := makeReceipt(addr3)
-			receipts = types.Receipts{receipt}
 			gen.AddUncheckedReceipt(receipt)
+			gen.AddUncheckedTx(makeTx(b, key1, uint64(i)))
 		case 99999:
 			receipt := makeReceipt(addr4)
-			receipts = types.Receipts{receipt}
 			gen.AddUncheckedReceipt(receipt)
-
-		}
-
-		// store the receipts
-		err := core.WriteReceipts(db, receipts)
-		if err != nil {
-			b.Fatal(err)
+			gen.AddUncheckedTx(makeTx(b, key1, uint64(i)))
 		}
-		core.WriteMipmapBloom(db, uint64(i+1), receipts)
 	})
 	for i, block := range chain {
 		core.WriteBlock(db, block)
@@ -104,7 +108,7 @@ func BenchmarkMipmaps(b *testing.B) {
 	}
 	b.ResetTimer()
 
-	filter := New(backend, true)
+	filter := New(backend)
 	filter.SetAddresses([]common.Address{addr1, addr2, addr3, addr4})
 	filter.SetBeginBlock(0)
 	filter.SetEndBlock(-1)
@@ -118,7 +122,7 @@ func BenchmarkMipmaps(b *testing.B) {
 }
 
 func TestFilters(t *testing.T) {
-	dir, err := ioutil.TempDir("", "mipmap")
+	dir, err := ioutil.TempDir("", "filtertest")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -127,7 +131,7 @@ func TestFilters(t *testing.T) {
 	var (
 		db, _   = ethdb.NewLDBDatabase(dir, 0, 0)
 		mux     = new(event.TypeMux)
-		backend = &testBackend{mux, db}
+		backend = &testBackend{mux: mux, db: db}
 		key1, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
 		addr    = crypto.PubkeyToAddress(key1.PublicKey)
 
@@ -140,7 +144,6 @@ func TestFilters(t *testing.T) {
 
 	genesis := core.GenesisBlockForTesting(db, addr, big.NewInt(1000000))
 	chain, receipts := core.GenerateChain(params.TestChainConfig, genesis, db, 1000, func(i int, gen *core.BlockGen) {
-		var receipts types.Receipts
 		switch i {
 		case 1:
 			receipt := types.NewReceipt(nil, new(big.Int))
@@ -151,7 +154,7 @@ func TestFilters(t *testing.T) {
 				},
 			}
 			gen.AddUncheckedReceipt(receipt)
-			receipts = types.Receipts{receipt}
+			gen.AddUncheckedTx(makeTx(t, key1, uint64(i)))
 		case 2:
 			receipt := types.NewReceipt(nil, new(big.Int))
 			receipt.Logs = []*types.Log{
@@ -161,7 +164,7 @@ func TestFilters(t *testing.T) {
 				},
 			}
 			gen.AddUncheckedReceipt(receipt)
-			receipts = types.Receipts{receipt}
+			gen.AddUncheckedTx(makeTx(t, key1, uint64(i)))
 		case 998:
 			receipt := types.NewReceipt(nil, new(big.Int))
 			receipt.Logs = []*types.Log{
@@ -171,7 +174,7 @@ func TestFilters(t *testing.T) {
 				},
 			}
 			gen.AddUncheckedReceipt(receipt)
-			receipts = types.Receipts{receipt}
+			gen.AddUncheckedTx(makeTx(t, key1, uint64(i)))
 		case 999:
 			receipt := types.NewReceipt(nil, new(big.Int))
 			receipt.Logs = []*types.Log{
@@ -181,18 +184,8 @@ func TestFilters(t *testing.T) {
 				},
 			}
 			gen.AddUncheckedReceipt(receipt)
-			receipts = types.Receipts{receipt}
+			gen.AddUncheckedTx(makeTx(t, key1, uint64(i)))
 		}
-
-		// store the receipts
-		err := core.WriteReceipts(db, receipts)
-		if err != nil {
-			t.Fatal(err)
-		}
-		// i is used as block number for the writes but since the i
-		// starts at 0 and block 0 (genesis) is already present increment
-		// by one
-		core.WriteMipmapBloom(db, uint64(i+1), receipts)
 	})
 	for i, block := range chain {
 		core.WriteBlock(db, block)
@@ -207,82 +200,117 @@ func TestFilters(t *testing.T) {
 		}
 	}
 
-	filter := New(backend, true)
-	filter.SetAddresses([]common.Address{addr})
-	filter.SetTopics([][]common.Hash{{hash1, hash2, hash3, hash4}})
-	filter.SetBeginBlock(0)
-	filter.SetEndBlock(-1)
+	// Run the filters both against the header blooms and against the bloom bits
+	// index of the complete sections, leaving the tail of the chain unindexed
+	indexBloomBits(t, db, testBloomBitsSections)
 
-	logs, _ := filter.Find(context.Background())
-	if len(logs) != 4 {
-		t.Error("expected 4 log, got", len(logs))
-	}
+	for _, sections := range []uint64{0, testBloomBitsSections} {
+		backend.sections = sections
+		name := fmt.Sprintf("sections %d", sections)
 
-	filter = New(backend, true)
-	filter.SetAddresses([]common.Address{addr})
-	filter.SetTopics([][]common.Hash{{hash3}})
-	filter.SetBeginBlock(900)
-	filter.SetEndBlock(999)
-	logs, _ = filter.Find(context.Background())
-	if len(logs) != 1 {
-		t.Error("expected 1 log, got", len(logs))
-	}
-	if len(logs) > 0 && logs[0].Topics[0] != hash3 {
-		t.Errorf("expected log[0].Topics[0] to be %x, got %x", hash3, logs[0].Topics[0])
-	}
+		filter := New(backend)
+		filter.SetAddresses([]common.Address{addr})
+		filter.SetTopics([][]common.Hash{{hash1, hash2, hash3, hash4}})
+		filter.SetBeginBlock(0)
+		filter.SetEndBlock(-1)
 
-	filter = New(backend, true)
-	filter.SetAddresses([]common.Address{addr})
-	filter.SetTopics([][]common.Hash{{hash3}})
-	filter.SetBeginBlock(990)
-	filter.SetEndBlock(-1)
-	logs, _ = filter.Find(context.Background())
-	if len(logs) != 1 {
-		t.Error("expected 1 log, got", len(logs))
-	}
-	if len(logs) > 0 && logs[0].Topics[0] != hash3 {
-		t.Errorf("expected log[0].Topics[0] to be %x, got %x", hash3, logs[0].Topics[0])
-	}
+		logs, _ := filter.Find(context.Background())
+		if len(logs) != 4 {
+			t.Error(name, "expected 4 log, got", len(logs))
+		}
 
-	filter = New(backend, true)
-	filter.SetTopics([][]common.Hash{{hash1, hash2}})
-	filter.SetBeginBlock(1)
-	filter.SetEndBlock(10)
+		filter = New(backend)
+		filter.SetAddresses([]common.Address{addr})
+		filter.SetTopics([][]common.Hash{{hash3}})
+		filter.SetBeginBlock(900)
+		filter.SetEndBlock(999)
+		logs, _ = filter.Find(context.Background())
+		if len(logs) != 1 {
+			t.Error(name, "expected 1 log, got", len(logs))
+		}
+		if len(logs) > 0 && logs[0].Topics[0] != hash3 {
+			t.Errorf("%s: expected log[0].Topics[0] to be %x, got %x", name, hash3, logs[0].Topics[0])
+		}
 
-	logs, _ = filter.Find(context.Background())
-	if len(logs) != 2 {
-		t.Error("expected 2 log, got", len(logs))
-	}
+		filter = New(backend)
+		filter.SetAddresses([]common.Address{addr})
+		filter.SetTopics([][]common.Hash{{hash3}})
+		filter.SetBeginBlock(990)
+		filter.SetEndBlock(-1)
+		logs, _ = filter.Find(context.Background())
+		if len(logs) != 1 {
+			t.Error(name, "expected 1 log, got", len(logs))
+		}
+		if len(logs) > 0 && logs[0].Topics[0] != hash3 {
+			t.Errorf("%s: expected log[0].Topics[0] to be %x, got %x", name, hash3, logs[0].Topics[0])
+		}
 
-	failHash := common.BytesToHash([]byte("fail"))
-	filter = New(backend, true)
-	filter.SetTopics([][]common.Hash{{failHash}})
-	filter.SetBeginBlock(0)
-	filter.SetEndBlock(-1)
+		filter = New(backend)
+		filter.SetTopics([][]common.Hash{{hash1, hash2}})
+		filter.SetBeginBlock(1)
+		filter.SetEndBlock(10)
 
-	logs, _ = filter.Find(context.Background())
-	if len(logs) != 0 {
-		t.Error("expected 0 log, got", len(logs))
-	}
+		logs, _ = filter.Find(context.Background())
+		if len(logs) != 2 {
+			t.Error(name, "expected 2 log, got", len(logs))
+		}
 
-	failAddr := common.BytesToAddress([]byte("failmenow"))
-	filter = New(backend, true)
-	filter.SetAddresses([]common.Address{failAddr})
-	filter.SetBeginBlock(0)
-	filter.SetEndBlock(-1)
+		failHash := common.BytesToHash([]byte("fail"))
+		filter = New(backend)
+		filter.SetTopics([][]common.Hash{{failHash}})
+		filter.SetBeginBlock(0)
+		filter.SetEndBlock(-1)
 
-	logs, _ = filter.Find(context.Background())
-	if len(logs) != 0 {
-		t.Error("expected 0 log, got", len(logs))
-	}
+		logs, _ = filter.Find(context.Background())
+		if len(logs) != 0 {
+			t.Error(name, "expected 0 log, got", len(logs))
+		}
 
-	filter = New(backend, true)
-	filter.SetTopics([][]common.Hash{{failHash}, {hash1}})
-	filter.SetBeginBlock(0)
-	filter.SetEndBlock(-1)
+		failAddr := common.BytesToAddress([]byte("failmenow"))
+		filter = New(backend)
+		filter.SetAddresses([]common.Address{failAddr})
+		filter.SetBeginBlock(0)
+		filter.SetEndBlock(-1)
+
+		logs, _ = filter.Find(context.Background())
+		if len(logs) != 0 {
+			t.Error(name, "expected 0 log, got", len(logs))
+		}
+
+		filter = New(backend)
+		filter.SetTopics([][]common.Hash{{failHash}, {hash1}})
+		filter.SetBeginBlock(0)
+		filter.SetEndBlock(-1)
 
-	logs, _ = filter.Find(context.Background())
-	if len(logs) != 0 {
-		t.Error("expected 0 log, got", len(logs))
+		logs, _ = filter.Find(context.Background())
+		if len(logs) != 0 {
+			t.Error(name, "expected 0 log, got", len(logs))
+		}
+	}
+}
+
+// indexBloomBits writes the bloom bits index of the given number of sections of
+// the canonical chain into the database.
+func indexBloomBits(t *testing.T, db ethdb.Database, sections uint64) {
+	for section := uint64(0); section < sections; section++ {
+		gen, err := bloombits.NewGenerator(testBloomBitsSection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var head common.Hash
+		for i := uint64(0); i < testBloomBitsSection; i++ {
+			number := section*testBloomBitsSection + i
+			head = core.GetCanonicalHash(db, number)
+			if err := gen.AddBloom(uint(i), core.GetHeader(db, head, number).Bloom); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for bit := uint(0); bit < types.BloomBitLength; bit++ {
+			bits, err := gen.Bitset(bit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			core.WriteBloomBits(db, bit, section, head, bitutil.CompressBytes(bits))
+		}
 	}
 }
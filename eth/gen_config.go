@@ -23,6 +23,16 @@ func (c Config) MarshalTOML() (interface{}, error) {
 		SkipBcVersionCheck      bool `toml:"-"`
 		DatabaseHandles         int  `toml:"-"`
 		DatabaseCache           int
+		DatabaseFreezer         string
+		Freezer                 bool
+		FreezerThreshold        uint64
+		NoPruning               bool
+		Snapshot                bool
+		DatabaseCompress        bool
+		StateDiffs              uint64
+		TxLookupLimit           uint64
+		StateReexec             uint64
+		TrieFlushInterval       uint64
 		Etherbase               common.Address `toml:",omitempty"`
 		MinerThreads            int            `toml:",omitempty"`
 		ExtraData               hexutil.Bytes  `toml:",omitempty"`
@@ -51,6 +61,16 @@ func (c Config) MarshalTOML() (interface{}, error) {
 	enc.SkipBcVersionCheck = c.SkipBcVersionCheck
 	enc.DatabaseHandles = c.DatabaseHandles
 	enc.DatabaseCache = c.DatabaseCache
+	enc.DatabaseFreezer = c.DatabaseFreezer
+	enc.Freezer = c.Freezer
+	enc.FreezerThreshold = c.FreezerThreshold
+	enc.NoPruning = c.NoPruning
+	enc.Snapshot = c.Snapshot
+	enc.DatabaseCompress = c.DatabaseCompress
+	enc.StateDiffs = c.StateDiffs
+	enc.TxLookupLimit = c.TxLookupLimit
+	enc.StateReexec = c.StateReexec
+	enc.TrieFlushInterval = c.TrieFlushInterval
 	enc.Etherbase = c.Etherbase
 	enc.MinerThreads = c.MinerThreads
 	enc.ExtraData = c.ExtraData
@@ -82,6 +102,16 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 		SkipBcVersionCheck      *bool `toml:"-"`
 		DatabaseHandles         *int  `toml:"-"`
 		DatabaseCache           *int
+		DatabaseFreezer         *string
+		Freezer                 *bool
+		FreezerThreshold        *uint64
+		NoPruning               *bool
+		Snapshot                *bool
+		DatabaseCompress        *bool
+		StateDiffs              *uint64
+		TxLookupLimit           *uint64
+		StateReexec             *uint64
+		TrieFlushInterval       *uint64
 		Etherbase               *common.Address `toml:",omitempty"`
 		MinerThreads            *int            `toml:",omitempty"`
 		ExtraData               hexutil.Bytes   `toml:",omitempty"`
@@ -131,6 +161,36 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	if dec.DatabaseCache != nil {
 		c.DatabaseCache = *dec.DatabaseCache
 	}
+	if dec.DatabaseFreezer != nil {
+		c.DatabaseFreezer = *dec.DatabaseFreezer
+	}
+	if dec.Freezer != nil {
+		c.Freezer = *dec.Freezer
+	}
+	if dec.FreezerThreshold != nil {
+		c.FreezerThreshold = *dec.FreezerThreshold
+	}
+	if dec.NoPruning != nil {
+		c.NoPruning = *dec.NoPruning
+	}
+	if dec.Snapshot != nil {
+		c.Snapshot = *dec.Snapshot
+	}
+	if dec.DatabaseCompress != nil {
+		c.DatabaseCompress = *dec.DatabaseCompress
+	}
+	if dec.StateDiffs != nil {
+		c.StateDiffs = *dec.StateDiffs
+	}
+	if dec.TxLookupLimit != nil {
+		c.TxLookupLimit = *dec.TxLookupLimit
+	}
+	if dec.StateReexec != nil {
+		c.StateReexec = *dec.StateReexec
+	}
+	if dec.TrieFlushInterval != nil {
+		c.TrieFlushInterval = *dec.TrieFlushInterval
+	}
 	if dec.Etherbase != nil {
 		c.Etherbase = *dec.Etherbase
 	}
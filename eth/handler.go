@@ -534,8 +534,9 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 			} else if err != nil {
 				return errResp(ErrDecode, "msg %v: %v", msg, err)
 			}
-			// Retrieve the requested state entry, stopping if enough was found
-			if entry, err := pm.chaindb.Get(hash.Bytes()); err == nil {
+			// Retrieve the requested state entry, including the recent ones not yet
+			// flushed to disk, stopping if enough was found
+			if entry, err := pm.blockchain.StateCache().TrieDB().Node(hash); err == nil {
 				data = append(data, entry)
 				bytes += len(entry)
 			}
@@ -0,0 +1,164 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// regenCacheLimit is the memory allowance of the trie nodes of the regenerated
+// states retained for follow-up requests.
+const regenCacheLimit = 64 * 1024 * 1024
+
+// stateRegenerator rebuilds the historical states pruned from the database by
+// re-executing the blocks on top of the nearest ancestor state persisted to disk.
+// The regenerated states live in a temporary in-memory trie database, which is
+// never flushed to disk, and are retained so that follow-up requests in the same range
+// don't need to re-execute the blocks again. States handed out to callers are
+// retained until released, the unused ones are evicted above the allowance.
+type stateRegenerator struct {
+	chain  *core.BlockChain
+	reexec uint64 // Maximum number of blocks to re-execute (0 = disabled)
+
+	cache state.Database      // Temporary trie database holding the regenerated states
+	roots []common.Hash       // Roots of the regenerated states, oldest first
+	refs  map[common.Hash]int // Number of callers using each regenerated state
+	limit common.StorageSize  // Memory allowance of the unused regenerated states
+	lock  sync.Mutex
+}
+
+// newStateRegenerator creates a regenerator for the historical states of the
+// given chain, re-executing at most reexec blocks to build any of them.
+func newStateRegenerator(chain *core.BlockChain, reexec uint64) *stateRegenerator {
+	return &stateRegenerator{
+		chain:  chain,
+		reexec: reexec,
+		cache:  state.NewDatabase(chain.StateCache().TrieDB().DiskDB()),
+		refs:   make(map[common.Hash]int),
+		limit:  regenCacheLimit,
+	}
+}
+
+// stateAt returns the state of the given block, regenerating it if the chain
+// doesn't hold it anymore. The returned release function must be called once
+// the caller is done with the state, so that a regenerated state isn't evicted
+// while still in use.
+func (r *stateRegenerator) stateAt(block *types.Block) (*state.StateDB, func(), error) {
+	// Serve the state from the chain if it's still available
+	statedb, err := r.chain.StateAt(block.Root())
+	if err == nil || r.reexec == 0 {
+		return statedb, func() {}, err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// Walk back to the nearest ancestor with its state persisted to disk, or
+	// regenerated earlier. The states held only in the chain's memory can't be
+	// built upon, as the chain may garbage collect their nodes while the retained
+	// states still reference them.
+	var blocks []*types.Block
+	for origin := block; ; {
+		if statedb, err = state.New(origin.Root(), r.cache); err == nil {
+			break
+		}
+		if uint64(len(blocks)) == r.reexec || origin.NumberU64() == 0 {
+			return nil, nil, fmt.Errorf("required historical state unavailable (reexec=%d)", r.reexec)
+		}
+		blocks = append(blocks, origin)
+
+		if origin = r.chain.GetBlock(origin.ParentHash(), origin.NumberU64()-1); origin == nil {
+			return nil, nil, fmt.Errorf("missing parent of block #%d", blocks[len(blocks)-1].NumberU64())
+		}
+	}
+	if len(blocks) == 0 {
+		return statedb, r.retain(block.Root()), nil
+	}
+	// Re-execute the blocks on top of the ancestor state, oldest first
+	var (
+		start     = time.Now()
+		processor = r.chain.Processor()
+		triedb    = r.cache.TrieDB()
+	)
+	for i := len(blocks) - 1; i >= 0; i-- {
+		next := blocks[i]
+		if _, _, _, err := processor.Process(next, statedb, vm.Config{}); err != nil {
+			return nil, nil, fmt.Errorf("processing block #%d failed: %v", next.NumberU64(), err)
+		}
+		root, err := statedb.Commit(r.chain.Config().IsEIP158(next.Number()))
+		if err != nil {
+			return nil, nil, err
+		}
+		if root != next.Root() {
+			return nil, nil, fmt.Errorf("block #%d state root mismatch: have %x, want %x", next.NumberU64(), root, next.Root())
+		}
+		// Retain the regenerated state, dropping the unused ones above the allowance.
+		// The preimages are only ever flushed to disk, so discard them right away.
+		triedb.DropPreimages()
+		triedb.Reference(root)
+		r.roots = append(r.roots, root)
+		r.trim()
+
+		if statedb, err = state.New(root, r.cache); err != nil {
+			return nil, nil, err
+		}
+	}
+	log.Info("Regenerated historical state", "number", block.NumberU64(), "hash", block.Hash(), "blocks", len(blocks), "elapsed", common.PrettyDuration(time.Since(start)))
+	return statedb, r.retain(block.Root()), nil
+}
+
+// retain marks a regenerated state as used by a caller, returning the function
+// releasing it. The lock must be held.
+func (r *stateRegenerator) retain(root common.Hash) func() {
+	r.refs[root]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+
+			if r.refs[root]--; r.refs[root] == 0 {
+				delete(r.refs, root)
+			}
+			r.trim()
+		})
+	}
+}
+
+// trim dereferences the oldest regenerated states not used by any caller until
+// the cache fits into its allowance. The newest state is always retained as the
+// base of follow-up regenerations. The lock must be held.
+func (r *stateRegenerator) trim() {
+	triedb := r.cache.TrieDB()
+	for i := 0; i < len(r.roots)-1 && triedb.NodesSize() > r.limit; {
+		if r.refs[r.roots[i]] > 0 {
+			i++
+			continue
+		}
+		triedb.Dereference(r.roots[i])
+		r.roots = append(r.roots[:i], r.roots[i+1:]...)
+	}
+}
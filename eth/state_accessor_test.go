@@ -0,0 +1,292 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// Tests that pruned historical states are regenerated by re-executing blocks
+// from the nearest available state, and retained for follow-up requests.
+func TestStateRegeneration(t *testing.T) {
+	var (
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		theAddr = common.Address{1}
+		gspec   = &core.Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  core.GenesisAlloc{address: {Balance: big.NewInt(1000000000)}},
+		}
+		gendb, _ = ethdb.NewMemDatabase()
+		db, _    = ethdb.NewMemDatabase()
+	)
+	// Generate the chain in a separate database, as the generator persists all states
+	blocks, _ := core.GenerateChain(gspec.Config, gspec.MustCommit(gendb), gendb, 256, func(i int, block *core.BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), theAddr, big.NewInt(1000), big.NewInt(21000), new(big.Int), nil), types.HomesteadSigner{}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.AddTx(tx)
+	})
+	gspec.MustCommit(db)
+	chain, _ := core.NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
+	defer chain.Stop()
+
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	target := blocks[63]
+	if _, err := chain.StateAt(target.Root()); err == nil {
+		t.Fatalf("state of block #%d not pruned", target.NumberU64())
+	}
+	// Regeneration must fail if the available state is too far away
+	if _, _, err := newStateRegenerator(chain, 32).stateAt(target); err == nil {
+		t.Fatalf("state regenerated beyond the re-execution limit")
+	}
+	regen := newStateRegenerator(chain, 64)
+	statedb, release, err := regen.stateAt(target)
+	if err != nil {
+		t.Fatalf("failed to regenerate state: %v", err)
+	}
+	if balance := statedb.GetBalance(theAddr); balance.Cmp(big.NewInt(64*1000)) != 0 {
+		t.Fatalf("balance mismatch: have %v, want %v", balance, 64*1000)
+	}
+	release()
+
+	// Follow-up requests must build on the retained states
+	regen.reexec = 1
+	if statedb, release, err = regen.stateAt(blocks[64]); err != nil {
+		t.Fatalf("failed to regenerate follow-up state: %v", err)
+	}
+	if balance := statedb.GetBalance(theAddr); balance.Cmp(big.NewInt(65*1000)) != 0 {
+		t.Fatalf("follow-up balance mismatch: have %v, want %v", balance, 65*1000)
+	}
+	release()
+
+	if _, release, err = regen.stateAt(blocks[32]); err != nil {
+		t.Fatalf("failed to retrieve retained state: %v", err)
+	}
+	release()
+
+	// States in use must survive the eviction until released, unused ones not
+	regen = newStateRegenerator(chain, 64)
+	regen.limit = 0
+
+	if _, release, err = regen.stateAt(target); err != nil {
+		t.Fatalf("failed to regenerate state: %v", err)
+	}
+	_, next, err := regen.stateAt(blocks[64])
+	if err != nil {
+		t.Fatalf("failed to regenerate follow-up state: %v", err)
+	}
+	defer next()
+
+	if _, err := regen.cache.TrieDB().Node(target.Root()); err != nil {
+		t.Fatalf("state in use evicted: %v", err)
+	}
+	if _, err := regen.cache.TrieDB().Node(blocks[32].Root()); err == nil {
+		t.Fatalf("unused state retained above the allowance")
+	}
+	// Releasing a state twice must not release it for the other users
+	_, again, err := regen.stateAt(target)
+	if err != nil {
+		t.Fatalf("failed to retrieve retained state: %v", err)
+	}
+	release()
+	release()
+
+	if _, err := regen.cache.TrieDB().Node(target.Root()); err != nil {
+		t.Fatalf("state still in use evicted: %v", err)
+	}
+	again()
+
+	if _, err := regen.cache.TrieDB().Node(target.Root()); err == nil {
+		t.Fatalf("released state retained above the allowance")
+	}
+	if _, err := regen.cache.TrieDB().Node(blocks[64].Root()); err != nil {
+		t.Fatalf("newest state evicted: %v", err)
+	}
+}
+
+// Tests that retained regenerated states remain intact after the chain garbage
+// collects the in-memory states they branch off from.
+func TestStateRegenerationChainGC(t *testing.T) {
+	var (
+		key, _   = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address  = crypto.PubkeyToAddress(key.PublicKey)
+		theAddr  = common.Address{1}
+		forkAddr = common.Address{2}
+		gspec    = &core.Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  core.GenesisAlloc{address: {Balance: big.NewInt(1000000000)}},
+		}
+		gendb, _ = ethdb.NewMemDatabase()
+		db, _    = ethdb.NewMemDatabase()
+	)
+	blocks, _ := core.GenerateChain(gspec.Config, gspec.MustCommit(gendb), gendb, 256, func(i int, block *core.BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), theAddr, big.NewInt(1000), big.NewInt(21000), new(big.Int), nil), types.HomesteadSigner{}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.AddTx(tx)
+	})
+	// Create a side block the chain never imports, so its state is always regenerated
+	fork, _ := core.GenerateChain(gspec.Config, blocks[127], gendb, 1, func(i int, block *core.BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), forkAddr, big.NewInt(5000), big.NewInt(21000), new(big.Int), nil), types.HomesteadSigner{}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.AddTx(tx)
+	})
+	gspec.MustCommit(db)
+	chain, _ := core.NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
+	defer chain.Stop()
+
+	if _, err := chain.InsertChain(blocks[:128]); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if _, err := chain.StateAt(blocks[127].Root()); err != nil {
+		t.Fatalf("state of block #%d not held by the chain: %v", blocks[127].NumberU64(), err)
+	}
+	// checkState verifies the balances of the regenerated side state
+	checkState := func(statedb *state.StateDB) {
+		if balance := statedb.GetBalance(theAddr); balance.Cmp(big.NewInt(128*1000)) != 0 {
+			t.Fatalf("balance mismatch: have %v, want %v", balance, 128*1000)
+		}
+		if balance := statedb.GetBalance(forkAddr); balance.Cmp(big.NewInt(5000)) != 0 {
+			t.Fatalf("fork balance mismatch: have %v, want %v", balance, 5000)
+		}
+	}
+	regen := newStateRegenerator(chain, 129)
+	statedb, release, err := regen.stateAt(fork[0])
+	if err != nil {
+		t.Fatalf("failed to regenerate state: %v", err)
+	}
+	checkState(statedb)
+	release()
+
+	// Move the chain on until it dereferences the states the side block was built on
+	if _, err := chain.InsertChain(blocks[128:]); err != nil {
+		t.Fatalf("failed to extend chain: %v", err)
+	}
+	if _, err := chain.StateAt(blocks[127].Root()); err == nil {
+		t.Fatalf("state of block #%d not garbage collected", blocks[127].NumberU64())
+	}
+	// The retained state must still be complete, without re-execution
+	regen.reexec = 1
+	if statedb, release, err = regen.stateAt(fork[0]); err != nil {
+		t.Fatalf("failed to retrieve retained state: %v", err)
+	}
+	checkState(statedb)
+	release()
+}
+
+// Tests that regenerating many states keeps the memory use within the allowance
+// without evicting the retained states prematurely, e.g. due to the preimages
+// of the touched accounts piling up.
+func TestStateRegenerationMemory(t *testing.T) {
+	var (
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &core.Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  core.GenesisAlloc{address: {Balance: big.NewInt(1000000000)}},
+		}
+		gendb, _ = ethdb.NewMemDatabase()
+		db, _    = ethdb.NewMemDatabase()
+	)
+	// Touch a fresh account in every block, each adding a new preimage
+	blocks, _ := core.GenerateChain(gspec.Config, gspec.MustCommit(gendb), gendb, 256, func(i int, block *core.BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.BigToAddress(big.NewInt(int64(i+1))), big.NewInt(1000), big.NewInt(21000), new(big.Int), nil), types.HomesteadSigner{}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.AddTx(tx)
+	})
+	gspec.MustCommit(db)
+	chain, _ := core.NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), new(event.TypeMux), vm.Config{})
+	defer chain.Stop()
+
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	// regenerate builds the states of the given range one by one, on top of each other
+	regenerate := func(regen *stateRegenerator, from, to int) {
+		for i := from; i < to; i++ {
+			_, release, err := regen.stateAt(blocks[i])
+			if err != nil {
+				t.Fatalf("failed to regenerate state #%d: %v", blocks[i].NumberU64(), err)
+			}
+			release()
+		}
+	}
+	// Measure the node memory needed to retain all the regenerated states
+	regen := newStateRegenerator(chain, 128)
+	regenerate(regen, 63, 128)
+
+	triedb := regen.cache.TrieDB()
+	if size := triedb.Size(); size != triedb.NodesSize() {
+		t.Fatalf("preimages retained: total size %v, nodes size %v", size, triedb.NodesSize())
+	}
+	// With exactly that much allowance, every state must be retained and served
+	// without re-execution
+	regen = newStateRegenerator(chain, 128)
+	regen.limit = triedb.NodesSize()
+	regenerate(regen, 63, 128)
+
+	triedb = regen.cache.TrieDB()
+	if triedb.NodesSize() > regen.limit {
+		t.Fatalf("memory use above allowance: have %v, want at most %v", triedb.NodesSize(), regen.limit)
+	}
+	nodes := triedb.Nodes()
+	regen.reexec = 1
+	for i := 64; i < 128; i++ {
+		if _, release, err := regen.stateAt(blocks[i]); err != nil {
+			t.Fatalf("state #%d not retained: %v", blocks[i].NumberU64(), err)
+		} else {
+			release()
+		}
+	}
+	if triedb.Nodes() != nodes {
+		t.Fatalf("retained states re-executed: have %d nodes, want %d", triedb.Nodes(), nodes)
+	}
+	// With a smaller allowance, the memory use must stay bounded, only the newest
+	// state being retained regardless of its size
+	regen = newStateRegenerator(chain, 128)
+	regen.limit = triedb.NodesSize() / 2
+	regenerate(regen, 63, 128)
+
+	triedb = regen.cache.TrieDB()
+	if size := triedb.Size(); size != triedb.NodesSize() {
+		t.Fatalf("preimages retained: total size %v, nodes size %v", size, triedb.NodesSize())
+	}
+	if size := triedb.NodesSize(); size > regen.limit && len(regen.roots) > 1 {
+		t.Fatalf("memory use above allowance: have %v, want at most %v", size, regen.limit)
+	}
+}
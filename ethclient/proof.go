@@ -0,0 +1,198 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethclient
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// AccountResult is the state of an account along with the Merkle proofs of it
+// and some of its storage slots, as defined by EIP-1186.
+type AccountResult struct {
+	Address      common.Address
+	AccountProof []rlp.RawValue
+	Balance      *big.Int
+	CodeHash     common.Hash
+	Nonce        uint64
+	StorageHash  common.Hash
+	StorageProof []StorageResult
+}
+
+// StorageResult is the value of a storage slot along with its Merkle proof.
+type StorageResult struct {
+	Key   common.Hash
+	Value *big.Int
+	Proof []rlp.RawValue
+}
+
+// GetProof returns the account and storage values of the given account along
+// with their Merkle proofs. The block number can be nil, in which case the
+// proof is taken from the latest known block.
+func (ec *Client) GetProof(ctx context.Context, account common.Address, keys []common.Hash, blockNumber *big.Int) (*AccountResult, error) {
+	type storageResult struct {
+		Key   common.Hash     `json:"key"`
+		Value *hexutil.Big    `json:"value"`
+		Proof []hexutil.Bytes `json:"proof"`
+	}
+	type accountResult struct {
+		Address      common.Address  `json:"address"`
+		AccountProof []hexutil.Bytes `json:"accountProof"`
+		Balance      *hexutil.Big    `json:"balance"`
+		CodeHash     common.Hash     `json:"codeHash"`
+		Nonce        hexutil.Uint64  `json:"nonce"`
+		StorageHash  common.Hash     `json:"storageHash"`
+		StorageProof []storageResult `json:"storageProof"`
+	}
+	hexKeys := make([]string, len(keys))
+	for i, key := range keys {
+		hexKeys[i] = key.Hex()
+	}
+	var res *accountResult
+	if err := ec.c.CallContext(ctx, &res, "eth_getProof", account, hexKeys, toBlockNumArg(blockNumber)); err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, ethereum.NotFound
+	}
+	result := &AccountResult{
+		Address:      res.Address,
+		AccountProof: fromHexSlice(res.AccountProof),
+		Balance:      (*big.Int)(res.Balance),
+		CodeHash:     res.CodeHash,
+		Nonce:        uint64(res.Nonce),
+		StorageHash:  res.StorageHash,
+		StorageProof: make([]StorageResult, len(res.StorageProof)),
+	}
+	for i, slot := range res.StorageProof {
+		result.StorageProof[i] = StorageResult{
+			Key:   slot.Key,
+			Value: (*big.Int)(slot.Value),
+			Proof: fromHexSlice(slot.Proof),
+		}
+	}
+	return result, nil
+}
+
+// fromHexSlice converts a list of hex decoded blobs into RLP encoded trie nodes.
+func fromHexSlice(blobs []hexutil.Bytes) []rlp.RawValue {
+	nodes := make([]rlp.RawValue, len(blobs))
+	for i, blob := range blobs {
+		nodes[i] = rlp.RawValue(blob)
+	}
+	return nodes
+}
+
+// proofAccount mirrors the consensus representation of accounts, needed to
+// check the proven account against the returned fields.
+type proofAccount struct {
+	Nonce    uint64
+	Balance  *big.Int
+	Root     common.Hash
+	CodeHash []byte
+}
+
+// VerifyProof checks the account and storage proofs of a GetProof result
+// against the state root of a trusted header, ensuring that all the returned
+// values are the ones committed to by the header.
+func VerifyProof(header *types.Header, res *AccountResult) error {
+	blob, err := trie.VerifyProof(header.Root, crypto.Keccak256(res.Address[:]), res.AccountProof)
+	if err != nil {
+		return fmt.Errorf("invalid account proof: %v", err)
+	}
+	balance := res.Balance
+	if balance == nil {
+		balance = new(big.Int)
+	}
+	if blob == nil {
+		// The account doesn't exist, all fields must be empty
+		if res.Nonce != 0 || balance.Sign() != 0 || res.StorageHash != types.EmptyRootHash {
+			return fmt.Errorf("non-empty fields for missing account %x", res.Address)
+		}
+		if res.CodeHash != (common.Hash{}) && res.CodeHash != crypto.Keccak256Hash(nil) {
+			return fmt.Errorf("code hash %x for missing account %x", res.CodeHash, res.Address)
+		}
+	} else {
+		var account proofAccount
+		if err := rlp.DecodeBytes(blob, &account); err != nil {
+			return fmt.Errorf("invalid proven account: %v", err)
+		}
+		if account.Nonce != res.Nonce {
+			return fmt.Errorf("nonce mismatch: proven %d, returned %d", account.Nonce, res.Nonce)
+		}
+		if account.Balance.Cmp(balance) != 0 {
+			return fmt.Errorf("balance mismatch: proven %v, returned %v", account.Balance, balance)
+		}
+		if account.Root != res.StorageHash {
+			return fmt.Errorf("storage hash mismatch: proven %x, returned %x", account.Root, res.StorageHash)
+		}
+		if !bytes.Equal(account.CodeHash, res.CodeHash[:]) {
+			return fmt.Errorf("code hash mismatch: proven %x, returned %x", account.CodeHash, res.CodeHash)
+		}
+	}
+	for _, slot := range res.StorageProof {
+		if err := verifyStorageProof(res.StorageHash, slot); err != nil {
+			return fmt.Errorf("storage slot %x: %v", slot.Key, err)
+		}
+	}
+	return nil
+}
+
+// verifyStorageProof checks the proof of a single storage slot against the
+// storage root of its account.
+func verifyStorageProof(root common.Hash, slot StorageResult) error {
+	value := slot.Value
+	if value == nil {
+		value = new(big.Int)
+	}
+	// Empty storage tries have no nodes, hence an empty proof
+	if root == types.EmptyRootHash {
+		if len(slot.Proof) != 0 {
+			return fmt.Errorf("non-empty proof in empty storage")
+		}
+		if value.Sign() != 0 {
+			return fmt.Errorf("non-zero value %v in empty storage", value)
+		}
+		return nil
+	}
+	blob, err := trie.VerifyProof(root, crypto.Keccak256(slot.Key[:]), slot.Proof)
+	if err != nil {
+		return fmt.Errorf("invalid proof: %v", err)
+	}
+	proven := new(big.Int)
+	if blob != nil {
+		var content []byte
+		if err := rlp.DecodeBytes(blob, &content); err != nil {
+			return fmt.Errorf("invalid proven value: %v", err)
+		}
+		proven.SetBytes(content)
+	}
+	if proven.Cmp(value) != 0 {
+		return fmt.Errorf("value mismatch: proven %v, returned %v", proven, value)
+	}
+	return nil
+}
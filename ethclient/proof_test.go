@@ -0,0 +1,129 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethclient
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/internal/ethapi"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// proofBackend is an API backend only serving the state of a fixed block.
+type proofBackend struct {
+	ethapi.Backend
+	db     ethdb.Database
+	header *types.Header
+}
+
+func (b *proofBackend) StateAndHeaderByNumber(ctx context.Context, blockNr rpc.BlockNumber) (*state.StateDB, *types.Header, func(), error) {
+	statedb, err := state.New(b.header.Root, state.NewDatabase(b.db))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return statedb, b.header, func() {}, nil
+}
+
+// newProofTester creates a committed state with a plain account and a contract
+// with some storage, returning an RPC client to the blockchain API serving proofs
+// out of it.
+func newProofTester(t *testing.T) (*Client, *types.Header) {
+	db, _ := ethdb.NewMemDatabase()
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(db))
+
+	statedb.SetBalance(common.Address{0x01}, big.NewInt(1000))
+	statedb.SetNonce(common.Address{0x02}, 5)
+	statedb.SetCode(common.Address{0x02}, []byte{0x60, 0x00})
+	for i := byte(1); i <= 16; i++ {
+		statedb.SetState(common.Address{0x02}, common.Hash{i}, common.Hash{31: i})
+	}
+	root, err := statedb.CommitTo(db, false)
+	if err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	header := &types.Header{Number: big.NewInt(1), Root: root}
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", ethapi.NewPublicBlockChainAPI(&proofBackend{db: db, header: header})); err != nil {
+		t.Fatalf("failed to register blockchain API: %v", err)
+	}
+	return NewClient(rpc.DialInProc(server)), header
+}
+
+// Tests that account and storage proofs retrieved over RPC verify against the
+// state root, both for existing and missing accounts and slots.
+func TestGetProof(t *testing.T) {
+	client, header := newProofTester(t)
+
+	tests := []struct {
+		account common.Address
+		keys    []common.Hash
+		balance int64
+		nonce   uint64
+	}{
+		{common.Address{0x01}, nil, 1000, 0},
+		{common.Address{0x02}, []common.Hash{{0x01}, {0x10}, {0xff}}, 0, 5},
+		{common.Address{0x03}, []common.Hash{{0x01}}, 0, 0},
+	}
+	for i, tt := range tests {
+		res, err := client.GetProof(context.Background(), tt.account, tt.keys, nil)
+		if err != nil {
+			t.Fatalf("test %d: failed to retrieve proof: %v", i, err)
+		}
+		if res.Balance.Int64() != tt.balance || res.Nonce != tt.nonce {
+			t.Errorf("test %d: account mismatch: have balance %v nonce %d, want %d %d", i, res.Balance, res.Nonce, tt.balance, tt.nonce)
+		}
+		if len(res.StorageProof) != len(tt.keys) {
+			t.Fatalf("test %d: storage proof count mismatch: have %d, want %d", i, len(res.StorageProof), len(tt.keys))
+		}
+		if err := VerifyProof(header, res); err != nil {
+			t.Errorf("test %d: failed to verify proof: %v", i, err)
+		}
+	}
+}
+
+// Tests that tampering with any returned value fails the proof verification.
+func TestVerifyProofTampering(t *testing.T) {
+	client, header := newProofTester(t)
+
+	tamperers := []func(res *AccountResult){
+		func(res *AccountResult) { res.Balance = big.NewInt(1) },
+		func(res *AccountResult) { res.Nonce++ },
+		func(res *AccountResult) { res.CodeHash = common.Hash{0x01} },
+		func(res *AccountResult) { res.StorageHash = common.Hash{0x01} },
+		func(res *AccountResult) { res.StorageProof[0].Value = big.NewInt(2) },
+		func(res *AccountResult) { res.StorageProof[1].Value = big.NewInt(1) },
+		func(res *AccountResult) { res.AccountProof = res.AccountProof[:len(res.AccountProof)-1] },
+		func(res *AccountResult) { res.Address = common.Address{0x03} },
+	}
+	for i, tamper := range tamperers {
+		res, err := client.GetProof(context.Background(), common.Address{0x02}, []common.Hash{{0x01}, {0xff}}, nil)
+		if err != nil {
+			t.Fatalf("failed to retrieve proof: %v", err)
+		}
+		tamper(res)
+		if err := VerifyProof(header, res); err == nil {
+			t.Errorf("tamper %d: verification succeeded", i)
+		}
+	}
+}
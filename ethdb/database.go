@@ -22,13 +22,14 @@ import (
 	"sync"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/filter"
-	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 
 	gometrics "github.com/rcrowley/go-metrics"
 )
@@ -147,10 +148,44 @@ func (db *LDBDatabase) Delete(key []byte) error {
 	return db.db.Delete(key, nil)
 }
 
-func (db *LDBDatabase) NewIterator() iterator.Iterator {
+// Has returns whether the given key is present in the database.
+func (db *LDBDatabase) Has(key []byte) (bool, error) {
+	return db.db.Has(key, nil)
+}
+
+// NewIterator creates an iterator over the entire key space of the database.
+func (db *LDBDatabase) NewIterator() Iterator {
 	return db.db.NewIterator(nil, nil)
 }
 
+// NewIteratorWithPrefix creates an iterator over the keys starting with a
+// particular prefix.
+func (db *LDBDatabase) NewIteratorWithPrefix(prefix []byte) Iterator {
+	return db.db.NewIterator(util.BytesPrefix(prefix), nil)
+}
+
+// NewIteratorWithRange creates an iterator over the keys in the range
+// [start, limit).
+func (db *LDBDatabase) NewIteratorWithRange(start, limit []byte) Iterator {
+	return db.db.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+}
+
+// DeleteRange removes all the keys in the range [start, limit), in batches of
+// limited size.
+func (db *LDBDatabase) DeleteRange(start, limit []byte) error {
+	return deleteRange(db, start, limit)
+}
+
+// Compact flattens the underlying leveldb storage for the range [start, limit).
+func (db *LDBDatabase) Compact(start, limit []byte) error {
+	return db.db.CompactRange(util.Range{Start: start, Limit: limit})
+}
+
+// Stat returns a particular leveldb property, e.g. "leveldb.stats".
+func (db *LDBDatabase) Stat(property string) (string, error) {
+	return db.db.GetProperty(property)
+}
+
 func (db *LDBDatabase) Close() {
 	// Stop the metrics collection to avoid internal database races
 	db.quitLock.Lock()
@@ -284,12 +319,20 @@ func (db *LDBDatabase) NewBatch() Batch {
 }
 
 type ldbBatch struct {
-	db *leveldb.DB
-	b  *leveldb.Batch
+	db   *leveldb.DB
+	b    *leveldb.Batch
+	size int
 }
 
 func (b *ldbBatch) Put(key, value []byte) error {
 	b.b.Put(key, value)
+	b.size += len(value)
+	return nil
+}
+
+func (b *ldbBatch) Delete(key []byte) error {
+	b.b.Delete(key)
+	b.size++
 	return nil
 }
 
@@ -297,6 +340,39 @@ func (b *ldbBatch) Write() error {
 	return b.db.Write(b.b, nil)
 }
 
+func (b *ldbBatch) ValueSize() int {
+	return b.size
+}
+
+func (b *ldbBatch) Reset() {
+	b.b.Reset()
+	b.size = 0
+}
+
+// deleteRange removes all the keys of a database in the range [start, limit),
+// flushing the deletions in batches of ideal size.
+func deleteRange(db Database, start, limit []byte) error {
+	it := db.NewIteratorWithRange(start, limit)
+	defer it.Release()
+
+	batch := db.NewBatch()
+	for it.Next() {
+		if err := batch.Delete(common.CopyBytes(it.Key())); err != nil {
+			return err
+		}
+		if batch.ValueSize() >= IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	return batch.Write()
+}
+
 type table struct {
 	db     Database
 	prefix string
@@ -319,10 +395,67 @@ func (dt *table) Get(key []byte) ([]byte, error) {
 	return dt.db.Get(append([]byte(dt.prefix), key...))
 }
 
+func (dt *table) Has(key []byte) (bool, error) {
+	return dt.db.Has(append([]byte(dt.prefix), key...))
+}
+
 func (dt *table) Delete(key []byte) error {
 	return dt.db.Delete(append([]byte(dt.prefix), key...))
 }
 
+func (dt *table) NewIterator() Iterator {
+	return dt.NewIteratorWithPrefix(nil)
+}
+
+func (dt *table) NewIteratorWithPrefix(prefix []byte) Iterator {
+	return &tableIterator{dt.db.NewIteratorWithPrefix(append([]byte(dt.prefix), prefix...)), len(dt.prefix)}
+}
+
+func (dt *table) NewIteratorWithRange(start, limit []byte) Iterator {
+	start, limit = dt.tableRange(start, limit)
+	return &tableIterator{dt.db.NewIteratorWithRange(start, limit), len(dt.prefix)}
+}
+
+func (dt *table) DeleteRange(start, limit []byte) error {
+	start, limit = dt.tableRange(start, limit)
+	return dt.db.DeleteRange(start, limit)
+}
+
+func (dt *table) Compact(start, limit []byte) error {
+	start, limit = dt.tableRange(start, limit)
+	return dt.db.Compact(start, limit)
+}
+
+func (dt *table) Stat(property string) (string, error) {
+	return dt.db.Stat(property)
+}
+
+// tableRange converts a key range of the table into the range of the
+// underlying database, open ends being bounded by the table prefix.
+func (dt *table) tableRange(start, limit []byte) ([]byte, []byte) {
+	bounds := util.BytesPrefix([]byte(dt.prefix))
+	if start != nil {
+		bounds.Start = append([]byte(dt.prefix), start...)
+	}
+	if limit != nil {
+		bounds.Limit = append([]byte(dt.prefix), limit...)
+	}
+	return bounds.Start, bounds.Limit
+}
+
+// tableIterator strips the table prefix from the keys of an iterator.
+type tableIterator struct {
+	Iterator
+	prefix int
+}
+
+func (it *tableIterator) Key() []byte {
+	if key := it.Iterator.Key(); key != nil {
+		return key[it.prefix:]
+	}
+	return nil
+}
+
 func (dt *table) Close() {
 	// Do nothing; don't close the underlying DB.
 }
@@ -345,6 +478,18 @@ func (tb *tableBatch) Put(key, value []byte) error {
 	return tb.batch.Put(append([]byte(tb.prefix), key...), value)
 }
 
+func (tb *tableBatch) Delete(key []byte) error {
+	return tb.batch.Delete(append([]byte(tb.prefix), key...))
+}
+
 func (tb *tableBatch) Write() error {
 	return tb.batch.Write()
 }
+
+func (tb *tableBatch) ValueSize() int {
+	return tb.batch.ValueSize()
+}
+
+func (tb *tableBatch) Reset() {
+	tb.batch.Reset()
+}
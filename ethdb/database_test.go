@@ -19,6 +19,8 @@ package ethdb
 import (
 	"os"
 	"path/filepath"
+	"reflect"
+	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
 )
@@ -32,3 +34,99 @@ func newDb() *LDBDatabase {
 
 	return db
 }
+
+// testDatabases returns a fresh instance of every database implementation,
+// along with a cleanup function closing them.
+func testDatabases() (map[string]Database, func()) {
+	ldb := newDb()
+	mem, _ := NewMemDatabase()
+	tbl, _ := NewMemDatabase()
+	tbl.Put([]byte("a"), []byte("outside"))
+
+	dbs := map[string]Database{
+		"leveldb": ldb,
+		"memory":  mem,
+		"table":   NewTable(tbl, "tbl-"),
+	}
+	return dbs, func() {
+		ldb.Close()
+		os.RemoveAll(ldb.Path())
+	}
+}
+
+// Tests that the prefix and range iterators return exactly the matching keys
+// in ascending order.
+func TestIterators(t *testing.T) {
+	dbs, cleanup := testDatabases()
+	defer cleanup()
+
+	for name, db := range dbs {
+		for _, key := range []string{"a", "ab", "abc", "b", "ba", "c"} {
+			db.Put([]byte(key), []byte("v"+key))
+		}
+		tests := []struct {
+			it   Iterator
+			want []string
+		}{
+			{db.NewIterator(), []string{"a", "ab", "abc", "b", "ba", "c"}},
+			{db.NewIteratorWithPrefix([]byte("a")), []string{"a", "ab", "abc"}},
+			{db.NewIteratorWithPrefix([]byte("ab")), []string{"ab", "abc"}},
+			{db.NewIteratorWithPrefix([]byte("d")), nil},
+			{db.NewIteratorWithRange([]byte("ab"), []byte("ba")), []string{"ab", "abc", "b"}},
+			{db.NewIteratorWithRange([]byte("b"), nil), []string{"b", "ba", "c"}},
+			{db.NewIteratorWithRange(nil, []byte("ab")), []string{"a"}},
+		}
+		for i, tt := range tests {
+			var have []string
+			for tt.it.Next() {
+				if want := "v" + string(tt.it.Key()); string(tt.it.Value()) != want {
+					t.Errorf("%s: test %d: value mismatch for %q: have %q, want %q", name, i, tt.it.Key(), tt.it.Value(), want)
+				}
+				have = append(have, string(tt.it.Key()))
+			}
+			if err := tt.it.Error(); err != nil {
+				t.Errorf("%s: test %d: iteration failed: %v", name, i, err)
+			}
+			tt.it.Release()
+
+			if !reflect.DeepEqual(have, tt.want) {
+				t.Errorf("%s: test %d: keys mismatch: have %q, want %q", name, i, have, tt.want)
+			}
+		}
+	}
+}
+
+// Tests that existence checks, range deletions and batched deletions are
+// applied correctly.
+func TestDeletions(t *testing.T) {
+	dbs, cleanup := testDatabases()
+	defer cleanup()
+
+	for name, db := range dbs {
+		for i := byte(0); i < 10; i++ {
+			db.Put([]byte{i}, []byte{i})
+		}
+		if err := db.DeleteRange([]byte{2}, []byte{5}); err != nil {
+			t.Fatalf("%s: failed to delete range: %v", name, err)
+		}
+		batch := db.NewBatch()
+		batch.Put([]byte{10}, []byte{10, 10})
+		batch.Delete([]byte{7})
+		if size := batch.ValueSize(); size != 3 {
+			t.Errorf("%s: batch size mismatch: have %d, want 3", name, size)
+		}
+		if err := batch.Write(); err != nil {
+			t.Fatalf("%s: failed to write batch: %v", name, err)
+		}
+		batch.Reset()
+		if size := batch.ValueSize(); size != 0 {
+			t.Errorf("%s: reset batch size mismatch: have %d, want 0", name, size)
+		}
+		for i := byte(0); i <= 10; i++ {
+			want := i != 2 && i != 3 && i != 4 && i != 7
+			if has, err := db.Has([]byte{i}); has != want || err != nil {
+				t.Errorf("%s: key %d existence mismatch: have %v (%v), want %v", name, i, has, err, want)
+			}
+		}
+	}
+}
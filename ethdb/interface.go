@@ -16,15 +16,114 @@
 
 package ethdb
 
-type Database interface {
+// IdealBatchSize is the amount of data a batch should accumulate before being
+// written out, balancing memory use against write amplification.
+const IdealBatchSize = 100 * 1024
+
+// Putter wraps the database write operation supported by both batches and regular databases.
+type Putter interface {
 	Put(key []byte, value []byte) error
-	Get(key []byte) ([]byte, error)
+}
+
+// Deleter wraps the database delete operation supported by both batches and regular databases.
+type Deleter interface {
 	Delete(key []byte) error
+}
+
+// Database wraps all database operations. All methods are safe for concurrent use.
+type Database interface {
+	Putter
+	Deleter
+	Iteratee
+	Get(key []byte) ([]byte, error)
+	Has(key []byte) (bool, error)
 	Close()
 	NewBatch() Batch
+
+	// DeleteRange removes all the keys in the range [start, limit). A nil
+	// start or limit leaves the range open on that side.
+	DeleteRange(start, limit []byte) error
+
+	// Compact flattens the underlying storage for the range [start, limit),
+	// discarding deleted and overwritten data. A nil start or limit leaves
+	// the range open on that side.
+	Compact(start, limit []byte) error
+
+	// Stat returns a particular internal statistic of the database.
+	Stat(property string) (string, error)
 }
 
+// Batch is a write-only database that commits changes to its host database
+// when Write is called. Batches cannot be used concurrently.
 type Batch interface {
-	Put(key, value []byte) error
+	Putter
+	Deleter
+	ValueSize() int // amount of data in the batch
 	Write() error
+	// Reset resets the batch for reuse
+	Reset()
+}
+
+// Iterator iterates over the key/value pairs of a database in ascending key
+// order. The key and value slices are only valid until the next call to Next.
+// An iterator must be released after use.
+type Iterator interface {
+	// Next moves the iterator to the next key/value pair, returning whether
+	// the iterator is exhausted.
+	Next() bool
+
+	// Error returns any accumulated error. Exhausting all the key/value pairs
+	// is not considered to be an error.
+	Error() error
+
+	// Key returns the key of the current key/value pair, or nil if done.
+	Key() []byte
+
+	// Value returns the value of the current key/value pair, or nil if done.
+	Value() []byte
+
+	// Release releases associated resources.
+	Release()
+}
+
+// Iteratee wraps the creation of iterators over the content of a database.
+type Iteratee interface {
+	// NewIterator creates an iterator over the entire key space of the database.
+	NewIterator() Iterator
+
+	// NewIteratorWithPrefix creates an iterator over the keys starting with a
+	// particular prefix.
+	NewIteratorWithPrefix(prefix []byte) Iterator
+
+	// NewIteratorWithRange creates an iterator over the keys in the range
+	// [start, limit). A nil start or limit leaves the range open on that side.
+	NewIteratorWithRange(start, limit []byte) Iterator
+}
+
+// AncientReader contains the methods required to read from immutable ancient
+// chain data, keyed by block number.
+type AncientReader interface {
+	// HasAncient returns an indicator whether the specified data exists in the
+	// ancient store.
+	HasAncient(kind string, number uint64) (bool, error)
+
+	// Ancient retrieves an ancient binary blob from the append-only immutable files.
+	Ancient(kind string, number uint64) ([]byte, error)
+
+	// Ancients returns the number of items stored in the ancient store.
+	Ancients() (uint64, error)
+}
+
+// AncientWriter contains the methods required to write to immutable ancient
+// chain data.
+type AncientWriter interface {
+	// AppendAncient injects all binary blobs belonging to a block at the end of
+	// the append-only immutable table files.
+	AppendAncient(number uint64, hash, header, body, receipts, td []byte) error
+
+	// TruncateAncients discards all but the first n ancient items.
+	TruncateAncients(n uint64) error
+
+	// Sync flushes all in-memory ancient store data to disk.
+	Sync() error
 }
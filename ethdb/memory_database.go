@@ -17,7 +17,10 @@
 package ethdb
 
 import (
+	"bytes"
 	"errors"
+	"sort"
+	"strconv"
 	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -55,6 +58,14 @@ func (db *MemDatabase) Get(key []byte) ([]byte, error) {
 	return nil, errors.New("not found")
 }
 
+func (db *MemDatabase) Has(key []byte) (bool, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	_, ok := db.db[string(key)]
+	return ok, nil
+}
+
 func (db *MemDatabase) Keys() [][]byte {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
@@ -82,17 +93,140 @@ func (db *MemDatabase) Delete(key []byte) error {
 	return nil
 }
 
+// NewIterator creates an iterator over the entire key space of the database.
+func (db *MemDatabase) NewIterator() Iterator {
+	return db.NewIteratorWithRange(nil, nil)
+}
+
+// NewIteratorWithPrefix creates an iterator over the keys starting with a
+// particular prefix.
+func (db *MemDatabase) NewIteratorWithPrefix(prefix []byte) Iterator {
+	return db.newIterator(func(key []byte) bool {
+		return bytes.HasPrefix(key, prefix)
+	})
+}
+
+// NewIteratorWithRange creates an iterator over the keys in the range
+// [start, limit).
+func (db *MemDatabase) NewIteratorWithRange(start, limit []byte) Iterator {
+	return db.newIterator(func(key []byte) bool {
+		return inRange(key, start, limit)
+	})
+}
+
+// newIterator creates an iterator over a snapshot of the keys accepted by the
+// filter, along with their values.
+func (db *MemDatabase) newIterator(filter func(key []byte) bool) Iterator {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var keys []string
+	for key := range db.db {
+		if filter([]byte(key)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	it := &memIterator{index: -1, keys: make([][]byte, len(keys)), values: make([][]byte, len(keys))}
+	for i, key := range keys {
+		it.keys[i], it.values[i] = []byte(key), db.db[key]
+	}
+	return it
+}
+
+// DeleteRange removes all the keys in the range [start, limit).
+func (db *MemDatabase) DeleteRange(start, limit []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	for key := range db.db {
+		if inRange([]byte(key), start, limit) {
+			delete(db.db, key)
+		}
+	}
+	return nil
+}
+
+// Compact is a no-op, there is nothing to flatten in memory.
+func (db *MemDatabase) Compact(start, limit []byte) error {
+	return nil
+}
+
+// Stat returns a particular internal statistic of the database. The memory
+// database only reports its entry count as "count".
+func (db *MemDatabase) Stat(property string) (string, error) {
+	if property != "count" {
+		return "", errors.New("unknown property")
+	}
+	return strconv.Itoa(db.Len()), nil
+}
+
 func (db *MemDatabase) Close() {}
 
 func (db *MemDatabase) NewBatch() Batch {
 	return &memBatch{db: db}
 }
 
-type kv struct{ k, v []byte }
+func (db *MemDatabase) Len() int {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return len(db.db)
+}
+
+// inRange returns whether a key falls in the range [start, limit), nil bounds
+// leaving the range open on that side.
+func inRange(key, start, limit []byte) bool {
+	return (start == nil || bytes.Compare(key, start) >= 0) && (limit == nil || bytes.Compare(key, limit) < 0)
+}
+
+// memIterator iterates over a sorted snapshot of the memory database content.
+type memIterator struct {
+	index  int
+	keys   [][]byte
+	values [][]byte
+}
+
+func (it *memIterator) Next() bool {
+	if it.index >= len(it.keys) {
+		return false
+	}
+	it.index++
+	return it.index < len(it.keys)
+}
+
+func (it *memIterator) Error() error {
+	return nil
+}
+
+func (it *memIterator) Key() []byte {
+	if it.index < 0 || it.index >= len(it.keys) {
+		return nil
+	}
+	return it.keys[it.index]
+}
+
+func (it *memIterator) Value() []byte {
+	if it.index < 0 || it.index >= len(it.keys) {
+		return nil
+	}
+	return it.values[it.index]
+}
+
+func (it *memIterator) Release() {
+	it.index, it.keys, it.values = len(it.keys), nil, nil
+}
+
+type kv struct {
+	k, v []byte
+	del  bool
+}
 
 type memBatch struct {
 	db     *MemDatabase
 	writes []kv
+	size   int
 	lock   sync.RWMutex
 }
 
@@ -100,7 +234,17 @@ func (b *memBatch) Put(key, value []byte) error {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	b.writes = append(b.writes, kv{common.CopyBytes(key), common.CopyBytes(value)})
+	b.writes = append(b.writes, kv{common.CopyBytes(key), common.CopyBytes(value), false})
+	b.size += len(value)
+	return nil
+}
+
+func (b *memBatch) Delete(key []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.writes = append(b.writes, kv{common.CopyBytes(key), nil, true})
+	b.size++
 	return nil
 }
 
@@ -112,7 +256,26 @@ func (b *memBatch) Write() error {
 	defer b.db.lock.Unlock()
 
 	for _, kv := range b.writes {
+		if kv.del {
+			delete(b.db.db, string(kv.k))
+			continue
+		}
 		b.db.db[string(kv.k)] = kv.v
 	}
 	return nil
 }
+
+func (b *memBatch) ValueSize() int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return b.size
+}
+
+func (b *memBatch) Reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.writes = b.writes[:0]
+	b.size = 0
+}
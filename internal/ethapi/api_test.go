@@ -0,0 +1,76 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethapi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// chainDbBackend is a backend only serving a chain database.
+type chainDbBackend struct {
+	Backend
+	db ethdb.Database
+}
+
+func (b *chainDbBackend) ChainDb() ethdb.Database { return b.db }
+
+// Tests that the chain database debugging methods reach the key-value store
+// wrapped by the freezer.
+func TestChaindbDebugAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chaindb-api-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ldb, err := ethdb.NewLDBDatabase(filepath.Join(dir, "chaindata"), 0, 0)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	db, err := core.NewDatabaseWithFreezer(ldb, filepath.Join(dir, "ancient"), params.ImmutabilityThreshold, false)
+	if err != nil {
+		t.Fatalf("failed to open freezer: %v", err)
+	}
+	defer db.Close()
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("debug", NewPrivateDebugAPI(&chainDbBackend{db: db})); err != nil {
+		t.Fatalf("failed to register API: %v", err)
+	}
+	client := rpc.DialInProc(server)
+	defer client.Close()
+
+	var stats string
+	if err := client.Call(&stats, "debug_chaindbProperty", ""); err != nil {
+		t.Fatalf("failed to retrieve database stats: %v", err)
+	}
+	if !strings.Contains(stats, "Compactions") {
+		t.Errorf("unexpected database stats: %q", stats)
+	}
+	if err := client.Call(nil, "debug_chaindbCompact"); err != nil {
+		t.Fatalf("failed to compact database: %v", err)
+	}
+}
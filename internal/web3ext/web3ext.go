@@ -232,6 +232,12 @@ web3._extend({
 			call: 'debug_dumpBlock',
 			params: 1
 		}),
+		new web3._extend.Method({
+			name: 'accountRange',
+			call: 'debug_accountRange',
+			params: 5,
+			inputFormatter: [web3._extend.formatters.inputBlockNumberFormatter, null, null, null, null]
+		}),
 		new web3._extend.Method({
 			name: 'chaindbProperty',
 			call: 'debug_chaindbProperty',
@@ -334,6 +340,41 @@ web3._extend({
 			params: 2,
 			inputFormatter: [null, null]
 		}),
+		new web3._extend.Method({
+			name: 'debugTransaction',
+			call: 'debug_debugTransaction',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'debugState',
+			call: 'debug_debugState',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'debugStep',
+			call: 'debug_debugStep',
+			params: 2
+		}),
+		new web3._extend.Method({
+			name: 'debugAddBreakpoint',
+			call: 'debug_debugAddBreakpoint',
+			params: 3
+		}),
+		new web3._extend.Method({
+			name: 'debugRemoveBreakpoint',
+			call: 'debug_debugRemoveBreakpoint',
+			params: 2
+		}),
+		new web3._extend.Method({
+			name: 'debugStorage',
+			call: 'debug_debugStorage',
+			params: 2
+		}),
+		new web3._extend.Method({
+			name: 'debugStop',
+			call: 'debug_debugStop',
+			params: 1
+		}),
 		new web3._extend.Method({
 			name: 'preimage',
 			call: 'debug_preimage',
@@ -350,6 +391,12 @@ web3._extend({
 			call: 'debug_storageRangeAt',
 			params: 5,
 		}),
+		new web3._extend.Method({
+			name: 'getStateDiff',
+			call: 'debug_getStateDiff',
+			params: 1,
+			inputFormatter: [web3._extend.formatters.inputBlockNumberFormatter]
+		}),
 	],
 	properties: []
 });
@@ -396,6 +443,12 @@ web3._extend({
 			},
 			params: 2,
 			inputFormatter: [web3._extend.formatters.inputBlockNumberFormatter, web3._extend.utils.toHex]
+		}),
+		new web3._extend.Method({
+			name: 'getProof',
+			call: 'eth_getProof',
+			params: 3,
+			inputFormatter: [web3._extend.formatters.inputAddressFormatter, null, web3._extend.formatters.inputBlockNumberFormatter]
 		})
 	],
 	properties:
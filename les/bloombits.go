@@ -0,0 +1,100 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"context"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/bitutil"
+	"github.com/ethereum/go-ethereum/light"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+const (
+	// bloomServiceThreads is the number of goroutines used globally by a light
+	// client to service bloombits lookups for all running filters.
+	bloomServiceThreads = 4
+
+	// bloomFilterThreads is the number of goroutines used locally per filter to
+	// multiplex requests onto the global servicing goroutines.
+	bloomFilterThreads = 3
+
+	// bloomRetrievalTimeout is the maximum time to wait for the servers to deliver
+	// a bit vector not indexed locally yet.
+	bloomRetrievalTimeout = 10 * time.Second
+)
+
+// startBloomHandlers starts a batch of goroutines to accept bloom bit database
+// retrievals from possibly a range of filters and serving the data to satisfy.
+// The light client indexes the blooms of its own header chain, the sections not
+// indexed yet are requested from the servers.
+func (eth *LightEthereum) startBloomHandlers() {
+	for i := 0; i < bloomServiceThreads; i++ {
+		go func() {
+			for {
+				select {
+				case <-eth.closeBloomHandler:
+					return
+
+				case request := <-eth.bloomRequests:
+					task := <-request
+
+					task.Bitsets = make([][]byte, len(task.Sections))
+					for i, section := range task.Sections {
+						ctx, cancel := context.WithTimeout(context.Background(), bloomRetrievalTimeout)
+						compVector, err := light.GetBloomBits(ctx, eth.odr, task.Bit, section)
+						cancel()
+						if err != nil {
+							task.Error = err
+							break
+						}
+						blob, err := bitutil.DecompressBytes(compVector, int(params.BloomBitsBlocks/8))
+						if err != nil {
+							task.Error = err
+							break
+						}
+						task.Bitsets[i] = blob
+					}
+					request <- task
+				}
+			}
+		}()
+	}
+}
+
+// bloomSections returns the number of bloom bit sections available for filtering,
+// either from the local index or, if a server supporting it is connected, from
+// the network for the sections confirmed in the header chain.
+func (eth *LightEthereum) bloomSections() uint64 {
+	sections, _ := eth.bloomIndexer.Sections()
+
+	head := eth.blockchain.CurrentHeader().Number.Uint64() + 1
+	if head <= params.BloomConfirms {
+		return sections
+	}
+	confirmed := (head - params.BloomConfirms) / params.BloomBitsBlocks
+	if confirmed <= sections {
+		return sections
+	}
+	for _, p := range eth.peers.AllPeers() {
+		if p.version >= lpv2 {
+			return confirmed
+		}
+	}
+	return sections
+}
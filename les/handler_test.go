@@ -342,3 +342,36 @@ func testGetProofs(t *testing.T, protocol int) {
 		t.Errorf("proofs mismatch: %v", err)
 	}
 }
+
+// Tests that bloom bit vectors can be retrieved by section and section head.
+func TestGetBloomBitsLes2(t *testing.T) { testGetBloomBits(t, 2) }
+
+func testGetBloomBits(t *testing.T, protocol int) {
+	// Assemble the test environment
+	db, _ := ethdb.NewMemDatabase()
+	pm := newTestProtocolManagerMust(t, false, 4, testChainGen, nil, nil, db)
+	peer, _ := newTestPeer(t, "peer", protocol, pm, true)
+	defer peer.close()
+
+	// Store a few vectors, requesting them along with missing ones
+	var (
+		head    = common.Hash{0x01}
+		reqs    []BloomReq
+		vectors [][]byte
+	)
+	for bit := uint64(0); bit < 4; bit++ {
+		vector := []byte{byte(bit), 0x01, 0x02}
+		core.WriteBloomBits(db, uint(bit), 1, head, vector)
+
+		reqs = append(reqs, BloomReq{Bit: bit, Section: 1, SectionHead: head})
+		vectors = append(vectors, vector)
+	}
+	reqs = append(reqs, BloomReq{Bit: 0, Section: 2, SectionHead: head}, BloomReq{Bit: 0, Section: 1, SectionHead: common.Hash{0x02}})
+
+	// Send the bloom bits request and verify the response
+	cost := peer.GetRequestCost(GetBloomBitsMsg, len(reqs))
+	sendRequest(peer.app, GetBloomBitsMsg, 42, cost, reqs)
+	if err := expectResponse(peer.app, BloomBitsMsg, 42, testBufLimit, vectors); err != nil {
+		t.Errorf("bloom bits mismatch: %v", err)
+	}
+}
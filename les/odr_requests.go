@@ -24,12 +24,14 @@ import (
 	"fmt"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/bitutil"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/light"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
 )
@@ -64,6 +66,8 @@ func LesRequest(req light.OdrRequest) LesOdrRequest {
 		return (*CodeRequest)(r)
 	case *light.ChtRequest:
 		return (*ChtRequest)(r)
+	case *light.BloomRequest:
+		return (*BloomRequest)(r)
 	default:
 		return nil
 	}
@@ -354,3 +358,64 @@ func (r *ChtRequest) Validate(db ethdb.Database, msg *Msg) error {
 
 	return nil
 }
+
+type BloomReq struct {
+	Bit, Section uint64
+	SectionHead  common.Hash
+}
+
+// ODR request type for bloom bit vectors of the bloom bits index, see LesOdrRequest
+// interface. The vectors can't be verified without the headers of the section,
+// but a server can only hide matches with them, not fabricate any: the potential
+// matches are checked against the headers and the receipts of the blocks.
+type BloomRequest light.BloomRequest
+
+// GetCost returns the cost of the given ODR request according to the serving
+// peer's cost table (implementation of LesOdrRequest)
+func (r *BloomRequest) GetCost(peer *peer) uint64 {
+	return peer.GetRequestCost(GetBloomBitsMsg, 1)
+}
+
+// CanSend tells if a certain peer is suitable for serving the given request
+func (r *BloomRequest) CanSend(peer *peer) bool {
+	if peer.version < lpv2 {
+		return false
+	}
+	peer.lock.RLock()
+	defer peer.lock.RUnlock()
+
+	return peer.headInfo.Number >= (r.Section+1)*params.BloomBitsBlocks-1+params.BloomConfirms
+}
+
+// Request sends an ODR request to the LES network (implementation of LesOdrRequest)
+func (r *BloomRequest) Request(reqID uint64, peer *peer) error {
+	peer.Log().Debug("Requesting bloom bits", "bit", r.Bit, "section", r.Section)
+	req := &BloomReq{
+		Bit:         uint64(r.Bit),
+		Section:     r.Section,
+		SectionHead: r.SectionHead,
+	}
+	return peer.RequestBloomBits(reqID, r.GetCost(peer), []*BloomReq{req})
+}
+
+// Valid processes an ODR request reply message from the LES network
+// returns true and stores results in memory if the message was a valid reply
+// to the request (implementation of LesOdrRequest)
+func (r *BloomRequest) Validate(db ethdb.Database, msg *Msg) error {
+	log.Debug("Validating bloom bits", "bit", r.Bit, "section", r.Section)
+
+	// Ensure we have a correct message with a single bit vector
+	if msg.MsgType != MsgBloomBits {
+		return errInvalidMessageType
+	}
+	vectors := msg.Obj.([][]byte)
+	if len(vectors) != 1 {
+		return errMultipleEntries
+	}
+	// Ensure the vector covers exactly a section
+	if _, err := bitutil.DecompressBytes(vectors[0], int(params.BloomBitsBlocks/8)); err != nil {
+		return fmt.Errorf("invalid bloom bits: %v", err)
+	}
+	r.BloomBits = vectors[0]
+	return nil
+}
@@ -17,15 +17,18 @@
 package les
 
 import (
+	"bytes"
 	"context"
 	"testing"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/bitutil"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/light"
+	"github.com/ethereum/go-ethereum/params"
 )
 
 var testBankSecureTrieKey = secAddr(testBankAddress)
@@ -122,3 +125,60 @@ func testAccess(t *testing.T, protocol int, fn accessTestFn) {
 	// expect all retrievals to pass
 	test(5)
 }
+
+// Tests that the bloom bit vectors are retrieved from the servers which confirmed
+// their sections, and stored locally.
+func TestBloomBitsAccessLes2(t *testing.T) {
+	// Assemble the test environment
+	peers := newPeerSet()
+	dist := newRequestDistributor(peers, make(chan struct{}))
+	rm := newRetrieveManager(peers, dist, nil)
+	db, _ := ethdb.NewMemDatabase()
+	ldb, _ := ethdb.NewMemDatabase()
+	odr := NewLesOdr(ldb, rm)
+
+	pm := newTestProtocolManagerMust(t, false, 4, testChainGen, nil, nil, db)
+	lpm := newTestProtocolManagerMust(t, true, 0, nil, peers, odr, ldb)
+	_, err1, lpeer, err2 := newTestPeerPair("peer", 2, pm, lpm)
+	select {
+	case <-time.After(time.Millisecond * 100):
+	case err := <-err1:
+		t.Fatalf("peer 1 handshake error: %v", err)
+	case err := <-err2:
+		t.Fatalf("peer 1 handshake error: %v", err)
+	}
+	bits := make([]byte, params.BloomBitsBlocks/8)
+	bits[10] = 0x20
+	head, vector := common.Hash{0x01}, bitutil.CompressBytes(bits)
+	core.WriteBloomBits(db, 3, 0, head, vector)
+
+	retrieve := func(bit uint) (*light.BloomRequest, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+
+		req := &light.BloomRequest{Bit: bit, Section: 0, SectionHead: head}
+		return req, odr.Retrieve(ctx, req)
+	}
+	// The section isn't confirmed by the server yet
+	if _, err := retrieve(3); err == nil {
+		t.Fatalf("unconfirmed section retrieved")
+	}
+	lpeer.lock.Lock()
+	lpeer.headInfo.Number = params.BloomBitsBlocks - 1 + params.BloomConfirms
+	lpeer.lock.Unlock()
+
+	req, err := retrieve(3)
+	if err != nil {
+		t.Fatalf("failed to retrieve bloom bits: %v", err)
+	}
+	if !bytes.Equal(req.BloomBits, vector) {
+		t.Fatalf("bloom bits mismatch: have %x, want %x", req.BloomBits, vector)
+	}
+	if stored, _ := core.GetBloomBits(ldb, 3, 0, head); !bytes.Equal(stored, vector) {
+		t.Fatalf("stored bloom bits mismatch: have %x, want %x", stored, vector)
+	}
+	// Vectors unknown to the server must fail
+	if _, err := retrieve(4); err == nil {
+		t.Fatalf("missing bloom bits retrieved")
+	}
+}
@@ -157,3 +157,18 @@ func (req *ChtRequest) StoreResult(db ethdb.Database) {
 	core.WriteCanonicalHash(db, hash, num)
 	//storeProof(db, req.Proof)
 }
+
+// BloomRequest is the ODR request type for retrieving the bloom bit vector of a
+// section, identified by the hash of its last block.
+type BloomRequest struct {
+	OdrRequest
+	Bit         uint
+	Section     uint64
+	SectionHead common.Hash
+	BloomBits   []byte // Compressed bit vector
+}
+
+// StoreResult stores the retrieved data in local database
+func (req *BloomRequest) StoreResult(db ethdb.Database) {
+	core.WriteBloomBits(db, req.Bit, req.Section, req.SectionHead, req.BloomBits)
+}
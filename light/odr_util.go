@@ -27,6 +27,7 @@ import (
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/rlp"
 )
 
@@ -150,15 +151,40 @@ func GetBlock(ctx context.Context, odr OdrBackend, hash common.Hash, number uint
 }
 
 // GetBlockReceipts retrieves the receipts generated by the transactions included
-// in a block given by its hash.
+// in a block given by its hash, along with the fields derived from the block.
 func GetBlockReceipts(ctx context.Context, odr OdrBackend, hash common.Hash, number uint64) (types.Receipts, error) {
-	receipts := core.GetBlockReceipts(odr.Database(), hash, number)
-	if receipts != nil {
-		return receipts, nil
+	receipts := core.GetRawBlockReceipts(odr.Database(), hash, number)
+	if receipts == nil {
+		r := &ReceiptsRequest{Hash: hash, Number: number}
+		if err := odr.Retrieve(ctx, r); err != nil {
+			return nil, err
+		}
+		receipts = r.Receipts
+	}
+	// Fill in the fields derivable from the block
+	body, err := GetBody(ctx, odr, hash, number)
+	if err != nil {
+		return nil, err
+	}
+	if err := core.DeriveReceiptsData(hash, number, body.Transactions, receipts); err != nil {
+		return nil, err
+	}
+	return receipts, nil
+}
+
+// GetBloomBits retrieves the compressed bloom bit vector of a canonical chain
+// section from the local index, or from the network if it's not indexed yet.
+func GetBloomBits(ctx context.Context, odr OdrBackend, bit uint, section uint64) ([]byte, error) {
+	head, err := GetCanonicalHash(ctx, odr, (section+1)*params.BloomBitsBlocks-1)
+	if err != nil {
+		return nil, err
+	}
+	if bits, err := core.GetBloomBits(odr.Database(), bit, section, head); err == nil {
+		return bits, nil
 	}
-	r := &ReceiptsRequest{Hash: hash, Number: number}
+	r := &BloomRequest{Bit: bit, Section: section, SectionHead: head}
 	if err := odr.Retrieve(ctx, r); err != nil {
 		return nil, err
 	}
-	return r.Receipts, nil
+	return r.BloomBits, nil
 }
@@ -24,6 +24,7 @@ import (
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
 )
 
@@ -64,6 +65,11 @@ func (db *odrDatabase) CopyTrie(t state.Trie) state.Trie {
 	}
 }
 
+// TrieDB returns nil, as light client states are never committed.
+func (db *odrDatabase) TrieDB() *trie.NodeDatabase {
+	return nil
+}
+
 func (db *odrDatabase) ContractCode(addrHash, codeHash common.Hash) ([]byte, error) {
 	if codeHash == sha3_nil {
 		return nil, nil
@@ -113,6 +119,16 @@ func (t *odrTrie) TryDelete(key []byte) error {
 	})
 }
 
+func (t *odrTrie) TryProve(key []byte) ([]rlp.RawValue, error) {
+	key = crypto.Keccak256(key)
+	var proof []rlp.RawValue
+	err := t.do(key, func() (err error) {
+		proof, err = t.trie.TryProve(key)
+		return err
+	})
+	return proof, err
+}
+
 func (t *odrTrie) CommitTo(db trie.DatabaseWriter) (common.Hash, error) {
 	if t.trie == nil {
 		return t.id.Root, nil
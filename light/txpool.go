@@ -193,6 +193,8 @@ func (pool *TxPool) checkMinedTxs(ctx context.Context, hash common.Hash, idx uin
 		//fmt.Println(" txHash:", txHash)
 		if tx, ok := pool.pending[txHash]; ok {
 			//fmt.Println("TX FOUND")
+			// Retrieve the receipts of the block, making them available locally
+			// to the receipt lookups of the mined transactions
 			if receipts == nil {
 				receipts, err = GetBlockReceipts(ctx, pool.odr, hash, idx)
 				if err != nil {
@@ -201,10 +203,7 @@ func (pool *TxPool) checkMinedTxs(ctx context.Context, hash common.Hash, idx uin
 				if len(receipts) != len(block.Transactions()) {
 					panic(nil) // should never happen if hashes did match
 				}
-				core.SetReceiptsData(pool.config, block, receipts)
 			}
-			//fmt.Println("WriteReceipt", receipts[i].TxHash)
-			core.WriteReceipt(pool.chainDb, receipts[i])
 			pool.storeTxBlockData(txHash, txBlockData{hash, idx, uint64(i)})
 			delete(pool.pending, txHash)
 			list = append(list, tx)
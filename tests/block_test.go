@@ -20,6 +20,7 @@ import (
 	"math/big"
 	"testing"
 
+	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/params"
 )
 
@@ -74,7 +75,8 @@ func TestBlockchain(t *testing.T) {
 
 	bt.walk(t, blockTestDir, func(t *testing.T, name string, test *BlockTest) {
 		cfg := bt.findConfig(name)
-		if err := bt.checkFailure(t, name, test.Run(cfg)); err != nil {
+		_, err := test.Run(cfg, vm.Config{})
+		if err := bt.checkFailure(t, name, err); err != nil {
 			t.Error(err)
 		}
 	})
@@ -53,6 +53,7 @@ type btJSON struct {
 	Pre       core.GenesisAlloc     `json:"pre"`
 	Post      core.GenesisAlloc     `json:"postState"`
 	BestBlock common.UnprefixedHash `json:"lastblockhash"`
+	Network   string                `json:"network"`
 }
 
 type btBlock struct {
@@ -91,42 +92,62 @@ type btHeaderMarshaling struct {
 	Timestamp  *math.HexOrDecimal256
 }
 
-func (t *BlockTest) Run(config *params.ChainConfig) error {
+// Run imports the blocks of the test into a fresh chain and validates the
+// result. The state root of the resulting chain head is returned even if the
+// validation fails.
+func (t *BlockTest) Run(config *params.ChainConfig, vmconfig vm.Config) (common.Hash, error) {
 	// import pre accounts & construct test genesis block & state root
 	db, _ := ethdb.NewMemDatabase()
 	gblock, err := t.genesis(config).Commit(db)
 	if err != nil {
-		return err
+		return common.Hash{}, err
 	}
 	if gblock.Hash() != t.json.Genesis.Hash {
-		return fmt.Errorf("genesis block hash doesn't match test: computed=%x, test=%x\n", gblock.Hash().Bytes()[:6], t.json.Genesis.Hash[:6])
+		return gblock.Root(), fmt.Errorf("genesis block hash doesn't match test: computed=%x, test=%x\n", gblock.Hash().Bytes()[:6], t.json.Genesis.Hash[:6])
 	}
 	if gblock.Root() != t.json.Genesis.StateRoot {
-		return fmt.Errorf("genesis block state root does not match test: computed=%x, test=%x", gblock.Root().Bytes()[:6], t.json.Genesis.StateRoot[:6])
+		return gblock.Root(), fmt.Errorf("genesis block state root does not match test: computed=%x, test=%x", gblock.Root().Bytes()[:6], t.json.Genesis.StateRoot[:6])
 	}
 
-	chain, err := core.NewBlockChain(db, config, ethash.NewShared(), new(event.TypeMux), vm.Config{})
+	chain, err := core.NewBlockChain(db, nil, config, ethash.NewShared(), new(event.TypeMux), vmconfig)
 	if err != nil {
-		return err
+		return gblock.Root(), err
 	}
 	defer chain.Stop()
 
 	validBlocks, err := t.insertBlocks(chain)
 	if err != nil {
-		return err
+		return chain.CurrentBlock().Root(), err
 	}
 	cmlast := chain.LastBlockHash()
 	if common.Hash(t.json.BestBlock) != cmlast {
-		return fmt.Errorf("last block hash validation mismatch: want: %x, have: %x", t.json.BestBlock, cmlast)
+		return chain.CurrentBlock().Root(), fmt.Errorf("last block hash validation mismatch: want: %x, have: %x", t.json.BestBlock, cmlast)
 	}
 	newDB, err := chain.State()
 	if err != nil {
-		return err
+		return chain.CurrentBlock().Root(), err
 	}
 	if err = t.validatePostState(newDB); err != nil {
-		return fmt.Errorf("post state validation failed: %v", err)
+		return chain.CurrentBlock().Root(), fmt.Errorf("post state validation failed: %v", err)
 	}
-	return t.validateImportedHeaders(chain, validBlocks)
+	return chain.CurrentBlock().Root(), t.validateImportedHeaders(chain, validBlocks)
+}
+
+// Network returns the name of the fork the test was generated for, if the
+// test specifies it.
+func (t *BlockTest) Network() string {
+	return t.json.Network
+}
+
+// ExpectedRoot returns the state root of the block the test is expected to
+// end up with as the chain head.
+func (t *BlockTest) ExpectedRoot() common.Hash {
+	for _, b := range t.json.Blocks {
+		if b.BlockHeader != nil && b.BlockHeader.Hash == common.Hash(t.json.BestBlock) {
+			return b.BlockHeader.StateRoot
+		}
+	}
+	return t.json.Genesis.StateRoot
 }
 
 func (t *BlockTest) genesis(config *params.ChainConfig) *core.Genesis {
@@ -37,8 +37,8 @@ import (
 	"github.com/ethereum/go-ethereum/params"
 )
 
-// This table defines supported forks and their chain config.
-var stateTestForks = map[string]*params.ChainConfig{
+// Forks table defines supported forks and their chain config.
+var Forks = map[string]*params.ChainConfig{
 	"Frontier": &params.ChainConfig{
 		ChainId: big.NewInt(1),
 	},
@@ -165,11 +165,12 @@ func (t *StateTest) Subtests() []StateSubtest {
 	return sub
 }
 
-// Run executes a specific subtest.
-func (t *StateTest) Run(subtest StateSubtest, vmconfig vm.Config) error {
-	config, ok := stateTestForks[subtest.Fork]
+// Run executes a specific subtest. The resulting state is committed and returned
+// even if it doesn't match the expected one.
+func (t *StateTest) Run(subtest StateSubtest, vmconfig vm.Config) (*state.StateDB, error) {
+	config, ok := Forks[subtest.Fork]
 	if !ok {
-		return fmt.Errorf("no config for fork %q", subtest.Fork)
+		return nil, fmt.Errorf("no config for fork %q", subtest.Fork)
 	}
 	block, _ := t.genesis(config).ToBlock()
 	db, _ := ethdb.NewMemDatabase()
@@ -178,7 +179,7 @@ func (t *StateTest) Run(subtest StateSubtest, vmconfig vm.Config) error {
 	post := t.json.Post[subtest.Fork][subtest.Index]
 	msg, err := t.json.Tx.toMessage(post)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	context := core.NewEVMContext(msg, block.Header(), nil, &t.json.Env.Coinbase)
 	context.GetHash = vmTestBlockHash
@@ -190,16 +191,22 @@ func (t *StateTest) Run(subtest StateSubtest, vmconfig vm.Config) error {
 	if _, _, err := core.ApplyMessage(evm, msg, gaspool); err != nil {
 		statedb.RevertToSnapshot(snapshot)
 	}
+	// Commit before validating, so the returned state is final on any failure
+	root, _ := statedb.CommitTo(db, config.IsEIP158(block.Number()))
 	if post.Logs != nil {
 		if err := checkLogs(statedb.Logs(), *post.Logs); err != nil {
-			return err
+			return statedb, err
 		}
 	}
-	root, _ := statedb.CommitTo(db, config.IsEIP158(block.Number()))
 	if root != common.Hash(post.Root) {
-		return fmt.Errorf("post state root mismatch: got %x, want %x", root, post.Root)
+		return statedb, fmt.Errorf("post state root mismatch: got %x, want %x", root, post.Root)
 	}
-	return nil
+	return statedb, nil
+}
+
+// ExpectedRoot returns the post state root the subtest is expected to produce.
+func (t *StateTest) ExpectedRoot(subtest StateSubtest) common.Hash {
+	return common.Hash(t.json.Post[subtest.Fork][subtest.Index].Root)
 }
 
 func (t *StateTest) gasLimit(subtest StateSubtest) uint64 {
@@ -0,0 +1,410 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// LeafReferences extracts the hashes of the objects a trie leaf refers to, such
+// as the storage trie root and the code of an account. The referenced objects
+// are kept in memory as long as the leaf is.
+type LeafReferences func(value []byte) []common.Hash
+
+// NodeDatabase is an intermediate write layer between the trie data structures
+// and the disk database. Committed trie nodes are accumulated in memory, where
+// they are reference counted, so that tries which are no longer needed can be
+// dropped without ever touching the disk.
+//
+// Nodes are only written to disk when a trie is explicitly committed, or when
+// the memory allowance is exceeded, in which case the oldest nodes are flushed.
+// As children are always inserted before their parents, the disk never holds
+// a node whose children are missing.
+//
+// Keys which aren't node hashes (e.g. the preimages of secure tries) are held
+// until the next flush, but are never garbage collected.
+type NodeDatabase struct {
+	diskdb ethdb.Database // Persistent storage for matured trie nodes
+	onleaf LeafReferences // Extractor of the references held by leaves
+
+	nodes  map[common.Hash]*cachedNode // Cached nodes, along with the pinned roots under the zero hash
+	oldest common.Hash                 // Oldest cached node, first to be flushed
+	newest common.Hash                 // Newest cached node, last to be flushed
+
+	preimages map[string][]byte // Non-node entries waiting to be flushed
+
+	nodesSize     common.StorageSize // Storage size of the cached nodes
+	preimagesSize common.StorageSize // Storage size of the preimages
+
+	gcnodes    uint64             // Nodes garbage collected since the last commit
+	gcsize     common.StorageSize // Data storage garbage collected since the last commit
+	flushnodes uint64             // Nodes flushed since the last commit
+	flushsize  common.StorageSize // Data storage flushed since the last commit
+
+	lock sync.RWMutex
+}
+
+// cachedNode is a trie node held in memory along with its reference counts.
+type cachedNode struct {
+	blob     []byte              // Encoded node
+	parents  int                 // Number of live nodes (or pins) referencing this one
+	children map[common.Hash]int // Cached children and the number of times they are referenced
+
+	flushPrev common.Hash // Previous node in the flush order
+	flushNext common.Hash // Next node in the flush order
+}
+
+// size returns the storage size the node accounts for.
+func (n *cachedNode) size() common.StorageSize {
+	return common.StorageSize(common.HashLength + len(n.blob))
+}
+
+// NewNodeDatabase creates a node database on top of a persistent store. The
+// onleaf callback, if not nil, is used to link the leaves of the tries to the
+// objects they refer to.
+func NewNodeDatabase(diskdb ethdb.Database, onleaf LeafReferences) *NodeDatabase {
+	return &NodeDatabase{
+		diskdb: diskdb,
+		onleaf: onleaf,
+		nodes: map[common.Hash]*cachedNode{
+			{}: {children: make(map[common.Hash]int)},
+		},
+		preimages: make(map[string][]byte),
+	}
+}
+
+// DiskDB retrieves the persistent storage backing the node database.
+func (db *NodeDatabase) DiskDB() ethdb.Database {
+	return db.diskdb
+}
+
+// Node retrieves a node by its hash from memory, falling back to the disk.
+func (db *NodeDatabase) Node(hash common.Hash) ([]byte, error) {
+	db.lock.RLock()
+	node := db.nodes[hash]
+	db.lock.RUnlock()
+
+	if node != nil && hash != (common.Hash{}) {
+		return node.blob, nil
+	}
+	return db.diskdb.Get(hash[:])
+}
+
+// Get retrieves a node or preimage from memory, falling back to the disk.
+func (db *NodeDatabase) Get(key []byte) ([]byte, error) {
+	if len(key) == common.HashLength {
+		return db.Node(common.BytesToHash(key))
+	}
+	db.lock.RLock()
+	blob, ok := db.preimages[string(key)]
+	db.lock.RUnlock()
+
+	if ok {
+		return blob, nil
+	}
+	return db.diskdb.Get(key)
+}
+
+// Put inserts a node into memory, referencing all its cached children. Keys
+// which aren't hashes are stored as preimages.
+func (db *NodeDatabase) Put(key, value []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if len(key) != common.HashLength {
+		if _, ok := db.preimages[string(key)]; !ok {
+			db.preimages[string(key)] = common.CopyBytes(value)
+			db.preimagesSize += common.StorageSize(len(key) + len(value))
+		}
+		return nil
+	}
+	hash := common.BytesToHash(key)
+	if _, ok := db.nodes[hash]; ok {
+		return nil
+	}
+	node := &cachedNode{
+		blob:      common.CopyBytes(value),
+		children:  make(map[common.Hash]int),
+		flushPrev: db.newest,
+	}
+	// Reference the children which are still in memory, the others being
+	// safely on disk already
+	if n, err := decodeNode(key, value, 0); err == nil {
+		for _, child := range db.references(n, nil) {
+			if cached, ok := db.nodes[child]; ok && child != (common.Hash{}) {
+				cached.parents++
+				node.children[child]++
+			}
+		}
+	}
+	db.nodes[hash] = node
+
+	// Append the node to the flush order
+	if db.oldest == (common.Hash{}) {
+		db.oldest = hash
+	} else {
+		db.nodes[db.newest].flushNext = hash
+	}
+	db.newest = hash
+	db.nodesSize += node.size()
+
+	return nil
+}
+
+// references collects the hashes a decoded node refers to, including the
+// objects referenced by its leaves.
+func (db *NodeDatabase) references(n node, refs []common.Hash) []common.Hash {
+	switch n := n.(type) {
+	case *shortNode:
+		return db.references(n.Val, refs)
+	case *fullNode:
+		for _, child := range n.Children {
+			if child != nil {
+				refs = db.references(child, refs)
+			}
+		}
+	case hashNode:
+		refs = append(refs, common.BytesToHash(n))
+	case valueNode:
+		if db.onleaf != nil {
+			refs = append(refs, db.onleaf(n)...)
+		}
+	}
+	return refs
+}
+
+// Reference pins a trie root in memory, preventing it and its descendants
+// from being garbage collected until it is dereferenced. Roots which aren't
+// cached are already on disk and are ignored.
+func (db *NodeDatabase) Reference(root common.Hash) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	node, ok := db.nodes[root]
+	if !ok || root == (common.Hash{}) {
+		return
+	}
+	node.parents++
+	db.nodes[common.Hash{}].children[root]++
+}
+
+// Dereference unpins a trie root, dropping from memory all the nodes which
+// are no longer referenced.
+func (db *NodeDatabase) Dereference(root common.Hash) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	pins := db.nodes[common.Hash{}].children
+	if pins[root] == 0 {
+		return
+	}
+	if pins[root]--; pins[root] == 0 {
+		delete(pins, root)
+	}
+	nodes, size, start := len(db.nodes), db.nodesSize, time.Now()
+	db.dereference(root, 1)
+
+	db.gcnodes += uint64(nodes - len(db.nodes))
+	db.gcsize += size - db.nodesSize
+
+	log.Debug("Dereferenced trie from memory database", "nodes", nodes-len(db.nodes), "size", size-db.nodesSize, "time", time.Since(start),
+		"gcnodes", db.gcnodes, "gcsize", db.gcsize, "livenodes", len(db.nodes)-1, "livesize", db.nodesSize)
+}
+
+// dereference drops count references to a node, deleting it along with its
+// children if no references are left.
+func (db *NodeDatabase) dereference(hash common.Hash, count int) {
+	node, ok := db.nodes[hash]
+	if !ok {
+		return
+	}
+	// Nodes flushed and reinserted may lose references they never got, they
+	// are safely on disk though
+	if node.parents -= count; node.parents > 0 {
+		return
+	}
+	db.unlink(hash, node)
+	delete(db.nodes, hash)
+	db.nodesSize -= node.size()
+
+	for child, refs := range node.children {
+		db.dereference(child, refs)
+	}
+}
+
+// unlink removes a node from the flush order.
+func (db *NodeDatabase) unlink(hash common.Hash, node *cachedNode) {
+	if node.flushPrev == (common.Hash{}) {
+		db.oldest = node.flushNext
+	} else {
+		db.nodes[node.flushPrev].flushNext = node.flushNext
+	}
+	if node.flushNext == (common.Hash{}) {
+		db.newest = node.flushPrev
+	} else {
+		db.nodes[node.flushNext].flushPrev = node.flushPrev
+	}
+}
+
+// Commit writes the trie rooted at the given hash from memory to disk, along
+// with all the pending preimages, dropping the written nodes from memory.
+func (db *NodeDatabase) Commit(root common.Hash) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	start := time.Now()
+	batch := db.diskdb.NewBatch()
+	for key, value := range db.preimages {
+		if err := batch.Put([]byte(key), value); err != nil {
+			return err
+		}
+	}
+	if err := db.commit(root, batch); err != nil {
+		return err
+	}
+	if err := batch.Write(); err != nil {
+		log.Error("Failed to write trie to disk", "err", err)
+		return err
+	}
+	db.preimages, db.preimagesSize = make(map[string][]byte), 0
+
+	nodes, size := len(db.nodes), db.nodesSize
+	db.uncache(root)
+
+	log.Debug("Persisted trie from memory database", "nodes", nodes-len(db.nodes)+int(db.flushnodes), "size", size-db.nodesSize+db.flushsize, "time", time.Since(start),
+		"gcnodes", db.gcnodes, "gcsize", db.gcsize, "livenodes", len(db.nodes)-1, "livesize", db.nodesSize)
+
+	db.gcnodes, db.gcsize, db.flushnodes, db.flushsize = 0, 0, 0, 0
+	return nil
+}
+
+// commit writes a cached node to the batch after all its cached children.
+func (db *NodeDatabase) commit(hash common.Hash, batch ethdb.Batch) error {
+	node, ok := db.nodes[hash]
+	if !ok || hash == (common.Hash{}) {
+		return nil
+	}
+	for child := range node.children {
+		if err := db.commit(child, batch); err != nil {
+			return err
+		}
+	}
+	return batch.Put(hash[:], node.blob)
+}
+
+// uncache drops a persisted node and its cached children from memory.
+// References to them from other nodes are left dangling, which is harmless as
+// the nodes can be loaded from disk.
+func (db *NodeDatabase) uncache(hash common.Hash) {
+	node, ok := db.nodes[hash]
+	if !ok || hash == (common.Hash{}) {
+		return
+	}
+	db.unlink(hash, node)
+	delete(db.nodes, hash)
+	db.nodesSize -= node.size()
+
+	for child := range node.children {
+		db.uncache(child)
+	}
+}
+
+// Cap flushes the oldest nodes to disk, along with all the pending preimages,
+// until the memory held by the database drops below the given limit.
+func (db *NodeDatabase) Cap(limit common.StorageSize) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	nodes, size, start := len(db.nodes), db.nodesSize, time.Now()
+	batch := db.diskdb.NewBatch()
+
+	for key, value := range db.preimages {
+		if err := batch.Put([]byte(key), value); err != nil {
+			return err
+		}
+	}
+	remaining, next := db.nodesSize, db.oldest
+	for remaining > limit && next != (common.Hash{}) {
+		node := db.nodes[next]
+		if err := batch.Put(next[:], node.blob); err != nil {
+			return err
+		}
+		remaining -= node.size()
+		next = node.flushNext
+	}
+	if err := batch.Write(); err != nil {
+		log.Error("Failed to write flush list to disk", "err", err)
+		return err
+	}
+	db.preimages, db.preimagesSize = make(map[string][]byte), 0
+
+	for db.oldest != next {
+		hash := db.oldest
+		node := db.nodes[hash]
+		db.unlink(hash, node)
+		delete(db.nodes, hash)
+		db.nodesSize -= node.size()
+	}
+	db.flushnodes += uint64(nodes - len(db.nodes))
+	db.flushsize += size - db.nodesSize
+
+	log.Debug("Flushed trie nodes from memory database", "nodes", nodes-len(db.nodes), "size", size-db.nodesSize, "time", time.Since(start),
+		"flushnodes", db.flushnodes, "flushsize", db.flushsize, "livenodes", len(db.nodes)-1, "livesize", db.nodesSize)
+
+	return nil
+}
+
+// Size returns the current storage size of the memory cache in front of the
+// persistent database layer.
+func (db *NodeDatabase) Size() common.StorageSize {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.nodesSize + db.preimagesSize
+}
+
+// NodesSize returns the storage size of the trie nodes held in memory, without
+// the pending preimages.
+func (db *NodeDatabase) NodesSize() common.StorageSize {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.nodesSize
+}
+
+// DropPreimages discards the pending preimages without writing them to disk.
+// It is meant for databases which are never persisted, where the preimages
+// would otherwise accumulate forever.
+func (db *NodeDatabase) DropPreimages() {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.preimages, db.preimagesSize = make(map[string][]byte), 0
+}
+
+// Nodes returns the number of trie nodes held in memory.
+func (db *NodeDatabase) Nodes() int {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return len(db.nodes) - 1
+}
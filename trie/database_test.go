@@ -0,0 +1,175 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// makeNodeDatabaseTries commits two versions of a trie to a node database,
+// the second one sharing most of its nodes with the first.
+func makeNodeDatabaseTries(t *testing.T, db *NodeDatabase) (common.Hash, common.Hash) {
+	trie, _ := New(common.Hash{}, db)
+	for i := 0; i < 100; i++ {
+		trie.Update([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%064d", i)))
+	}
+	root1, err := trie.CommitTo(db)
+	if err != nil {
+		t.Fatalf("failed to commit trie: %v", err)
+	}
+	trie.Update([]byte("key-000"), []byte("changed"))
+	root2, err := trie.CommitTo(db)
+	if err != nil {
+		t.Fatalf("failed to commit trie: %v", err)
+	}
+	return root1, root2
+}
+
+// checkTrie verifies that a trie can be fully iterated.
+func checkTrie(db Database, root common.Hash) error {
+	trie, err := New(root, db)
+	if err != nil {
+		return err
+	}
+	it := NewIterator(trie.NodeIterator(nil))
+	for it.Next() {
+	}
+	return it.Err
+}
+
+// Tests that dereferencing a root only drops the nodes it doesn't share with
+// other pinned roots, without touching the disk.
+func TestNodeDatabaseDereference(t *testing.T) {
+	diskdb, _ := ethdb.NewMemDatabase()
+	db := NewNodeDatabase(diskdb, nil)
+
+	root1, root2 := makeNodeDatabaseTries(t, db)
+	db.Reference(root1)
+	db.Reference(root2)
+	nodes := db.Nodes()
+
+	db.Dereference(root1)
+	if db.Nodes() >= nodes || db.Nodes() == 0 {
+		t.Fatalf("node count after dereference mismatch: have %d, want between 0 and %d", db.Nodes(), nodes)
+	}
+	if err := checkTrie(db, root2); err != nil {
+		t.Fatalf("retained trie broken: %v", err)
+	}
+	if err := checkTrie(db, root1); err == nil {
+		t.Fatalf("dereferenced trie still complete")
+	}
+	db.Dereference(root2)
+	if db.Nodes() != 0 || db.Size() != 0 {
+		t.Fatalf("database not empty after dereferencing all roots: %d nodes, %v", db.Nodes(), db.Size())
+	}
+	if len(diskdb.Keys()) != 0 {
+		t.Fatalf("garbage collected nodes written to disk: %d entries", len(diskdb.Keys()))
+	}
+}
+
+// Tests that committing a root persists it fully and drops it from memory,
+// while the other roots remain accessible.
+func TestNodeDatabaseCommit(t *testing.T) {
+	diskdb, _ := ethdb.NewMemDatabase()
+	db := NewNodeDatabase(diskdb, nil)
+
+	root1, root2 := makeNodeDatabaseTries(t, db)
+	db.Reference(root1)
+	db.Reference(root2)
+
+	if err := db.Commit(root1); err != nil {
+		t.Fatalf("failed to commit trie: %v", err)
+	}
+	if err := checkTrie(diskdb, root1); err != nil {
+		t.Fatalf("committed trie broken on disk: %v", err)
+	}
+	if err := checkTrie(db, root2); err != nil {
+		t.Fatalf("retained trie broken: %v", err)
+	}
+	db.Dereference(root1)
+	db.Dereference(root2)
+	if db.Nodes() != 0 {
+		t.Fatalf("database not empty after dereferencing all roots: %d nodes", db.Nodes())
+	}
+	if err := checkTrie(diskdb, root1); err != nil {
+		t.Fatalf("committed trie broken on disk after dereference: %v", err)
+	}
+}
+
+// Tests that capping the memory flushes the oldest nodes, keeping every trie
+// accessible through the database.
+func TestNodeDatabaseCap(t *testing.T) {
+	diskdb, _ := ethdb.NewMemDatabase()
+	db := NewNodeDatabase(diskdb, nil)
+
+	root1, root2 := makeNodeDatabaseTries(t, db)
+	db.Reference(root1)
+	db.Reference(root2)
+
+	limit := db.Size() / 2
+	if err := db.Cap(limit); err != nil {
+		t.Fatalf("failed to cap database: %v", err)
+	}
+	if db.Size() > limit {
+		t.Fatalf("database size above limit: have %v, want at most %v", db.Size(), limit)
+	}
+	for _, root := range []common.Hash{root1, root2} {
+		if err := checkTrie(db, root); err != nil {
+			t.Fatalf("trie %x broken after cap: %v", root, err)
+		}
+	}
+	if err := db.Cap(0); err != nil {
+		t.Fatalf("failed to cap database: %v", err)
+	}
+	for _, root := range []common.Hash{root1, root2} {
+		if err := checkTrie(diskdb, root); err != nil {
+			t.Fatalf("trie %x broken on disk after full flush: %v", root, err)
+		}
+	}
+}
+
+// Tests that objects referenced by leaves live as long as the leaves do.
+func TestNodeDatabaseLeafReferences(t *testing.T) {
+	diskdb, _ := ethdb.NewMemDatabase()
+
+	// Leaves hold the hash of a blob inserted beforehand
+	blob := []byte("referenced blob")
+	blobHash := common.BytesToHash(crypto.Keccak256(blob))
+	db := NewNodeDatabase(diskdb, func(value []byte) []common.Hash {
+		return []common.Hash{common.BytesToHash(value)}
+	})
+	db.Put(blobHash[:], blob)
+
+	trie, _ := New(common.Hash{}, db)
+	trie.Update([]byte("key"), blobHash[:])
+	trie.Update([]byte("other"), make([]byte, 40))
+	root, _ := trie.CommitTo(db)
+
+	db.Reference(root)
+	if blob, _ := db.Get(blobHash[:]); blob == nil {
+		t.Fatalf("referenced blob missing")
+	}
+	db.Dereference(root)
+	if db.Nodes() != 0 {
+		t.Fatalf("referenced blob not garbage collected: %d nodes left", db.Nodes())
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"fmt"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/crypto/sha3"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/rlp"
@@ -37,6 +38,16 @@ import (
 // (at least the root node), ending with the node that proves the
 // absence of the key.
 func (t *Trie) Prove(key []byte) []rlp.RawValue {
+	proof, err := t.TryProve(key)
+	if err != nil {
+		log.Error(fmt.Sprintf("Unhandled trie error: %v", err))
+	}
+	return proof
+}
+
+// TryProve constructs a merkle proof for key, same as Prove. If a node was
+// not found in the database, a MissingNodeError is returned.
+func (t *Trie) TryProve(key []byte) ([]rlp.RawValue, error) {
 	// Collect all nodes on the path to key.
 	key = keybytesToHex(key)
 	nodes := []node{}
@@ -60,8 +71,7 @@ func (t *Trie) Prove(key []byte) []rlp.RawValue {
 			var err error
 			tn, err = t.resolveHash(n, nil)
 			if err != nil {
-				log.Error(fmt.Sprintf("Unhandled trie error: %v", err))
-				return nil
+				return nil, err
 			}
 		default:
 			panic(fmt.Sprintf("%T: invalid node: %v", tn, tn))
@@ -81,7 +91,19 @@ func (t *Trie) Prove(key []byte) []rlp.RawValue {
 			proof = append(proof, enc)
 		}
 	}
-	return proof
+	return proof, nil
+}
+
+// Prove constructs a merkle proof for key, hashing it before looking it up in
+// the underlying trie. Proofs are verified against the hashed key.
+func (t *SecureTrie) Prove(key []byte) []rlp.RawValue {
+	return t.trie.Prove(t.hashKey(key))
+}
+
+// TryProve constructs a merkle proof for key, same as Prove. If a node was
+// not found in the database, a MissingNodeError is returned.
+func (t *SecureTrie) TryProve(key []byte) ([]rlp.RawValue, error) {
+	return t.trie.TryProve(t.hashKey(key))
 }
 
 // VerifyProof checks merkle proofs. The given proof must contain the
@@ -102,7 +124,7 @@ func VerifyProof(rootHash common.Hash, key []byte, proof []rlp.RawValue) (value
 		if err != nil {
 			return nil, fmt.Errorf("bad proof node %d: %v", i, err)
 		}
-		keyrest, cld := get(n, key)
+		keyrest, cld := get(n, key, true)
 		switch cld := cld.(type) {
 		case nil:
 			if i != len(proof)-1 {
@@ -124,7 +146,10 @@ func VerifyProof(rootHash common.Hash, key []byte, proof []rlp.RawValue) (value
 	return nil, errors.New("unexpected end of proof")
 }
 
-func get(tn node, key []byte) ([]byte, node) {
+// get returns the child of tn along key along with the remaining key. If
+// skipResolved is set, already resolved nodes are descended into until a hash,
+// value or missing node is reached, otherwise only a single step is taken.
+func get(tn node, key []byte, skipResolved bool) ([]byte, node) {
 	for {
 		switch n := tn.(type) {
 		case *shortNode:
@@ -133,9 +158,15 @@ func get(tn node, key []byte) ([]byte, node) {
 			}
 			tn = n.Val
 			key = key[len(n.Key):]
+			if !skipResolved {
+				return key, tn
+			}
 		case *fullNode:
 			tn = n.Children[key[0]]
 			key = key[1:]
+			if !skipResolved {
+				return key, tn
+			}
 		case hashNode:
 			return key, n
 		case nil:
@@ -147,3 +178,364 @@ func get(tn node, key []byte) ([]byte, node) {
 		}
 	}
 }
+
+// ProveRange collects all the key/value pairs of the trie between origin and
+// limit (both inclusive) and constructs a merkle proof that they are exactly
+// the content of the trie in that range. The proof consists of the nodes on the
+// paths to the two edge keys, which don't need to exist in the trie. All keys
+// of the trie must be of the same length as the edges.
+func (t *Trie) ProveRange(origin, limit []byte) (keys, values [][]byte, proof []rlp.RawValue, err error) {
+	if bytes.Compare(origin, limit) > 0 {
+		return nil, nil, nil, errors.New("invalid range edges")
+	}
+	it := NewIterator(t.NodeIterator(origin))
+	for it.Next() {
+		if bytes.Compare(it.Key, limit) > 0 {
+			break
+		}
+		keys = append(keys, common.CopyBytes(it.Key))
+		values = append(values, common.CopyBytes(it.Value))
+	}
+	if it.Err != nil {
+		return nil, nil, nil, it.Err
+	}
+	// Merge the two edge proofs, deduplicating the shared nodes
+	if proof, err = t.TryProve(origin); err != nil {
+		return nil, nil, nil, err
+	}
+	last, err := t.TryProve(limit)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	seen := make(map[string]struct{})
+	for _, node := range proof {
+		seen[string(node)] = struct{}{}
+	}
+	for _, node := range last {
+		if _, ok := seen[string(node)]; !ok {
+			proof = append(proof, node)
+		}
+	}
+	return keys, values, proof, nil
+}
+
+// VerifyRangeProof checks that the given key/value pairs are exactly the content
+// of the trie with the given root hash between origin and limit (both inclusive),
+// using the edge proofs produced by ProveRange. The keys must be sorted in
+// ascending order and have the same length as the edges, and none of the values
+// may be empty. The edges don't need to exist in the trie, and the range may be
+// empty.
+//
+// If the proof is empty, the key/value pairs are expected to make up the entire
+// trie, which is checked by rebuilding it.
+func VerifyRangeProof(rootHash common.Hash, origin, limit []byte, keys, values [][]byte, proof []rlp.RawValue) error {
+	if len(keys) != len(values) {
+		return fmt.Errorf("inconsistent proof data, keys: %d, values: %d", len(keys), len(values))
+	}
+	if bytes.Compare(origin, limit) > 0 {
+		return errors.New("invalid range edges")
+	}
+	if len(origin) != len(limit) {
+		return errors.New("inconsistent edge lengths")
+	}
+	for i, key := range keys {
+		if len(key) != len(origin) {
+			return fmt.Errorf("inconsistent key length at %d", i)
+		}
+		if i > 0 && bytes.Compare(keys[i-1], key) >= 0 {
+			return errors.New("range is not monotonically increasing")
+		}
+		if len(values[i]) == 0 {
+			return fmt.Errorf("empty value at %d", i)
+		}
+	}
+	if len(keys) > 0 && (bytes.Compare(keys[0], origin) < 0 || bytes.Compare(keys[len(keys)-1], limit) > 0) {
+		return errors.New("keys outside of the range edges")
+	}
+	// Special case, there are no edge proofs at all, the pairs must be the
+	// entire trie
+	if len(proof) == 0 {
+		tr := &Trie{db: emptyProofDatabase{}}
+		for i, key := range keys {
+			if err := tr.TryUpdate(key, values[i]); err != nil {
+				return err
+			}
+		}
+		if have := tr.Hash(); have != rootHash {
+			return fmt.Errorf("invalid proof, want hash %x, got %x", rootHash, have)
+		}
+		return nil
+	}
+	nodes := make(map[common.Hash][]byte, len(proof))
+	for _, node := range proof {
+		nodes[crypto.Keccak256Hash(node)] = node
+	}
+	// Special case, the two edges are the same, so there are no two distinct
+	// paths to construct. The single key is either proven or disproven.
+	if bytes.Equal(origin, limit) {
+		_, value, err := proofToPath(rootHash, nil, origin, nodes)
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(keys) == 0 && value != nil:
+			return errors.New("more entries available")
+		case len(keys) == 1 && !bytes.Equal(value, values[0]):
+			return errors.New("correct proof but invalid data")
+		}
+		return nil
+	}
+	// Convert the edge proofs to edge trie paths, the second path being merged
+	// into the first one. Proofs of absence are allowed for both edges.
+	root, _, err := proofToPath(rootHash, nil, origin, nodes)
+	if err != nil {
+		return err
+	}
+	if root, _, err = proofToPath(rootHash, root, limit, nodes); err != nil {
+		return err
+	}
+	// Remove all the references inside the range, and refill them from the
+	// given pairs. The rebuilt trie must be the original one.
+	empty, err := unsetInternal(root, origin, limit)
+	if err != nil {
+		return err
+	}
+	tr := &Trie{root: root, db: emptyProofDatabase{}}
+	if empty {
+		tr.root = nil
+	}
+	for i, key := range keys {
+		if err := tr.TryUpdate(key, values[i]); err != nil {
+			return err
+		}
+	}
+	if have := tr.Hash(); have != rootHash {
+		return fmt.Errorf("invalid proof, want hash %x, got %x", rootHash, have)
+	}
+	return nil
+}
+
+// emptyProofDatabase is the node database of the tries rebuilt from range
+// proofs. Any node not contained in the proof is unavailable, and the rebuilt
+// tries are only ever hashed, never committed.
+type emptyProofDatabase struct{}
+
+func (emptyProofDatabase) Get(key []byte) ([]byte, error) {
+	return nil, errors.New("not found")
+}
+
+func (emptyProofDatabase) Put(key, value []byte) error {
+	return errors.New("not supported")
+}
+
+// proofToPath resolves the path to key from the root through the given proof
+// nodes, linking the resolved nodes into the trie rooted at root, which is
+// created if nil. The value of the key is returned if it exists in the trie,
+// but proofs of absence are accepted too.
+func proofToPath(rootHash common.Hash, root node, key []byte, proof map[common.Hash][]byte) (node, []byte, error) {
+	resolve := func(hash hashNode) (node, error) {
+		buf, ok := proof[common.BytesToHash(hash)]
+		if !ok {
+			return nil, fmt.Errorf("proof node %x missing", hash)
+		}
+		n, err := decodeNode(hash, buf, 0)
+		if err != nil {
+			return nil, fmt.Errorf("bad proof node %x: %v", hash, err)
+		}
+		return n, nil
+	}
+	if root == nil {
+		n, err := resolve(rootHash[:])
+		if err != nil {
+			return nil, nil, err
+		}
+		root = n
+	}
+	var (
+		err           error
+		child, parent node
+		keyrest       []byte
+		value         []byte
+	)
+	key, parent = keybytesToHex(key), root
+	for {
+		keyrest, child = get(parent, key, false)
+		switch cld := child.(type) {
+		case nil:
+			// The trie doesn't contain the key, but all the nodes on the way
+			// are resolved, which is enough to prove the range
+			return root, nil, nil
+		case *shortNode, *fullNode:
+			key, parent = keyrest, child // Already resolved
+			continue
+		case hashNode:
+			if child, err = resolve(cld); err != nil {
+				return nil, nil, err
+			}
+		case valueNode:
+			value = cld
+		}
+		// Link the resolved child into its parent
+		switch p := parent.(type) {
+		case *shortNode:
+			p.Val = child
+		case *fullNode:
+			p.Children[key[0]] = child
+		}
+		if value != nil {
+			return root, value, nil
+		}
+		key, parent = keyrest, child
+	}
+}
+
+// unsetInternal removes all the nodes between the paths of the left and right
+// edge keys, to be refilled from the proven range. It returns whether the whole
+// trie is inside the range.
+//
+// The paths are followed down to the point where they fork, which may be a full
+// node with the edges pointing to different children, or a short node not
+// matching one or both of the edges.
+func unsetInternal(n node, left []byte, right []byte) (bool, error) {
+	left, right = keybytesToHex(left), keybytesToHex(right)
+
+	var (
+		pos    = 0
+		parent node
+
+		// Fork indicators: 0 means the edge matches the short node, -1 that the
+		// edge is less and 1 that the edge is greater than the short node key
+		shortForkLeft, shortForkRight int
+	)
+findFork:
+	for {
+		switch rn := n.(type) {
+		case *shortNode:
+			rn.flags = nodeFlag{dirty: true}
+
+			shortForkLeft = compareShortKey(left[pos:], rn.Key)
+			shortForkRight = compareShortKey(right[pos:], rn.Key)
+			if shortForkLeft != 0 || shortForkRight != 0 {
+				break findFork
+			}
+			parent = n
+			n, pos = rn.Val, pos+len(rn.Key)
+
+		case *fullNode:
+			rn.flags = nodeFlag{dirty: true}
+
+			leftnode, rightnode := rn.Children[left[pos]], rn.Children[right[pos]]
+			if leftnode == nil || rightnode == nil || leftnode != rightnode {
+				break findFork
+			}
+			parent = n
+			n, pos = rn.Children[left[pos]], pos+1
+
+		default:
+			return false, fmt.Errorf("invalid edge path at %T", n)
+		}
+	}
+	switch rn := n.(type) {
+	case *shortNode:
+		// The subtrie is entirely outside of the range, nothing to remove
+		if shortForkLeft == shortForkRight {
+			return false, nil
+		}
+		// The subtrie is either entirely inside the range, or it's the leaf of
+		// one of the edges, remove it
+		_, leaf := rn.Val.(valueNode)
+		if (shortForkLeft != 0 && shortForkRight != 0) || leaf {
+			if parent == nil {
+				return true, nil
+			}
+			return false, unsetChild(parent, left[pos-1])
+		}
+		// Only one of the edges runs through the short node
+		if shortForkRight != 0 {
+			return false, unset(rn, rn.Val, left[pos:], len(rn.Key), false)
+		}
+		return false, unset(rn, rn.Val, right[pos:], len(rn.Key), true)
+
+	case *fullNode:
+		// Remove all the children between the edges, and the parts of the edge
+		// children inside the range
+		for i := left[pos] + 1; i < right[pos]; i++ {
+			rn.Children[i] = nil
+		}
+		if err := unset(rn, rn.Children[left[pos]], left[pos:], 1, false); err != nil {
+			return false, err
+		}
+		return false, unset(rn, rn.Children[right[pos]], right[pos:], 1, true)
+
+	default:
+		return false, fmt.Errorf("invalid edge path at %T", n)
+	}
+}
+
+// unset removes all the nodes on one side of an edge path: the left side for the
+// right edge if removeLeft is set, the right side for the left edge otherwise.
+// If the edge doesn't exist in the trie, the subtrie at the fork point is either
+// removed or kept, depending on whether it's inside the range or not.
+func unset(parent node, child node, key []byte, pos int, removeLeft bool) error {
+	switch cld := child.(type) {
+	case *fullNode:
+		if key[pos] >= 16 {
+			return errors.New("invalid edge path")
+		}
+		if removeLeft {
+			for i := 0; i < int(key[pos]); i++ {
+				cld.Children[i] = nil
+			}
+		} else {
+			for i := key[pos] + 1; i < 16; i++ {
+				cld.Children[i] = nil
+			}
+		}
+		cld.flags = nodeFlag{dirty: true}
+		return unset(cld, cld.Children[key[pos]], key, pos+1, removeLeft)
+
+	case *shortNode:
+		if len(key[pos:]) < len(cld.Key) || !bytes.Equal(cld.Key, key[pos:pos+len(cld.Key)]) {
+			// The edge doesn't exist, the subtrie is inside the range if it's
+			// on the inner side of the edge, otherwise it's kept as is
+			cmp := bytes.Compare(cld.Key, key[pos:])
+			if (removeLeft && cmp < 0) || (!removeLeft && cmp > 0) {
+				return unsetChild(parent, key[pos-1])
+			}
+			return nil
+		}
+		// The edge leaf itself is part of the range
+		if _, ok := cld.Val.(valueNode); ok {
+			return unsetChild(parent, key[pos-1])
+		}
+		cld.flags = nodeFlag{dirty: true}
+		return unset(cld, cld.Val, key, pos+len(cld.Key), removeLeft)
+
+	case nil:
+		// The edge doesn't exist, the fork point is a full node with no child
+		// on the path
+		return nil
+
+	default:
+		return fmt.Errorf("invalid edge path at %T", child)
+	}
+}
+
+// unsetChild removes the child at the given index of a full node.
+func unsetChild(parent node, index byte) error {
+	fn, ok := parent.(*fullNode)
+	if !ok || index >= 16 {
+		return errors.New("invalid edge path")
+	}
+	fn.Children[index] = nil
+	return nil
+}
+
+// compareShortKey compares the prefix of an edge path with the key of a short
+// node, returning 0 if the path runs through the node.
+func compareShortKey(path, key []byte) int {
+	if len(path) < len(key) {
+		return bytes.Compare(path, key)
+	}
+	return bytes.Compare(path[:len(key)], key)
+}
@@ -20,6 +20,7 @@ import (
 	"bytes"
 	crand "crypto/rand"
 	mrand "math/rand"
+	"sort"
 	"testing"
 	"time"
 
@@ -129,6 +130,230 @@ func BenchmarkVerifyProof(b *testing.B) {
 	}
 }
 
+// sortedKeys returns the keys of a random trie in ascending order.
+func sortedKeys(vals map[string]*kv) []string {
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Tests that range proofs over random ranges of a random trie verify, both with
+// existent and non-existent edge keys.
+func TestRangeProof(t *testing.T) {
+	trie, vals := randomTrie(1024)
+	root, keys := trie.Hash(), sortedKeys(vals)
+
+	for i := 0; i < 500; i++ {
+		start := mrand.Intn(len(keys))
+		end := start + mrand.Intn(len(keys)-start)
+
+		origin, limit := []byte(keys[start]), []byte(keys[end])
+		if mrand.Intn(2) == 0 {
+			// Move the edges into the gaps around the range
+			origin = decreaseKey(common.CopyBytes(origin))
+			limit = increaseKey(common.CopyBytes(limit))
+		}
+		rangeKeys, rangeVals, proof, err := trie.ProveRange(origin, limit)
+		if err != nil {
+			t.Fatalf("case %d: failed to prove range: %v", i, err)
+		}
+		if want := countRange(keys, origin, limit); len(rangeKeys) != want {
+			t.Fatalf("case %d: range size mismatch: have %d, want %d", i, len(rangeKeys), want)
+		}
+		for j, key := range rangeKeys {
+			if !bytes.Equal(rangeVals[j], vals[string(key)].v) {
+				t.Fatalf("case %d: value mismatch for key %x", i, key)
+			}
+		}
+		if err := VerifyRangeProof(root, origin, limit, rangeKeys, rangeVals, proof); err != nil {
+			t.Fatalf("case %d: failed to verify range [%x, %x], %d items: %v", i, origin, limit, len(rangeKeys), err)
+		}
+	}
+}
+
+// Tests that ranges without any entries between the edges can be proven.
+func TestEmptyRangeProof(t *testing.T) {
+	trie, vals := randomTrie(1024)
+	root, keys := trie.Hash(), sortedKeys(vals)
+
+	for i := 0; i < 100; i++ {
+		pos := mrand.Intn(len(keys) - 1)
+		origin := increaseKey([]byte(keys[pos]))
+		limit := decreaseKey([]byte(keys[pos+1]))
+		if bytes.Compare(origin, limit) > 0 {
+			continue // adjacent keys, no gap to prove
+		}
+		rangeKeys, _, proof, err := trie.ProveRange(origin, limit)
+		if err != nil {
+			t.Fatalf("case %d: failed to prove range: %v", i, err)
+		}
+		if len(rangeKeys) != 0 {
+			t.Fatalf("case %d: non-empty range: %d items", i, len(rangeKeys))
+		}
+		if err := VerifyRangeProof(root, origin, limit, nil, nil, proof); err != nil {
+			t.Fatalf("case %d: failed to verify empty range: %v", i, err)
+		}
+		// Claiming the neighbouring entry is inside the gap must fail
+		next := []byte(keys[pos+1])
+		if err := VerifyRangeProof(root, origin, next, nil, nil, proof); err == nil {
+			t.Fatalf("case %d: missing edge entry accepted", i)
+		}
+	}
+}
+
+// Tests that single element ranges, with the edges being the element itself or
+// surrounding it, can be proven.
+func TestSingleRangeProof(t *testing.T) {
+	trie, vals := randomTrie(1024)
+	root, keys := trie.Hash(), sortedKeys(vals)
+
+	for i := 0; i < 100; i++ {
+		key := []byte(keys[mrand.Intn(len(keys))])
+		for _, edges := range [][2][]byte{
+			{key, key},
+			{decreaseKey(common.CopyBytes(key)), key},
+			{key, increaseKey(common.CopyBytes(key))},
+			{decreaseKey(common.CopyBytes(key)), increaseKey(common.CopyBytes(key))},
+		} {
+			rangeKeys, rangeVals, proof, err := trie.ProveRange(edges[0], edges[1])
+			if err != nil {
+				t.Fatalf("case %d: failed to prove range: %v", i, err)
+			}
+			if countRange(keys, edges[0], edges[1]) != 1 {
+				continue // neighbouring key on an edge
+			}
+			if len(rangeKeys) != 1 || !bytes.Equal(rangeKeys[0], key) {
+				t.Fatalf("case %d: range mismatch: have %x, want [%x]", i, rangeKeys, key)
+			}
+			if err := VerifyRangeProof(root, edges[0], edges[1], rangeKeys, rangeVals, proof); err != nil {
+				t.Fatalf("case %d: failed to verify range [%x, %x]: %v", i, edges[0], edges[1], err)
+			}
+		}
+	}
+}
+
+// Tests that the entire trie can be verified without any edge proofs, both for
+// populated and empty tries.
+func TestAllElementsRangeProof(t *testing.T) {
+	trie, vals := randomTrie(1024)
+	keys := sortedKeys(vals)
+
+	var rangeKeys, rangeVals [][]byte
+	for _, key := range keys {
+		rangeKeys = append(rangeKeys, []byte(key))
+		rangeVals = append(rangeVals, vals[key].v)
+	}
+	origin, limit := make([]byte, 32), bytes.Repeat([]byte{0xff}, 32)
+	if err := VerifyRangeProof(trie.Hash(), origin, limit, rangeKeys, rangeVals, nil); err != nil {
+		t.Fatalf("failed to verify whole trie: %v", err)
+	}
+	if err := VerifyRangeProof(trie.Hash(), origin, limit, rangeKeys[1:], rangeVals[1:], nil); err == nil {
+		t.Fatalf("incomplete trie accepted")
+	}
+	// The whole trie proven with edge proofs must verify too
+	_, _, proof, err := trie.ProveRange(origin, limit)
+	if err != nil {
+		t.Fatalf("failed to prove whole trie: %v", err)
+	}
+	if err := VerifyRangeProof(trie.Hash(), origin, limit, rangeKeys, rangeVals, proof); err != nil {
+		t.Fatalf("failed to verify whole trie with proof: %v", err)
+	}
+	// An empty trie has no entries
+	if err := VerifyRangeProof(emptyRoot, origin, limit, nil, nil, nil); err != nil {
+		t.Fatalf("failed to verify empty trie: %v", err)
+	}
+}
+
+// Tests that any modification of a proven range fails the verification.
+func TestBadRangeProof(t *testing.T) {
+	trie, vals := randomTrie(1024)
+	root, keys := trie.Hash(), sortedKeys(vals)
+
+	for i := 0; i < 500; i++ {
+		start := mrand.Intn(len(keys) - 2)
+		end := start + 2 + mrand.Intn(len(keys)-start-2)
+
+		origin, limit := []byte(keys[start]), []byte(keys[end])
+		rangeKeys, rangeVals, proof, err := trie.ProveRange(origin, limit)
+		if err != nil {
+			t.Fatalf("case %d: failed to prove range: %v", i, err)
+		}
+		index := mrand.Intn(len(rangeKeys))
+		switch mrand.Intn(5) {
+		case 0:
+			// Drop an entry from the range
+			rangeKeys = append(rangeKeys[:index:index], rangeKeys[index+1:]...)
+			rangeVals = append(rangeVals[:index:index], rangeVals[index+1:]...)
+		case 1:
+			// Modify a value
+			rangeVals[index] = randBytes(20)
+		case 2:
+			// Add an entry outside the range
+			rangeKeys = append(rangeKeys, increaseKey(common.CopyBytes(limit)))
+			rangeVals = append(rangeVals, randBytes(20))
+		case 3:
+			// Corrupt a proof node
+			node := common.CopyBytes(proof[mrand.Intn(len(proof))])
+			node[len(node)-1] ^= 0x01
+			proof = append(proof[:0:0], proof...)
+			proof[mrand.Intn(len(proof))] = node
+		case 4:
+			// Swap two entries
+			if index == 0 {
+				index = 1
+			}
+			rangeKeys[index-1], rangeKeys[index] = rangeKeys[index], rangeKeys[index-1]
+		}
+		if err := VerifyRangeProof(root, origin, limit, rangeKeys, rangeVals, proof); err == nil {
+			t.Fatalf("case %d: tampered range accepted", i)
+		}
+	}
+}
+
+// countRange returns the number of sorted keys between origin and limit, both
+// inclusive.
+func countRange(keys []string, origin, limit []byte) int {
+	start := sort.SearchStrings(keys, string(origin))
+	end := sort.SearchStrings(keys, string(limit))
+	if end < len(keys) && keys[end] == string(limit) {
+		end++
+	}
+	return end - start
+}
+
+// increaseKey increments a key in place as a big endian number, leaving the
+// maximal key unchanged.
+func increaseKey(key []byte) []byte {
+	if bytes.Equal(key, bytes.Repeat([]byte{0xff}, len(key))) {
+		return key
+	}
+	for i := len(key) - 1; i >= 0; i-- {
+		key[i]++
+		if key[i] != 0x0 {
+			break
+		}
+	}
+	return key
+}
+
+// decreaseKey decrements a key in place as a big endian number, leaving the
+// zero key unchanged.
+func decreaseKey(key []byte) []byte {
+	if bytes.Equal(key, make([]byte, len(key))) {
+		return key
+	}
+	for i := len(key) - 1; i >= 0; i-- {
+		key[i]--
+		if key[i] != 0xff {
+			break
+		}
+	}
+	return key
+}
+
 func randomTrie(n int) (*Trie, map[string]*kv) {
 	trie := new(Trie)
 	vals := make(map[string]*kv)